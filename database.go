@@ -52,7 +52,7 @@ func dbconn(path, index string) (*storage.DB, error) {
 			return nil, err
 		}
 
-		idx, err := storage.Open(path + "/" + index)
+		idx, err := storage.Open(path+"/"+index, 0666)
 		dbConns[path] = make(map[string]*storage.DB)
 		dbConns[path][index] = idx
 		return idx, err
@@ -60,7 +60,7 @@ func dbconn(path, index string) (*storage.DB, error) {
 
 	if idx, ok := dbConns[path][index]; !ok {
 		var err error
-		idx, err = storage.Open(path + "/" + index)
+		idx, err = storage.Open(path+"/"+index, 0666)
 		dbConns[path][index] = idx
 		return idx, err
 	}
@@ -152,6 +152,6 @@ func pointremove(path, index string, from, to int64) error {
 	if dbErr != nil {
 		return dbErr
 	}
-	storage.Delete(from, to)
-	return nil
+	_, err := storage.DeleteRange(from, to)
+	return err
 }
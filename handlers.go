@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"github.com/dustin/seriesly/timelib"
+	"github.com/vimrus/tickdb/storage"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
@@ -15,7 +16,7 @@ func dbPath(filename string) string {
 func serverInfo(parts []string, w http.ResponseWriter, req *http.Request) {
 	info := map[string]string{
 		"tickdb":  "Welcome",
-		"version": "0.0",
+		"version": storage.LibraryVersion,
 	}
 	render(200, w, info)
 }
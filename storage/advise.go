@@ -0,0 +1,33 @@
+package storage
+
+// Advice tells the system how the database file is about to be read, see
+// DB.Advise.
+type Advice int
+
+const (
+	// AdviceNormal undoes an earlier advice.
+	AdviceNormal Advice = iota
+
+	// AdviceSequential expects reads in order, such as a long export, so
+	// the system reads further ahead.
+	AdviceSequential
+
+	// AdviceRandom expects scattered reads, such as point lookups, so the
+	// system does not read ahead.
+	AdviceRandom
+
+	// AdviceWillNeed asks for the whole file to be read into the page
+	// cache ahead of use.
+	AdviceWillNeed
+)
+
+// Advise hints the system about how the database file is about to be read.
+// The database reads the file rather than mapping it, so the hint applies
+// to the page cache and read-ahead of the file. It does nothing on systems
+// without such hints.
+func (db *DB) Advise(advice Advice) error {
+	if db.file == nil {
+		return ErrDatabaseNotOpen
+	}
+	return fadvise(db.file, advice)
+}
@@ -0,0 +1,31 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadviseAdvice maps an Advice to the POSIX_FADV value of Linux.
+var fadviseAdvice = map[Advice]uintptr{
+	AdviceNormal:     0,
+	AdviceRandom:     1,
+	AdviceSequential: 2,
+	AdviceWillNeed:   3,
+}
+
+// fadvise applies advice to all of file.
+func fadvise(file *os.File, advice Advice) error {
+	a, ok := fadviseAdvice[advice]
+	if !ok {
+		return syscall.EINVAL
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, a, 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError("fadvise", errno)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package storage
+
+import (
+	"os"
+)
+
+// fadvise is a no-op where the file cannot be advised.
+func fadvise(file *os.File, advice Advice) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skip("file advice is only given on linux/amd64 and linux/arm64")
+	}
+
+	db := tempDB(t)
+	for _, advice := range []Advice{AdviceSequential, AdviceRandom, AdviceWillNeed, AdviceNormal} {
+		if err := db.Advise(advice); err != nil {
+			t.Fatalf("advice %d: %v", advice, err)
+		}
+	}
+	if err := db.Advise(Advice(42)); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Advise(AdviceRandom); err != ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// WriteTo writes a consistent copy of the database to w and returns the
+// number of bytes written. Writes may continue while it runs: the copy ends
+// at the last chunk written by the last flush before it started, and starts
+// with a meta pointing at the root of that flush and the info of db.
+func (db *DB) WriteTo(w io.Writer) (int64, error) {
+	db.rwlock.Lock()
+	if db.file == nil {
+		db.rwlock.Unlock()
+		return 0, ErrDatabaseNotOpen
+	}
+	m := *db.meta
+	end := db.pos
+	db.rwlock.Unlock()
+
+	head := make([]byte, MetaSize)
+	copy(head, chunkBytes(m.toBytes()))
+	copy(head[MetaCopyPos:], chunkBytes(m.toBytes()))
+	if db.info != (DBInfo{}) {
+		copy(head[InfoPos:], chunkBytes(db.info.toBytes()))
+	}
+	n, err := w.Write(head)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	copied, err := io.Copy(w, io.NewSectionReader(&db.ops, int64(MetaSize), end-int64(MetaSize)))
+	return total + copied, err
+}
+
+// Clone writes a consistent copy of the database to a new file at dstPath,
+// as WriteTo does, and opens it. The copy is writable and independent of
+// db, it is opened with the options db was opened with except ReadOnly and
+// WAL. dstPath must not exist.
+func (db *DB) Clone(dstPath string, mode os.FileMode) (*DB, error) {
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(dstPath)
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(dstPath)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(dstPath)
+		return nil, err
+	}
+
+	opts := &Options{
+		MaxLeafPoints:     db.maxLeafPoints,
+		MaxLeafBytes:      db.maxLeafBytes,
+		MaxTxOps:          db.maxTxOps,
+		MergeOnDuplicate:  db.mergeDup,
+		DeltaValues:       db.deltaValues,
+		Debug:             db.debug,
+		NoSync:            db.NoSync,
+		Transform:         db.transform,
+		Retention:         db.retention,
+		RetentionInterval: db.retentionInterval,
+		SweepInterval:     db.sweepInterval,
+		ChangeLog:         db.changes.size,
+		Logger:            db.logger,
+	}
+	if db.cache != nil {
+		opts.MaxCachedNodes = db.cache.max
+		opts.MemorySoftLimit = db.cache.soft
+		opts.OnMemoryPressure = db.onMemoryPressure
+	}
+	if db.queries != nil {
+		opts.QueryCacheSize = db.queries.max
+	}
+	if db.group != nil {
+		opts.GroupCommitDelay = db.group.delay
+	}
+	return OpenWithOptions(dstPath, mode, opts)
+}
+
+// chunkBytes returns data framed the way writeChunk writes it.
+func chunkBytes(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeUint32(uint32(len(data)) + uint32(ChunkCrcSize)))
+	buf.Write(encodeUint32(crc32.ChecksumIEEE(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
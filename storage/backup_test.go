@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 {
+		return base.Add(time.Duration(i) * 7 * time.Minute).UnixNano()
+	}
+	const batches, batchSize = 20, 50
+	put := func(b int) error {
+		points := make([]Point, batchSize)
+		for i := range points {
+			points[i] = Point{Timestamp: key(b*batchSize + i), Value: map[string]float64{"v": float64(b)}}
+		}
+		return db.PutBatch(points)
+	}
+	for b := 0; b < batches/2; b++ {
+		if err := put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Back up while the second half of the batches is written.
+	errc := make(chan error, 1)
+	go func() {
+		for b := batches / 2; b < batches; b++ {
+			if err := put(b); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	var buf bytes.Buffer
+	n, err := db.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+
+	path := filepath.Join(t.TempDir(), "backup")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := backup.Count(key(0), key(batches*batchSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < batches/2*batchSize || count%batchSize != 0 {
+		t.Fatalf("backup holds %d points", count)
+	}
+	points, err := backup.Range(key(0), key(batches*batchSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range points {
+		if p.Timestamp != key(i) || p.Value["v"] != float64(i/batchSize) {
+			t.Fatalf("point %d: got %d %v", i, p.Timestamp, p.Value)
+		}
+	}
+
+	// The backup is a database of its own.
+	if err := backup.Put(key(-1), map[string]float64{"v": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key(-1)); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 500; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 7 * time.Minute).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "clone")
+	clone, err := db.Clone(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+
+	if info := clone.Info(); info != db.Info() {
+		t.Fatalf("clone Info = %+v, want %+v", info, db.Info())
+	}
+
+	end := points[len(points)-1].Timestamp
+	got, err := clone.Range(points[0].Timestamp, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(points) {
+		t.Fatalf("clone holds %d points, want %d", len(got), len(points))
+	}
+	for i, p := range got {
+		if p.Timestamp != points[i].Timestamp || p.Value["v"] != points[i].Value["v"] {
+			t.Fatalf("point %d is %d %v, want %d %v", i, p.Timestamp, p.Value, points[i].Timestamp, points[i].Value)
+		}
+	}
+
+	// Writes to either side stay there.
+	if err := clone.Put(end+1, map[string]float64{"v": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(end+2, map[string]float64{"v": -2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(end + 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := clone.Get(end + 2); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := clone.Get(end + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Clone(path, 0600); !os.IsExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -5,86 +5,102 @@ import (
 	"math"
 )
 
+// byteOrder is the order every fixed-size integer and float of the file is
+// stored in, whatever the order of the host: chunk headers, metas, keys and
+// values alike. Nothing is ever cast from memory, so a file written on a
+// host of either order reads on any other.
+var byteOrder = binary.BigEndian
+
 func encodeUint16(v uint16) []byte {
 	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, v)
+	byteOrder.PutUint16(bytes, v)
 	return bytes
 }
 
 func decodeUint16(bytes []byte) uint16 {
-	return binary.BigEndian.Uint16(bytes)
+	return byteOrder.Uint16(bytes)
 }
 
 func encodeInt16(v int16) []byte {
 	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, uint16(v))
+	byteOrder.PutUint16(bytes, uint16(v))
 	return bytes
 }
 
 func decodeInt16(bytes []byte) int16 {
-	return int16(binary.BigEndian.Uint16(bytes))
+	return int16(byteOrder.Uint16(bytes))
 }
 
 func encodeUint32(v uint32) []byte {
 	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, v)
+	byteOrder.PutUint32(bytes, v)
 	return bytes
 }
 
 func decodeUint32(bytes []byte) uint32 {
-	return binary.BigEndian.Uint32(bytes)
+	return byteOrder.Uint32(bytes)
 }
 
 func encodeInt32(v int32) []byte {
 	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, uint32(v))
+	byteOrder.PutUint32(bytes, uint32(v))
 	return bytes
 }
 
 func decodeInt32(bytes []byte) int32 {
-	return int32(binary.BigEndian.Uint32(bytes))
+	return int32(byteOrder.Uint32(bytes))
 }
 
 func encodeUint64(v uint64) []byte {
 	bytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(bytes, v)
+	byteOrder.PutUint64(bytes, v)
 	return bytes
 }
 
 func decodeUint64(bytes []byte) uint64 {
-	return binary.BigEndian.Uint64(bytes)
+	return byteOrder.Uint64(bytes)
 }
 
 func encodeInt64(v int64) []byte {
 	bytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(bytes, uint64(v))
+	byteOrder.PutUint64(bytes, uint64(v))
 	return bytes
 }
 
 func decodeInt64(bytes []byte) int64 {
-	return int64(binary.BigEndian.Uint64(bytes))
+	return int64(byteOrder.Uint64(bytes))
 }
 
 func encodeFloat32(v float32) []byte {
 	bits := math.Float32bits(v)
 	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, bits)
+	byteOrder.PutUint32(bytes, bits)
 	return bytes
 }
 
 func decodeFloat32(bytes []byte) float32 {
-	bits := binary.BigEndian.Uint32(bytes)
+	bits := byteOrder.Uint32(bytes)
 	return math.Float32frombits(bits)
 }
 
 func encodeFloat64(v float64) []byte {
 	bits := math.Float64bits(v)
 	bytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(bytes, bits)
+	byteOrder.PutUint64(bytes, bits)
 	return bytes
 }
 
 func decodeFloat64(bytes []byte) float64 {
-	bits := binary.BigEndian.Uint64(bytes)
+	bits := byteOrder.Uint64(bytes)
 	return math.Float64frombits(bits)
 }
+
+func encodeVarint(v int64) []byte {
+	bytes := make([]byte, binary.MaxVarintLen64)
+	return bytes[:binary.PutVarint(bytes, v)]
+}
+
+func encodeUvarint(v uint64) []byte {
+	bytes := make([]byte, binary.MaxVarintLen64)
+	return bytes[:binary.PutUvarint(bytes, v)]
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultMaxCachedNodes is the default number of nodes kept in the cache.
+const DefaultMaxCachedNodes = 1024
+
+// nodeCache keeps the chunks of the most recently read nodes, keyed by
+// position, evicting the least recently used once it holds max of them.
+// Chunks are never rewritten in place, so an entry cannot go stale. Only
+// the checked bytes are kept: every read decodes a fresh node, since nodes
+// are linked into the tree of whoever read them. Dirty nodes are never
+// cached, they only reach the file when they are flushed.
+type nodeCache struct {
+	mu    sync.Mutex
+	max   int
+	lru   *list.List // front is the most recently used
+	items map[int64]*list.Element
+	bytes int64 // of the cached chunks
+
+	// soft is Options.MemorySoftLimit, over is whether bytes went over it
+	// and has not dropped back to it since.
+	soft int64
+	over bool
+}
+
+type cacheEntry struct {
+	pos  int64
+	data []byte
+}
+
+// newNodeCache returns a cache of max entries, or nil if max is zero.
+func newNodeCache(max int) *nodeCache {
+	if max == 0 {
+		return nil
+	}
+	return &nodeCache{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[int64]*list.Element),
+	}
+}
+
+// get returns the chunk at pos, if it is cached.
+func (c *nodeCache) get(pos int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[pos]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// put caches the chunk at pos, evicting the least recently used ones over
+// the limit. It returns the bytes cached, and whether the chunk took them
+// over the soft limit.
+func (c *nodeCache) put(pos int64, data []byte) (bytes int64, pressure bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[pos]; ok {
+		c.lru.MoveToFront(e)
+		return c.bytes, false
+	}
+	c.items[pos] = c.lru.PushFront(&cacheEntry{pos: pos, data: data})
+	c.bytes += int64(len(data))
+	for c.lru.Len() > c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		entry := e.Value.(*cacheEntry)
+		delete(c.items, entry.pos)
+		c.bytes -= int64(len(entry.data))
+	}
+
+	if c.soft > 0 {
+		pressure = c.bytes > c.soft && !c.over
+		c.over = c.bytes > c.soft
+	}
+	return c.bytes, pressure
+}
+
+// size returns the bytes of the cached chunks.
+func (c *nodeCache) size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// len returns the number of cached chunks.
+func (c *nodeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodeCache(t *testing.T) {
+	c := newNodeCache(2)
+	c.put(1, []byte{1})
+	c.put(2, []byte{2})
+	if _, ok := c.get(1); !ok {
+		t.Fatal("1 not cached")
+	}
+	// 2 is now the least recently used.
+	c.put(3, []byte{3})
+	if _, ok := c.get(2); ok {
+		t.Fatal("2 not evicted")
+	}
+	for _, pos := range []int64{1, 3} {
+		if data, ok := c.get(pos); !ok || data[0] != byte(pos) {
+			t.Fatalf("get(%d) = %v, %v", pos, data, ok)
+		}
+	}
+	if c.len() != 2 {
+		t.Fatalf("len = %d, want 2", c.len())
+	}
+
+	// A nil cache caches nothing.
+	c = newNodeCache(0)
+	c.put(1, []byte{1})
+	if _, ok := c.get(1); ok || c.len() != 0 {
+		t.Fatal("nil cache cached")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	const max = 16
+	opts := &Options{MaxLeafPoints: 4, MaxCachedNodes: max}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Small leaves over a couple of days make a tree of far more nodes
+	// than the cache holds.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	for i := 0; i < 500; i++ {
+		key := base.Add(time.Duration(i) * 7 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.InteriorNodes + stats.LeafNodes; n <= max {
+		t.Fatalf("only %d nodes", n)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		points, err := db.Range(keys[0], keys[len(keys)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(keys) {
+			t.Fatalf("got %d points, want %d", len(points), len(keys))
+		}
+		for i, p := range points {
+			if p.Timestamp != keys[i] || p.Value["v"] != float64(i) {
+				t.Fatalf("point %d: got %d %v", i, p.Timestamp, p.Value)
+			}
+		}
+		if n := db.cache.len(); n > max {
+			t.Fatalf("cache holds %d nodes, max %d", n, max)
+		}
+	}
+	for i, key := range keys {
+		point, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if point.Value["v"] != float64(i) {
+			t.Fatalf("Get(%d) = %v", key, point.Value)
+		}
+	}
+	if n := db.cache.len(); n != max {
+		t.Fatalf("cache holds %d nodes, want %d", n, max)
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	c := newNodeCache(2)
+	c.soft = 4
+	steps := []struct {
+		size     int
+		bytes    int64
+		pressure bool
+	}{
+		{3, 3, false},
+		{2, 5, true},  // over the limit
+		{3, 5, false}, // still over, evicting the first
+		{1, 4, false}, // back to the limit
+		{2, 3, false},
+		{3, 5, true}, // over again
+	}
+	for i, s := range steps {
+		bytes, pressure := c.put(int64(i), make([]byte, s.size))
+		if bytes != s.bytes || pressure != s.pressure || c.size() != s.bytes {
+			t.Fatalf("put %d: got %d, %v, want %d, %v", i, bytes, pressure, s.bytes, s.pressure)
+		}
+	}
+
+	// Through the database, the callback fires once the nodes read take
+	// the cache over the limit.
+	db := tempDB(t)
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 2000; i++ {
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(), Value: map[string]float64{"v": float64(i)}})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []int64
+	const soft = 4096
+	db = reopen(t, db, &Options{
+		MaxLeafPoints:    DefaultMaxLeafPoints,
+		MaxCachedNodes:   DefaultMaxCachedNodes,
+		MemorySoftLimit:  soft,
+		OnMemoryPressure: func(bytes int64) { calls = append(calls, bytes) },
+	})
+	defer db.Close()
+	if len(calls) != 0 {
+		t.Fatalf("called before reading: %v", calls)
+	}
+	if _, err := db.Range(points[0].Timestamp, points[len(points)-1].Timestamp); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] <= soft {
+		t.Fatalf("got calls %v, want one over %d", calls, soft)
+	}
+	if usage := db.MemoryUsage(); usage < calls[0] {
+		t.Fatalf("MemoryUsage = %d, below the %d reported", usage, calls[0])
+	}
+}
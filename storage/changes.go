@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"encoding/gob"
+	"io"
+	"sort"
+	"time"
+)
+
+// changeLog keeps the keys written by the last transactions flushed, for
+// Changes. It is only touched with the writer lock held.
+type changeLog struct {
+	size    int                // transactions kept, Options.ChangeLog
+	from    uint64             // the log holds every key written after it
+	txs     []changeTx         // oldest first
+	pending map[int64]struct{} // keys written since the last flush
+	lost    bool               // whether keys not in pending were written
+}
+
+// changeTx is the keys written by the flush of txid.
+type changeTx struct {
+	txid uint64
+	keys []int64
+}
+
+func newChangeLog(size int, txid uint64) *changeLog {
+	return &changeLog{size: size, from: txid, pending: make(map[int64]struct{})}
+}
+
+// add records a write at key.
+func (l *changeLog) add(key int64) {
+	if l.size > 0 && !l.lost {
+		l.pending[key] = struct{}{}
+	}
+}
+
+// lose records that points were written without their keys being known,
+// such as by DeleteRange, so the transactions before cannot be replayed.
+func (l *changeLog) lose() {
+	l.lost = true
+}
+
+// commit moves the keys written since the last flush into the flush of
+// txid, dropping the oldest transaction past size.
+func (l *changeLog) commit(txid uint64) {
+	defer l.discard()
+	if l.size == 0 || l.lost {
+		l.txs, l.from = nil, txid
+		return
+	}
+
+	keys := make([]int64, 0, len(l.pending))
+	for key := range l.pending {
+		keys = append(keys, key)
+	}
+	l.txs = append(l.txs, changeTx{txid: txid, keys: keys})
+	if len(l.txs) > l.size {
+		l.from = l.txs[0].txid
+		l.txs = append(l.txs[:0:0], l.txs[1:]...)
+	}
+}
+
+// discard forgets the keys written since the last flush.
+func (l *changeLog) discard() {
+	clear(l.pending)
+	l.lost = false
+}
+
+// keys returns the keys written after txid, sorted, or false if the log no
+// longer goes back that far.
+func (l *changeLog) keys(txid uint64) ([]int64, bool) {
+	if txid < l.from {
+		return nil, false
+	}
+	seen := make(map[int64]struct{})
+	for _, tx := range l.txs {
+		if tx.txid <= txid {
+			continue
+		}
+		for _, key := range tx.keys {
+			seen[key] = struct{}{}
+		}
+	}
+	keys := make([]int64, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, true
+}
+
+// changeSet is the gob form of what Changes writes: the points at every
+// key written after From, as of To.
+type changeSet struct {
+	Version  uint16
+	From, To uint64
+	Points   []changePoint
+}
+
+// changePoint is a point of a changeSet, or its removal if Deleted is set.
+type changePoint struct {
+	Timestamp int64
+	Value     map[string]float64
+	Expires   int64 // unixnano, zero for a point put without a TTL
+	Deleted   bool
+}
+
+// Changes writes to w the points written in the transactions after
+// sinceTxID, for ApplyChanges to replay on a replica: the ones put as they
+// are now, and the ones removed as removals. Only the keys written are
+// kept, for the last Options.ChangeLog transactions, so it returns
+// ErrFullSyncRequired if sinceTxID is older than that, if it is ahead of
+// db, or if a transaction since removed points by range, as Truncate,
+// DeleteRange, RenameMetric, Expire and SweepExpired do. Series are not
+// included.
+func (db *DB) Changes(sinceTxID uint64, w io.Writer) error {
+	db.rwlock.Lock()
+	if db.file == nil {
+		db.rwlock.Unlock()
+		return ErrDatabaseNotOpen
+	}
+	txid := db.TxID()
+	keys, ok := db.changes.keys(sinceTxID)
+	db.rwlock.Unlock()
+	if !ok || sinceTxID > txid {
+		return ErrFullSyncRequired
+	}
+
+	// Points read here may have been written again since txid, the next
+	// call from txid on sends them once more.
+	s := changeSet{Version: Version, From: sinceTxID, To: txid}
+	now := time.Now().UnixNano()
+	err := db.View(func(tx *Tx) error {
+		for _, key := range keys {
+			point, metrics, expires, err := tx.root.find(NewTime(key))
+			if err != nil {
+				return err
+			}
+			if point != nil {
+				expires = point.expires
+			}
+			if point == nil && metrics == nil || expires != 0 && expires <= now {
+				s.Points = append(s.Points, changePoint{Timestamp: key, Deleted: true})
+				continue
+			}
+
+			value := map[string]float64(nil)
+			if point != nil {
+				value = point.Value
+			} else if value, err = decodeMetrics(metrics); err != nil {
+				return err
+			}
+			s.Points = append(s.Points, changePoint{Timestamp: key, Value: value, Expires: expires})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// ApplyChanges replays on db the points written by Changes, replacing the
+// ones db holds at the same keys whatever Options.MergeOnDuplicate is set
+// to, and flushes them at once, or not at all if it fails. Values are
+// stored as Changes wrote them, without Options.Transform. AppliedTxID
+// returns the transaction of the source they bring db up to.
+func (db *DB) ApplyChanges(r io.Reader) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	var s changeSet
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != Version {
+		return ErrVersionMismatch
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	for _, point := range s.Points {
+		if err := db.delete(point.Timestamp); err != nil && err != ErrNotFound {
+			db.rollback()
+			return err
+		}
+		if point.Deleted {
+			continue
+		}
+		for k := range point.Value {
+			if len(k) > MaxMetricNameLength {
+				db.rollback()
+				return ErrMetricNameTooLong
+			}
+		}
+		if err := db.putRaw(db.root, point.Timestamp, point.Value, point.Expires); err != nil {
+			db.rollback()
+			return err
+		}
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	db.applied.Store(s.To)
+	return nil
+}
+
+// AppliedTxID returns the transaction of the source the last ApplyChanges
+// brought db up to, to pass to Changes next. It is zero until ApplyChanges
+// is called, and is not kept across Open.
+func (db *DB) AppliedTxID() uint64 {
+	return db.applied.Load()
+}
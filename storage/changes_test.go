@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	dir := t.TempDir()
+	src, err := OpenWithOptions(filepath.Join(dir, "src"), 0600, &Options{MaxLeafPoints: 4, ChangeLog: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := OpenWithOptions(filepath.Join(dir, "dst"), 0600, &Options{MaxLeafPoints: 4, MergeOnDuplicate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// sync sends dst the changes of src since it last applied them and
+	// returns how many points they carried.
+	sync := func() int {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := src.Changes(dst.AppliedTxID(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		var s changeSet
+		if err := gob.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.ApplyChanges(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if dst.AppliedTxID() != src.TxID() {
+			t.Fatalf("applied txid %d, want %d", dst.AppliedTxID(), src.TxID())
+		}
+		want, err := src.Range(0, 1<<62)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.Range(0, 1<<62)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("replica holds %v, want %v", got, want)
+		}
+		return len(s.Points)
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 { return base.Add(time.Duration(i) * time.Minute).UnixNano() }
+	points := make([]Point, 20)
+	for i := range points {
+		points[i] = Point{Timestamp: key(i), Value: map[string]float64{"a": float64(i), "b": 1}}
+	}
+	if err := src.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	if n := sync(); n != 20 {
+		t.Fatalf("first sync sent %d points, want 20", n)
+	}
+
+	// Only the keys written since are sent, and a point replaced loses the
+	// metrics it no longer holds though dst merges duplicates.
+	if err := src.Put(key(3), map[string]float64{"a": 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Delete(key(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(key(40), map[string]float64{"c": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.PutWithTTL(key(41), map[string]float64{"c": 5}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := sync(); n != 4 {
+		t.Fatalf("second sync sent %d points, want 4", n)
+	}
+	if n := sync(); n != 0 {
+		t.Fatalf("sync without writes sent %d points", n)
+	}
+
+	// A removal by range cannot be replayed.
+	since := src.TxID()
+	if _, err := src.DeleteRange(key(10), key(12)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Changes(since, new(bytes.Buffer)); err != ErrFullSyncRequired {
+		t.Fatalf("Changes across DeleteRange: %v, want ErrFullSyncRequired", err)
+	}
+	if err := src.Changes(src.TxID(), new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor can more transactions than the log keeps.
+	since = src.TxID()
+	for i := 0; i < 9; i++ {
+		if err := src.Put(key(50+i), map[string]float64{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Changes(since, new(bytes.Buffer)); err != ErrFullSyncRequired {
+		t.Fatalf("Changes past the log: %v, want ErrFullSyncRequired", err)
+	}
+	if err := src.Changes(since+1, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Changes(src.TxID()+1, new(bytes.Buffer)); err != ErrFullSyncRequired {
+		t.Fatalf("Changes ahead of the source: %v, want ErrFullSyncRequired", err)
+	}
+
+	// The log is not kept across Open.
+	since = src.TxID()
+	src = reopen(t, src, &Options{MaxLeafPoints: 4, ChangeLog: 8})
+	if err := src.Changes(since-1, new(bytes.Buffer)); err != ErrFullSyncRequired {
+		t.Fatalf("Changes from before Open: %v, want ErrFullSyncRequired", err)
+	}
+	if err := src.Changes(since, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+}
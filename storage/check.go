@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxCorruptProblems is the number of problems found by Check that
+// corruptError spells out.
+const maxCorruptProblems = 3
+
+// Check walks the tree and every series as of the last flush and returns
+// every problem it finds, or nil if there are none. It verifies that every
+// pointer leads to a chunk inside the file that decodes to a node one level
+// below its parent, that the keys of every node are increasing and lie in
+// the bucket its parent keys it by, and that the point counts kept in
+// interior nodes are right. A child that cannot be read is reported and
+// skipped, the rest of the tree is still checked.
+func (db *DB) Check() []error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return []error{err}
+	}
+	defer tx.Rollback()
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return []error{fmt.Errorf("stat: %w", err)}
+	}
+
+	c := checker{db: db, size: info.Size()}
+	var span *nodePointer
+	if !validRootLevel(tx.root.level) {
+		c.errorf("root at %d: level %#x cannot be a root", tx.meta.root, tx.root.level)
+	} else if key, ok := tx.root.span(); ok && tx.root.level != LevelRoot {
+		// Everything below a root of Options.RootLevel lies in one bucket.
+		t := NewTime(key)
+		span = &nodePointer{key: t.Timestamp(tx.root.level)}
+	}
+	c.node(tx.root, tx.meta.root, span)
+
+	registry, err := db.readRegistry(tx.meta.registry)
+	if err != nil {
+		c.errorf("registry at %d: %w", tx.meta.registry, err)
+	}
+	for name, pos := range registry {
+		root, err := db.node(pos)
+		if err != nil {
+			c.errorf("series %s: %w", name, err)
+			continue
+		}
+		if root.level != LevelRoot {
+			c.errorf("series %s: root at %d: level %#x, want %#x", name, pos, root.level, LevelRoot)
+		}
+		c.node(root, pos, nil)
+	}
+	return c.errs
+}
+
+// corruptError wraps ErrCorrupt with the first problems in errs.
+func corruptError(errs []error) error {
+	problems := make([]string, 0, maxCorruptProblems+1)
+	for i, err := range errs {
+		if i == maxCorruptProblems {
+			problems = append(problems, fmt.Sprintf("and %d more", len(errs)-i))
+			break
+		}
+		problems = append(problems, err.Error())
+	}
+	return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+}
+
+type checker struct {
+	db   *DB
+	size int64 // of the file
+	errs []error
+}
+
+func (c *checker) errorf(format string, a ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, a...))
+}
+
+// node checks n, read from pos, and everything below it. bucket is the
+// pointer n was reached by, nil for the root.
+func (c *checker) node(n *node, pos int64, bucket *nodePointer) {
+	var first, end int64
+	if bucket != nil {
+		t := NewTime(bucket.key)
+		first, end = bucket.key, t.next(n.level)
+	}
+	inBucket := func(key int64) bool {
+		return bucket == nil || key >= first && key < end
+	}
+
+	if n.isLeaf {
+		for i, point := range n.points {
+			if i > 0 && point.Timestamp <= n.points[i-1].Timestamp {
+				c.errorf("leaf at %d: point %d at %d after %d", pos, i, point.Timestamp, n.points[i-1].Timestamp)
+			}
+			if !inBucket(point.Timestamp) {
+				c.errorf("leaf at %d: point %d at %d outside [%d, %d)", pos, i, point.Timestamp, first, end)
+			}
+		}
+		return
+	}
+
+	for i, pointer := range n.pointers {
+		if i > 0 && pointer.key <= n.pointers[i-1].key {
+			c.errorf("node at %d: pointer %d key %d after %d", pos, i, pointer.key, n.pointers[i-1].key)
+		}
+		if !inBucket(pointer.key) {
+			c.errorf("node at %d: pointer %d key %d outside [%d, %d)", pos, i, pointer.key, first, end)
+		}
+
+		if pointer.pos < int64(MetaSize) || pointer.pos >= c.size {
+			c.errorf("node at %d: pointer %d to %d outside the file", pos, i, pointer.pos)
+			continue
+		}
+		_, _, size, err := c.db.ChunkAt(pointer.pos)
+		if err == nil && pointer.pos+int64(size) > c.size {
+			c.errorf("node at %d: pointer %d to chunk at %d ending past the file", pos, i, pointer.pos)
+			continue
+		}
+		child, err := c.db.node(pointer.pos)
+		if err != nil {
+			c.errorf("node at %d: pointer %d: %w", pos, i, err)
+			continue
+		}
+
+		if child.level != n.level<<1 {
+			c.errorf("node at %d: pointer %d to level %#x, want %#x", pos, i, child.level, n.level<<1)
+			continue
+		}
+		if count := child.count(); pointer.count >= 0 && count >= 0 && pointer.count != count {
+			c.errorf("node at %d: pointer %d counts %d points, child holds %d", pos, i, pointer.count, count)
+		}
+		c.node(child, pointer.pos, pointer)
+	}
+}
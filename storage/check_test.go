@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 3*24*6; i++ {
+		key := base.Add(time.Duration(i) * 10 * time.Minute).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// Find the day node, it has three children.
+	n := db.root
+	for len(n.pointers) < 3 {
+		child, err := n.childAt(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n = child
+	}
+
+	// Point one day outside the file, one at a chunk of the wrong
+	// level and one at a day holding other points, and write the damaged
+	// tree out as the new root.
+	n.pointers[0].pos = 1 << 40
+	n.pointers[1].pos = n.pointers[2].pointer.pointers[0].pos
+	n.pointers[2].key = n.pointers[0].key
+	n.pointers[2].count = 1
+	for p := n; p.parent != nil; p = p.parent {
+		index := 0
+		for p.parent.pointers[index].pointer != p {
+			index++
+		}
+		p.parent.dirty = index
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := db.Check()
+	want := []string{
+		"pointer 0 to 1099511627776 outside the file",
+		"pointer 1 to level",
+		"pointer 2 key",
+		"pointer 2 counts 1 points",
+		"outside [",
+	}
+	for _, w := range want {
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), w) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no error containing %q in %v", w, errs)
+		}
+	}
+}
+
+func TestStrictOnOpen(t *testing.T) {
+	db := tempDB(t)
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 3*24; i++ {
+		key := base.Add(time.Duration(i) * time.Hour).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	strict := &Options{MaxLeafPoints: DefaultMaxLeafPoints, StrictOnOpen: true}
+	db = reopen(t, db, strict)
+
+	// Damage the chunk of the first child of the root.
+	pos := db.root.pointers[0].pos
+	path := db.Path()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff}, pos+ChunkLengthSize+ChunkCrcSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWithOptions(path, 0600, strict); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !strings.Contains(err.Error(), ErrChunkBadCrc.Error()) {
+		t.Fatalf("error does not name the problem: %v", err)
+	}
+
+	// Without the flag the damage is only found by the queries reaching it.
+	db, err = Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Aggregate(base.UnixNano(), base.Add(time.Hour).UnixNano(), LevelHour, "v"); !errors.Is(err, ErrChunkBadCrc) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"hash/crc32"
+)
+
+// Checksum is an algorithm the meta is checked with, on top of the crc32 of
+// every chunk.
+type Checksum uint8
+
+const (
+	// ChecksumCRC32 only checks the meta with the crc32 of its chunk, as
+	// files written before Options.Checksum existed are.
+	ChecksumCRC32 Checksum = iota
+
+	// ChecksumCRC32C adds a crc32 with the Castagnoli polynomial.
+	ChecksumCRC32C
+
+	// ChecksumSHA256 adds a SHA-256 digest, which unlike a crc cannot be
+	// matched by changing a few bytes on purpose.
+	ChecksumSHA256
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// valid reports whether c is a known algorithm.
+func (c Checksum) valid() bool {
+	return c <= ChecksumSHA256
+}
+
+// sum returns the digest of data by c, nil for ChecksumCRC32.
+func (c Checksum) sum(data []byte) []byte {
+	switch c {
+	case ChecksumCRC32C:
+		return byteOrder.AppendUint32(nil, crc32.Checksum(data, castagnoli))
+	case ChecksumSHA256:
+		digest := sha256.Sum256(data)
+		return digest[:]
+	}
+	return nil
+}
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumSHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	for _, checksum := range []Checksum{ChecksumCRC32, ChecksumCRC32C, ChecksumSHA256} {
+		t.Run(checksum.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := OpenWithOptions(path, 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Checksum: checksum})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put(base, map[string]float64{"v": 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Opened with another algorithm the file keeps its own.
+			other := ChecksumSHA256
+			if checksum == other {
+				other = ChecksumCRC32
+			}
+			db = reopen(t, db, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Checksum: other})
+			if db.meta.checksum != checksum {
+				t.Fatalf("checksum %v, want %v", db.meta.checksum, checksum)
+			}
+			if err := db.Put(base+1, map[string]float64{"v": 2}); err != nil {
+				t.Fatal(err)
+			}
+			db = reopen(t, db, nil)
+			defer db.Close()
+			if db.meta.checksum != checksum {
+				t.Fatalf("checksum %v after a write, want %v", db.meta.checksum, checksum)
+			}
+			if p, err := db.Get(base + 1); err != nil || p.Value["v"] != 2 {
+				t.Fatalf("Get = %v, %v", p, err)
+			}
+
+			// Change the txid and write the meta back with a matching
+			// chunk crc, as someone tampering with the file would.
+			data, err := db.readChunkAt(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[33]++
+			pos := db.pos
+			db.pos = 0
+			if _, _, err := db.writeChunk(data); err != nil {
+				t.Fatal(err)
+			}
+			db.pos = pos
+
+			_, err = db.readMetaAt(0)
+			if checksum == ChecksumCRC32 {
+				if err != nil {
+					t.Fatalf("crc32 meta: %v", err)
+				}
+			} else if err != ErrChecksum {
+				t.Fatalf("tampered meta: %v, want ErrChecksum", err)
+			}
+		})
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Checksum: ChecksumSHA256 + 1}); err != ErrInvalidOptions {
+		t.Fatalf("unknown checksum: %v, want ErrInvalidOptions", err)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"hash/crc32"
+	"io"
 )
 
 const ChunkLengthSize int64 = 4
@@ -19,11 +20,20 @@ func (db *DB) readChunkAt(pos int64) ([]byte, error) {
 	size := decodeUint32(chunkPrefix[0:ChunkLengthSize])
 	crc := decodeUint32(chunkPrefix[ChunkLengthSize : ChunkLengthSize+ChunkCrcSize])
 
+	// size counts the crc, a smaller one means the prefix is corrupt.
+	if size < uint32(ChunkCrcSize) {
+		return nil, ErrChunkBadCrc
+	}
 	size -= uint32(ChunkLengthSize)
 	data := make([]byte, size)
 	pos += int64(n)
 	n, err = db.ops.ReadAt(data, pos)
 	if uint32(n) < size {
+		// Running into the end of the file means the chunk was cut short,
+		// any other error is the reader's own.
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
 		return nil, ErrChunkDataLessThanSize
 	}
 
@@ -61,6 +71,50 @@ func (db *DB) writeChunk(buf []byte) (int64, int64, error) {
 		return db.pos, int64(written), err
 	}
 	db.pos += int64(written)
+	db.counters.chunksWritten.Add(1)
 
 	return startPos, db.pos - startPos, nil
 }
+
+// ChunkAt reads the header of the node chunk at pos without decoding or
+// checking the rest of it. size is the number of bytes the chunk takes in
+// the file, header included. It returns ErrInvalid if pos does not hold a
+// node chunk.
+func (db *DB) ChunkAt(pos int64) (level uint16, isLeaf bool, size int, err error) {
+	if pos < int64(MetaSize) {
+		return 0, false, 0, ErrInvalid
+	}
+
+	header := make([]byte, ChunkLengthSize+ChunkCrcSize+2)
+	if _, err := db.ops.ReadAt(header, pos); err != nil {
+		return 0, false, 0, err
+	}
+
+	length := decodeUint32(header[0:ChunkLengthSize])
+	if length < uint32(ChunkCrcSize)+2 {
+		return 0, false, 0, ErrInvalid
+	}
+	flags := decodeUint16(header[ChunkLengthSize+ChunkCrcSize:])
+	if flags&LeafFlag == VersionedChunkFlag {
+		if length < uint32(ChunkCrcSize)+chunkHeaderSize+2 {
+			return 0, false, 0, ErrInvalid
+		}
+		versioned := make([]byte, chunkHeaderSize+2)
+		if _, err := db.ops.ReadAt(versioned, pos+ChunkLengthSize+ChunkCrcSize); err != nil {
+			return 0, false, 0, err
+		}
+		if versioned[2] != ChunkVersion {
+			return 0, false, 0, ErrVersionMismatch
+		}
+		flags = decodeUint16(versioned[chunkHeaderSize:])
+	}
+	switch flags & LeafFlag {
+	case LeafChunkFlag:
+		isLeaf = true
+	case InteriorChunkFlag:
+	default:
+		return 0, false, 0, ErrInvalid
+	}
+
+	return flags & LevelFlag, isLeaf, int(ChunkLengthSize) + int(length), nil
+}
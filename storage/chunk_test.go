@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadChunkCorrupt(t *testing.T) {
+	db := tempDB(t)
+	// The file is corrupted behind the back of the cache.
+	db.cache = nil
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	pos := db.meta.root
+
+	if _, err := db.node(pos); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the chunk data.
+	b := make([]byte, 1)
+	off := pos + ChunkLengthSize + ChunkCrcSize + 3
+	if _, err := db.ops.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if _, err := db.ops.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.node(pos); !errors.Is(err, ErrChunkBadCrc) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A length shorter than the crc must not underflow.
+	if _, err := db.ops.WriteAt(encodeUint32(1), pos); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.node(pos); !errors.Is(err, ErrChunkBadCrc) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A length past the end of the file.
+	if _, err := db.ops.WriteAt(encodeUint32(1<<20), pos); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.node(pos); !errors.Is(err, ErrChunkDataLessThanSize) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChunkAt(t *testing.T) {
+	db := tempDB(t)
+
+	// A single point below an hour leaf.
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	level, isLeaf, size, err := db.ChunkAt(db.meta.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != LevelRoot || isLeaf {
+		t.Fatalf("root: got level %#x leaf %v", level, isLeaf)
+	}
+	// The root is the last chunk written.
+	if want := int(db.pos - db.meta.root); size != want {
+		t.Fatalf("root: got size %d, want %d", size, want)
+	}
+
+	// Follow the tree down to the leaf.
+	n := db.root
+	for !n.isLeaf {
+		pointer := n.pointers[0]
+		level, isLeaf, _, err := db.ChunkAt(pointer.pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level != pointer.pointer.level || isLeaf != pointer.pointer.isLeaf {
+			t.Fatalf("chunk at %d: got level %#x leaf %v, want %#x %v",
+				pointer.pos, level, isLeaf, pointer.pointer.level, pointer.pointer.isLeaf)
+		}
+		n = pointer.pointer
+	}
+
+	if _, _, _, err := db.ChunkAt(0); err != ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, _, err := db.ChunkAt(db.meta.root + 1); err != ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChunkVersion(t *testing.T) {
+	db := tempDB(t)
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	leaf := db.root
+	for !leaf.isLeaf {
+		leaf = leaf.pointers[0].pointer
+	}
+
+	for _, n := range []*node{db.root, leaf} {
+		versioned := n.encode()
+		if versioned[2] != ChunkVersion {
+			t.Fatalf("encoded version %d, want %d", versioned[2], ChunkVersion)
+		}
+		// Chunks written before the header are version 1, and mark the
+		// histograms of interior nodes in their node flags.
+		headerless := append([]byte(nil), versioned[chunkHeaderSize:]...)
+		if !n.isLeaf {
+			copy(headerless, encodeUint16(decodeUint16(headerless)|headerlessHistogramFlag))
+		}
+
+		for _, b := range [][]byte{versioned, headerless} {
+			pos, _, err := db.writeChunk(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := db.node(pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.level != n.level || got.isLeaf != n.isLeaf || len(got.points) != len(n.points) ||
+				len(got.pointers) != len(n.pointers) {
+				t.Fatalf("decoded level %#x leaf %v, want %#x %v", got.level, got.isLeaf, n.level, n.isLeaf)
+			}
+			level, isLeaf, _, err := db.ChunkAt(pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != n.level || isLeaf != n.isLeaf {
+				t.Fatalf("ChunkAt: level %#x leaf %v, want %#x %v", level, isLeaf, n.level, n.isLeaf)
+			}
+		}
+
+		// A header never says version 1.
+		for _, version := range []byte{1, ChunkVersion + 1} {
+			unknown := append([]byte(nil), versioned...)
+			unknown[2] = version
+			if _, err := db.decodeNode(unknown); err != ErrVersionMismatch {
+				t.Fatalf("decoding version %d: %v, want ErrVersionMismatch", version, err)
+			}
+			pos, _, err := db.writeChunk(unknown)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err := db.ChunkAt(pos); err != ErrVersionMismatch {
+				t.Fatalf("ChunkAt of version %d: %v, want ErrVersionMismatch", version, err)
+			}
+		}
+
+		long := append([]byte(nil), versioned...)
+		copy(long[4:chunkHeaderSize], encodeUint32(uint32(len(versioned))))
+		if _, err := db.decodeNode(long); err != ErrInvalid {
+			t.Fatalf("decoding a length past the chunk: %v, want ErrInvalid", err)
+		}
+	}
+}
+
+func TestReadFaults(t *testing.T) {
+	db := tempDB(t)
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	path := db.Path()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	errDisk := errors.New("disk on fire")
+	faults := []struct {
+		name string
+		read func(o *Ops, b []byte, off int64) (int, error)
+		want func(err error) bool
+	}{
+		{
+			"short read",
+			func(o *Ops, b []byte, off int64) (int, error) {
+				return o.File.ReadAt(b[:len(b)/2], off)
+			},
+			func(err error) bool {
+				return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrChunkDataLessThanSize)
+			},
+		},
+		{
+			"read error",
+			func(o *Ops, b []byte, off int64) (int, error) {
+				return 0, errDisk
+			},
+			func(err error) bool { return errors.Is(err, errDisk) },
+		},
+	}
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints}
+	for _, f := range faults {
+		// Reads of both metas fail, Open fails with them and leaves the
+		// file unlocked.
+		_, err := openWithOps(path, 0600, opts, func(o *Ops) {
+			o.readAt = func(b []byte, off int64) (int, error) { return f.read(o, b, off) }
+		})
+		if err == nil || !f.want(err) {
+			t.Fatalf("%s: Open: %v", f.name, err)
+		}
+
+		// Reads of nodes fail once the database is open.
+		var fail atomic.Bool
+		db, err := openWithOps(path, 0600, opts, func(o *Ops) {
+			o.readAt = func(b []byte, off int64) (int, error) {
+				if fail.Load() && off >= int64(MetaSize) {
+					return f.read(o, b, off)
+				}
+				return o.File.ReadAt(b, off)
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		fail.Store(true)
+		if _, err := db.Get(key); !f.want(err) {
+			t.Fatalf("%s: Get: %v", f.name, err)
+		}
+		if _, _, _, err := db.ChunkAt(db.meta.root); !f.want(err) {
+			t.Fatalf("%s: ChunkAt: %v", f.name, err)
+		}
+		if errs := db.Check(); len(errs) == 0 {
+			t.Fatalf("%s: Check found nothing", f.name)
+		}
+
+		fail.Store(false)
+		if _, err := db.Get(key); err != nil {
+			t.Fatalf("%s: Get once reads work again: %v", f.name, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestEncodingGolden pins the bytes of the file format, which is big-endian
+// on every host: a change here breaks every file already written.
+func TestEncodingGolden(t *testing.T) {
+	ints := []struct {
+		got  []byte
+		want string
+	}{
+		{encodeUint16(0x0102), "0102"},
+		{encodeUint32(0x01020304), "01020304"},
+		{encodeUint64(0x0102030405060708), "0102030405060708"},
+		{encodeInt64(-2), "fffffffffffffffe"},
+		{encodeFloat64(1.5), "3ff8000000000000"},
+	}
+	for _, i := range ints {
+		if got := hex.EncodeToString(i.got); got != i.want {
+			t.Fatalf("got %s, want %s", got, i.want)
+		}
+	}
+
+	metaHex := "00000000ef5d2bca0001000000000000020000000000000000000000000000000007"
+	m := &meta{magic: magic, version: Version, root: 512, txid: 7}
+	if got := hex.EncodeToString(m.toBytes()); got != metaHex {
+		t.Fatalf("meta: got %s, want %s", got, metaHex)
+	}
+	metaBytes, _ := hex.DecodeString(metaHex)
+	decoded, err := newMetaFromBytes(metaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *m {
+		t.Fatalf("meta: decoded %+v, want %+v", decoded, m)
+	}
+
+	leafHex := "3000020000000027a0408080fbbc8ddffdee280b0001763ff800000000000080e59a770b000176c000000000000000"
+	db := &DB{}
+	leaf := db.newLeafNode()
+	leaf.level = LevelSecond
+	leaf.points = []*Point{
+		{Timestamp: 1472390640000000000, Value: map[string]float64{"v": 1.5}},
+		{Timestamp: 1472390640250000000, Value: map[string]float64{"v": -2}},
+	}
+	if got := hex.EncodeToString(leaf.encode()); got != leafHex {
+		t.Fatalf("leaf: got %s, want %s", got, leafHex)
+	}
+	leafBytes, _ := hex.DecodeString(leafHex)
+	n, err := db.decodeNode(leafBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.points) != len(leaf.points) {
+		t.Fatalf("leaf: decoded %d points, want %d", len(n.points), len(leaf.points))
+	}
+	for i, p := range n.points {
+		if p.Timestamp != leaf.points[i].Timestamp || !reflect.DeepEqual(p.Value, leaf.points[i].Value) {
+			t.Fatalf("leaf: point %d decoded as %+v, want %+v", i, p, leaf.points[i])
+		}
+	}
+}
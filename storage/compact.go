@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"os"
+)
+
+// Compact writes the live tree of a read-only snapshot into a new database
+// at dstPath, leaving behind the chunks superseded by later flushes. Chunks
+// are written children first, so every subtree is contiguous in the new
+// file. The new database goes on from the transaction of the snapshot and
+// keeps the info of db. dstPath must not exist.
+func (db *DB) Compact(dstPath string) error {
+	if _, err := os.Stat(dstPath); err == nil {
+		return os.ErrExist
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dst, err := Open(dstPath, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	pos, err := tx.root.compact(dst)
+	if err != nil {
+		return err
+	}
+
+	dst.meta.root = pos
+	dst.meta.txid = tx.meta.txid
+	dst.meta.checksum = tx.meta.checksum
+	if db.info != (DBInfo{}) {
+		if err := dst.writeInfo(db.info); err != nil {
+			return err
+		}
+	}
+
+	registry, err := db.readRegistry(tx.meta.registry)
+	if err != nil {
+		return err
+	}
+	if len(registry) > 0 {
+		for name, pos := range registry {
+			root, err := db.node(pos)
+			if err != nil {
+				return err
+			}
+			if registry[name], err = root.compact(dst); err != nil {
+				return err
+			}
+		}
+		if dst.meta.registry, _, err = dst.writeChunk(encodeRegistry(registry)); err != nil {
+			return err
+		}
+	}
+
+	if err := dst.writeMeta(dst.meta); err != nil {
+		return err
+	}
+	return dst.ops.Sync()
+}
+
+// compact writes n and everything below it to dst and returns the position
+// of n in dst.
+func (n *node) compact(dst *DB) (int64, error) {
+	if n.isLeaf {
+		pos, _, err := dst.writeChunk(n.encode())
+		return pos, err
+	}
+
+	c := dst.newInteriorNode()
+	c.level = n.level
+	for _, pointer := range n.pointers {
+		child := pointer.pointer
+		if child == nil {
+			var err error
+			if child, err = n.db.node(pointer.pos); err != nil {
+				return 0, err
+			}
+		}
+
+		pos, err := child.compact(dst)
+		if err != nil {
+			return 0, err
+		}
+		c.pointers = append(c.pointers, &nodePointer{
+			key:   pointer.key,
+			pos:   pos,
+			count: child.count(),
+			value: pointer.value,
+		})
+	}
+
+	pos, _, err := dst.writeChunk(c.encode())
+	return pos, err
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	keys := make([]int64, 50)
+	for i := range keys {
+		keys[i] = base + int64(i)*int64(37*time.Minute) + int64(i)
+	}
+
+	// Overwrite every key a few times, each Put rewrites its whole path.
+	for round := 0; round < 5; round++ {
+		for i, key := range keys {
+			if err := db.Put(key, map[string]float64{"v": float64(round*100 + i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dstPath := filepath.Join(t.TempDir(), "compact")
+	if err := db.Compact(dstPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(dstPath); err != os.ErrExist {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	src, err := os.Stat(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Size() >= src.Size()/10 {
+		t.Fatalf("compacted file not smaller: %d >= %d/10", dst.Size(), src.Size())
+	}
+
+	cdb, err := Open(dstPath, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+	if got, want := cdb.TxID(), db.TxID(); got != want {
+		t.Fatalf("TxID = %d, want %d", got, want)
+	}
+	if info := cdb.Info(); info != db.Info() {
+		t.Fatalf("compacted Info = %+v, want %+v", info, db.Info())
+	}
+	for i, key := range keys {
+		p, err := cdb.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Value["v"] != float64(400+i) {
+			t.Fatalf("unexpected value: %v", p.Value)
+		}
+	}
+	if got, want := cdb.root.reduce()["v"], db.root.reduce()["v"]; !sameValue(got, want) {
+		t.Fatalf("got aggregate %+v, want %+v", got, want)
+	}
+
+	// The compacted database stays writable.
+	if err := cdb.Put(base-1, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cdb.Get(base - 1); err != nil {
+		t.Fatal(err)
+	}
+}
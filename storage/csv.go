@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ImportCSV reads timestamp,metric,value rows from r and inserts them in
+// batches of importBatchSize points as it goes, rows sharing a timestamp
+// become one point. Rows of a timestamp put by an earlier batch are added
+// to the point stored. Timestamps are parsed with tsLayout, e.g.
+// time.RFC3339Nano, or read as unix nanoseconds when tsLayout is empty. An
+// optional header row starting with "timestamp" is skipped. A malformed row
+// fails the import with its line number, the batches before it are kept.
+func (db *DB) ImportCSV(r io.Reader, tsLayout string) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	// The span of the timestamps put so far, points in it may need merging.
+	lo, hi := int64(math.MaxInt64), int64(math.MinInt64)
+
+	values := make(map[int64]map[string]float64)
+	flush := func() error {
+		points := make([]Point, 0, len(values))
+		for ts, value := range values {
+			points = append(points, Point{Timestamp: ts, Value: value})
+		}
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Timestamp < points[j].Timestamp
+		})
+		if err := db.putMerged(points, lo, hi); err != nil {
+			return err
+		}
+
+		if first := points[0].Timestamp; first < lo {
+			lo = first
+		}
+		if last := points[len(points)-1].Timestamp; last > hi {
+			hi = last
+		}
+		clear(values)
+		return nil
+	}
+
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if first && record[0] == "timestamp" {
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		ts, err := parseCSVTime(record[0], tsLayout)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if record[1] == "" {
+			return fmt.Errorf("line %d: empty metric name", line)
+		}
+		v, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if values[ts] == nil {
+			if len(values) == importBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			values[ts] = make(map[string]float64)
+		}
+		values[ts][record[1]] = v
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+	return flush()
+}
+
+// putMerged inserts points sorted by timestamp and flushes them once, like
+// PutBatch. The metrics of the ones between lo and hi inclusive are added
+// to the point stored at their timestamp, if there is one.
+func (db *DB) putMerged(points []Point, lo, hi int64) error {
+	return db.Update(func(tx *Tx) error {
+		for _, point := range points {
+			if err := checkValue(point.Value); err != nil {
+				return err
+			}
+			value := db.transformed(point.Value)
+			var expires int64
+			if point.Timestamp >= lo && point.Timestamp <= hi {
+				stored, err := tx.Get(point.Timestamp)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+				if stored != nil {
+					// Stored values are already transformed.
+					merged := make(map[string]float64, len(stored.Value)+len(value))
+					for k, v := range stored.Value {
+						merged[k] = v
+					}
+					for k, v := range value {
+						merged[k] = v
+					}
+					value, expires = merged, stored.expires
+				}
+			}
+			if err := db.putRaw(db.root, point.Timestamp, value, expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func parseCSVTime(s, layout string) (int64, error) {
+	if layout == "" {
+		return strconv.ParseInt(s, 10, 64)
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportCSV(t *testing.T) {
+	db := tempDB(t)
+
+	data := `timestamp,metric,value
+2016-08-28T21:24:00Z,open,10.1
+2016-08-28T21:24:00Z,close,10.2
+2016-08-28T21:25:00Z,open,10.3
+2016-08-28T21:24:30.5Z,volume,7
+`
+	if err := db.ImportCSV(strings.NewReader(data), time.RFC3339Nano); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	p, err := db.Get(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Value) != 2 || p.Value["open"] != 10.1 || p.Value["close"] != 10.2 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+	if p, err := db.Get(ts + 30500*int64(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	} else if p.Value["volume"] != 7 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+
+	// Unix nanosecond timestamps.
+	data = "1472419440000000001,open,1\n1472419440000000001,high,2\n"
+	if err := db.ImportCSV(strings.NewReader(data), ""); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.Get(1472419440000000001); err != nil {
+		t.Fatal(err)
+	} else if len(p.Value) != 2 || p.Value["high"] != 2 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+}
+
+func TestImportCSVMalformed(t *testing.T) {
+	db := tempDB(t)
+
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"2016-08-28T21:24:00Z,open,1\n2016-08-28T21:25:00Z,open,x\n", "line 2: "},
+		{"2016-08-28T21:24:00Z,open,1\nyesterday,open,1\n", "line 2: "},
+		{"2016-08-28T21:24:00Z,,1\n", "line 1: empty metric name"},
+		{"2016-08-28T21:24:00Z,open,1\n2016-08-28T21:25:00Z,open\n", "line 2"},
+	}
+	for _, tt := range tests {
+		err := db.ImportCSV(strings.NewReader(tt.data), time.RFC3339)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ImportCSV(%q) = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+
+	err := db.ImportCSV(strings.NewReader("2016-08-28T21:24:00Z,open,x\n"), time.RFC3339)
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("ImportCSV of a bad value = %v, want %v", err, strconv.ErrSyntax)
+	}
+	var perr *time.ParseError
+	if err := db.ImportCSV(strings.NewReader("yesterday,open,1\n"), time.RFC3339); !errors.As(err, &perr) {
+		t.Errorf("ImportCSV of a bad timestamp = %v, want a *time.ParseError", err)
+	}
+
+	// Nothing of a failed import is stored.
+	if _, err := db.Get(time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestImportCSVBatches(t *testing.T) {
+	db := tempDB(t)
+
+	// The open rows fill more than a batch before the close rows of the
+	// same timestamps come.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	n := importBatchSize + importBatchSize/2
+	var data strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&data, "%d,open,%d\n", base+int64(i)*int64(time.Second), i)
+	}
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&data, "%d,close,%d\n", base+int64(i)*int64(time.Second), -i)
+	}
+	if err := db.ImportCSV(strings.NewReader(data.String()), ""); err != nil {
+		t.Fatal(err)
+	}
+	points, err := db.Range(base, base+int64(n)*int64(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != n {
+		t.Fatalf("got %d points, want %d", len(points), n)
+	}
+	for i, p := range points {
+		if len(p.Value) != 2 || p.Value["open"] != float64(i) || p.Value["close"] != float64(-i) {
+			t.Fatalf("point %d = %v", i, p.Value)
+		}
+	}
+
+	// The batches before a malformed row are kept.
+	next := base + int64(time.Hour)
+	data.Reset()
+	for i := 0; i <= importBatchSize; i++ {
+		fmt.Fprintf(&data, "%d,open,%d\n", next+int64(i)*int64(time.Second), i)
+	}
+	data.WriteString("yesterday,open,1\n")
+	if err := db.ImportCSV(strings.NewReader(data.String()), ""); err == nil {
+		t.Fatal("expected error importing a malformed row")
+	}
+	count, err := db.Count(next, next+int64(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != importBatchSize {
+		t.Fatalf("Count = %d, want %d", count, importBatchSize)
+	}
+}
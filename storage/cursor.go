@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"context"
 	"sort"
+	"time"
 )
 
 type Cursor struct {
 	db      *DB
+	root    *node
 	level   uint16
 	reducer map[string]string
 	stack   []elemRef
+	err     error // the first child that could not be read while moving
 }
 
 // fix position to insert data.
@@ -20,7 +24,9 @@ func (c *Cursor) fix(t *Time, n *node) error {
 		if t.Level()>>1 <= n.level {
 			return nil
 		}
-		n.expand()
+		if err := n.expand(); err != nil {
+			return err
+		}
 	}
 
 	if len(n.pointers) == 0 {
@@ -33,9 +39,10 @@ func (c *Cursor) fix(t *Time, n *node) error {
 
 	// If the inserted node is not equal dirty node, flush the dirty.
 	// Only one dirty branch in the tree.
-	if n.dirty != -1 && n.dirty != index {
-		n.pointers[n.dirty].pointer.reduce()
-		n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
+	if n.dirty != index {
+		if err := n.flushDirty(); err != nil {
+			return err
+		}
 	}
 
 	// Cannot find the key == ts
@@ -48,19 +55,86 @@ func (c *Cursor) fix(t *Time, n *node) error {
 	if child == nil {
 		var err error
 		child, err = c.db.node(n.pointers[index].pos)
-		child.parent = n
 		if err != nil {
 			return err
 		}
+		child.parent = n
 		n.pointers[index].pointer = child
-		n.dirty = index
 	}
+	n.dirty = index
 
-	e = elemRef{node: child}
-	c.stack = append(c.stack, e)
 	return c.fix(t, child)
 }
 
+// First moves the cursor to the first point and returns its key and value.
+// The value is nil if there are no points. Like the other moves it passes
+// over expired points, see PutWithTTL.
+func (c *Cursor) First() (int64, map[string]float64) {
+	c.rewind()
+	c.skipExpired(c.next)
+	return c.keyValue()
+}
+
+// Last moves the cursor to the last point and returns its key and value.
+// The value is nil if there are no points.
+func (c *Cursor) Last() (int64, map[string]float64) {
+	c.level = levelPoint
+
+	e := elemRef{node: c.root}
+	e.index = e.count() - 1
+	c.stack = append(c.stack[:0], e)
+	if !c.root.isLeaf && len(c.root.pointers) > 0 {
+		c.last()
+	}
+	c.skipExpired(c.prev)
+	return c.keyValue()
+}
+
+// Next moves the cursor to the next point and returns its key and value.
+// The value is nil past the last point, where Prev steps back onto it.
+// An unpositioned cursor moves to the first point.
+func (c *Cursor) Next() (int64, map[string]float64) {
+	if len(c.stack) == 0 || c.level != levelPoint {
+		return c.First()
+	}
+	c.next()
+	c.skipExpired(c.next)
+	return c.keyValue()
+}
+
+// Prev moves the cursor to the previous point and returns its key and
+// value. The value is nil before the first point, where Next steps forward
+// onto it. An unpositioned cursor moves to the last point.
+func (c *Cursor) Prev() (int64, map[string]float64) {
+	if len(c.stack) == 0 || c.level != levelPoint {
+		return c.Last()
+	}
+	c.prev()
+	c.skipExpired(c.prev)
+	return c.keyValue()
+}
+
+// skipExpired moves the cursor with move until it is on a point that has
+// not expired or on none.
+func (c *Cursor) skipExpired(move func() bool) {
+	now := time.Now().UnixNano()
+	for point := c.point(); point != nil && point.expired(now); point = c.point() {
+		move()
+	}
+}
+
+// keyValue returns the key and value of the point under the cursor.
+func (c *Cursor) keyValue() (int64, map[string]float64) {
+	point := c.point()
+	if point == nil {
+		return 0, nil
+	}
+	if point.Value == nil {
+		return point.Timestamp, map[string]float64{}
+	}
+	return point.Timestamp, point.Value
+}
+
 // seek moves the cursor to a given key and returns it.
 // If the key does not exist then the next key is used.
 func (c *Cursor) seek(seek int64) {
@@ -69,7 +143,95 @@ func (c *Cursor) seek(seek int64) {
 	// Start from root and traverse to correct position.
 	c.stack = c.stack[:0]
 	t := NewTime(seek)
-	c.search(&t, c.db.root)
+	c.search(&t, c.root)
+}
+
+// get returns the point at key.
+func (c *Cursor) get(key int64) (*Point, error) {
+	c.level = levelPoint
+
+	c.seek(key)
+	if c.err != nil {
+		return nil, c.err
+	}
+	point := c.point()
+	if point != nil && point.Timestamp == key && !point.expired(time.Now().UnixNano()) {
+		return point, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// ctxCheckInterval is the number of points scanned between checks of the
+// context of a scan.
+const ctxCheckInterval = 256
+
+// collect returns the points between start and end inclusive, keeping only
+// the given metrics unless there are none. Points without any of them are
+// left out. It stops with the error of ctx once ctx is done.
+func (c *Cursor) collect(ctx context.Context, start, end int64, metrics []string) ([]Point, error) {
+	points := make([]Point, 0)
+	if start > end {
+		return points, nil
+	}
+
+	c.level = levelPoint
+	set := newMetricSet(metrics)
+
+	c.seek(start)
+	err := c.eachContext(ctx, end, func(point *Point) error {
+		if point.Timestamp < start {
+			return nil
+		}
+		if value := set.filter(point); value != nil {
+			points = append(points, Point{Timestamp: point.Timestamp, Value: value})
+		}
+		return nil
+	})
+	return points, err
+}
+
+// rewind moves the cursor to the first point in the tree.
+func (c *Cursor) rewind() {
+	c.level = levelPoint
+
+	c.stack = append(c.stack[:0], elemRef{node: c.root})
+	if !c.root.isLeaf && len(c.root.pointers) > 0 {
+		c.first()
+	}
+}
+
+// each calls fn for the point under the cursor and every point after it up
+// to end inclusive, passing over expired points. It stops at the first
+// error returned by fn, or by reading a node on the way.
+func (c *Cursor) each(end int64, fn func(point *Point) error) error {
+	now := time.Now().UnixNano()
+	for point := c.point(); point != nil && c.err == nil; point = c.point() {
+		if point.Timestamp > end {
+			break
+		}
+		if !point.expired(now) {
+			if err := fn(point); err != nil {
+				return err
+			}
+		}
+		c.next()
+	}
+	return c.err
+}
+
+// eachContext is each, checking ctx every ctxCheckInterval points.
+func (c *Cursor) eachContext(ctx context.Context, end int64, fn func(point *Point) error) error {
+	n := 0
+	return c.each(end, func(point *Point) error {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		n++
+		return fn(point)
+	})
 }
 
 // next moves the cursor to next node.
@@ -78,6 +240,7 @@ func (c *Cursor) next() bool {
 	ref.index++
 	if ref.count() == 0 || ref.index >= ref.count() {
 		if len(c.stack) <= 1 {
+			ref.index = ref.count()
 			return true
 		}
 		c.stack = c.stack[:len(c.stack)-1]
@@ -101,6 +264,7 @@ func (c *Cursor) first() error {
 		var err error
 		n, err = c.db.node(ref.node.pointers[ref.index].pos)
 		if err != nil {
+			c.fail(err)
 			return err
 		}
 	} else {
@@ -117,12 +281,13 @@ func (c *Cursor) first() error {
 	return nil
 }
 
-// prev moves the cursor to next node.
+// prev moves the cursor to previous node.
 func (c *Cursor) prev() bool {
 	ref := &c.stack[len(c.stack)-1]
 	ref.index--
 	if ref.count() == 0 || ref.index < 0 {
 		if len(c.stack) <= 1 {
+			ref.index = -1
 			return true
 		}
 		c.stack = c.stack[:len(c.stack)-1]
@@ -145,13 +310,15 @@ func (c *Cursor) last() error {
 		var err error
 		n, err = c.db.node(ref.node.pointers[ref.index].pos)
 		if err != nil {
+			c.fail(err)
 			return err
 		}
 	} else {
 		n = ref.node.pointers[ref.index].pointer
 	}
 
-	e := elemRef{node: n, index: len(n.pointers) - 1}
+	e := elemRef{node: n}
+	e.index = e.count() - 1
 	c.stack = append(c.stack, e)
 
 	if !n.isLeaf && n.level < c.level>>1 {
@@ -172,11 +339,11 @@ func (c *Cursor) points() []*Point {
 	return points
 }
 
-// keyValue returns the key and value of the current cursor.
+// point returns the point under the cursor, nil if it is not on one.
 func (c *Cursor) point() *Point {
 	ref := &c.stack[len(c.stack)-1]
 	if ref.isLeaf() {
-		if ref.count() == 0 || ref.index >= ref.count() {
+		if ref.count() == 0 || ref.index < 0 || ref.index >= ref.count() {
 			return nil
 		}
 		return ref.node.points[ref.index]
@@ -219,6 +386,7 @@ func (c *Cursor) searchInterior(t *Time) {
 		var err error
 		n.pointers[index].pointer, err = n.db.node(n.pointers[index].pos)
 		if err != nil {
+			c.fail(err)
 			return
 		}
 	}
@@ -240,6 +408,13 @@ func (c *Cursor) searchLeaf(t *Time) {
 	}
 }
 
+// fail records err unless an earlier error was recorded.
+func (c *Cursor) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 // node returns the node that the cursor is currently positioned on.
 func (c *Cursor) node() *node {
 	_assert(len(c.stack) > 0, "accessing a node with a zero-length cursor stack")
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCursorNextPrev(t *testing.T) {
+	db := tempDB(t)
+
+	c := db.Cursor()
+	if _, v := c.First(); v != nil {
+		t.Fatalf("unexpected value in empty db: %v", v)
+	}
+	if _, v := c.Last(); v != nil {
+		t.Fatalf("unexpected value in empty db: %v", v)
+	}
+
+	// Nanosecond keys spread over several months, so iteration crosses
+	// leaves at every level of the tree.
+	base := time.Date(2016, 6, 30, 23, 0, 0, 11, time.Local)
+	var points []Point
+	for i := 0; i < 300; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 7 * time.Hour).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		c := db.Cursor()
+		var forward []int64
+		for k, v := c.First(); v != nil; k, v = c.Next() {
+			if want := float64(len(forward)); v["v"] != want {
+				t.Fatalf("value at %d: got %v, want %v", k, v["v"], want)
+			}
+			forward = append(forward, k)
+		}
+		if len(forward) != len(points) {
+			t.Fatalf("forward: got %d points, want %d", len(forward), len(points))
+		}
+
+		// Stepping back from the end lands on the last point.
+		if k, _ := c.Prev(); k != points[len(points)-1].Timestamp {
+			t.Fatalf("Prev after end: got %d", k)
+		}
+
+		var backward []int64
+		for k, v := c.Last(); v != nil; k, v = c.Prev() {
+			backward = append(backward, k)
+		}
+		if len(backward) != len(forward) {
+			t.Fatalf("backward: got %d points, want %d", len(backward), len(forward))
+		}
+		for i, k := range backward {
+			if k != forward[len(forward)-1-i] {
+				t.Fatalf("backward point %d: got %d, want %d", i, k, forward[len(forward)-1-i])
+			}
+		}
+
+		if k, _ := c.Next(); k != points[0].Timestamp {
+			t.Fatalf("Next before start: got %d", k)
+		}
+	}
+	check(db)
+
+	// Nodes loaded lazily from disk.
+	db = reopen(t, db, nil)
+	check(db)
+}
+
+func TestCursorCorruptLeaf(t *testing.T) {
+	db := tempDB(t)
+
+	// Three days of points an hour apart, one leaf a day.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 3*24; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * time.Hour).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the leaf of the first day on disk, with nothing of it left in
+	// memory or the node cache.
+	n := db.root
+	var pos int64
+	for !n.isLeaf {
+		pos = n.pointers[0].pos
+		var err error
+		if n, err = db.node(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ops.WriteAt([]byte{0xFF, 0xFF}, pos+ChunkLengthSize+ChunkCrcSize+2); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, nil)
+	defer db.Close()
+
+	// Every read reaching the leaf fails instead of finding nothing.
+	start, end := points[0].Timestamp, points[len(points)-1].Timestamp
+	reads := map[string]func() error{
+		"Get": func() error {
+			_, err := db.Get(start)
+			return err
+		},
+		"Range": func() error {
+			_, err := db.Range(start, end)
+			return err
+		},
+		"ForEach": func() error {
+			return db.ForEach(func(int64, map[string]float64) error { return nil })
+		},
+		"Tx.Get": func() error {
+			return db.View(func(tx *Tx) error {
+				_, err := tx.Get(start)
+				return err
+			})
+		},
+		"Tx.Range": func() error {
+			return db.View(func(tx *Tx) error {
+				_, err := tx.Range(start, end)
+				return err
+			})
+		},
+		"ExportJSON": func() error {
+			return db.ExportJSON(io.Discard)
+		},
+		"Downsample": func() error {
+			_, err := db.Downsample(start, end, time.Hour, "sum", "none")
+			return err
+		},
+		"Rate": func() error {
+			_, err := db.Rate(start, end, "v")
+			return err
+		},
+		"OHLC": func() error {
+			_, err := db.OHLC(start, end, "v", "", time.Hour)
+			return err
+		},
+		"TimeWeightedAverage": func() error {
+			_, err := db.TimeWeightedAverage(start, end, "v")
+			return err
+		},
+	}
+	for name, read := range reads {
+		if err := read(); err == nil || err == ErrNotFound {
+			t.Errorf("%s of a damaged leaf: %v, want a read error", name, err)
+		}
+	}
+}
@@ -2,96 +2,561 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DB is a database of points stored in a single file. Its methods are safe
+// for concurrent use: writers are serialized, and every read works on its
+// own tree, decoded from the root of the last commit when it begins, so
+// reads neither block each other nor see a write half done. The only state
+// readers share is the node cache, which has its own lock.
 type DB struct {
-	path     string
-	file     *os.File
-	meta     *meta
-	pos      int64
-	metalock sync.Mutex // Allows only one writer at a time.
-	rwlock   sync.Mutex // Allows only one writer at a time.
-	root     *node      // root node in memory, need flush
+	// NoSync skips syncing the file after every write, which speeds up
+	// bulk loads of data that can be loaded again. A crash may lose the
+	// writes since the last Sync, or leave the meta pointing at chunks
+	// that never reached the disk. Sync still syncs. It is set from
+	// Options.NoSync and may be changed between writes.
+	NoSync bool
 
-	ops Ops
+	path      string
+	file      *os.File
+	meta      *meta
+	pos       int64
+	metalock  sync.Mutex         // Protects meta and txs.
+	rwlock    sync.Mutex         // Allows only one writer at a time.
+	root      *node              // root node in memory, need flush
+	tail      *node              // leaf of root the last put went to, see appendTail
+	txs       []*Tx              // open read-only transactions
+	wal       *wal               // nil unless Options.WAL is set
+	series    map[string]*Series // handles returned by Series, by name
+	registry  map[string]int64   // series roots as of the last flush
+	cache     *nodeCache         // nil if Options.MaxCachedNodes is zero
+	queries   *queryCache        // nil if Options.QueryCacheSize is zero
+	group     *groupCommit       // nil if Options.GroupCommitDelay is zero
+	committed chan struct{}      // closed and replaced by every flush
+	changes   *changeLog         // keys written by the last flushes, for Changes
+	closeOnce sync.Once          // runs close for the first Close
+	applied   atomic.Uint64      // source txid of the last ApplyChanges
+
+	// Options.Retention, applied by a goroutine stopped and waited for
+	// through retentionStop and retentionDone.
+	retention         map[uint16]time.Duration
+	retentionInterval time.Duration
+	retentionStop     chan struct{}
+	retentionDone     chan struct{}
+
+	// expired holds for a level of Expire the time before which no point
+	// aligned to it is left in the tree, so the next run can skip the
+	// subtrees before it. Putting an older point moves it back.
+	expired map[uint16]int64
+
+	// Options.SweepInterval, the expired points of PutWithTTL are removed
+	// by a goroutine stopped and waited for through sweepStop and
+	// sweepDone.
+	sweepInterval time.Duration
+	sweepStop     chan struct{}
+	sweepDone     chan struct{}
+
+	maxLeafPoints int
+	maxLeafBytes  int
+	maxTxOps      int
+	txOps         int // puts and deletes since the last flush or rollback
+	readOnly      bool
+	mergeDup      bool
+	deltaValues   bool
+	debug         bool
+	checksum      Checksum // Options.Checksum, for metas written from scratch
+	info          DBInfo
+	transform     func(metric string, v float64) float64
+	logger        Logger
+
+	onMemoryPressure func(bytes int64)
+
+	ops      Ops
+	counters counters
+}
+
+// Options represents the options that can be set when opening a database.
+type Options struct {
+	// MaxLeafPoints is the number of points a leaf holds before it is
+	// expanded into sub-leaves one level finer. It must be positive.
+	MaxLeafPoints int
+
+	// MaxLeafBytes bounds the encoded size of a leaf as well, so leaves of
+	// points carrying many metrics are expanded before they reach
+	// MaxLeafPoints. The size is estimated from above. Zero leaves it
+	// unbounded.
+	MaxLeafBytes int
+
+	// MaxTxOps bounds the puts and deletes a single write, a PutBatch or a
+	// writable transaction, holds in memory before it is flushed. The one
+	// going over it returns ErrTxTooLarge, so a runaway batch fails and is
+	// rolled back instead of growing the tree until memory runs out. Zero
+	// leaves it unbounded.
+	MaxTxOps int
+
+	// ReadOnly opens the file read-only. Writes return ErrDatabaseReadOnly
+	// and the file must already hold a database.
+	ReadOnly bool
+
+	// MergeOnDuplicate merges the metrics of a point put at an existing
+	// timestamp into the stored ones, instead of replacing them all.
+	MergeOnDuplicate bool
+
+	// WAL records the root of every flush in a log next to the database
+	// before the meta is rewritten, so Open can recover from a crash in the
+	// middle of that write. It costs an extra sync per flush.
+	WAL bool
+
+	// InMemory keeps the database in an unlinked temporary file that is
+	// never synced, for tests and caches. Nothing is left on disk once it
+	// is closed. It cannot be combined with ReadOnly or WAL.
+	InMemory bool
+
+	// Timeout is how long Open waits for the lock on the file before
+	// returning ErrTimeout. Zero waits forever. The lock is exclusive
+	// unless ReadOnly is set, in which case it is shared with other
+	// readers.
+	Timeout time.Duration
+
+	// MaxCachedNodes is the number of recently read nodes kept in memory,
+	// so walking the same part of the tree again does not go to the file.
+	// Zero disables the cache.
+	MaxCachedNodes int
+
+	// MemorySoftLimit is the size in bytes of the chunks held by the node
+	// cache past which OnMemoryPressure is called. Zero never calls it.
+	MemorySoftLimit int64
+
+	// OnMemoryPressure is called with the bytes held by the node cache
+	// when a read takes them over MemorySoftLimit, and again only once
+	// they dropped back under it and went over once more. It runs in the
+	// goroutine of the read, which it holds up, so the host should only
+	// start whatever it does to shed memory from there.
+	OnMemoryPressure func(bytes int64)
+
+	// QueryCacheSize is the number of Aggregate results kept in memory, so
+	// the same query asked again before anything is written is answered
+	// without reading the tree. Zero disables the cache.
+	QueryCacheSize int
+
+	// GroupCommitDelay makes Put wait that long for other puts before
+	// committing, and commit every put that arrived in the meantime with a
+	// single flush and sync. Each Put still returns once its point is
+	// stored, so many writers putting at once sync far less often, at the
+	// cost of the delay added to every put. Zero commits every put on its
+	// own.
+	GroupCommitDelay time.Duration
+
+	// NoSync sets DB.NoSync. It cannot be combined with WAL.
+	NoSync bool
+
+	// Transform is applied to every value put, with the name of its metric,
+	// before it is stored, so values can be normalized at write time. Nil
+	// stores values as they are.
+	Transform func(metric string, v float64) float64
+
+	// Retention maps a level to how long the points aligned to it, and to
+	// nothing coarser, are kept, see Expire. With LevelSecond mapped to an
+	// hour and LevelHour to a month, points written every few seconds are
+	// kept for an hour and the ones on the hour for a month. Points are
+	// expired in the background every RetentionInterval while the database
+	// is open. It cannot be combined with ReadOnly.
+	Retention map[uint16]time.Duration
+
+	// RetentionInterval is how often Retention is applied, zero means
+	// DefaultRetentionInterval.
+	RetentionInterval time.Duration
+
+	// SweepInterval is how often the points put with PutWithTTL that have
+	// expired are removed in the background, see SweepExpired. Zero leaves
+	// them until SweepExpired is called, reads skip them in the meantime.
+	// It cannot be combined with ReadOnly.
+	SweepInterval time.Duration
+
+	// DeltaValues writes leaves storing every value as the delta from the
+	// previous value of its metric in the leaf, in a tag byte and four
+	// bytes where the delta fits a float32 and a tag byte alone where the
+	// value did not change, which shrinks slowly changing series. Values
+	// whose delta would lose precision are stored in full, so every value
+	// reads back exactly. Leaves are read whichever way they were written.
+	DeltaValues bool
+
+	// RootLevel is the level of the root of a new file, LevelRoot if zero.
+	// A root at LevelHour holds the points of a single hour, keyed by
+	// minute below it, so data spanning minutes is kept four levels
+	// shallower than under a root keyed by year. Puts outside the bucket of
+	// the points already held return ErrOutsideRootSpan. It must have a
+	// level below it, and a file keeps the level it was created with.
+	RootLevel uint16
+
+	// ChangeLog is the number of transactions whose written keys are kept
+	// in memory, so Changes can send a replica what they wrote. Zero keeps
+	// none, and Changes asks for a full sync unless nothing was written.
+	ChangeLog int
+
+	// Checksum is what the meta of a new file is checked with besides the
+	// crc32 of its chunk. It is stored in the meta, so a file keeps the
+	// algorithm it was created with and is read whatever this is set to.
+	// Zero is ChecksumCRC32.
+	Checksum Checksum
+
+	// Debug checks the invariants of the part of the tree held in memory
+	// after every put and panics on the first one broken, to catch bugs in
+	// the tree code where they happen rather than in the queries that
+	// trip over them later. It is slow, for tests and development only.
+	Debug bool
+
+	// StrictOnOpen runs Check once the file is opened and fails Open with
+	// ErrCorrupt if it finds any problem, instead of leaving them to fail
+	// the queries that reach them. It reads the whole file.
+	StrictOnOpen bool
+
+	// Logger receives the messages of problems the database recovers from
+	// on its own, such as a damaged meta copy. Nil discards them.
+	Logger Logger
+}
+
+// Logger is the interface Options.Logger must implement, *log.Logger does.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// discardLogger is the Logger used when Options.Logger is nil.
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+
+// DefaultOptions represent the options used if nil options are passed into
+// OpenWithOptions.
+var DefaultOptions = &Options{
+	MaxLeafPoints:  DefaultMaxLeafPoints,
+	MaxCachedNodes: DefaultMaxCachedNodes,
 }
 
-func Open(path string) (*DB, error) {
+// Open opens the database at path with the default options, creating it if
+// it does not exist.
+func Open(path string, mode os.FileMode) (*DB, error) {
+	return OpenWithOptions(path, mode, nil)
+}
+
+// OpenWithOptions opens the database at path, creating it if it does not
+// exist. Passing nil options uses DefaultOptions.
+func OpenWithOptions(path string, mode os.FileMode, opts *Options) (*DB, error) {
+	return openWithOps(path, mode, opts, nil)
+}
+
+// openWithOps is OpenWithOptions calling setup, if not nil, on the Ops of
+// the database before its file is opened, so tests can inject faults into
+// the reads and writes of Open itself.
+func openWithOps(path string, mode os.FileMode, opts *Options, setup func(ops *Ops)) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if opts.MaxLeafPoints <= 0 || opts.MaxLeafBytes < 0 || opts.MaxCachedNodes < 0 || opts.ChangeLog < 0 || opts.QueryCacheSize < 0 || opts.MaxTxOps < 0 {
+		return nil, ErrInvalidOptions
+	}
+	if opts.InMemory && (opts.ReadOnly || opts.WAL) {
+		return nil, ErrInvalidOptions
+	}
+	if opts.NoSync && opts.WAL {
+		return nil, ErrInvalidOptions
+	}
+	if len(opts.Retention) > 0 && opts.ReadOnly || !validRetention(opts.Retention) || opts.RetentionInterval < 0 {
+		return nil, ErrInvalidOptions
+	}
+	if opts.SweepInterval < 0 || opts.SweepInterval > 0 && opts.ReadOnly {
+		return nil, ErrInvalidOptions
+	}
+	if opts.GroupCommitDelay < 0 || opts.MemorySoftLimit < 0 {
+		return nil, ErrInvalidOptions
+	}
+	if !opts.Checksum.valid() {
+		return nil, ErrInvalidOptions
+	}
+	if opts.RootLevel != 0 && !validRootLevel(opts.RootLevel) {
+		return nil, ErrInvalidOptions
+	}
+
 	db := &DB{path: path}
+	if setup != nil {
+		setup(&db.ops)
+	}
+	db.maxLeafPoints = opts.MaxLeafPoints
+	db.maxLeafBytes = opts.MaxLeafBytes
+	db.maxTxOps = opts.MaxTxOps
+	db.readOnly = opts.ReadOnly
+	db.mergeDup = opts.MergeOnDuplicate
+	db.NoSync = opts.NoSync
+	db.transform = opts.Transform
+	db.checksum = opts.Checksum
+	db.deltaValues = opts.DeltaValues
+	db.debug = opts.Debug
+	db.cache = newNodeCache(opts.MaxCachedNodes)
+	if db.cache != nil {
+		db.cache.soft = opts.MemorySoftLimit
+	}
+	db.onMemoryPressure = opts.OnMemoryPressure
+	db.queries = newQueryCache(opts.QueryCacheSize)
+	if opts.GroupCommitDelay > 0 {
+		db.group = &groupCommit{delay: opts.GroupCommitDelay}
+	}
+	db.logger = opts.Logger
+	if db.logger == nil {
+		db.logger = discardLogger{}
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
 
 	var err error
-	if db.file, err = db.ops.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+	if opts.InMemory {
+		db.file, err = db.ops.OpenTemp()
+	} else {
+		db.file, err = db.ops.OpenFile(db.path, flag, mode)
+	}
+	if err != nil {
 		_ = db.Close()
 		return nil, err
 	}
 
+	// An in-memory file cannot be opened by anyone else.
+	if !opts.InMemory {
+		if err := flock(db.file, !db.readOnly, opts.Timeout); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	if err := db.load(mode, opts); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	db.committed = make(chan struct{})
+	db.changes = newChangeLog(opts.ChangeLog, db.meta.txid)
+
+	if opts.StrictOnOpen {
+		if errs := db.Check(); errs != nil {
+			_ = db.Close()
+			return nil, corruptError(errs)
+		}
+	}
+
+	if len(opts.Retention) > 0 {
+		db.startRetention(opts.Retention, opts.RetentionInterval)
+	}
+	if opts.SweepInterval > 0 {
+		db.startSweep(opts.SweepInterval)
+	}
+	return db, nil
+}
+
+// load reads the meta and the root of an opened file, writing them first if
+// the file is empty.
+func (db *DB) load(mode os.FileMode, opts *Options) error {
+	var err error
 	db.pos, err = db.ops.GotoEOF()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if opts.WAL {
+		if db.wal, err = openWAL(db.path, mode, db.readOnly); err != nil {
+			return err
+		}
 	}
 
 	// Check db whether exists.
-	if db.pos == 0 {
+	if db.pos == 0 && db.readOnly {
+		return ErrInvalid
+	} else if db.pos == 0 {
+		// A log left behind by an earlier database at this path does
+		// not apply to the new one.
+		if db.wal != nil {
+			if err = db.wal.reset(); err != nil {
+				return err
+			}
+		}
+
 		// Write meta
-		db.meta = newMeta()
+		db.meta = newMeta(opts.Checksum)
 		err = db.writeMeta(db.meta)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = db.writeInfo(DBInfo{
+			Created:        time.Unix(0, time.Now().UnixNano()),
+			LibraryVersion: LibraryVersion,
+			FormatVersion:  Version,
+			MaxLeafPoints:  opts.MaxLeafPoints,
+			MaxLeafBytes:   opts.MaxLeafBytes,
+			Checksum:       opts.Checksum,
+		})
+		if err != nil {
+			return err
 		}
 
 		// Write root
 		root := db.newLeafNode()
 		root.level = LevelRoot
+		if opts.RootLevel != 0 {
+			root.level = opts.RootLevel
+		}
 		db.pos = int64(MetaSize)
-		db.writeChunk(root.encode())
+		if _, _, err = db.writeChunk(root.encode()); err != nil {
+			return err
+		}
 
 		db.root = root
+	} else if db.pos < int64(MetaSize) {
+		return fmt.Errorf("%w: %d bytes, want at least %d", ErrCorruptTooSmall, db.pos, MetaSize)
 	} else {
 		// Read meta
 		err = db.loadMeta()
+		if db.wal != nil {
+			err = db.recoverMeta(err)
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
+		db.readInfo()
 
 		// Read root
 		db.root, err = db.node(db.meta.root)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return db, nil
+	db.series = make(map[string]*Series)
+	db.registry, err = db.readRegistry(db.meta.registry)
+	return err
 }
 
 // node read a chunk in the given positon, return node object.
 func (db *DB) node(pos int64) (*node, error) {
-	nodeBytes, err := db.readChunkAt(pos)
+	nodeBytes, err := db.nodeBytes(pos)
 	if err != nil {
 		return nil, err
 	}
-	return db.decodeNode(nodeBytes)
+	n, err := db.decodeNode(nodeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decode node at %d: %w", pos, err)
+	}
+	return n, nil
 }
 
-func (db *DB) loadMeta() error {
-	chunk, err := db.readChunkAt(0)
+// nodeRange reads the node at pos for a query of the metrics in set between
+// from and to inclusive, see decodeInteriorRange.
+func (db *DB) nodeRange(pos, from, to int64, set metricSet) (*node, error) {
+	nodeBytes, err := db.nodeBytes(pos)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.meta, err = newMetaFromBytes(chunk)
+	nodeBytes, hflags, err := chunkNode(nodeBytes)
 	if err != nil {
+		return nil, fmt.Errorf("decode node at %d: %w", pos, err)
+	}
+	var n *node
+	if decodeUint16(nodeBytes[0:2])&LeafFlag == LeafChunkFlag {
+		n, err = db.decodeLeafNode(nodeBytes, hflags)
+	} else {
+		n, err = db.decodeInteriorRange(nodeBytes, hflags, from, to, set)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode node at %d: %w", pos, err)
+	}
+	return n, nil
+}
+
+// nodeBytes returns the chunk of the node at pos, through the cache.
+func (db *DB) nodeBytes(pos int64) ([]byte, error) {
+	nodeBytes, ok := db.cache.get(pos)
+	if db.cache != nil {
+		if ok {
+			db.counters.cacheHits.Add(1)
+		} else {
+			db.counters.cacheMisses.Add(1)
+		}
+	}
+	if !ok {
+		var err error
+		nodeBytes, err = db.readChunkAt(pos)
+		if err != nil {
+			return nil, fmt.Errorf("read node at %d: %w", pos, err)
+		}
+		if bytes, pressure := db.cache.put(pos, nodeBytes); pressure && db.onMemoryPressure != nil {
+			db.onMemoryPressure(bytes)
+		}
+	}
+	return nodeBytes, nil
+}
+
+// loadMeta reads the meta, falling back to its copy if the first one is
+// damaged. A damaged or stale copy is rewritten from the good one.
+func (db *DB) loadMeta() error {
+	m0, err0 := db.readMetaAt(0)
+	m1, err1 := db.readMetaAt(MetaCopyPos)
+	if err0 != nil && err1 != nil {
+		return fmt.Errorf("read meta: %w", err0)
+	}
+
+	// The first meta is written first, so when both are readable it is
+	// never older than the copy.
+	good, bad, badPos := m0, err1, MetaCopyPos
+	if err0 != nil {
+		good, bad, badPos = m1, err0, 0
+	} else if err1 == nil && *m0 == *m1 {
+		db.meta = m0
+		return nil
+	}
+	db.meta = good
+
+	if db.readOnly {
+		return nil
+	}
+	if bad == nil {
+		bad = fmt.Errorf("root %d, want %d", m1.root, m0.root)
+	}
+	db.logger.Printf("tickdb: %s: rewriting meta at %d: %v", db.path, badPos, bad)
+	if err := db.writeMetaAt(good, badPos); err != nil {
 		return err
 	}
-	return nil
+	return db.ops.Sync()
+}
+
+func (db *DB) readMetaAt(pos uint64) (*meta, error) {
+	chunk, err := db.readChunkAt(int64(pos))
+	if err != nil {
+		return nil, err
+	}
+	return newMetaFromBytes(chunk)
 }
 
+// writeMeta writes m and then its copy, so a torn write leaves one of the
+// two readable.
 func (db *DB) writeMeta(m *meta) error {
+	if err := db.writeMetaAt(m, 0); err != nil {
+		return err
+	}
+	return db.writeMetaAt(m, MetaCopyPos)
+}
+
+func (db *DB) writeMetaAt(m *meta, at uint64) error {
 	metaBytes := m.toBytes()
 
 	pos := db.pos
-	db.pos = 0
+	db.pos = int64(at)
 	_, _, err := db.writeChunk(metaBytes)
 	db.pos = pos
 
@@ -106,6 +571,11 @@ func (db *DB) Path() string {
 	return db.path
 }
 
+// IsReadOnly returns whether the database was opened read-only.
+func (db *DB) IsReadOnly() bool {
+	return db.readOnly
+}
+
 // Build a query
 func (db *DB) Query(from int64, to int64, level uint16, count int, reducer map[string]string) []*Point {
 	c := db.Cursor()
@@ -124,58 +594,674 @@ func (db *DB) Query(from int64, to int64, level uint16, count int, reducer map[s
 	return result
 }
 
-func (db *DB) Get(key int64) (*Point, error) {
-	c := db.Cursor()
-	c.level = LevelNSecond
+// Get returns the point at key, key is unixnano.
+func (db *DB) Get(key int64) (point *Point, err error) {
+	db.counters.gets.Add(1)
+	err = db.View(func(tx *Tx) error {
+		point, err = tx.Get(key)
+		return err
+	})
+	return point, err
+}
+
+// Range returns the points between start and end inclusive, ordered by
+// timestamp. An empty range returns an empty slice.
+//
+// If metrics are given only those are returned, and points carrying none of
+// them are left out.
+func (db *DB) Range(start, end int64, metrics ...string) ([]Point, error) {
+	return db.RangeContext(context.Background(), start, end, metrics...)
+}
+
+// RangeContext is Range, returning the error of ctx if ctx is done before
+// the scan ends.
+func (db *DB) RangeContext(ctx context.Context, start, end int64, metrics ...string) (points []Point, err error) {
+	db.counters.ranges.Add(1)
+	err = db.View(func(tx *Tx) error {
+		points, err = tx.Cursor().collect(ctx, start, end, metrics)
+		return err
+	})
+	return points, err
+}
+
+// First returns the earliest point, or ErrNotFound if there are none. It
+// reads one node per level.
+func (db *DB) First() (int64, map[string]float64, error) {
+	return db.edge(false)
+}
+
+// Last returns the latest point, or ErrNotFound if there are none. It reads
+// one node per level.
+func (db *DB) Last() (int64, map[string]float64, error) {
+	return db.edge(true)
+}
+
+func (db *DB) edge(last bool) (ts int64, value map[string]float64, err error) {
+	err = db.View(func(tx *Tx) error {
+		point, err := tx.root.edge(last)
+		if err != nil {
+			return err
+		}
+		ts, value = point.Timestamp, point.Value
+		return nil
+	})
+	return ts, value, err
+}
 
-	c.seek(key)
-	point := c.point()
-	if point.Timestamp == key {
-		return point, nil
+// ForEach calls fn for every point in timestamp order, on a snapshot of the
+// tree taken when it starts. It stops and returns the error if fn returns
+// one.
+func (db *DB) ForEach(fn func(ts int64, value map[string]float64) error) error {
+	return db.ForEachContext(context.Background(), fn)
+}
+
+// ForEachContext is ForEach, returning the error of ctx if ctx is done
+// before the scan ends.
+func (db *DB) ForEachContext(ctx context.Context, fn func(ts int64, value map[string]float64) error) error {
+	return db.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.rewind()
+		return c.eachContext(ctx, math.MaxInt64, func(point *Point) error {
+			return fn(point.Timestamp, point.Value)
+		})
+	})
+}
+
+// Aggregate returns the reduced values of every metric between start and
+// end. Both ends are aligned to the buckets of level, so a level of LevelDay
+// covers whole days from the day of start to the day of end. If metrics are
+// given only those are reduced. With Options.QueryCacheSize set, results
+// are cached until the next write.
+func (db *DB) Aggregate(start, end int64, level uint16, metrics ...string) (map[string]Value, error) {
+	value := make(map[string]Value)
+
+	from := NewTime(start)
+	to := NewTime(end)
+	set := newMetricSet(metrics)
+	err := db.View(func(tx *Tx) error {
+		key := newQueryKey(from.Timestamp(level), to.next(level)-1, level, metrics, tx.meta.txid)
+		if cached, ok := db.queries.get(key); ok {
+			db.counters.queryCacheHits.Add(1)
+			value = cached
+			return nil
+		}
+		if db.queries != nil {
+			db.counters.queryCacheMisses.Add(1)
+		}
+		if err := tx.root.aggregate(key.from, key.to, set, false, value); err != nil {
+			return err
+		}
+		db.queries.put(key, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Average returns the mean of metric over the points between start and end
+// inclusive, or ErrNotFound if none of them holds it other than as NaN.
+// Subtrees lying entirely in the range are summed from the values kept in
+// their parents.
+func (db *DB) Average(start, end int64, metric string) (float64, error) {
+	value := make(map[string]Value)
+	set := newMetricSet([]string{metric})
+	err := db.View(func(tx *Tx) error {
+		return tx.root.aggregate(start, end, set, false, value)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	v := value[metric]
+	if v.count == 0 {
+		return 0, ErrNotFound
+	}
+	return v.sum / float64(v.count), nil
+}
+
+// MetricNames returns the names of the metrics stored in the database,
+// sorted. The reduced values kept in the root already carry every name, so
+// no points are read.
+func (db *DB) MetricNames() ([]string, error) {
+	names := make([]string, 0)
+	err := db.View(func(tx *Tx) error {
+		for k := range tx.root.reduce() {
+			names = append(names, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MetricsInRange returns the names of the metrics held by the points
+// between start and end inclusive, sorted. Like MetricNames it reads the
+// names off the reduced values of the children lying entirely in the range,
+// so only the leaves at its edges are scanned, and not even those when the
+// names below them are all found already.
+func (db *DB) MetricsInRange(start, end int64) ([]string, error) {
+	found := make(map[string]struct{})
+	err := db.View(func(tx *Tx) error {
+		return tx.root.metricsIn(start, end, found)
+	})
+	if err != nil {
+		return nil, err
 	}
+	names := make([]string, 0, len(found))
+	for k := range found {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	return nil, ErrNotFound
+// Count returns the number of points between start and end inclusive.
+// Children lying entirely in the range are answered from the counts kept in
+// their parent, so only the leaves at the edges of the range are read.
+func (db *DB) Count(start, end int64) (int, error) {
+	var n int64
+	err := db.View(func(tx *Tx) (err error) {
+		n, err = tx.root.countRange(start, end)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
 }
 
-// put insert data, key is unixnano.
+// Put inserts data, key is unixnano.
+//
+// The root node starts at LevelRoot, or Options.RootLevel. Every level
+// below it is one unit finer than its parent: the root's children are keyed
+// by the start of their year, a year's children by the start of their
+// month, and so on down to LevelNSecond. The key is routed by truncating
+// it with Time.Timestamp at each level until the node holding its bucket
+// is reached, after which the dirty path is flushed and the meta is
+// rewritten to point at the new root.
+//
+// A nil or empty value returns ErrEmptyValue: a point without metrics adds
+// nothing to the values reduced over it and would only take room in the
+// tree. Delete removes a point instead.
+//
+// With Options.GroupCommitDelay the put is committed together with the
+// others arriving within the delay.
 func (db *DB) Put(key int64, value map[string]float64) error {
+	db.counters.puts.Add(1)
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if db.group != nil {
+		return db.groupPut(key, value)
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if err := db.put(key, value); err != nil {
+		db.rollback()
+		return err
+	}
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// PutBatch inserts points in timestamp order and flushes them once. If any
+// insert fails, as for a point with an empty value, none of the points are
+// stored. Points need not be sorted, and points at the same timestamp are
+// put in the order given, so like separate puts the last one wins, or they
+// are merged with Options.MergeOnDuplicate.
+func (db *DB) PutBatch(points []Point) error {
+	return db.putBatch(points, false)
+}
+
+// putBatch is PutBatch, keeping the time the points expire with ttl and
+// clearing their TTL otherwise.
+func (db *DB) putBatch(points []Point, ttl bool) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	sorted := make([]Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	for _, point := range sorted {
+		var expires int64
+		if ttl {
+			expires = point.expires
+		}
+		if err := db.putIn(db.root, point.Timestamp, point.Value, expires); err != nil {
+			db.rollback()
+			return err
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// put inserts data into the tree in memory without flushing it.
+func (db *DB) put(key int64, value map[string]float64) error {
+	return db.putIn(db.root, key, value, 0)
+}
+
+// putIn inserts data into the tree below root in memory.
+func (db *DB) putIn(root *node, key int64, value map[string]float64, expires int64) error {
+	if err := checkValue(value); err != nil {
+		return err
+	}
+	return db.putRaw(root, key, db.transformed(value), expires)
+}
+
+// checkValue returns the error putting value fails with whatever its key.
+func checkValue(value map[string]float64) error {
+	if len(value) == 0 {
+		return ErrEmptyValue
+	}
+	for k := range value {
+		if len(k) > MaxMetricNameLength {
+			return ErrMetricNameTooLong
+		}
+	}
+	return nil
+}
+
+// putRaw inserts value, already transformed, into the tree below root in
+// memory.
+func (db *DB) putRaw(root *node, key int64, value map[string]float64, expires int64) error {
+	if err := db.checkTxOps(); err != nil {
+		return err
+	}
 	tm := NewTime(key)
+	if root == db.root {
+		if err := db.checkSpan(key); err != nil {
+			return err
+		}
+		db.changes.add(key)
+		db.unexpire(key)
+		if ok, err := db.appendTail(&tm, value, expires); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			db.txOps++
+			root.reduce()
+			if db.debug {
+				assertTree(root)
+			}
+			return nil
+		}
+	}
 
 	c := db.Cursor()
-	c.stack = c.stack[:0]
 
 	// Move cursor to correct position.
-	c.fix(&tm, db.root)
+	if err := c.fix(&tm, root); err != nil {
+		return err
+	}
+
+	n := c.node()
+	if err := n.put(&tm, value, expires); err != nil {
+		return err
+	}
+	if root == db.root && n.isLeaf {
+		db.tail = n
+	}
+	db.txOps++
+	root.reduce()
+	if db.debug {
+		assertTree(root)
+	}
+	return nil
+}
+
+// validRootLevel reports whether a root can be at level, which must have a
+// level below it.
+func validRootLevel(level uint16) bool {
+	return level >= LevelRoot && level < LevelNSecond && level&(level-1) == 0
+}
+
+// span returns a key below n, a root, whose bucket at the level of n holds
+// every point below it, or false if n is empty.
+func (n *node) span() (int64, bool) {
+	if n.isLeaf && len(n.points) > 0 {
+		return n.points[0].Timestamp, true
+	}
+	if !n.isLeaf && len(n.pointers) > 0 {
+		return n.pointers[0].key, true
+	}
+	return 0, false
+}
+
+// checkSpan returns ErrOutsideRootSpan unless a point at key fits the root
+// of db, see Options.RootLevel.
+func (db *DB) checkSpan(key int64) error {
+	level := db.root.level
+	if level == LevelRoot {
+		return nil
+	}
+	ref, ok := db.root.span()
+	if !ok {
+		return nil
+	}
+	a, b := NewTime(ref), NewTime(key)
+	if a.Timestamp(level) != b.Timestamp(level) {
+		return ErrOutsideRootSpan
+	}
+	return nil
+}
+
+// appendTail appends value at t to the leaf of db.root the last put went
+// to, skipping the search from the root, and reports whether it did. It
+// only does when t is after the points of the leaf and every node from
+// the root down to the leaf is keyed by the bucket of t, so t belongs at
+// the end of the leaf. The leaf must be on the dirty branch, or on none
+// since the last flush, in which case its path becomes the dirty one.
+func (db *DB) appendTail(t *Time, value map[string]float64, expires int64) (bool, error) {
+	n := db.tail
+	if n == nil || !n.isLeaf || len(n.points) == 0 || t.TS <= n.points[len(n.points)-1].Timestamp {
+		return false, nil
+	}
+	if t.Level()>>1 > n.level {
+		return false, nil
+	}
+	var path []int
+	for child := n; child != db.root; child = child.parent {
+		p := child.parent
+		if p == nil {
+			return false, nil
+		}
+		key := t.Timestamp(child.level)
+		i := sort.Search(len(p.pointers), func(i int) bool {
+			return p.pointers[i].key >= key
+		})
+		if i == len(p.pointers) || p.pointers[i].key != key || p.pointers[i].pointer != child {
+			return false, nil
+		}
+		if p.dirty != -1 && p.dirty != i {
+			return false, nil
+		}
+		path = append(path, i)
+	}
+	child := n
+	for _, i := range path {
+		child.parent.dirty = i
+		child = child.parent
+	}
+
+	db.counters.tailAppends.Add(1)
+	if err := n.insertPoint(t, value, expires); err != nil {
+		return true, err
+	}
+	if !n.isLeaf {
+		db.tail = nil
+	}
+	return true, nil
+}
+
+// transformed returns value with Options.Transform applied, in a new map
+// so the caller's is left alone.
+func (db *DB) transformed(value map[string]float64) map[string]float64 {
+	if db.transform == nil {
+		return value
+	}
+	out := make(map[string]float64, len(value))
+	for k, v := range value {
+		out[k] = db.transform(k, v)
+	}
+	return out
+}
+
+// duplicate returns the value to store when value is put at a timestamp
+// already holding old.
+func (db *DB) duplicate(old, value map[string]float64) map[string]float64 {
+	if !db.mergeDup {
+		return value
+	}
+	// old may be a map the caller of an earlier Put still holds.
+	merged := make(map[string]float64, len(old)+len(value))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range value {
+		merged[k] = v
+	}
+	return merged
+}
+
+// rollback discards the changes made in memory since the last flush by
+// reloading the root the meta points to.
+func (db *DB) rollback() error {
+	db.changes.discard()
+	db.txOps = 0
+	root, err := db.node(db.meta.root)
+	if err != nil {
+		return err
+	}
+	db.root = root
+	db.rollbackSeries()
+	return nil
+}
+
+// Delete removes the point at key, key is unixnano.
+// It returns ErrNotFound if there is no point at key.
+func (db *DB) Delete(key int64) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if err := db.delete(key); err != nil {
+		return err
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// delete removes the point at key from the tree in memory without flushing
+// it.
+func (db *DB) delete(key int64) error {
+	if err := db.checkTxOps(); err != nil {
+		return err
+	}
+	tm := NewTime(key)
+	empty, err := db.root.remove(&tm)
+	if err != nil {
+		return err
+	}
+	db.txOps++
+	if empty {
+		db.root.isLeaf = true
+	}
+	db.changes.add(key)
+	return nil
+}
+
+// checkTxOps returns ErrTxTooLarge if the write in progress already holds
+// Options.MaxTxOps puts and deletes, before another is applied.
+func (db *DB) checkTxOps() error {
+	if db.maxTxOps > 0 && db.txOps >= db.maxTxOps {
+		return ErrTxTooLarge
+	}
+	return nil
+}
+
+// Truncate removes every point before ts. Subtrees that end before ts are
+// dropped whole without being read, their chunks are left for Compact to
+// leave behind.
+func (db *DB) Truncate(ts int64) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
 
-	return c.node().put(&tm, value)
+	empty, err := db.root.truncate(ts)
+	if err != nil {
+		db.rollback()
+		return err
+	}
+	db.changes.lose()
+	if empty {
+		db.root.isLeaf = true
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
 }
 
-func (db *DB) Delete(from int64, to int64) {
-	fromTime := NewTime(from)
-	toTime := NewTime(to)
+// DeleteRange removes the points between start and end inclusive and
+// returns how many there were. Subtrees lying entirely in the range are
+// dropped whole, their chunks are left for Compact to leave behind.
+func (db *DB) DeleteRange(start, end int64) (int, error) {
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
 
-	empty := db.root.clean(&fromTime, &toTime)
+	removed, empty, err := db.root.deleteRange(start, end)
+	if err != nil {
+		db.rollback()
+		return 0, err
+	}
+	db.changes.lose()
 	if empty {
 		db.root.isLeaf = true
 	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+// RenameMetric renames the metric old to new in every point and returns
+// how many points held old. A point already holding new keeps its value
+// of new, and the values reduced from points holding either are merged
+// into those of new. The rename is flushed at once, or not at all if it
+// fails.
+func (db *DB) RenameMetric(old, new string) (int, error) {
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+	if len(new) > MaxMetricNameLength {
+		return 0, ErrMetricNameTooLong
+	}
+	if old == new {
+		return 0, nil
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	renamed, err := db.root.rename(old, new)
+	if err != nil {
+		db.rollback()
+		return 0, err
+	}
+	if renamed == 0 {
+		return 0, nil
+	}
+	db.changes.lose()
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return 0, err
+	}
+	return int(renamed), nil
 }
 
 func (db *DB) Cursor() *Cursor {
 	// Allocate and return a cursor.
 	return &Cursor{
 		db:    db,
+		root:  db.root,
 		stack: make([]elemRef, 0),
 	}
 }
 
 func (db *DB) Flush() error {
 	// Flush root, save to meta.
-	db.meta.root = db.root.flush()
-	err := db.writeMeta(db.meta)
+	pos, err := db.root.flush()
+	if err != nil {
+		return err
+	}
+	registry, regPos, err := db.flushSeries()
 	if err != nil {
 		return err
 	}
 
+	m := *db.meta
+	m.root = pos
+	m.txid++
+	if registry != nil {
+		m.registry = regPos
+	}
+
+	// The chunks must be on disk before the log points at them.
+	if db.wal != nil {
+		if err := db.ops.Sync(); err != nil {
+			return err
+		}
+		if err := db.wal.write(&m); err != nil {
+			return err
+		}
+	}
+	err = db.writeMeta(&m)
+	if err != nil {
+		return err
+	}
+
+	db.metalock.Lock()
+	db.meta.root = pos
+	db.meta.registry = m.registry
+	db.meta.txid = m.txid
+	close(db.committed)
+	db.committed = make(chan struct{})
+	db.metalock.Unlock()
+	db.changes.commit(m.txid)
+	db.txOps = 0
+	if registry != nil {
+		db.commitSeries(registry)
+	}
+
+	if db.NoSync {
+		return nil
+	}
 	err = db.ops.Sync()
 	if err != nil {
 		return err
@@ -184,39 +1270,144 @@ func (db *DB) Flush() error {
 	return nil
 }
 
+// Sync commits the contents of the database file to stable storage. Every
+// successful write already syncs before returning unless NoSync is set, so
+// Sync only costs the system call when nothing has been written since.
+func (db *DB) Sync() error {
+	if db.file == nil {
+		return ErrDatabaseNotOpen
+	}
+	return db.ops.Sync()
+}
+
+// TxID returns the id of the last flush, which counts the flushes of the
+// file since it was created.
+func (db *DB) TxID() uint64 {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	return db.meta.txid
+}
+
+// WaitForTxID blocks until a flush reaches the id min, returning right away
+// if one did already. It returns the error of ctx if ctx is done first, and
+// ErrDatabaseNotOpen if the database is closed first.
+func (db *DB) WaitForTxID(ctx context.Context, min uint64) error {
+	for {
+		db.metalock.Lock()
+		if db.committed == nil {
+			db.metalock.Unlock()
+			return ErrDatabaseNotOpen
+		}
+		if db.meta.txid >= min {
+			db.metalock.Unlock()
+			return nil
+		}
+		committed := db.committed
+		db.metalock.Unlock()
+
+		select {
+		case <-committed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops the background work of db and closes its file. Only the first
+// call does anything: later ones, concurrent or not, wait for it to finish
+// and return nil, so Close can be deferred besides being called for its
+// error.
 func (db *DB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		err = db.close()
+	})
+	return err
+}
+
+func (db *DB) close() error {
+	db.stopRetention()
+	db.stopSweep()
+
+	if db.wal != nil {
+		_ = db.wal.close()
+		db.wal = nil
+	}
+
+	// Wake up WaitForTxID, it returns ErrDatabaseNotOpen.
+	db.metalock.Lock()
+	if db.committed != nil {
+		close(db.committed)
+		db.committed = nil
+	}
+	db.metalock.Unlock()
+
+	var err error
+	if db.file != nil {
+		if err := funlock(db.file); err != nil {
+			db.logger.Printf("tickdb: %s: unlock: %v", db.path, err)
+		}
+		err = db.file.Close()
+	}
 	db.file = nil
 	db.path = ""
-	return nil
+	return err
 }
 
 const (
 	magic        uint64 = 0xEF5D2BCA
 	Version      uint16 = 1
 	MetaSize     uint64 = 512
+	MetaCopyPos  uint64 = MetaSize / 2
 	MetaBaseSize uint64 = 3
 	RootBaseSize uint64 = 12
 )
 
 type meta struct {
-	magic   uint64
-	version uint16
-	root    int64
+	magic    uint64
+	version  uint16
+	root     int64
+	registry int64 // position of the series registry, 0 if there is none
+	txid     uint64
+	checksum Checksum // what the meta is checked with besides its chunk crc
 }
 
-func newMeta() *meta {
+func newMeta(checksum Checksum) *meta {
 	m := &meta{}
 	m.version = Version
 	m.root = int64(MetaSize)
+	m.checksum = checksum
 	return m
 }
 
 func newMetaFromBytes(data []byte) (*meta, error) {
+	if len(data) < 18 {
+		return nil, ErrInvalid
+	}
 	m := &meta{}
 
 	m.magic = decodeUint64(data[:8])
 	m.version = decodeUint16(data[8:10])
 	m.root = decodeInt64(data[10:])
+	// Metas written before series existed end at the root.
+	if len(data) >= 26 {
+		m.registry = decodeInt64(data[18:])
+	}
+	// And before transaction ids at the registry, counting from zero.
+	if len(data) >= 34 {
+		m.txid = decodeUint64(data[26:])
+	}
+	// And before Options.Checksum at the txid, checked by the chunk crc
+	// alone.
+	if len(data) >= 35 {
+		m.checksum = Checksum(data[34])
+		if !m.checksum.valid() {
+			return nil, ErrVersionMismatch
+		}
+		if !bytes.Equal(data[35:], m.checksum.sum(data[:35])) {
+			return nil, ErrChecksum
+		}
+	}
 
 	return m, nil
 }
@@ -227,6 +1418,12 @@ func (m *meta) toBytes() []byte {
 	buf.Write(encodeUint64(m.magic))
 	buf.Write(encodeUint16(m.version))
 	buf.Write(encodeInt64(m.root))
+	buf.Write(encodeInt64(m.registry))
+	buf.Write(encodeUint64(m.txid))
+	if m.checksum != ChecksumCRC32 {
+		buf.WriteByte(byte(m.checksum))
+		buf.Write(m.checksum.sum(buf.Bytes()))
+	}
 
 	return buf.Bytes()
 }
@@ -249,6 +1446,21 @@ func (m *meta) copy(dest *meta) {
 // Quick operations for database file.
 type Ops struct {
 	File *os.File
+
+	// readAt and writeAt replace File.ReadAt and File.WriteAt when set,
+	// tests use them to inject faults.
+	readAt  func(b []byte, off int64) (n int, err error)
+	writeAt func(b []byte, off int64) (n int, err error)
+
+	// sync replaces File.Sync when set.
+	sync func() error
+
+	// noSync skips syncing the file, for files that do not outlive the DB.
+	noSync bool
+
+	// The bytes written since the last sync, and the ones synced.
+	unsynced atomic.Uint64
+	synced   atomic.Uint64
 }
 
 func (o *Ops) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
@@ -257,12 +1469,44 @@ func (o *Ops) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error
 	return o.File, err
 }
 
+// OpenTemp opens an unlinked temporary file, removed by the system once it
+// is closed.
+func (o *Ops) OpenTemp() (*os.File, error) {
+	file, err := os.CreateTemp("", "tickdb-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	o.File = file
+	o.noSync = true
+	return file, nil
+}
+
+// ReadAt reads len(b) bytes at off. Like io.ReaderAt it returns an error
+// whenever it reads fewer, io.ErrUnexpectedEOF if readAt returned none.
 func (o *Ops) ReadAt(b []byte, off int64) (n int, err error) {
-	return o.File.ReadAt(b, off)
+	if o.readAt != nil {
+		n, err = o.readAt(b, off)
+	} else {
+		n, err = o.File.ReadAt(b, off)
+	}
+	if n < len(b) && err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
 }
 
 func (o *Ops) WriteAt(b []byte, off int64) (n int, err error) {
-	return o.File.WriteAt(b, off)
+	if o.writeAt != nil {
+		n, err = o.writeAt(b, off)
+	} else {
+		n, err = o.File.WriteAt(b, off)
+	}
+	o.unsynced.Add(uint64(n))
+	return n, err
 }
 
 func (o *Ops) GotoEOF() (ret int64, err error) {
@@ -270,7 +1514,19 @@ func (o *Ops) GotoEOF() (ret int64, err error) {
 }
 
 func (o *Ops) Sync() error {
-	return o.File.Sync()
+	if o.noSync {
+		return nil
+	}
+	var err error
+	if o.sync != nil {
+		err = o.sync()
+	} else {
+		err = o.File.Sync()
+	}
+	if err == nil {
+		o.synced.Add(o.unsynced.Swap(0))
+	}
+	return err
 }
 
 // _assert will panic with a given formatted message if the given condition is false.
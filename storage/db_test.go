@@ -1,7 +1,16 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -45,3 +54,2208 @@ func Test_Update(t *testing.T) {
 		log.Fatal(err)
 	}
 }
+
+// tempDB opens a fresh database in a temporary directory.
+func tempDB(t *testing.T) *DB {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// reopen closes db and opens its file again with opts.
+func reopen(t *testing.T, db *DB, opts *Options) *DB {
+	path := db.Path()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenWithOptions(path, 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPutGetReopen(t *testing.T) {
+	db := tempDB(t)
+	path := db.Path()
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	keys := []int64{
+		base,
+		base + int64(time.Second),
+		base + int64(time.Hour) + 123,
+		base + int64(24*time.Hour) + 456789,
+	}
+	for i, k := range keys {
+		if err := db.Put(k, map[string]float64{"open": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		p, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("get %d: %v", k, err)
+		}
+		if p.Value["open"] != float64(i) {
+			t.Fatalf("get %d: unexpected value %v", k, p.Value)
+		}
+	}
+	if _, err := db.Get(base + 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	keys := []int64{
+		base + 10*int64(time.Second),
+		base + 20*int64(time.Second),
+		base + 30*int64(time.Second),
+		base + 6*int64(time.Minute) + 5*int64(time.Second),
+	}
+	for _, k := range keys {
+		if err := db.Put(k, map[string]float64{"v": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Middle element of a leaf.
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(keys[1]); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, k := range []int64{keys[0], keys[2]} {
+		if _, err := db.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only element of a leaf.
+	if err := db.Delete(keys[3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(keys[3]); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if v := db.root.reduce()["v"]; v.count != 2 || v.sum != 2 {
+		t.Fatalf("unexpected aggregate: %+v", v)
+	}
+
+	// Non-existent key.
+	if err := db.Delete(keys[1]); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Delete(base + 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Deletes must survive a reopen.
+	db = reopen(t, db, nil)
+	if _, err := db.Get(keys[1]); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Get(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	db := tempDB(t)
+
+	// Four days of points every 10 minutes, in leaves of an hour.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	for i := 0; i < 4*24*6; i++ {
+		key := base.Add(time.Duration(i) * 10 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(db *DB, first int) {
+		points, err := db.Range(keys[0], keys[len(keys)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(keys)-first {
+			t.Fatalf("got %d points, want %d", len(points), len(keys)-first)
+		}
+		for i, p := range points {
+			if p.Timestamp != keys[first+i] {
+				t.Fatalf("point %d: got %d, want %d", i, p.Timestamp, keys[first+i])
+			}
+		}
+
+		var want Value
+		for i := first; i < len(keys); i++ {
+			want.add(float64(i))
+		}
+		if got := db.root.reduce()["v"]; !sameValue(got, want) {
+			t.Fatalf("reduce = %+v, want %+v", got, want)
+		}
+		value, err := db.Aggregate(keys[0], keys[len(keys)-1], LevelDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := value["v"]; !sameValue(got, want) {
+			t.Fatalf("aggregate = %+v, want %+v", got, want)
+		}
+	}
+
+	// To a day boundary, dropping the first day whole.
+	first := 24 * 6
+	if err := db.Truncate(keys[first]); err != nil {
+		t.Fatal(err)
+	}
+	check(db, first)
+
+	// Inside a leaf, in the middle of an hour.
+	first += 24*6 + 5*6 + 3
+	if err := db.Truncate(keys[first] - 1); err != nil {
+		t.Fatal(err)
+	}
+	check(db, first)
+	db = reopen(t, db, nil)
+	check(db, first)
+
+	// Truncating before the first point changes nothing.
+	if err := db.Truncate(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	check(db, first)
+
+	// Everything.
+	if err := db.Truncate(keys[len(keys)-1] + 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Count(keys[0], keys[len(keys)-1]); err != nil || n != 0 {
+		t.Fatalf("Count = %d, %v", n, err)
+	}
+	if err := db.Put(keys[0], map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreEpoch(t *testing.T) {
+	opts := &Options{MaxLeafPoints: 4}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Points 300µs apart around the epoch, and a few days and years
+	// before it, so leaves down to microseconds straddle zero.
+	var keys []int64
+	for i := int64(-20); i < 20; i++ {
+		keys = append(keys, i*300*int64(time.Microsecond)+7)
+	}
+	for _, d := range []time.Time{
+		time.Date(1969, 12, 30, 12, 0, 0, 0, time.Local),
+		time.Date(1969, 7, 20, 20, 17, 40, 0, time.Local),
+		time.Date(1900, 1, 1, 0, 0, 0, 1, time.Local),
+	} {
+		keys = append(keys, d.UnixNano())
+	}
+	// Inserted in reverse.
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := db.Put(keys[i], map[string]float64{"v": float64(keys[i])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	if errs := db.Check(); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	points, err := db.Range(keys[0], keys[len(keys)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(keys) {
+		t.Fatalf("got %d points, want %d", len(points), len(keys))
+	}
+	for i, p := range points {
+		if p.Timestamp != keys[i] || p.Value["v"] != float64(keys[i]) {
+			t.Fatalf("point %d: got %d %v, want %d", i, p.Timestamp, p.Value, keys[i])
+		}
+		if _, err := db.Get(keys[i]); err != nil {
+			t.Fatalf("Get(%d): %v", keys[i], err)
+		}
+	}
+	if n, err := db.Count(keys[0], -1); err != nil || n != 3+20 {
+		t.Fatalf("Count before the epoch = %d, %v", n, err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := tempDB(t)
+
+	// Three days of points every 10 minutes, in leaves of an hour.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	left := make(map[int64]int)
+	for i := 0; i < 3*24*6; i++ {
+		key := base.Add(time.Duration(i) * 10 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		left[key] = i
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteRange := func(start, end int64) {
+		want := 0
+		for key := range left {
+			if key >= start && key <= end {
+				delete(left, key)
+				want++
+			}
+		}
+		n, err := db.DeleteRange(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("DeleteRange removed %d points, want %d", n, want)
+		}
+	}
+	check := func(db *DB) {
+		var want Value
+		var count int
+		for _, key := range keys {
+			i, ok := left[key]
+			if _, err := db.Get(key); (err == nil) != ok {
+				t.Fatalf("Get(%d): %v, want present %v", key, err, ok)
+			}
+			if ok {
+				want.add(float64(i))
+				count++
+			}
+		}
+		if n, err := db.Count(keys[0], keys[len(keys)-1]); err != nil || n != count {
+			t.Fatalf("Count = %d, %v, want %d", n, err, count)
+		}
+		value, err := db.Aggregate(keys[0], keys[len(keys)-1], LevelDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := value["v"]; !sameValue(got, want) {
+			t.Fatalf("aggregate = %+v, want %+v", got, want)
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+
+	// The second day, aligned.
+	day := base.AddDate(0, 0, 1)
+	deleteRange(day.UnixNano(), day.AddDate(0, 0, 1).UnixNano()-1)
+	check(db)
+
+	// From the middle of an hour into the middle of the next, on the
+	// third day.
+	start := day.AddDate(0, 0, 1).Add(5*time.Hour + 25*time.Minute)
+	deleteRange(start.UnixNano(), start.Add(time.Hour).UnixNano())
+	check(db)
+
+	// Across the gap left by the second day, and nothing at all.
+	deleteRange(base.Add(23*time.Hour).UnixNano(), day.AddDate(0, 0, 1).Add(time.Hour).UnixNano())
+	deleteRange(day.UnixNano(), day.Add(time.Hour).UnixNano())
+	check(db)
+	db = reopen(t, db, nil)
+	check(db)
+
+	// Everything.
+	deleteRange(keys[0], keys[len(keys)-1])
+	check(db)
+	if err := db.Put(keys[0], map[string]float64{"v": 0}); err != nil {
+		t.Fatal(err)
+	}
+	left[keys[0]] = 0
+	check(db)
+}
+
+func TestRange(t *testing.T) {
+	db := tempDB(t)
+
+	// Spread keys over several days, hours and sub-second offsets so the
+	// range has to cross many interior nodes.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	for day := 0; day < 3; day++ {
+		for hour := 0; hour < 24; hour += 5 {
+			tm := base.AddDate(0, 0, day).Add(time.Duration(hour) * time.Hour)
+			keys = append(keys, tm.UnixNano(), tm.Add(1500*time.Microsecond).UnixNano())
+		}
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := db.Put(keys[i], map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(start, end int64, want []int64) {
+		points, err := db.Range(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if points == nil {
+			t.Fatal("expected empty slice, got nil")
+		}
+		if len(points) != len(want) {
+			t.Fatalf("Range(%d, %d) returned %d points, want %d", start, end, len(points), len(want))
+		}
+		for i, p := range points {
+			if p.Timestamp != want[i] {
+				t.Fatalf("point %d: got %d, want %d", i, p.Timestamp, want[i])
+			}
+		}
+	}
+
+	// Everything.
+	check(keys[0], keys[len(keys)-1], keys)
+	// Multiple interior nodes.
+	check(keys[3], keys[20], keys[3:21])
+	check(keys[3]-1, keys[20]+1, keys[3:21])
+	// start == end.
+	check(keys[7], keys[7], keys[7:8])
+	check(keys[7]+1, keys[7]+1, nil)
+	// start after the last key.
+	check(keys[len(keys)-1]+1, keys[len(keys)-1]+int64(time.Hour), nil)
+	// end before the first key.
+	check(keys[0]-int64(time.Hour), keys[0]-1, nil)
+
+	// Nodes loaded lazily from disk.
+	db = reopen(t, db, nil)
+	check(keys[0], keys[len(keys)-1], keys)
+	check(keys[3]-1, keys[20]+1, keys[3:21])
+}
+
+func TestAggregate(t *testing.T) {
+	db := tempDB(t)
+
+	// A point every 20 minutes over three days, with nanoseconds so the
+	// tree has interior nodes down to the sub-second levels.
+	base := time.Date(2016, 8, 27, 0, 0, 0, 7, time.Local)
+	var keys []int64
+	for i := 0; i < 3*24*3; i++ {
+		key := base.Add(time.Duration(i) * 20 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		if err := db.Put(key, map[string]float64{"a": float64(i), "b": float64(i % 7)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(start, end int64, level uint16) {
+		from := NewTime(start)
+		to := NewTime(end)
+		lo, hi := from.Timestamp(level), to.next(level)
+
+		want := make(map[string]Value)
+		for i, key := range keys {
+			if key < lo || key >= hi {
+				continue
+			}
+			for k, v := range map[string]float64{"a": float64(i), "b": float64(i % 7)} {
+				vk := want[k]
+				vk.merge(Value{sum: v, max: v, min: v, first: v, last: v, count: 1})
+				want[k] = vk
+			}
+		}
+
+		got, err := db.Aggregate(start, end, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d metrics, want %d", len(got), len(want))
+		}
+		for k, w := range want {
+			g := got[k]
+			if g.Sum() != w.Sum() || g.Max() != w.Max() || g.Min() != w.Min() || g.First() != w.First() ||
+				g.Last() != w.Last() || g.Count() != w.Count() {
+				t.Fatalf("metric %s: got %+v, want %+v", k, g, w)
+			}
+		}
+	}
+
+	day := base.AddDate(0, 0, 1)
+	// A single hour, a span of hours and a whole day.
+	check(day.Add(5*time.Hour).UnixNano(), day.Add(5*time.Hour).UnixNano(), LevelHour)
+	check(day.Add(5*time.Hour+10*time.Minute).UnixNano(), day.Add(17*time.Hour).UnixNano(), LevelHour)
+	check(day.Add(-3*time.Hour).UnixNano(), day.Add(2*time.Hour).UnixNano(), LevelHour)
+	check(day.UnixNano(), day.UnixNano(), LevelDay)
+	check(day.Add(12*time.Hour).UnixNano(), day.AddDate(0, 0, 1).UnixNano(), LevelDay)
+	check(keys[0], keys[len(keys)-1], LevelDay)
+
+	// Up to the last key, whose bucket has no next one.
+	for _, level := range []uint16{LevelYear, LevelHour, LevelNSecond} {
+		got, err := db.Aggregate(0, math.MaxInt64, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := got["a"].Count(); n != len(keys) {
+			t.Fatalf("Aggregate up to math.MaxInt64 at %#x counted %d points, want %d", level, n, len(keys))
+		}
+	}
+}
+
+func TestAverage(t *testing.T) {
+	db := tempDB(t)
+
+	// Two days every 5 minutes, "b" on every third point only.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	for i := 0; i < 2*24*12; i++ {
+		key := base.Add(time.Duration(i) * 5 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		value := map[string]float64{"a": float64(i % 17)}
+		if i%3 == 0 {
+			value["b"] = float64(i)
+		}
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mean := func(from, to int, metric string) float64 {
+		var sum, n float64
+		for i := from; i <= to; i++ {
+			if metric == "a" {
+				sum += float64(i % 17)
+				n++
+			} else if i%3 == 0 {
+				sum += float64(i)
+				n++
+			}
+		}
+		return sum / n
+	}
+
+	for _, r := range [][2]int{{0, len(keys) - 1}, {5, 400}, {288, 289}, {3, 3}} {
+		for _, metric := range []string{"a", "b"} {
+			got, err := db.Average(keys[r[0]], keys[r[1]], metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mean(r[0], r[1], metric); math.Abs(got-want) > 1e-9 {
+				t.Fatalf("Average(%d, %d, %s) = %v, want %v", r[0], r[1], metric, got, want)
+			}
+		}
+	}
+
+	if _, err := db.Average(keys[1], keys[2], "b"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Average(keys[0], keys[len(keys)-1], "c"); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNaNInf(t *testing.T) {
+	db := tempDB(t)
+
+	// A point every 20 minutes over three days. "nan" is NaN at the ends and
+	// every fifth point, "all" is always NaN, "inf" is +Inf every seventh
+	// point and "both" is -Inf once and +Inf once.
+	base := time.Date(2016, 8, 27, 0, 0, 0, 0, time.Local)
+	n := 3 * 24 * 3
+	var keys []int64
+	values := make([]map[string]float64, n)
+	for i := 0; i < n; i++ {
+		value := map[string]float64{"nan": float64(i), "all": math.NaN(), "inf": float64(i), "both": float64(i)}
+		if i%5 == 0 || i == n-1 {
+			value["nan"] = math.NaN()
+		}
+		if i%7 == 3 {
+			value["inf"] = math.Inf(1)
+		}
+		switch i {
+		case 10:
+			value["both"] = math.Inf(-1)
+		case 100:
+			value["both"] = math.Inf(1)
+		}
+		values[i] = value
+
+		key := base.Add(time.Duration(i) * 20 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	same := func(a, b float64) bool {
+		return a == b || math.IsNaN(a) && math.IsNaN(b)
+	}
+	check := func(db *DB, from, to int) {
+		got, err := db.Aggregate(keys[from], keys[to], LevelNSecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"nan", "all", "inf", "both"} {
+			sum, min, max, count := 0.0, math.NaN(), math.NaN(), 0
+			for _, value := range values[from : to+1] {
+				f := value[k]
+				if math.IsNaN(f) {
+					continue
+				}
+				if count == 0 || f < min {
+					min = f
+				}
+				if count == 0 || f > max {
+					max = f
+				}
+				sum += f
+				count++
+			}
+			g := got[k]
+			if !same(g.Sum(), sum) || !same(g.Min(), min) || !same(g.Max(), max) || g.Count() != count ||
+				!same(g.First(), values[from][k]) || !same(g.Last(), values[to][k]) {
+				t.Fatalf("%s between %d and %d: got %+v, want sum %v min %v max %v count %d", k, from, to, g, sum, min, max, count)
+			}
+		}
+	}
+	checkAll := func(db *DB) {
+		check(db, 0, n-1)
+		check(db, 1, n-2)
+		check(db, 3, 3)
+		check(db, 0, 0)
+	}
+	checkAll(db)
+	db = reopen(t, db, nil)
+	defer db.Close()
+	checkAll(db)
+
+	if avg, err := db.Average(keys[0], keys[10], "nan"); err != nil || avg != 5 {
+		t.Fatalf("Average = %v, %v, want 5", avg, err)
+	}
+	if _, err := db.Average(keys[0], keys[n-1], "all"); err != ErrNotFound {
+		t.Fatalf("Average of NaN: %v, want ErrNotFound", err)
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	var points []Point
+	for i := 0; i < 100; i++ {
+		points = append(points, Point{
+			Timestamp: base + int64((i*37)%100)*int64(time.Minute) + int64(i),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopen(t, db, nil)
+	for _, p := range points {
+		got, err := db.Get(p.Timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Value["v"] != p.Value["v"] {
+			t.Fatalf("unexpected value: %v", got.Value)
+		}
+	}
+
+	// Make the subtree holding base unreadable so the second insert fails,
+	// the first insert of the batch must be rolled back with it.
+	db = reopen(t, db, nil)
+	db.root.pointers[0].pos = 1
+	next := time.Date(2017, 1, 1, 0, 0, 0, 1, time.Local).UnixNano()
+	err := db.PutBatch([]Point{
+		{Timestamp: next, Value: map[string]float64{"v": 1}},
+		{Timestamp: base + 1, Value: map[string]float64{"v": 1}},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := db.Get(next); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Get(points[0].Timestamp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutBatchDuplicates(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Points at the same timestamp, out of order around another, end up as
+	// a single entry holding the last value given.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	err := db.PutBatch([]Point{
+		{Timestamp: base + 1, Value: map[string]float64{"v": 1}},
+		{Timestamp: base, Value: map[string]float64{"v": 0}},
+		{Timestamp: base + 1, Value: map[string]float64{"v": 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := db.Range(base, base+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[1].Timestamp != base+1 || points[1].Value["v"] != 2 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+	if n, err := db.Count(base, base+1); err != nil || n != 2 {
+		t.Fatalf("Count = %d, %v, want 2", n, err)
+	}
+}
+
+func TestPutEmptyValue(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := db.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []map[string]float64{nil, {}} {
+		if err := db.Put(base+1, value); err != ErrEmptyValue {
+			t.Fatalf("Put(%v): %v, want ErrEmptyValue", value, err)
+		}
+		// Nor does it replace the point at a timestamp already held.
+		if err := db.Put(base, value); err != ErrEmptyValue {
+			t.Fatalf("Put(%v) over a point: %v, want ErrEmptyValue", value, err)
+		}
+		err := db.PutBatch([]Point{
+			{Timestamp: base + 2, Value: map[string]float64{"v": 2}},
+			{Timestamp: base + 3, Value: value},
+		})
+		if err != ErrEmptyValue {
+			t.Fatalf("PutBatch with %v: %v, want ErrEmptyValue", value, err)
+		}
+		err = db.LoadSorted([]Point{{Timestamp: base + 4, Value: value}})
+		if !errors.Is(err, ErrEmptyValue) {
+			t.Fatalf("LoadSorted with %v: %v, want ErrEmptyValue", value, err)
+		}
+	}
+
+	points, err := db.Range(base, base+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Value["v"] != 1 {
+		t.Fatalf("points after empty puts: %v", points)
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "db"), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	value := map[string]float64{"v": 1}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Second), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "db"), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	value := map[string]float64{"v": 1}
+
+	points := make([]Point, b.N)
+	for i := range points {
+		points[i] = Point{Timestamp: base + int64(i)*int64(time.Second), Value: value}
+	}
+
+	b.ResetTimer()
+	if err := db.PutBatch(points); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "db"), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	value := map[string]float64{"v": 1}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tx.Put(base+int64(i)*int64(time.Second), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	for _, noSync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("NoSync=%v", noSync), func(b *testing.B) {
+			opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, NoSync: noSync}
+			db, err := OpenWithOptions(filepath.Join(b.TempDir(), "db"), 0600, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+			value := map[string]float64{"v": 1}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(base+int64(i)*int64(time.Second), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := db.Sync(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPutAppend(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 8})
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 {
+		return base.Add(time.Duration(i) * 10 * time.Second).UnixNano()
+	}
+	want := make(map[int64]float64)
+	put := func(tx *Tx, i int) {
+		if err := tx.Put(key(i), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		want[key(i)] = float64(i)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Appends within a leaf, across leaves and across expansions, with
+	// points put behind the last one in between.
+	for i := 0; i < 1000; i += 2 {
+		put(tx, i)
+		if i%100 == 50 {
+			put(tx, i-25)
+			put(tx, i-49)
+		}
+	}
+	if db.tail == nil {
+		t.Fatal("no leaf to append to")
+	}
+	// Past the end and then into a bucket before it.
+	put(tx, 5000)
+	put(tx, 3)
+	put(tx, 5002)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		points, err := db.Range(key(0), key(5002))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(want) {
+			t.Fatalf("Range returned %d points, want %d", len(points), len(want))
+		}
+		for i, point := range points {
+			if i > 0 && point.Timestamp <= points[i-1].Timestamp {
+				t.Fatalf("point %d out of order", i)
+			}
+			if point.Value["v"] != want[point.Timestamp] {
+				t.Fatalf("point at %d = %v, want %v", point.Timestamp, point.Value["v"], want[point.Timestamp])
+			}
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatal(errs)
+		}
+	}
+	check(db)
+	db = reopen(t, db, &Options{MaxLeafPoints: 8})
+	check(db)
+}
+
+func TestPutAppendFlushed(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Every Put flushes, leaving no dirty branch, and still appends to the
+	// leaf of the one before, once the first two have turned the root,
+	// which starts out a leaf, into a path down to one.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(base.Add(time.Duration(i)*time.Second).UnixNano(), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := db.counters.tailAppends.Load(); got != n-2 {
+		t.Fatalf("%d of %d puts appended to the tail, want %d", got, n, n-2)
+	}
+
+	db = reopen(t, db, nil)
+	points, err := db.Range(base.UnixNano(), base.Add(n*time.Second).UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != n {
+		t.Fatalf("Range returned %d points, want %d", len(points), n)
+	}
+	for i, point := range points {
+		if point.Value["v"] != float64(i) {
+			t.Fatalf("point %d = %v", i, point.Value)
+		}
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+}
+
+func TestPutWriteError(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	if err := db.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	errDisk := errors.New("disk full")
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		return 0, errDisk
+	}
+	if err := db.Put(base+1, map[string]float64{"v": 2}); err != errDisk {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.ops.writeAt = nil
+
+	if _, err := db.Get(base + 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db = reopen(t, db, nil)
+	if p, err := db.Get(base); err != nil {
+		t.Fatal(err)
+	} else if p.Value["v"] != 1 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+	if _, err := db.Get(base + 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		points = append(points, Point{
+			Timestamp: base + int64(i)*int64(13*time.Minute) + int64(i%5),
+			Value:     map[string]float64{"v": float64(i % 17), "w": 1},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	var sum float64
+	var prev int64
+	err := db.ForEach(func(ts int64, value map[string]float64) error {
+		if ts <= prev {
+			t.Fatalf("out of order: %d after %d", ts, prev)
+		}
+		prev = ts
+		sum += value["v"]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := db.root.reduce()["v"].Sum(); sum != want {
+		t.Fatalf("got sum %v, want %v", sum, want)
+	}
+
+	errStop := errors.New("stop")
+	var n int
+	err = db.ForEach(func(ts int64, value map[string]float64) error {
+		if n++; n == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 10 {
+		t.Fatalf("unexpected result: %v after %d points", err, n)
+	}
+}
+
+func TestCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A point every 7 hours over four months, with nanoseconds so the
+	// leaves sit deep in the tree.
+	base := time.Date(2016, 7, 3, 0, 0, 0, 9, time.Local)
+	var points []Point
+	for i := 0; i < 4*30*24/7; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 7 * time.Hour).UnixNano(),
+			Value:     map[string]float64{"a": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(count func(start, end int64) (int, error), start, end int64) {
+		want := 0
+		for _, point := range points {
+			if point.Timestamp >= start && point.Timestamp <= end {
+				want++
+			}
+		}
+		got, err := count(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("Count(%d, %d) = %d, want %d", start, end, got, want)
+		}
+	}
+	checkAll := func(count func(start, end int64) (int, error)) {
+		aug := time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local)
+		// Aligned to months and days.
+		check(count, aug.UnixNano(), aug.AddDate(0, 1, 0).UnixNano()-1)
+		check(count, aug.UnixNano(), aug.AddDate(0, 2, 0).UnixNano()-1)
+		check(count, aug.AddDate(0, 0, 3).UnixNano(), aug.AddDate(0, 0, 4).UnixNano()-1)
+		// Unaligned edges.
+		check(count, aug.Add(-5*time.Hour).UnixNano(), aug.AddDate(0, 1, 2).Add(3*time.Hour).UnixNano())
+		check(count, points[1].Timestamp, points[len(points)-2].Timestamp)
+		check(count, points[3].Timestamp, points[3].Timestamp)
+		check(count, math.MinInt64, math.MaxInt64)
+	}
+	checkAll(db.Count)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAll(db.Count)
+
+	// Chunks written without counts fall back to reading the children.
+	for _, pointer := range db.root.pointers {
+		pointer.count = -1
+	}
+	checkAll(func(start, end int64) (int, error) {
+		n, err := db.root.countRange(start, end)
+		return int(n), err
+	})
+}
+
+func TestMetricFilter(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 48; i++ {
+		value := map[string]float64{"a": float64(i), "b": float64(-i), "c": 1}
+		if i%2 == 1 {
+			delete(value, "a")
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Hour).UnixNano(), Value: value})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	first, last := points[0].Timestamp, points[len(points)-1].Timestamp
+
+	got, err := db.Range(first, last, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 24 {
+		t.Fatalf("got %d points, want 24", len(got))
+	}
+	for _, p := range got {
+		if len(p.Value) != 1 || p.Value["a"] != float64((p.Timestamp-first)/int64(time.Hour)) {
+			t.Fatalf("unexpected value at %d: %v", p.Timestamp, p.Value)
+		}
+	}
+
+	got, err = db.Range(first, last, "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(points) {
+		t.Fatalf("got %d points, want %d", len(got), len(points))
+	}
+	for _, p := range got {
+		if _, ok := p.Value["a"]; ok || len(p.Value) != 2 {
+			t.Fatalf("unexpected value at %d: %v", p.Timestamp, p.Value)
+		}
+	}
+
+	// Filtered results must not share maps with the tree.
+	got[0].Value["b"] = 100
+	if p, err := db.Get(first); err != nil {
+		t.Fatal(err)
+	} else if p.Value["b"] != 0 {
+		t.Fatalf("tree modified through Range result: %v", p.Value)
+	}
+
+	value, err := db.Aggregate(first, last, LevelDay, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != 1 {
+		t.Fatalf("got metrics %v, want only b", value)
+	}
+	if b := value["b"]; b.Count() != len(points) || b.Min() != -47 || b.Max() != 0 {
+		t.Fatalf("unexpected aggregate of b: %+v", b)
+	}
+
+	if value, err = db.Aggregate(first, last, LevelDay, "missing"); err != nil {
+		t.Fatal(err)
+	} else if len(value) != 0 {
+		t.Fatalf("got metrics %v, want none", value)
+	}
+}
+
+func BenchmarkRangeMetrics(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "db"), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+
+	points := make([]Point, 1000)
+	for i := range points {
+		value := make(map[string]float64)
+		for m := 0; m < 20; m++ {
+			value[fmt.Sprintf("m%d", m)] = float64(i * m)
+		}
+		points[i] = Point{Timestamp: base + int64(i)*int64(time.Second), Value: value}
+	}
+	if err := db.PutBatch(points); err != nil {
+		b.Fatal(err)
+	}
+	end := points[len(points)-1].Timestamp
+
+	b.Run("all", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Range(base, end); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Range(base, end, "m3"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSync(t *testing.T) {
+	db := tempDB(t)
+
+	var writes, syncs int
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		writes++
+		return db.ops.File.WriteAt(b, off)
+	}
+	db.ops.sync = func() error {
+		syncs++
+		return db.ops.File.Sync()
+	}
+
+	if err := db.Put(time.Now().UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if writes == 0 || syncs != 1 {
+		t.Fatalf("got %d writes and %d syncs after Put", writes, syncs)
+	}
+
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if syncs != 2 {
+		t.Fatalf("got %d syncs, want 2", syncs)
+	}
+
+	// With NoSync only Sync syncs.
+	db.NoSync = true
+	if err := db.Put(time.Now().UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if syncs != 2 {
+		t.Fatalf("got %d syncs after Put with NoSync, want 2", syncs)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if syncs != 3 {
+		t.Fatalf("got %d syncs, want 3", syncs)
+	}
+	db.NoSync = false
+
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 1, NoSync: true, WAL: true}); err != ErrInvalidOptions {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errSync := errors.New("sync failed")
+	db.ops.sync = func() error { return errSync }
+	if err := db.Sync(); err != errSync {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 100; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, ReadOnly: true}
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "missing"), 0600, opts); err == nil {
+		t.Fatal("expected error opening a missing file read-only")
+	}
+
+	var dbs []*DB
+	for i := 0; i < 2; i++ {
+		db, err := OpenWithOptions(path, 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !db.IsReadOnly() {
+			t.Fatal("expected read-only database")
+		}
+		dbs = append(dbs, db)
+	}
+
+	errc := make(chan error, len(dbs))
+	for _, db := range dbs {
+		go func(db *DB) {
+			got, err := db.Range(points[0].Timestamp, points[len(points)-1].Timestamp)
+			if err == nil && len(got) != len(points) {
+				err = fmt.Errorf("got %d points, want %d", len(got), len(points))
+			}
+			errc <- err
+		}(db)
+	}
+	for range dbs {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db = dbs[0]
+	if p, err := db.Get(points[5].Timestamp); err != nil {
+		t.Fatal(err)
+	} else if p.Value["v"] != 5 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+	c := db.Cursor()
+	c.rewind()
+	if p := c.point(); p == nil || p.Timestamp != points[0].Timestamp {
+		t.Fatalf("unexpected first point: %v", p)
+	}
+
+	if err := db.Put(base.UnixNano(), map[string]float64{"v": 1}); err != ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.PutBatch(points[:1]); err != ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Delete(points[0].Timestamp); err != ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Begin(true); err != ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 {
+		return base.Add(time.Duration(i) * 17 * time.Minute).UnixNano()
+	}
+	const batches, batchSize = 20, 50
+
+	done := make(chan struct{})
+	errc := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errc <- nil
+					return
+				default:
+				}
+				points, err := db.Range(key(0), key(batches*batchSize))
+				if err != nil {
+					errc <- err
+					return
+				}
+				// Batches are committed whole, so a reader sees a
+				// multiple of batchSize points.
+				if len(points)%batchSize != 0 {
+					errc <- fmt.Errorf("read %d points mid-batch", len(points))
+					return
+				}
+				if _, err := db.Aggregate(key(0), key(batches*batchSize), LevelDay); err != nil {
+					errc <- err
+					return
+				}
+				if _, err := db.Count(key(0), key(batches*batchSize)); err != nil {
+					errc <- err
+					return
+				}
+				if _, err := db.Get(key(0)); err != nil && err != ErrNotFound {
+					errc <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for b := 0; b < batches; b++ {
+		points := make([]Point, batchSize)
+		for i := range points {
+			points[i] = Point{Timestamp: key(b*batchSize + i), Value: map[string]float64{"v": 1}}
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for r := 0; r < 4; r++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := db.Count(key(0), key(batches*batchSize)); err != nil {
+		t.Fatal(err)
+	} else if n != batches*batchSize {
+		t.Fatalf("got %d points, want %d", n, batches*batchSize)
+	}
+}
+
+func TestConcurrentGet(t *testing.T) {
+	db := tempDB(t)
+	// A cache smaller than the tree so readers evict each other's nodes.
+	db = reopen(t, db, &Options{MaxLeafPoints: 32, MaxCachedNodes: 16})
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 {
+		return base.Add(time.Duration(i) * 7 * time.Minute).UnixNano()
+	}
+	const n = 2000
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{Timestamp: key(i), Value: map[string]float64{"v": float64(i)}}
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers = 16
+	errc := make(chan error, readers)
+	for r := 0; r < readers; r++ {
+		go func(r int) {
+			for i := r; i < n; i += 37 {
+				point, err := db.Get(key(i))
+				if err != nil {
+					errc <- err
+					return
+				}
+				if point.Value["v"] != float64(i) {
+					errc <- fmt.Errorf("Get(%d) = %v, want %d", i, point.Value["v"], i)
+					return
+				}
+				end := i + 50
+				if end >= n {
+					end = n - 1
+				}
+				points, err := db.Range(key(i), key(end))
+				if err != nil {
+					errc <- err
+					return
+				}
+				if len(points) != end-i+1 {
+					errc <- fmt.Errorf("Range(%d, %d) returned %d points", i, end, len(points))
+					return
+				}
+			}
+			errc <- nil
+		}(r)
+	}
+	for r := 0; r < readers; r++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPutDuplicate(t *testing.T) {
+	tests := []struct {
+		merge bool
+		want  map[string]float64
+	}{
+		{false, map[string]float64{"mem": 2}},
+		{true, map[string]float64{"cpu": 3, "mem": 2}},
+	}
+
+	key := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	for _, tt := range tests {
+		opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, MergeOnDuplicate: tt.merge}
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first := map[string]float64{"cpu": 1, "mem": 1}
+		if err := db.Put(key, first); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(key, map[string]float64{"cpu": 3}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutBatch([]Point{{Timestamp: key, Value: map[string]float64{"mem": 2}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			// The second time from disk.
+			if i == 1 {
+				db = reopen(t, db, opts)
+			}
+			p, err := db.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Value) != len(tt.want) {
+				t.Fatalf("merge=%v: got %v, want %v", tt.merge, p.Value, tt.want)
+			}
+			for k, v := range tt.want {
+				if p.Value[k] != v {
+					t.Fatalf("merge=%v: got %v, want %v", tt.merge, p.Value, tt.want)
+				}
+			}
+			if n, err := db.Count(key, key); err != nil {
+				t.Fatal(err)
+			} else if n != 1 {
+				t.Fatalf("got %d points at one timestamp", n)
+			}
+		}
+
+		if first["cpu"] != 1 || first["mem"] != 1 {
+			t.Fatalf("the map of the first put was modified: %v", first)
+		}
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	db := tempDB(t)
+
+	if names, err := db.MetricNames(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatalf("unexpected names in empty db: %v", names)
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	metrics := []string{"mem", "cpu", "disk.read", "disk.write", "load"}
+	for i := 0; i < 200; i++ {
+		value := map[string]float64{metrics[i%len(metrics)]: float64(i)}
+		if i == 150 {
+			value["net"] = 1
+		}
+		if err := db.Put(base.Add(time.Duration(i)*time.Hour).UnixNano(), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"cpu", "disk.read", "disk.write", "load", "mem", "net"}
+	for i := 0; i < 2; i++ {
+		// The second time from disk.
+		if i == 1 {
+			db = reopen(t, db, nil)
+		}
+		names, err := db.MetricNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != len(want) {
+			t.Fatalf("got %v, want %v", names, want)
+		}
+		for i := range want {
+			if names[i] != want[i] {
+				t.Fatalf("got %v, want %v", names, want)
+			}
+		}
+	}
+}
+
+func TestMetricsInRange(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 8, MaxCachedNodes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cpu every hour of 20 days, mem on the first five, disk from the
+	// tenth to the fourteenth, and net once, between two hours.
+	base := time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local)
+	day := func(d int) time.Time { return base.AddDate(0, 0, d) }
+	var points []Point
+	for h := 0; h < 20*24; h++ {
+		value := map[string]float64{"cpu": float64(h)}
+		if h < 5*24 {
+			value["mem"] = 1
+		}
+		if h >= 10*24 && h < 15*24 {
+			value["disk"] = 1
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(h) * time.Hour).UnixNano(), Value: value})
+	}
+	net := day(7).Add(13*time.Hour + 30*time.Minute)
+	points = append(points, Point{Timestamp: net.UnixNano(), Value: map[string]float64{"net": 1}})
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, &Options{MaxLeafPoints: 8, MaxCachedNodes: 1024})
+	defer db.Close()
+
+	tests := []struct {
+		start, end time.Time
+		want       []string
+	}{
+		{base, day(20), []string{"cpu", "disk", "mem", "net"}},
+		{day(5), day(10).Add(-time.Nanosecond), []string{"cpu", "net"}},
+		{day(4).Add(23 * time.Hour), day(10), []string{"cpu", "disk", "mem", "net"}},
+		{net.Add(time.Nanosecond), day(9), []string{"cpu"}},
+		{net, net, []string{"net"}},
+		{day(14).Add(23*time.Hour + time.Nanosecond), day(30), []string{"cpu"}},
+		{day(30), day(40), []string{}},
+	}
+	for _, tt := range tests {
+		got, err := db.MetricsInRange(tt.start.UnixNano(), tt.end.UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%v-%v: %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	// A range covering whole months reads no node below the year.
+	before := db.Metrics()
+	if _, err := db.MetricsInRange(base.UnixNano(), base.AddDate(0, 1, 0).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	after := db.Metrics()
+	if read := after.CacheHits + after.CacheMisses - before.CacheHits - before.CacheMisses; read != 2 {
+		t.Fatalf("read %d nodes, want the root and the year", read)
+	}
+}
+
+func TestRenameMetric(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	defer db.Close()
+
+	// A point every 20 minutes over three days: "cpu" on the first two,
+	// "load" on the last two, and "mem" on all of them.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	n := 3 * 24 * 3
+	var keys []int64
+	var values []map[string]float64
+	for i := 0; i < n; i++ {
+		value := map[string]float64{"mem": float64(i)}
+		if i < 2*24*3 {
+			value["cpu"] = float64(i)
+		}
+		if i >= 24*3 {
+			value["load"] = -float64(i)
+		}
+		key := base.Add(time.Duration(i) * 20 * time.Minute).UnixNano()
+		keys = append(keys, key)
+		values = append(values, value)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renamed, err := db.RenameMetric("cpu", "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed != 2*24*3 {
+		t.Fatalf("renamed %d points, want %d", renamed, 2*24*3)
+	}
+	if values[0]["cpu"] != 0 {
+		t.Fatal("the map passed to Put was changed")
+	}
+
+	// The first day takes "cpu", the others keep "load".
+	var want Value
+	for i := 0; i < n; i++ {
+		if i < 24*3 {
+			want.add(float64(i))
+		} else {
+			want.add(-float64(i))
+		}
+	}
+	check := func(db *DB) {
+		got, err := db.Aggregate(keys[0], keys[n-1], LevelDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got["cpu"]; ok {
+			t.Fatal("cpu left after renaming")
+		}
+		if !sameValue(got["load"], want) {
+			t.Fatalf("load: got %+v, want %+v", got["load"], want)
+		}
+		if got["mem"].Count() != n {
+			t.Fatalf("mem: got %d values, want %d", got["mem"].Count(), n)
+		}
+		point, err := db.Get(keys[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(point.Value) != 2 || point.Value["load"] != 1 {
+			t.Fatalf("Get = %v, want load 1", point.Value)
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatal(errs)
+		}
+	}
+	check(db)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	check(db)
+
+	if renamed, err := db.RenameMetric("cpu", "load"); err != nil || renamed != 0 {
+		t.Fatalf("renaming again = %d, %v, want 0", renamed, err)
+	}
+}
+
+func TestScanContext(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	points := make([]Point, 5000)
+	for i := range points {
+		points[i] = Point{Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano(), Value: map[string]float64{"v": 1}}
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelled mid-scan, the scan stops within one check interval.
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := db.ForEachContext(ctx, func(ts int64, value map[string]float64) error {
+		calls++
+		if calls == 1000 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls > 1000+ctxCheckInterval {
+		t.Fatalf("scan went on for %d points after cancel", calls-1000)
+	}
+
+	if _, err := db.RangeContext(ctx, points[0].Timestamp, points[len(points)-1].Timestamp); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := db.RangeContext(context.Background(), points[0].Timestamp, points[len(points)-1].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(points) {
+		t.Fatalf("got %d points, want %d", len(got), len(points))
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	db, err := OpenWithOptions("", 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, InMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("in-memory database left %d files", len(entries))
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 300; i++ {
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(), Value: map[string]float64{"v": float64(i)}})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(points[7].Timestamp, map[string]float64{"v": -7}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := db.Get(points[7].Timestamp); err != nil {
+		t.Fatal(err)
+	} else if p.Value["v"] != -7 {
+		t.Fatalf("unexpected value: %v", p.Value)
+	}
+	if got, err := db.Range(points[0].Timestamp, points[len(points)-1].Timestamp); err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(points) {
+		t.Fatalf("got %d points, want %d", len(got), len(points))
+	}
+
+	file := db.file
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Stat(); err == nil {
+		t.Fatal("expected the file to be closed")
+	}
+
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, InMemory: true, ReadOnly: true}
+	if _, err := OpenWithOptions("", 0600, opts); err != ErrInvalidOptions {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// captureLogger keeps the messages it is given.
+type captureLogger struct {
+	messages []string
+}
+
+func (l *captureLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestMetaCopy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	root := db.meta.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pos := range []uint64{0, MetaCopyPos} {
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(make([]byte, MetaCopyPos), int64(pos)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		logger := &captureLogger{}
+		db, err := OpenWithOptions(path, 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "rewriting meta") {
+			t.Fatalf("unexpected messages: %q", logger.messages)
+		}
+		for _, at := range []uint64{0, MetaCopyPos} {
+			m, err := db.readMetaAt(at)
+			if err != nil {
+				t.Fatalf("meta at %d after zeroing %d: %v", at, pos, err)
+			}
+			if m.root != root {
+				t.Fatalf("meta at %d: got root %d, want %d", at, m.root, root)
+			}
+		}
+		if p, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		} else if p.Value["v"] != 1 {
+			t.Fatalf("unexpected value: %v", p.Value)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	db := tempDB(t)
+
+	key := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(key + 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A damaged root is reported with its position.
+	if _, err := db.ops.WriteAt(encodeUint32(1), db.meta.root); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Get(key)
+	if !errors.Is(err, ErrChunkBadCrc) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := fmt.Sprintf("read node at %d", db.meta.root); !strings.Contains(err.Error(), want) {
+		t.Fatalf("error %q does not mention %q", err, want)
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	db := tempDB(t)
+	path := db.Path()
+
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := OpenWithOptions(path, 0600, opts); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < opts.Timeout {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+
+	// Open waits for the lock to be released.
+	go func(db *DB) {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}(db)
+	opts.Timeout = 0
+	db, err := OpenWithOptions(path, 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the lock, a writer waits for them.
+	ro := &Options{MaxLeafPoints: DefaultMaxLeafPoints, ReadOnly: true, Timeout: 100 * time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if _, err := OpenWithOptions(path, 0600, ro); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.Timeout = 100 * time.Millisecond
+	if _, err := OpenWithOptions(path, 0600, opts); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	db := tempDB(t)
+
+	if _, _, err := db.First(); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := db.Last(); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Points spread over two years, inserted out of order.
+	base := time.Date(2015, 11, 30, 0, 0, 0, 5, time.Local)
+	var keys []int64
+	for i := 0; i < 100; i++ {
+		keys = append(keys, base.Add(time.Duration(i)*97*time.Hour).UnixNano())
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := db.Put(keys[(i*37)%len(keys)], map[string]float64{"v": float64((i * 37) % len(keys))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			db = reopen(t, db, nil)
+		}
+		if ts, v, err := db.First(); err != nil {
+			t.Fatal(err)
+		} else if ts != keys[0] || v["v"] != 0 {
+			t.Fatalf("First = %d %v, want %d", ts, v, keys[0])
+		}
+		if ts, v, err := db.Last(); err != nil {
+			t.Fatal(err)
+		} else if ts != keys[len(keys)-1] || v["v"] != float64(len(keys)-1) {
+			t.Fatalf("Last = %d %v, want %d", ts, v, keys[len(keys)-1])
+		}
+	}
+
+	// Deleting the edges moves them in.
+	if err := db.Delete(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _, err := db.First(); err != nil {
+		t.Fatal(err)
+	} else if ts != keys[1] {
+		t.Fatalf("First = %d, want %d", ts, keys[1])
+	}
+}
+
+func TestTransform(t *testing.T) {
+	opts := &Options{
+		MaxLeafPoints: DefaultMaxLeafPoints,
+		Transform: func(metric string, v float64) float64 {
+			if metric == "bytes" {
+				return v / (1 << 20)
+			}
+			return v
+		},
+	}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	value := map[string]float64{"bytes": 1 << 20, "count": 3}
+	if err := db.Put(base.UnixNano(), value); err != nil {
+		t.Fatal(err)
+	}
+	if value["bytes"] != 1<<20 {
+		t.Fatalf("Put changed the caller's map: %v", value)
+	}
+	var points []Point
+	for i := 1; i < 10; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+			Value:     map[string]float64{"bytes": float64(i+1) * (1 << 20), "count": 3},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		p, err := db.Get(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := float64(i + 1); p.Value["bytes"] != want || p.Value["count"] != 3 {
+			t.Fatalf("point %d: got %v, want bytes %v", i, p.Value, want)
+		}
+	}
+
+	agg, err := db.Aggregate(base.UnixNano(), base.UnixNano(), LevelDay, "bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := agg["bytes"]; v.Sum() != 55 || v.Max() != 10 {
+		t.Fatalf("got sum %v max %v, want 55 and 10", v.Sum(), v.Max())
+	}
+}
+
+func TestRootLevel(t *testing.T) {
+	dir := t.TempDir()
+	hour := time.Date(2016, 8, 28, 14, 0, 0, 0, time.Local)
+	points := make([]Point, 1000)
+	for i := range points {
+		points[i] = Point{
+			Timestamp: hour.Add(time.Duration(i) * 3500 * time.Millisecond).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		}
+	}
+
+	// depth returns the number of levels of the tree of db.
+	depth := func(db *DB) int {
+		max := 0
+		err := db.View(func(tx *Tx) error {
+			return tx.root.walk(1, func(n *node, depth int) error {
+				if depth > max {
+					max = depth
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return max
+	}
+
+	open := func(name string, level uint16) *DB {
+		db, err := OpenWithOptions(filepath.Join(dir, name), 0600, &Options{MaxLeafPoints: 16, RootLevel: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	deep := open("deep", 0)
+	defer deep.Close()
+	db := open("hour", LevelHour)
+
+	// A file keeps its root level whatever it is opened with.
+	db = reopen(t, db, nil)
+	defer db.Close()
+	if db.root.level != LevelHour {
+		t.Fatalf("root at level %#x, want %#x", db.root.level, LevelHour)
+	}
+	if got, want := depth(db), depth(deep)-4; got != want {
+		t.Fatalf("tree of depth %d, want %d", got, want)
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatalf("Check: %v", errs)
+	}
+
+	from, to := points[100].Timestamp+1, points[700].Timestamp
+	got, err := db.Range(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := deep.Range(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Range = %d points, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Timestamp != want[i].Timestamp || got[i].Value["v"] != want[i].Value["v"] {
+			t.Fatalf("Range point %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	for _, level := range []uint16{LevelNSecond, LevelMinute, LevelHour} {
+		got, err := db.Aggregate(from, to, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := deep.Aggregate(from, to, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameValue(got["v"], want["v"]) {
+			t.Fatalf("Aggregate at %#x = %+v, want %+v", level, got["v"], want["v"])
+		}
+	}
+
+	// Points outside the hour are rejected, a batch holding one as a whole.
+	if err := db.Put(hour.Add(time.Hour).UnixNano(), map[string]float64{"v": 1}); err != ErrOutsideRootSpan {
+		t.Fatalf("Put after the hour: %v, want ErrOutsideRootSpan", err)
+	}
+	err = db.PutBatch([]Point{
+		{Timestamp: hour.Add(time.Nanosecond).UnixNano(), Value: map[string]float64{"v": 1}},
+		{Timestamp: hour.Add(-time.Nanosecond).UnixNano(), Value: map[string]float64{"v": 1}},
+	})
+	if err != ErrOutsideRootSpan {
+		t.Fatalf("PutBatch before the hour: %v, want ErrOutsideRootSpan", err)
+	}
+	if ok, err := db.Has(hour.Add(time.Nanosecond).UnixNano()); ok || err != nil {
+		t.Fatalf("Has of a point of the failed batch = %v, %v", ok, err)
+	}
+
+	// Once emptied, the root takes the hour of the next points.
+	if _, err := db.DeleteRange(hour.UnixNano(), hour.Add(time.Hour).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	next := Point{Timestamp: hour.Add(5 * time.Hour).UnixNano(), Value: map[string]float64{"v": 1}}
+	if err := db.LoadSorted([]Point{next, {Timestamp: next.Timestamp + int64(time.Hour), Value: next.Value}}); err != ErrOutsideRootSpan {
+		t.Fatalf("LoadSorted across two hours: %v, want ErrOutsideRootSpan", err)
+	}
+	if err := db.LoadSorted([]Point{next}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(dir, "bad"), 0600, &Options{MaxLeafPoints: 16, RootLevel: LevelNSecond}); err != ErrInvalidOptions {
+		t.Fatalf("RootLevel of LevelNSecond: %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{
+		MaxLeafPoints: DefaultMaxLeafPoints,
+		WAL:           true,
+		SweepInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(time.Now().UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i+1, err)
+		}
+	}
+
+	// Concurrent calls wait for the first one.
+	db = tempDB(t)
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- db.Close() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.file != nil {
+		t.Fatal("file left open")
+	}
+}
+
+func TestOpenTooSmall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	if err := os.WriteFile(path, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every failed Open releases the file lock, or the next one would time
+	// out waiting for it.
+	for _, readOnly := range []bool{false, false, true} {
+		opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, ReadOnly: readOnly, Timeout: 100 * time.Millisecond}
+		db, err := OpenWithOptions(path, 0600, opts)
+		if !errors.Is(err, ErrCorruptTooSmall) || !strings.Contains(err.Error(), "100 bytes") {
+			t.Fatalf("Open read-only %v: %v, want ErrCorruptTooSmall with the size", readOnly, err)
+		}
+		if db != nil {
+			t.Fatal("Open returned a database with its error")
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 100 {
+		t.Fatalf("file grew to %d bytes", info.Size())
+	}
+}
+
+func TestFullRange(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Points at both ends of the keys and one in between.
+	keys := []int64{math.MinInt64, time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano(), math.MaxInt64}
+	for i, key := range keys {
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.Count(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Fatalf("Count = %d, want %d", n, len(keys))
+	}
+	points, err := db.Range(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(keys) {
+		t.Fatalf("Range returned %d points, want %d", len(points), len(keys))
+	}
+	for i, p := range points {
+		if p.Timestamp != keys[i] {
+			t.Fatalf("point %d at %d, want %d", i, p.Timestamp, keys[i])
+		}
+	}
+	if p, err := db.Get(math.MinInt64); err != nil || p.Value["v"] != 0 {
+		t.Fatalf("Get of the first key = %v, %v", p, err)
+	}
+	down, err := db.Downsample(math.MinInt64, math.MaxInt64, 24*time.Hour, "sum", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(down) != len(keys) {
+		t.Fatalf("Downsample returned %d windows, want %d", len(down), len(keys))
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+// assertTree panics, through _assert, unless the nodes held in memory
+// below root keep the invariants of the tree: the timestamps of a leaf are
+// increasing and inside the bucket it is keyed by, the keys of an interior
+// node are increasing and start the buckets of its children, and every
+// child is one level below its parent. Nodes only on disk are not read.
+// It runs after every put with Options.Debug.
+func assertTree(root *node) {
+	root.assertNode(nil)
+}
+
+// assertNode checks n and the children of it held in memory. bucket is the
+// pointer n was reached by, nil for a root.
+func (n *node) assertNode(bucket *nodePointer) {
+	var first, end int64
+	if bucket != nil {
+		t := NewTime(bucket.key)
+		first, end = bucket.key, t.next(n.level)
+	}
+	inBucket := func(key int64) bool {
+		return bucket == nil || key >= first && key < end
+	}
+
+	if n.isLeaf {
+		for i, point := range n.points {
+			if i > 0 {
+				_assert(point.Timestamp > n.points[i-1].Timestamp,
+					"leaf at level %#x: point %d at %d after %d", n.level, i, point.Timestamp, n.points[i-1].Timestamp)
+			}
+			_assert(inBucket(point.Timestamp),
+				"leaf at level %#x: point %d at %d outside [%d, %d)", n.level, i, point.Timestamp, first, end)
+		}
+		return
+	}
+
+	level := n.level << 1
+	for i, pointer := range n.pointers {
+		if i > 0 {
+			_assert(pointer.key > n.pointers[i-1].key,
+				"node at level %#x: pointer %d key %d after %d", n.level, i, pointer.key, n.pointers[i-1].key)
+		}
+		_assert(inBucket(pointer.key),
+			"node at level %#x: pointer %d key %d outside [%d, %d)", n.level, i, pointer.key, first, end)
+		t := NewTime(pointer.key)
+		_assert(t.Timestamp(level) == pointer.key,
+			"node at level %#x: pointer %d key %d does not start a bucket of level %#x", n.level, i, pointer.key, level)
+
+		child := pointer.pointer
+		if child == nil {
+			continue
+		}
+		_assert(child.level == level,
+			"node at level %#x: pointer %d to a child at level %#x", n.level, i, child.level)
+		child.assertNode(pointer)
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebug(t *testing.T) {
+	db := tempDB(t)
+	opts := &Options{MaxLeafPoints: 8, Debug: true}
+	db = reopen(t, db, opts)
+	defer db.Close()
+
+	// Sound puts in and out of order pass every check.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 200; i++ {
+		key := base.Add(time.Duration((i*37)%200) * 13 * time.Minute).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustPanic := func(name string, corrupt func(leaf *node)) {
+		t.Helper()
+		db = reopen(t, db, opts)
+		leaf := db.root
+		for !leaf.isLeaf {
+			var err error
+			if leaf, err = leaf.childAt(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		corrupt(leaf)
+
+		defer func() {
+			t.Helper()
+			r := recover()
+			msg, _ := r.(string)
+			if !strings.HasPrefix(msg, "assertion failed: ") {
+				t.Fatalf("%s: recovered %v, want an assertion", name, r)
+			}
+		}()
+		// The put goes to the same leaf, so the damage is in memory.
+		db.Put(leaf.points[0].Timestamp+1, map[string]float64{"v": 1})
+		t.Fatalf("%s: Put did not panic", name)
+	}
+
+	mustPanic("points out of order", func(leaf *node) {
+		leaf.points[1], leaf.points[2] = leaf.points[2], leaf.points[1]
+	})
+	// As if insertNode had sent the point to the wrong child.
+	mustPanic("point outside the bucket", func(leaf *node) {
+		leaf.points = append(leaf.points, &Point{Timestamp: base.AddDate(1, 0, 0).UnixNano()})
+	})
+	mustPanic("child at the wrong level", func(leaf *node) {
+		leaf.level <<= 1
+	})
+}
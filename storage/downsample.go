@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"time"
+)
+
+// MaxFillWindows is the most windows Downsample fills, each taking memory
+// whether it holds points or not.
+const MaxFillWindows = 1 << 20
+
+// Downsample groups the points between start and end inclusive into windows
+// of width bucket starting at start, and returns one point per window that
+// holds any. The point is stamped with the start of its window and carries
+// every metric reduced with agg, one of sum, avg, min, max, first or last.
+//
+// fill says what a window gets for a metric it holds no points of: nothing
+// with none, 0 with zero, the value of the last window holding the metric
+// with previous, or the value on the line between the windows around it
+// holding the metric with linear. Windows left without any metric are left
+// out. Filling more than MaxFillWindows windows returns ErrTooManyWindows.
+func (db *DB) Downsample(start, end int64, bucket time.Duration, agg, fill string) ([]Point, error) {
+	if bucket <= 0 {
+		return nil, ErrInvalidBucket
+	}
+	if _, ok := (Value{}).reduced(agg); !ok {
+		return nil, ErrInvalidAggregate
+	}
+	switch fill {
+	case "none", "zero", "previous", "linear":
+	default:
+		return nil, ErrInvalidFill
+	}
+
+	points := make([]Point, 0)
+	if start > end {
+		return points, nil
+	}
+	if fill != "none" && uint64(end-start)/uint64(bucket) >= MaxFillWindows {
+		return nil, ErrTooManyWindows
+	}
+
+	var window int64
+	values := make(map[string]Value)
+	emit := func() {
+		if len(values) == 0 {
+			return
+		}
+		point := Point{Timestamp: window, Value: make(map[string]float64, len(values))}
+		for k, v := range values {
+			point.Value[k], _ = v.reduced(agg)
+		}
+		points = append(points, point)
+		values = make(map[string]Value)
+	}
+
+	width := int64(bucket)
+	err := db.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.level = levelPoint
+		c.seek(start)
+		return c.each(end, func(point *Point) error {
+			if point.Timestamp < start {
+				return nil
+			}
+			// The distance from start fits a uint64 even when it
+			// overflows an int64.
+			if w := start + int64(uint64(point.Timestamp-start)/uint64(width)*uint64(width)); w != window {
+				emit()
+				window = w
+			}
+			for k, v := range point.Value {
+				vk := values[k]
+				vk.add(v)
+				values[k] = vk
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	emit()
+	if fill == "none" || len(points) == 0 {
+		return points, nil
+	}
+	return fillWindows(points, start, end, width, fill), nil
+}
+
+// fillWindows returns a point for every window from start to end, filling
+// the metrics missing from points as Downsample does.
+func fillWindows(points []Point, start, end, width int64, fill string) []Point {
+	metrics := make(map[string]struct{})
+	for _, point := range points {
+		for k := range point.Value {
+			metrics[k] = struct{}{}
+		}
+	}
+
+	var windows []Point
+	for w, i := start, 0; ; w += width {
+		if i < len(points) && points[i].Timestamp == w {
+			windows = append(windows, points[i])
+			i++
+		} else {
+			windows = append(windows, Point{Timestamp: w, Value: make(map[string]float64)})
+		}
+		if uint64(end-w) < uint64(width) {
+			break
+		}
+	}
+
+	for k := range metrics {
+		last := -1 // the last window holding k
+		for i, window := range windows {
+			if v, ok := window.Value[k]; ok {
+				if fill == "linear" && last >= 0 {
+					prev := windows[last].Value[k]
+					for j := last + 1; j < i; j++ {
+						windows[j].Value[k] = prev + (v-prev)*float64(j-last)/float64(i-last)
+					}
+				}
+				last = i
+				continue
+			}
+			switch {
+			case fill == "zero":
+				window.Value[k] = 0
+			case fill == "previous" && last >= 0:
+				window.Value[k] = windows[last].Value[k]
+			}
+		}
+	}
+
+	filled := windows[:0]
+	for _, window := range windows {
+		if len(window.Value) > 0 {
+			filled = append(filled, window)
+		}
+	}
+	return filled
+}
+
+// reduced returns the field of v named by agg, ok is false for an unknown
+// agg.
+func (v Value) reduced(agg string) (f float64, ok bool) {
+	switch agg {
+	case "sum":
+		return v.sum, true
+	case "avg":
+		if v.count == 0 {
+			return 0, true
+		}
+		return v.sum / float64(v.count), true
+	case "min":
+		return v.min, true
+	case "max":
+		return v.max, true
+	case "first":
+		return v.first, true
+	case "last":
+		return v.last, true
+	}
+	return 0, false
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	db := tempDB(t)
+
+	// A point a minute for 25 minutes, nothing for the next 20, then five
+	// more, so the window from 30 to 40 minutes is empty.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 50; i++ {
+		if i >= 25 && i < 45 {
+			continue
+		}
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+			Value:     map[string]float64{"v": float64(i % 7)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows start at base+2m: [2,12) [12,22) [22,32) [42,52).
+	start := base.Add(2 * time.Minute).UnixNano()
+	end := base.Add(49 * time.Minute).UnixNano()
+	windows := []struct {
+		offset int
+		values []float64
+	}{
+		{2, []float64{2, 3, 4, 5, 6, 0, 1, 2, 3, 4}},
+		{12, []float64{5, 6, 0, 1, 2, 3, 4, 5, 6, 0}},
+		{22, []float64{1, 2, 3}},
+		{42, []float64{3, 4, 5, 6, 0}},
+	}
+
+	for _, agg := range []string{"sum", "avg", "min", "max", "first", "last"} {
+		got, err := db.Downsample(start, end, 10*time.Minute, agg, "none")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(windows) {
+			t.Fatalf("%s: got %d points, want %d", agg, len(got), len(windows))
+		}
+		for i, w := range windows {
+			var v Value
+			for _, f := range w.values {
+				v.merge(Value{sum: f, max: f, min: f, first: f, last: f, count: 1})
+			}
+			want, _ := v.reduced(agg)
+			ts := base.Add(time.Duration(w.offset) * time.Minute).UnixNano()
+			if got[i].Timestamp != ts || got[i].Value["v"] != want {
+				t.Fatalf("%s window %d: got %d %v, want %d %v", agg, i, got[i].Timestamp, got[i].Value["v"], ts, want)
+			}
+		}
+	}
+
+	if _, err := db.Downsample(start, end, 0, "sum", "none"); err != ErrInvalidBucket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Downsample(start, end, time.Minute, "median", "none"); err != ErrInvalidAggregate {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Filling a year of millisecond windows is refused, leaving them
+	// unfilled is not.
+	yearEnd := time.Unix(0, start).AddDate(1, 0, 0).UnixNano()
+	if _, err := db.Downsample(start, yearEnd, time.Millisecond, "sum", "zero"); err != ErrTooManyWindows {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Downsample(math.MinInt64, math.MaxInt64, time.Nanosecond, "sum", "previous"); err != ErrTooManyWindows {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Downsample(start, yearEnd, time.Millisecond, "sum", "none"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Downsample(math.MinInt64, math.MaxInt64, 1<<62, "sum", "zero"); err != nil || len(got) != 4 {
+		t.Fatalf("Downsample over the widest windows = %d windows, %v", len(got), err)
+	}
+}
+
+func TestDownsampleFill(t *testing.T) {
+	db := tempDB(t)
+
+	// A point a minute for ten minutes but none at 5, 6 and 7, counting
+	// up by ten.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 10; i++ {
+		if i >= 5 && i < 8 {
+			continue
+		}
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+			Value:     map[string]float64{"v": float64(i * 10)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows of a minute from the one before the first point, which is
+	// only filled with zero.
+	start := base.Add(-time.Minute).UnixNano()
+	end := base.Add(9 * time.Minute).UnixNano()
+	known := []float64{0, 10, 20, 30, 40}
+	tests := []struct {
+		fill  string
+		first int // the minute of the first window
+		gap   []float64
+	}{
+		{"none", 0, nil},
+		{"zero", -1, []float64{0, 0, 0}},
+		{"previous", 0, []float64{40, 40, 40}},
+		{"linear", 0, []float64{50, 60, 70}},
+	}
+	for _, tt := range tests {
+		got, err := db.Downsample(start, end, time.Minute, "last", tt.fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []float64
+		if tt.first < 0 {
+			want = append(want, 0)
+		}
+		want = append(want, known...)
+		want = append(want, tt.gap...)
+		want = append(want, 80, 90)
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d points, want %d", tt.fill, len(got), len(want))
+		}
+		minute := tt.first
+		for i, p := range got {
+			if tt.gap == nil && minute == 5 {
+				minute = 8
+			}
+			if p.Timestamp != base.Add(time.Duration(minute)*time.Minute).UnixNano() || p.Value["v"] != want[i] {
+				t.Fatalf("%s: point %d is %v at %d, want %v at minute %d", tt.fill, i, p.Value, p.Timestamp, want[i], minute)
+			}
+			minute++
+		}
+	}
+
+	if _, err := db.Downsample(start, end, time.Minute, "last", "spline"); err != ErrInvalidFill {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
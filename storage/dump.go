@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes the tree as of the last flush to w as indented text, one line
+// per node. An interior node is shown with the key it is reached by, its
+// level and its position, a leaf also lists the timestamps of its points.
+func (db *DB) Dump(w io.Writer) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := fmt.Fprintf(w, "root level %#x at %d\n", tx.root.level, tx.meta.root); err != nil {
+		return err
+	}
+	return tx.root.dump(w, 1)
+}
+
+// dump writes the children of n to w, indented by depth.
+func (n *node) dump(w io.Writer, depth int) error {
+	indent := strings.Repeat("  ", depth)
+	for _, pointer := range n.pointers {
+		child := pointer.pointer
+		if child == nil {
+			var err error
+			if child, err = n.db.node(pointer.pos); err != nil {
+				return err
+			}
+		}
+
+		if !child.isLeaf {
+			if _, err := fmt.Fprintf(w, "%snode %d level %#x at %d\n", indent, pointer.key, child.level, pointer.pos); err != nil {
+				return err
+			}
+			if err := child.dump(w, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		keys := make([]string, len(child.points))
+		for i, point := range child.points {
+			keys[i] = fmt.Sprint(point.Timestamp)
+		}
+		if _, err := fmt.Fprintf(w, "%sleaf %d level %#x at %d: %s\n", indent, pointer.key, child.level, pointer.pos, strings.Join(keys, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// dumpPositions matches the positions of the nodes in a dump, which move
+// with every change to the encoding.
+var dumpPositions = regexp.MustCompile(` at [0-9]+`)
+
+func TestDump(t *testing.T) {
+	// Buckets follow the local calendar, pin it so the tree is the same
+	// everywhere.
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+
+	db := tempDB(t)
+	opts := &Options{MaxLeafPoints: 4, MaxCachedNodes: DefaultMaxCachedNodes}
+	db = reopen(t, db, opts)
+	defer db.Close()
+
+	// Two days, the second holding enough points to be expanded into hours,
+	// and a point in the next year.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	keys := []time.Time{
+		base,
+		base.Add(6 * time.Hour),
+		base.AddDate(0, 0, 1),
+		base.AddDate(0, 0, 1).Add(time.Hour),
+		base.AddDate(0, 0, 1).Add(time.Hour + 30*time.Minute),
+		base.AddDate(0, 0, 1).Add(2 * time.Hour),
+		base.AddDate(0, 0, 1).Add(3 * time.Hour),
+		time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC),
+	}
+	for i, key := range keys {
+		if err := db.Put(key.UnixNano(), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := db.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := dumpPositions.ReplaceAll(buf.Bytes(), nil)
+
+	golden := filepath.Join("testdata", "dump.golden")
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 )
 
+// Errors returned by the package may be wrapped with the position or
+// operation they come from, compare them with errors.Is.
 var (
 	// ErrDatabaseNotOpen is returned when a DB instance is accessed before it
 	// is opened or after it is closed.
@@ -16,6 +18,15 @@ var (
 	// This typically occurs when a file is not a database.
 	ErrInvalid = errors.New("invalid database")
 
+	// ErrCorrupt is returned by Open with Options.StrictOnOpen when the
+	// tree in the file is damaged.
+	ErrCorrupt = errors.New("database corrupt")
+
+	// ErrCorruptTooSmall is returned by Open for a file holding some bytes
+	// but fewer than the meta area, as left by a truncation or a crash
+	// while it was created. The error returned wraps it with the size.
+	ErrCorruptTooSmall = errors.New("database file too small")
+
 	// ErrVersionMismatch is returned when the data file was created with a different version.
 	ErrVersionMismatch = errors.New("version mismatch")
 
@@ -26,7 +37,83 @@ var (
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
 
+	// ErrInvalidOptions is returned when Open is given options out of range.
+	ErrInvalidOptions = errors.New("invalid options")
+
+	// ErrDatabaseReadOnly is returned when a write is attempted on a database
+	// opened read-only.
+	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
+	// ErrInvalidBucket is returned when downsampling into windows that are
+	// not positive.
+	ErrInvalidBucket = errors.New("invalid bucket")
+
+	// ErrInvalidAggregate is returned for an unknown aggregate function.
+	ErrInvalidAggregate = errors.New("invalid aggregate")
+
+	// ErrInvalidFill is returned for an unknown way of filling empty
+	// windows.
+	ErrInvalidFill = errors.New("invalid fill")
+
+	// ErrTooManyWindows is returned when filling empty windows over more
+	// than MaxFillWindows of them.
+	ErrTooManyWindows = errors.New("too many windows")
+
+	// ErrInvalidTTL is returned by PutWithTTL for a TTL that is not
+	// positive.
+	ErrInvalidTTL = errors.New("invalid ttl")
+
+	// ErrInvalidQuantile is returned for a quantile outside [0, 1].
+	ErrInvalidQuantile = errors.New("invalid quantile")
+
+	// ErrSnapshotMismatch is returned when restoring a snapshot taken at a
+	// different root than the one the database is at.
+	ErrSnapshotMismatch = errors.New("snapshot does not match database")
+
+	// ErrFullSyncRequired is returned by Changes when the changes asked
+	// for are no longer known, so the replica has to be copied whole.
+	ErrFullSyncRequired = errors.New("changes no longer known, full sync required")
+
+	// ErrTxClosed is returned when committing or rolling back a transaction
+	// that has already been committed or rolled back.
+	ErrTxClosed = errors.New("tx closed")
+
+	// ErrTxNotWritable is returned when writing within a read-only
+	// transaction.
+	ErrTxNotWritable = errors.New("tx not writable")
+
+	// ErrTxTooLarge is returned by the put or delete that takes a write
+	// over Options.MaxTxOps.
+	ErrTxTooLarge = errors.New("tx too large")
+
+	// ErrEmptyValue is returned when putting a point without metrics.
+	ErrEmptyValue = errors.New("point has no metrics")
+
+	// ErrOutsideRootSpan is returned when putting a point outside the
+	// bucket of the root of a database created with Options.RootLevel.
+	ErrOutsideRootSpan = errors.New("timestamp outside the span of the root")
+
+	// ErrMetricNameTooLong is returned when putting a metric whose name
+	// is longer than MaxMetricNameLength bytes.
+	ErrMetricNameTooLong = errors.New("metric name too long")
+
+	// ErrUnsorted is returned by LoadSorted, wrapped with the index of the
+	// offending point, for points that are not sorted by timestamp or
+	// share one.
+	ErrUnsorted = errors.New("points not sorted")
+
+	// ErrInvalidSeries is returned for a series name that is empty or too
+	// long.
+	ErrInvalidSeries = errors.New("invalid series name")
+
+	// ErrWriterClosed is returned when using a Writer after it is closed.
+	ErrWriterClosed = errors.New("writer closed")
+
+	// ErrChunkBadCrc is returned when a chunk does not match its crc or its
+	// length prefix is corrupt.
 	ErrChunkBadCrc = errors.New("chunk crc bad")
 
+	// ErrChunkDataLessThanSize is returned when the file ends before the
+	// length of a chunk.
 	ErrChunkDataLessThanSize = errors.New("chunk data less than size")
 )
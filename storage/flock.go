@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// flockRetryInterval is how long flock waits before trying a held lock
+// again.
+const flockRetryInterval = 50 * time.Millisecond
+
+// flock locks file, shared if exclusive is false. It retries until timeout
+// has passed, or forever if timeout is zero, and then returns ErrTimeout.
+func flock(file *os.File, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		} else if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(flockRetryInterval)
+	}
+}
+
+// funlock releases the lock taken by flock.
+func funlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
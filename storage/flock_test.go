@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCloseLogsUnlockError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	logger := &captureLogger{}
+	db, err := OpenWithOptions(path, 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in a closed file, so unlocking it fails.
+	file := db.file
+	defer file.Close()
+	closed, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	db.file = closed
+
+	if err := db.Close(); err == nil {
+		t.Fatal("closing a closed file succeeded")
+	}
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "unlock") {
+		t.Fatalf("unexpected messages: %q", logger.messages)
+	}
+}
@@ -0,0 +1,15 @@
+package storage
+
+import (
+	"os"
+	"time"
+)
+
+// flock is a no-op on Windows, the file is not locked.
+func flock(file *os.File, exclusive bool, timeout time.Duration) error {
+	return nil
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// GetMany returns the points at keys, in the order of keys. A key without
+// a point, or whose point expired, gets a Point with that timestamp and a
+// nil Value. The keys are looked up in order within one transaction, so
+// every node on the way to them is read once however many keys it holds,
+// where Get reads them again for every key.
+func (db *DB) GetMany(keys []int64) ([]Point, error) {
+	db.counters.gets.Add(uint64(len(keys)))
+	points := make([]Point, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		points[i].Timestamp = key
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+
+	err := db.View(func(tx *Tx) error {
+		return tx.root.getMany(keys, order, points, time.Now().UnixNano())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// getMany sets the values of points to those of the points below n at
+// keys, visiting them in order, the indexes of keys sorted by key.
+func (n *node) getMany(keys []int64, order []int, points []Point, now int64) error {
+	if n.isLeaf {
+		index := 0
+		for _, i := range order {
+			for index < len(n.points) && n.points[index].Timestamp < keys[i] {
+				index++
+			}
+			if index == len(n.points) {
+				break
+			}
+			if point := n.points[index]; point.Timestamp == keys[i] && !point.expired(now) {
+				points[i].Value = point.Value
+			}
+		}
+		return nil
+	}
+
+	level := n.level << 1
+	for len(order) > 0 {
+		t := NewTime(keys[order[0]])
+		bucket, end := t.Timestamp(level), t.next(level)
+		j := sort.Search(len(order), func(j int) bool {
+			return keys[order[j]] >= end
+		})
+
+		index := sort.Search(len(n.pointers), func(i int) bool {
+			return n.pointers[i].key >= bucket
+		})
+		if index < len(n.pointers) && n.pointers[index].key == bucket {
+			child, err := n.childAt(index)
+			if err != nil {
+				return err
+			}
+			if err := child.getMany(keys, order[:j], points, now); err != nil {
+				return err
+			}
+		}
+		order = order[j:]
+	}
+	return nil
+}
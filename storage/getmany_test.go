@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// getManyDB returns a database of 5000 points a few seconds apart and
+// their keys.
+func getManyDB(tb testing.TB, opts *Options) (*DB, []int64) {
+	db, err := OpenWithOptions(filepath.Join(tb.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	points := make([]Point, 5000)
+	keys := make([]int64, len(points))
+	for i := range points {
+		keys[i] = base.Add(time.Duration(i) * 7 * time.Second).UnixNano()
+		points[i] = Point{Timestamp: keys[i], Value: map[string]float64{"v": float64(i)}}
+	}
+	if err := db.LoadSorted(points); err != nil {
+		tb.Fatal(err)
+	}
+	return db, keys
+}
+
+func TestGetMany(t *testing.T) {
+	db, stored := getManyDB(t, &Options{MaxLeafPoints: 16})
+	defer db.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]int64, 0, 300)
+	for i := 0; i < 200; i++ {
+		keys = append(keys, stored[rng.Intn(len(stored))])
+	}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, stored[rng.Intn(len(stored))]+1)
+	}
+	keys = append(keys, keys[0], 0, 1<<62)
+	rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	points, err := db.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(keys) {
+		t.Fatalf("GetMany returned %d points, want %d", len(points), len(keys))
+	}
+	for i, key := range keys {
+		if points[i].Timestamp != key {
+			t.Fatalf("point %d at %d, want %d", i, points[i].Timestamp, key)
+		}
+		want, err := db.Get(key)
+		if err == ErrNotFound {
+			if points[i].Value != nil {
+				t.Fatalf("point %d at %d: %v, want a miss", i, key, points[i].Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(points[i].Value, want.Value) {
+			t.Fatalf("point %d at %d: %v, want %v", i, key, points[i].Value, want.Value)
+		}
+	}
+
+	if points, err := db.GetMany(nil); err != nil || len(points) != 0 {
+		t.Fatalf("GetMany(nil) = %v, %v", points, err)
+	}
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	// Every node read goes through the cache, so its hits and misses count
+	// the nodes decoded.
+	db, stored := getManyDB(b, &Options{MaxLeafPoints: 16, MaxCachedNodes: 1 << 16})
+	defer db.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]int64, 100)
+	for i := range keys {
+		keys[i] = stored[rng.Intn(len(stored))]
+	}
+	nodes := func() uint64 {
+		m := db.Metrics()
+		return m.CacheHits + m.CacheMisses
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		start := nodes()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				if _, err := db.Get(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(nodes()-start)/float64(b.N), "nodes/op")
+	})
+	b.Run("GetMany", func(b *testing.B) {
+		start := nodes()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetMany(keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(nodes()-start)/float64(b.N), "nodes/op")
+	})
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommit collects the puts of Options.GroupCommitDelay. The first put
+// to arrive while none is waiting leads the group: it sleeps for the
+// delay, takes the writer lock and commits every put collected by then at
+// once, with a single flush and sync.
+type groupCommit struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	pending []groupWrite
+	leading bool // a put is waiting to commit pending
+}
+
+// groupWrite is a put waiting for its group to commit, done receives the
+// result.
+type groupWrite struct {
+	key   int64
+	value map[string]float64
+	done  chan error
+}
+
+// groupPut adds the put to the group in progress, or starts one, and
+// returns once the group is committed. A value no put could store fails
+// right away instead of failing its group.
+func (db *DB) groupPut(key int64, value map[string]float64) error {
+	if err := checkValue(value); err != nil {
+		return err
+	}
+	g := db.group
+	done := make(chan error, 1)
+
+	g.mu.Lock()
+	g.pending = append(g.pending, groupWrite{key: key, value: value, done: done})
+	lead := !g.leading
+	g.leading = true
+	g.mu.Unlock()
+
+	if lead {
+		time.Sleep(g.delay)
+		db.commitGroup()
+	}
+	return <-done
+}
+
+// commitGroup commits the puts collected so far. Puts arriving once it has
+// taken them start the next group. If the group fails as a whole, each put
+// is committed on its own, so one bad put does not fail the others.
+func (db *DB) commitGroup() {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	g := db.group
+	g.mu.Lock()
+	writes := g.pending
+	g.pending = nil
+	g.leading = false
+	g.mu.Unlock()
+
+	err := func() error {
+		for _, w := range writes {
+			if err := db.put(w.key, w.value); err != nil {
+				return err
+			}
+		}
+		return db.Flush()
+	}()
+	if err == nil {
+		for _, w := range writes {
+			w.done <- nil
+		}
+		return
+	}
+	db.rollback()
+	if len(writes) == 1 {
+		writes[0].done <- err
+		return
+	}
+
+	for _, w := range writes {
+		if err := db.put(w.key, w.value); err != nil {
+			db.rollback()
+			w.done <- err
+			continue
+		}
+		if err := db.Flush(); err != nil {
+			db.rollback()
+			w.done <- err
+			continue
+		}
+		w.done <- nil
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, GroupCommitDelay: 20 * time.Millisecond, RootLevel: LevelHour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var syncs atomic.Int64
+	db.ops.sync = func() error {
+		syncs.Add(1)
+		return db.ops.File.Sync()
+	}
+
+	// put puts points all at once and returns their errors.
+	put := func(points []Point) []error {
+		errs := make([]error, len(points))
+		var wg sync.WaitGroup
+		for i, p := range points {
+			wg.Add(1)
+			go func(i int, p Point) {
+				defer wg.Done()
+				errs[i] = db.Put(p.Timestamp, p.Value)
+			}(i, p)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	const writers = 50
+	hour := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	points := make([]Point, 2*writers)
+	for i := range points {
+		points[i] = Point{Timestamp: hour.Add(time.Duration(i) * time.Second).UnixNano(), Value: map[string]float64{"v": float64(i)}}
+	}
+
+	// Puts arriving together are committed together.
+	for i, err := range put(points[:writers]) {
+		if err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+	}
+	if n := syncs.Load(); n >= writers {
+		t.Fatalf("got %d syncs for %d puts", n, writers)
+	}
+
+	// A put failing in the tree, outside the hour of the root, fails on its
+	// own and not its group. A nil value is turned away before joining one.
+	outside := Point{Timestamp: hour.Add(time.Hour).UnixNano(), Value: map[string]float64{"v": 1}}
+	errs := put(append(points[writers:], outside, Point{Timestamp: hour.UnixNano()}))
+	for i, err := range errs[:writers] {
+		if err != nil {
+			t.Fatalf("put %d: %v", writers+i, err)
+		}
+	}
+	if err := errs[writers]; err != ErrOutsideRootSpan {
+		t.Fatalf("put outside the hour: %v, want ErrOutsideRootSpan", err)
+	}
+	if err := errs[writers+1]; err != ErrEmptyValue {
+		t.Fatalf("put of a nil value: %v, want ErrEmptyValue", err)
+	}
+
+	// Every put that returned is on disk.
+	db = reopen(t, db, nil)
+	defer db.Close()
+	for i, want := range points {
+		p, err := db.Get(want.Timestamp)
+		if err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+		if p.Value["v"] != float64(i) {
+			t.Fatalf("put %d: unexpected value %v", i, p.Value)
+		}
+	}
+	if _, err := db.Get(outside.Timestamp); err != ErrNotFound {
+		t.Fatalf("put outside the hour stored: %v", err)
+	}
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprint(delay), func(b *testing.B) {
+			db, err := OpenWithOptions(b.TempDir()+"/db", 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, GroupCommitDelay: delay})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			var syncs atomic.Int64
+			db.ops.sync = func() error {
+				syncs.Add(1)
+				return db.ops.File.Sync()
+			}
+
+			var key atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := db.Put(key.Add(1), map[string]float64{"v": 1}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(syncs.Load())/float64(b.N), "syncs/op")
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Has reports whether there is a point at key, key is unixnano, leaving out
+// expired points. Leaves read from disk are scanned for the timestamp
+// without decoding their metrics.
+func (db *DB) Has(key int64) (ok bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		ok, err = tx.root.has(NewTime(key), time.Now().UnixNano())
+		return err
+	})
+	return ok, err
+}
+
+// GetInto stores the metrics of the point at key in dst, after clearing
+// it, and reports whether there is one, leaving out expired points. Unlike
+// Get it does not decode the leaf holding the point when reading it from
+// disk, only the metrics of the point, so reusing dst across calls saves
+// most of the allocations of a read.
+func (db *DB) GetInto(key int64, dst map[string]float64) (ok bool, err error) {
+	db.counters.gets.Add(1)
+	clear(dst)
+	err = db.View(func(tx *Tx) error {
+		point, metrics, expires, err := tx.root.find(NewTime(key))
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano()
+		switch {
+		case point != nil && !point.expired(now):
+			for k, v := range point.Value {
+				dst[k] = v
+			}
+			ok = true
+		case metrics != nil && (expires == 0 || expires > now):
+			if err := decodeMetricsInto(metrics, dst); err != nil {
+				clear(dst)
+				return err
+			}
+			ok = true
+		}
+		return nil
+	})
+	return ok, err
+}
+
+func (n *node) has(t Time, now int64) (bool, error) {
+	point, metrics, expires, err := n.find(t)
+	if err != nil {
+		return false, err
+	}
+	if point != nil {
+		return !point.expired(now), nil
+	}
+	return metrics != nil && (expires == 0 || expires > now), nil
+}
+
+// find looks for the point at t below n. A point in memory is returned as
+// it is, one in a leaf read from disk as its encoded metrics, not nil, and
+// its expiry. Both are nil if there is no point at t.
+func (n *node) find(t Time) (*Point, []byte, int64, error) {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= t.TS
+		})
+		if index < len(n.points) && n.points[index].Timestamp == t.TS {
+			return n.points[index], nil, 0, nil
+		}
+		return nil, nil, 0, nil
+	}
+
+	ts := t.Timestamp(n.level << 1)
+	index := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= ts
+	})
+	if index >= len(n.pointers) || n.pointers[index].key != ts {
+		return nil, nil, 0, nil
+	}
+	pointer := n.pointers[index]
+	if pointer.pointer != nil {
+		return pointer.pointer.find(t)
+	}
+
+	nodeBytes, err := n.db.nodeBytes(pointer.pos)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	body, hflags, err := chunkNode(nodeBytes)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("decode node at %d: %w", pointer.pos, err)
+	}
+	// The values in a leaf of value deltas need the points before them.
+	if decodeUint16(body[0:2])&LeafFlag == LeafChunkFlag && hflags&ValueDeltaChunkFlag == 0 {
+		metrics, expires, ok, err := leafChunkFind(body, hflags, t.TS)
+		if err != nil || !ok {
+			return nil, nil, 0, err
+		}
+		return nil, metrics, expires, nil
+	}
+	child, err := n.db.decodeNode(nodeBytes)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("decode node at %d: %w", pointer.pos, err)
+	}
+	return child.find(t)
+}
+
+// leafChunkFind scans the timestamps of an encoded leaf for ts, skipping
+// over the metrics, and returns the encoded metrics and the expiry of the
+// point at ts if there is one.
+func leafChunkFind(nodeBytes []byte, hflags byte, ts int64) ([]byte, int64, bool, error) {
+	flags := decodeUint16(nodeBytes[0:2])
+	delta := flags&DeltaChunkFlag != 0
+	expiry := delta && hflags&ExpiryChunkFlag != 0
+
+	bufPos := 2
+	var cur int64
+	for i := 0; bufPos < len(nodeBytes); i++ {
+		var length int
+		var expires int64
+		if delta {
+			var size int
+			if i == 0 {
+				cur, size = binary.Varint(nodeBytes[bufPos:])
+			} else {
+				var d uint64
+				d, size = binary.Uvarint(nodeBytes[bufPos:])
+				cur += int64(d)
+			}
+			if size <= 0 {
+				return nil, 0, false, ErrInvalid
+			}
+			bufPos += size
+			if expiry {
+				if expires, size = binary.Varint(nodeBytes[bufPos:]); size <= 0 {
+					return nil, 0, false, ErrInvalid
+				}
+				bufPos += size
+			}
+
+			l, size := binary.Uvarint(nodeBytes[bufPos:])
+			if size <= 0 || l > uint64(len(nodeBytes)-bufPos-size) {
+				return nil, 0, false, ErrInvalid
+			}
+			bufPos += size
+			length = int(l)
+		} else {
+			if bufPos+10 > len(nodeBytes) {
+				return nil, 0, false, ErrInvalid
+			}
+			length = int(decodeUint16(nodeBytes[bufPos:bufPos+2])) - 8
+			cur = decodeInt64(nodeBytes[bufPos+2 : bufPos+10])
+			bufPos += 10
+			if length < 0 || length > len(nodeBytes)-bufPos {
+				return nil, 0, false, ErrInvalid
+			}
+		}
+
+		if cur == ts {
+			return nodeBytes[bufPos : bufPos+length], expires, true, nil
+		} else if cur > ts {
+			return nil, 0, false, nil
+		}
+		bufPos += length
+	}
+	return nil, 0, false, nil
+}
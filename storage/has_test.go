@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHas(t *testing.T) {
+	// Millisecond keys fill two large second leaves, so a Get decodes many
+	// points to find one.
+	opts := &Options{MaxLeafPoints: 1000}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 2000; i += 2 {
+		value := make(map[string]float64)
+		for m := 0; m < 5; m++ {
+			value[fmt.Sprintf("m%d", m)] = float64(i)
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Millisecond).UnixNano(), Value: value})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < 2000; i++ {
+			ok, err := db.Has(base.Add(time.Duration(i) * time.Millisecond).UnixNano())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (i%2 == 0) {
+				t.Fatalf("Has(%d) = %v", i, ok)
+			}
+		}
+		if ok, err := db.Has(base.AddDate(1, 0, 0).UnixNano()); err != nil || ok {
+			t.Fatalf("Has next year = %v, %v", ok, err)
+		}
+	}
+	check(db)
+
+	key := points[len(points)/2].Timestamp
+
+	// Leaves are read through the node cache, so a second Has of the
+	// same key does not read the file.
+	db = reopen(t, db, &Options{MaxLeafPoints: 1000, MaxCachedNodes: 16})
+	reads := 0
+	db.ops.readAt = func(b []byte, off int64) (int, error) {
+		reads++
+		return db.file.ReadAt(b, off)
+	}
+	for i := 0; i < 2; i++ {
+		reads = 0
+		if ok, err := db.Has(key); err != nil || !ok {
+			t.Fatalf("Has = %v, %v", ok, err)
+		}
+	}
+	if reads != 0 {
+		t.Fatalf("Has read the file %d times with the node cached", reads)
+	}
+	db.ops.readAt = nil
+
+	// Leaves read from disk are scanned, not decoded.
+	db = reopen(t, db, opts)
+	check(db)
+
+	has := testing.AllocsPerRun(10, func() { db.Has(key) })
+	get := testing.AllocsPerRun(10, func() { db.Get(key) })
+	if has*10 > get {
+		t.Fatalf("Has made %v allocations, Get %v", has, get)
+	}
+
+	// Damage is reported as an error, not as a missing key.
+	if _, err := db.ops.WriteAt(encodeUint32(1), db.meta.root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Has(key); err == nil {
+		t.Fatal("expected error reading a damaged root")
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	opts := &Options{MaxLeafPoints: 1000}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 2000; i += 2 {
+		value := make(map[string]float64)
+		for m := 0; m < 1+i%5; m++ {
+			value[fmt.Sprintf("m%d", m)] = float64(i + m)
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Millisecond).UnixNano(), Value: value})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		dst := map[string]float64{"stale": 1}
+		for i, point := range points {
+			ok, err := db.GetInto(point.Timestamp, dst)
+			if err != nil || !ok {
+				t.Fatalf("GetInto(%d) = %v, %v", i, ok, err)
+			}
+			if !reflect.DeepEqual(dst, point.Value) {
+				t.Fatalf("GetInto(%d) = %v, want %v", i, dst, point.Value)
+			}
+		}
+		ok, err := db.GetInto(points[0].Timestamp+1, dst)
+		if err != nil || ok || len(dst) != 0 {
+			t.Fatalf("GetInto of a missing key = %v, %v, %v", ok, err, dst)
+		}
+	}
+	check(db)
+	db = reopen(t, db, opts)
+	check(db)
+
+	key := points[len(points)/2].Timestamp
+	dst := make(map[string]float64)
+	into := testing.AllocsPerRun(10, func() { db.GetInto(key, dst) })
+	get := testing.AllocsPerRun(10, func() { db.Get(key) })
+	if into*10 > get {
+		t.Fatalf("GetInto made %v allocations, Get %v", into, get)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	db, err := OpenWithOptions(filepath.Join(b.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 1000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		value := make(map[string]float64)
+		for m := 0; m < 5; m++ {
+			value[fmt.Sprintf("m%d", m)] = float64(i)
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Millisecond).UnixNano(), Value: value})
+	}
+	if err := db.PutBatch(points); err != nil {
+		b.Fatal(err)
+	}
+	key := points[len(points)/2].Timestamp
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetInto", func(b *testing.B) {
+		dst := make(map[string]float64)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetInto(key, dst); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+const (
+	// histogramAccuracy is the relative error of a quantile read from a
+	// histogram.
+	histogramAccuracy = 0.02
+
+	// maxHistogramBins bounds the size of a histogram. Past it the buckets
+	// nearest to zero are folded together, losing accuracy there first.
+	maxHistogramBins = 512
+
+	// minHistogramValue is the magnitude below which values count as zero.
+	minHistogramValue = 1e-9
+)
+
+var (
+	histogramGamma    = (1 + histogramAccuracy) / (1 - histogramAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// histogram counts values in buckets whose bounds grow by histogramGamma,
+// so any value in a bucket is within histogramAccuracy of its middle.
+// Merging two histograms adds up their buckets, which lets an interior node
+// keep the histogram of all the points below it.
+type histogram struct {
+	zero uint64
+	pos  map[int32]uint64 // buckets of positive values
+	neg  map[int32]uint64 // buckets of negative values, by magnitude
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		pos: make(map[int32]uint64),
+		neg: make(map[int32]uint64),
+	}
+}
+
+// bucket returns the index of the bucket holding the magnitude m.
+func bucket(m float64) int32 {
+	return int32(math.Ceil(math.Log(m) / histogramLogGamma))
+}
+
+// bucketValue returns the middle of the bucket at index i.
+func bucketValue(i int32) float64 {
+	return 2 * math.Pow(histogramGamma, float64(i)) / (histogramGamma + 1)
+}
+
+func (h *histogram) add(v float64) {
+	switch {
+	case math.Abs(v) < minHistogramValue || math.IsNaN(v):
+		h.zero++
+	case v > 0:
+		h.pos[bucket(v)]++
+	default:
+		h.neg[bucket(-v)]++
+	}
+	h.collapse()
+}
+
+func (h *histogram) merge(o *histogram) {
+	h.zero += o.zero
+	for i, c := range o.pos {
+		h.pos[i] += c
+	}
+	for i, c := range o.neg {
+		h.neg[i] += c
+	}
+	h.collapse()
+}
+
+func (h *histogram) clone() *histogram {
+	c := newHistogram()
+	c.merge(h)
+	return c
+}
+
+// collapse folds the buckets nearest to zero into their neighbours until
+// there are at most maxHistogramBins.
+func (h *histogram) collapse() {
+	for len(h.pos)+len(h.neg) > maxHistogramBins {
+		buckets := h.pos
+		if len(h.neg) > len(h.pos) {
+			buckets = h.neg
+		}
+		keys := sortedBuckets(buckets)
+		buckets[keys[1]] += buckets[keys[0]]
+		delete(buckets, keys[0])
+	}
+}
+
+func (h *histogram) count() uint64 {
+	n := h.zero
+	for _, c := range h.pos {
+		n += c
+	}
+	for _, c := range h.neg {
+		n += c
+	}
+	return n
+}
+
+// quantile returns the value below which a fraction q of the values lie.
+func (h *histogram) quantile(q float64) float64 {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(total-1))
+
+	var seen uint64
+	neg := sortedBuckets(h.neg)
+	for i := len(neg) - 1; i >= 0; i-- {
+		if seen += h.neg[neg[i]]; seen > rank {
+			return -bucketValue(neg[i])
+		}
+	}
+	if seen += h.zero; seen > rank {
+		return 0
+	}
+	pos := sortedBuckets(h.pos)
+	for _, i := range pos {
+		if seen += h.pos[i]; seen > rank {
+			return bucketValue(i)
+		}
+	}
+	return bucketValue(pos[len(pos)-1])
+}
+
+func sortedBuckets(buckets map[int32]uint64) []int32 {
+	keys := make([]int32, 0, len(buckets))
+	for i := range buckets {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+	return keys
+}
+
+// encodeHistogram returns the histogram of v encoded by encodeHistogram.
+func (v *Value) encodeHistogram() []byte {
+	if v.histBytes != nil {
+		return v.histBytes
+	}
+	return encodeHistogram(v.hist)
+}
+
+// encodeHistogram encodes h, which may be nil, as the zero count plus one
+// followed by the negative and then the positive buckets in order. A nil
+// histogram is a single zero.
+func encodeHistogram(h *histogram) []byte {
+	if h == nil {
+		return encodeUvarint(0)
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(encodeUvarint(h.zero + 1))
+	for _, buckets := range []map[int32]uint64{h.neg, h.pos} {
+		buf.Write(encodeUvarint(uint64(len(buckets))))
+		for _, i := range sortedBuckets(buckets) {
+			buf.Write(encodeVarint(int64(i)))
+			buf.Write(encodeUvarint(buckets[i]))
+		}
+	}
+	return buf.Bytes()
+}
+
+// histogramSize returns the length of the histogram encoded at the start of
+// b, checking that it decodes.
+func histogramSize(b []byte) (int, error) {
+	zero, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, ErrInvalid
+	}
+	if zero == 0 {
+		return n, nil
+	}
+	for sign := 0; sign < 2; sign++ {
+		length, size := binary.Uvarint(b[n:])
+		if size <= 0 {
+			return 0, ErrInvalid
+		}
+		n += size
+		for j := uint64(0); j < 2*length; j++ {
+			_, size := binary.Uvarint(b[n:])
+			if size <= 0 {
+				return 0, ErrInvalid
+			}
+			n += size
+		}
+	}
+	return n, nil
+}
+
+// decodeHistogram decodes a histogram encoded by encodeHistogram and
+// returns it with the number of bytes read.
+func decodeHistogram(b []byte) (*histogram, int, error) {
+	zero, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, 0, ErrInvalid
+	}
+	if zero == 0 {
+		return nil, n, nil
+	}
+
+	h := newHistogram()
+	h.zero = zero - 1
+	for _, buckets := range []map[int32]uint64{h.neg, h.pos} {
+		length, size := binary.Uvarint(b[n:])
+		if size <= 0 {
+			return nil, 0, ErrInvalid
+		}
+		n += size
+		for j := uint64(0); j < length; j++ {
+			i, size := binary.Varint(b[n:])
+			if size <= 0 {
+				return nil, 0, ErrInvalid
+			}
+			n += size
+			c, size := binary.Uvarint(b[n:])
+			if size <= 0 {
+				return nil, 0, ErrInvalid
+			}
+			n += size
+			buckets[int32(i)] = c
+		}
+	}
+	return h, n, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+)
+
+// LibraryVersion is the version of tickdb recorded in the files it creates.
+const LibraryVersion = "0.0"
+
+const (
+	// InfoPos is where the info of a file is written when it is created,
+	// in the part of the meta area after the copy of the meta.
+	InfoPos uint64 = MetaCopyPos + MetaCopyPos/2
+
+	infoMagic uint32 = 0x1F0D2BCA
+)
+
+// DBInfo describes how and when a database file was created, see DB.Info.
+type DBInfo struct {
+	// Created is when the file was created.
+	Created time.Time
+
+	// LibraryVersion is the LibraryVersion of the tickdb that created it.
+	LibraryVersion string
+
+	// FormatVersion is the Version of the file format it was created with.
+	FormatVersion uint16
+
+	// MaxLeafPoints, MaxLeafBytes and Checksum are the options it was
+	// created with.
+	MaxLeafPoints int
+	MaxLeafBytes  int
+	Checksum      Checksum
+}
+
+// Info returns how and when the file of db was created. It is the zero
+// DBInfo for files created before it was recorded.
+func (db *DB) Info() DBInfo {
+	return db.info
+}
+
+func (i *DBInfo) toBytes() []byte {
+	buf := new(bytes.Buffer)
+
+	buf.Write(encodeUint32(infoMagic))
+	buf.Write(encodeInt64(i.Created.UnixNano()))
+	buf.Write(encodeUint16(uint16(len(i.LibraryVersion))))
+	buf.WriteString(i.LibraryVersion)
+	buf.Write(encodeUint16(i.FormatVersion))
+	buf.Write(encodeUint32(uint32(i.MaxLeafPoints)))
+	buf.Write(encodeUint32(uint32(i.MaxLeafBytes)))
+	buf.WriteByte(byte(i.Checksum))
+
+	return buf.Bytes()
+}
+
+func newInfoFromBytes(data []byte) (DBInfo, error) {
+	var i DBInfo
+	if len(data) < 14 || decodeUint32(data[0:4]) != infoMagic {
+		return i, ErrInvalid
+	}
+	i.Created = time.Unix(0, decodeInt64(data[4:12]))
+	n := int(decodeUint16(data[12:14]))
+	if len(data) != 14+n+11 {
+		return i, ErrInvalid
+	}
+	i.LibraryVersion = string(data[14 : 14+n])
+	data = data[14+n:]
+	i.FormatVersion = decodeUint16(data[0:2])
+	i.MaxLeafPoints = int(decodeUint32(data[2:6]))
+	i.MaxLeafBytes = int(decodeUint32(data[6:10]))
+	i.Checksum = Checksum(data[10])
+	return i, nil
+}
+
+// writeInfo records the info of a file being created at InfoPos.
+func (db *DB) writeInfo(info DBInfo) error {
+	pos := db.pos
+	db.pos = int64(InfoPos)
+	_, _, err := db.writeChunk(info.toBytes())
+	db.pos = pos
+
+	if err != nil {
+		return err
+	}
+	db.info = info
+	return nil
+}
+
+// readInfo reads the info of the file, leaving it zero if there is none.
+func (db *DB) readInfo() {
+	data, err := db.readChunkAt(int64(InfoPos))
+	if err != nil {
+		return
+	}
+	if info, err := newInfoFromBytes(data); err == nil {
+		db.info = info
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInfo(t *testing.T) {
+	before := time.Now()
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 16, MaxLeafBytes: 4096, Checksum: ChecksumCRC32C})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	if err := db.Put(before.UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	created := db.Info()
+
+	db = reopen(t, db, nil)
+	info := db.Info()
+	if info != created {
+		t.Fatalf("Info after reopen = %+v, want %+v", info, created)
+	}
+	if info.Created.Before(before.Round(0)) || info.Created.After(time.Now()) {
+		t.Fatalf("created at %v, want after %v", info.Created, before)
+	}
+	want := DBInfo{
+		Created:        info.Created,
+		LibraryVersion: LibraryVersion,
+		FormatVersion:  Version,
+		MaxLeafPoints:  16,
+		MaxLeafBytes:   4096,
+		Checksum:       ChecksumCRC32C,
+	}
+	if info != want {
+		t.Fatalf("Info = %+v, want %+v", info, want)
+	}
+
+	// Files written before the info was recorded have none.
+	if _, err := db.ops.WriteAt(make([]byte, MetaSize-InfoPos), int64(InfoPos)); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, nil)
+	if info := db.Info(); info != (DBInfo{}) {
+		t.Fatalf("Info without one = %+v", info)
+	}
+	if p, err := db.Get(before.UnixNano()); err != nil || p.Value["v"] != 1 {
+		t.Fatalf("Get = %v, %v", p, err)
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"time"
+)
+
+// Iterator steps through the points of a range in timestamp order. It reads
+// the tree one leaf at a time as it advances, so unlike Range it holds at
+// most one leaf of points however long the range is. It sees the database
+// as of the last flush before it was created.
+//
+//	it, err := db.Iterator(start, end)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		point := it.Point()
+//		...
+//	}
+//	return it.Err()
+type Iterator struct {
+	tx         *Tx // nil once the iterator is done or closed
+	c          *Cursor
+	start, end int64
+	point      *Point
+	started    bool
+}
+
+// Iterator returns an iterator over the points between start and end
+// inclusive. It holds a read-only transaction until Next returns false or
+// it is closed.
+func (db *DB) Iterator(start, end int64) (*Iterator, error) {
+	tx, err := db.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	c := tx.Cursor()
+	c.level = levelPoint
+	return &Iterator{tx: tx, c: c, start: start, end: end}, nil
+}
+
+// Next moves to the next point and reports whether there is one. Once it
+// returns false the iterator is closed, Err tells whether it ran out of
+// points or failed. Expired points are passed over, see PutWithTTL.
+func (it *Iterator) Next() bool {
+	if it.tx == nil {
+		return false
+	}
+
+	if !it.started {
+		it.started = true
+		if it.start > it.end {
+			it.Close()
+			return false
+		}
+		it.c.seek(it.start)
+	} else {
+		it.c.next()
+	}
+
+	now := time.Now().UnixNano()
+	point := it.c.point()
+	for point != nil && point.Timestamp <= it.end && (point.Timestamp < it.start || point.expired(now)) {
+		it.c.next()
+		point = it.c.point()
+	}
+	if point == nil || point.Timestamp > it.end || it.c.err != nil {
+		it.point = nil
+		it.Close()
+		return false
+	}
+	it.point = point
+	return true
+}
+
+// Point returns the point Next moved to. Its value must not be modified.
+func (it *Iterator) Point() Point {
+	if it.point == nil {
+		return Point{}
+	}
+	return Point{Timestamp: it.point.Timestamp, Value: it.point.Value}
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.c.err
+}
+
+// Close releases the transaction of the iterator. It is safe to call more
+// than once.
+func (it *Iterator) Close() error {
+	if it.tx == nil {
+		return nil
+	}
+	tx := it.tx
+	it.tx = nil
+	return tx.Rollback()
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIterator(t *testing.T) {
+	db := tempDB(t)
+
+	// A point every thirty seconds for four days.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	const perDay = 24 * 60 * 2
+	for day := 0; day < 4; day++ {
+		points := make([]Point, perDay)
+		for i := range points {
+			points[i] = Point{
+				Timestamp: base.Add(time.Duration(day*perDay+i) * 30 * time.Second).UnixNano(),
+				Value:     map[string]float64{"v": float64(day*perDay + i)},
+			}
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func(i int) int64 { return base.Add(time.Duration(i) * 30 * time.Second).UnixNano() }
+
+	for _, r := range [][2]int64{
+		{key(0), key(4*perDay - 1)},
+		{key(100) - 1, key(2*perDay + 7)},
+		{key(5), key(5)},
+		{key(6), key(5)},
+	} {
+		want, err := db.Range(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := db.Iterator(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for it.Next() {
+			p := it.Point()
+			if n >= len(want) || p.Timestamp != want[n].Timestamp || p.Value["v"] != want[n].Value["v"] {
+				t.Fatalf("%v: point %d is %d %v", r, n, p.Timestamp, p.Value)
+			}
+			n++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Fatalf("%v: got %d points, want %d", r, n, len(want))
+		}
+		if it.Next() {
+			t.Fatal("Next after the end")
+		}
+	}
+
+	// Iterating a day or all four allocates the same per point, the
+	// leaves passed are not kept.
+	perPoint := func(days int) float64 {
+		allocs := testing.AllocsPerRun(3, func() {
+			it, err := db.Iterator(key(0), key(days*perDay-1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for it.Next() {
+			}
+		})
+		return allocs / float64(days*perDay)
+	}
+	if one, four := perPoint(1), perPoint(4); four > one*1.1 {
+		t.Fatalf("%.2f allocations per point over four days, %.2f over one", four, one)
+	}
+
+	// Only the path to the first point is held in the tree of the
+	// transaction.
+	it, err := db.Iterator(key(0), key(4*perDay-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+	}
+	loaded := 0
+	var count func(n *node)
+	count = func(n *node) {
+		loaded++
+		for _, pointer := range n.pointers {
+			if pointer.pointer != nil {
+				count(pointer.pointer)
+			}
+		}
+	}
+	count(it.c.root)
+	if loaded > 8 {
+		t.Fatalf("%d nodes held after iterating", loaded)
+	}
+
+	// A leaf that cannot be read ends the iteration with its error.
+	it, err = db.Iterator(key(0), key(4*perDay-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	n := it.c.stack[len(it.c.stack)-2].node
+	n.pointers[len(n.pointers)-1].pos = 1
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Fatal("expected error")
+	}
+}
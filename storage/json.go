@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+)
+
+// importBatchSize is the number of points ImportJSON inserts per batch.
+const importBatchSize = 1000
+
+// jsonPoint is the representation of a point used by ExportJSON and
+// ImportJSON.
+type jsonPoint struct {
+	TS      int64                `json:"ts"`
+	Values  map[string]jsonValue `json:"values"`
+	Expires int64                `json:"expires,omitempty"` // see PutWithTTL
+}
+
+// jsonValue is a value of a jsonPoint. JSON numbers cannot hold NaN or an
+// infinity, so those are written as the strings "NaN", "+Inf" and "-Inf".
+type jsonValue float64
+
+func (v jsonValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(f)
+}
+
+func (v *jsonValue) UnmarshalJSON(data []byte) error {
+	var f float64
+	switch string(data) {
+	case `"NaN"`:
+		f = math.NaN()
+	case `"+Inf"`:
+		f = math.Inf(1)
+	case `"-Inf"`:
+		f = math.Inf(-1)
+	default:
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+	}
+	*v = jsonValue(f)
+	return nil
+}
+
+// ExportJSON writes every point to w in timestamp order, one JSON object
+// per line. The points are streamed from a read-only transaction, so the
+// export is consistent while writes continue. NaN and infinite values are
+// written as the strings "NaN", "+Inf" and "-Inf", and points put with a
+// TTL carry the unixnano time they expire.
+func (db *DB) ExportJSON(w io.Writer) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	enc := json.NewEncoder(w)
+
+	c := tx.Cursor()
+	c.rewind()
+	return c.each(math.MaxInt64, func(point *Point) error {
+		values := make(map[string]jsonValue, len(point.Value))
+		for k, v := range point.Value {
+			values[k] = jsonValue(v)
+		}
+		return enc.Encode(jsonPoint{TS: point.Timestamp, Values: values, Expires: point.expires})
+	})
+}
+
+// ImportJSON reads points written by ExportJSON from r and inserts them in
+// batches, keeping the time the points put with a TTL expire.
+func (db *DB) ImportJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	batch := make([]Point, 0, importBatchSize)
+	for {
+		var p jsonPoint
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		value := make(map[string]float64, len(p.Values))
+		for k, v := range p.Values {
+			value[k] = float64(v)
+		}
+		batch = append(batch, Point{Timestamp: p.TS, Value: value, expires: p.Expires})
+		if len(batch) == importBatchSize {
+			if err := db.putBatch(batch, true); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.putBatch(batch, true)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportJSON(t *testing.T) {
+	src := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	var keys []int64
+	for i := 0; i < 2500; i++ {
+		key := base + int64(i)*int64(7*time.Minute) + int64(i%3)
+		keys = append(keys, key)
+		if i%500 == 0 {
+			if err := src.Put(key, map[string]float64{"open": float64(i), "close": -float64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var points []Point
+	for i, key := range keys {
+		points = append(points, Point{Timestamp: key, Value: map[string]float64{"open": float64(i), "close": -float64(i)}})
+	}
+	if err := src.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != len(keys) {
+		t.Fatalf("exported %d points, want %d", lines, len(keys))
+	}
+	if !strings.HasPrefix(buf.String(), `{"ts":`) {
+		t.Fatalf("unexpected export: %.40s", buf.String())
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i := 0; dec.More(); i++ {
+		var p jsonPoint
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.TS != keys[i] {
+			t.Fatalf("point %d: got ts %d, want %d", i, p.TS, keys[i])
+		}
+	}
+
+	dst := tempDB(t)
+	if err := dst.ImportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		want, err := src.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Value) != 2 || got.Value["open"] != want.Value["open"] || got.Value["close"] != want.Value["close"] {
+			t.Fatalf("key %d: got %v, want %v", key, got.Value, want.Value)
+		}
+	}
+
+	// An empty database exports nothing.
+	buf.Reset()
+	if err := tempDB(t).ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected export: %q", buf.String())
+	}
+}
+
+func TestExportImportJSONNonFinite(t *testing.T) {
+	src := tempDB(t)
+	defer src.Close()
+
+	key := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	value := map[string]float64{"nan": math.NaN(), "inf": math.Inf(1), "-inf": math.Inf(-1), "v": 1.5}
+	if err := src.Put(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"nan":"NaN"`, `"inf":"+Inf"`, `"-inf":"-Inf"`, `"v":1.5`} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("export %q lacks %s", buf.String(), s)
+		}
+	}
+
+	dst := tempDB(t)
+	defer dst.Close()
+	if err := dst.ImportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p, err := dst.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(p.Value["nan"]) || !math.IsInf(p.Value["inf"], 1) || !math.IsInf(p.Value["-inf"], -1) || p.Value["v"] != 1.5 {
+		t.Fatalf("imported %v", p.Value)
+	}
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LoadSorted stores points sorted by timestamp, with no two at the same
+// one, far faster than PutBatch: into an empty database the tree is built
+// bottom-up, every leaf and interior node written once, in order, and the
+// root committed at the end. Into a database already holding points they
+// are put one by one as PutBatch does. Unsorted points, or two at the same
+// timestamp, are rejected with ErrUnsorted, and points without metrics with
+// ErrEmptyValue, before anything is stored, wrapped in an error naming the
+// index of the first offending point. If storing fails none of them are.
+func (db *DB) LoadSorted(points []Point) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	loaded := make([]Point, len(points))
+	for i, point := range points {
+		if i > 0 && point.Timestamp <= points[i-1].Timestamp {
+			return fmt.Errorf("%w: point %d at %d, after %d", ErrUnsorted, i, point.Timestamp, points[i-1].Timestamp)
+		}
+		if err := checkValue(point.Value); err != nil {
+			return fmt.Errorf("point %d: %w", i, err)
+		}
+		loaded[i] = Point{Timestamp: point.Timestamp, Value: db.transformed(point.Value)}
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.root.isLeaf || len(db.root.points) > 0 {
+		for _, point := range loaded {
+			if err := db.putRaw(db.root, point.Timestamp, point.Value, 0); err != nil {
+				db.rollback()
+				return err
+			}
+		}
+	} else if len(loaded) > 0 {
+		// The points are sorted, so they share the bucket of the root if
+		// the first and last do.
+		if level := db.root.level; level != LevelRoot {
+			first, last := NewTime(loaded[0].Timestamp), NewTime(loaded[len(loaded)-1].Timestamp)
+			if first.Timestamp(level) != last.Timestamp(level) {
+				return ErrOutsideRootSpan
+			}
+		}
+		root, err := db.build(db.root.level, loaded)
+		if err != nil {
+			db.rollback()
+			return err
+		}
+		db.root = root
+		db.unexpire(loaded[0].Timestamp)
+		for _, point := range loaded {
+			db.changes.add(point.Timestamp)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// build returns a node of level holding points, which lie in one bucket of
+// level. A leaf is returned if it can hold them all without being
+// expanded, otherwise an interior node whose children are built and
+// flushed in order and left to be read back when needed.
+func (db *DB) build(level uint16, points []Point) (*node, error) {
+	if db.fitsLeaf(level, points) {
+		n := db.newLeafNode()
+		n.level = level
+		for i := range points {
+			n.points = append(n.points, &points[i])
+		}
+		n.resize()
+		return n, nil
+	}
+
+	n := db.newInteriorNode()
+	n.level = level
+	for len(points) > 0 {
+		t := NewTime(points[0].Timestamp)
+		end := t.next(level << 1)
+		i := sort.Search(len(points), func(i int) bool {
+			return points[i].Timestamp >= end
+		})
+
+		child, err := db.build(level<<1, points[:i])
+		if err != nil {
+			return nil, err
+		}
+		np := &nodePointer{key: t.Timestamp(level << 1), pointer: child}
+		np.refresh()
+		if np.pos, err = child.flush(); err != nil {
+			return nil, err
+		}
+		np.pointer = nil
+		n.pointers = append(n.pointers, np)
+		points = points[i:]
+	}
+	return n, nil
+}
+
+// fitsLeaf reports whether a leaf of level can hold points: none of them is
+// finer than the level below it, which a leaf is expanded to hold, and
+// there are not so many of them that it would be expanded as overfull.
+func (db *DB) fitsLeaf(level uint16, points []Point) bool {
+	if level<<1 > LevelNSecond {
+		return true
+	}
+	if len(points) > db.maxLeafPoints {
+		return false
+	}
+	size := 0
+	for i := range points {
+		t := NewTime(points[i].Timestamp)
+		if t.Level() > level<<1 {
+			return false
+		}
+		size += db.pointSize(&points[i])
+	}
+	return db.maxLeafBytes == 0 || size <= db.maxLeafBytes || len(points) <= 1
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sortedPoints returns n points from base, spaced irregularly so they are
+// aligned to anything from the hour down to the nanosecond.
+func sortedPoints(base time.Time, n int) []Point {
+	points := make([]Point, n)
+	ts := base.UnixNano()
+	for i := range points {
+		points[i] = Point{Timestamp: ts, Value: map[string]float64{"a": float64(i), "b": float64(i % 13)}}
+		switch i % 4 {
+		case 0:
+			ts += int64(7 * time.Minute)
+		case 1:
+			ts += int64(3*time.Second + 250*time.Millisecond)
+		case 2:
+			ts += int64(11*time.Second + 17)
+		default:
+			ts += int64(time.Hour) - ts%int64(time.Hour)
+		}
+	}
+	return points
+}
+
+func TestLoadSorted(t *testing.T) {
+	opts := &Options{MaxLeafPoints: 16, MaxLeafBytes: 512}
+	open := func() *DB {
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	points := sortedPoints(time.Date(2016, 12, 30, 0, 0, 0, 0, time.Local), 3000)
+	loaded, put := open(), open()
+	defer put.Close()
+	if err := loaded.LoadSorted(points); err != nil {
+		t.Fatal(err)
+	}
+	if err := put.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	loaded = reopen(t, loaded, opts)
+	defer loaded.Close()
+
+	if errs := loaded.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+	first, last := points[0].Timestamp, points[len(points)-1].Timestamp
+	for _, point := range points[:100] {
+		got, err := loaded.Get(point.Timestamp)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", point.Timestamp, err)
+		}
+		if got.Value["a"] != point.Value["a"] {
+			t.Fatalf("Get(%d) = %v, want %v", point.Timestamp, got.Value, point.Value)
+		}
+	}
+	for _, r := range [][2]int64{{first, last}, {points[100].Timestamp + 1, points[2000].Timestamp}} {
+		want, err := put.Range(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loaded.Range(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Range returned %d points, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Timestamp != want[i].Timestamp || got[i].Value["b"] != want[i].Value["b"] {
+				t.Fatalf("point %d: got %v, want %v", i, got[i], want[i])
+			}
+		}
+	}
+	for _, level := range []uint16{LevelYear, LevelDay, LevelHour, LevelNSecond} {
+		want, err := put.Aggregate(first, last, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loaded.Aggregate(first, last, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, w := range want {
+			if !sameValue(got[k], w) {
+				t.Fatalf("level %#x: metric %s: got %+v, want %+v", level, k, got[k], w)
+			}
+		}
+	}
+
+	// Points into a database that is not empty are put one by one.
+	more := sortedPoints(time.Date(2017, 3, 1, 0, 0, 0, 0, time.Local), 100)
+	if err := loaded.LoadSorted(more); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := loaded.Count(first, more[len(more)-1].Timestamp); err != nil || n != len(points)+len(more) {
+		t.Fatalf("Count = %d, %v, want %d", n, err, len(points)+len(more))
+	}
+
+	for _, tt := range []struct {
+		points []Point
+		index  string
+	}{
+		{[]Point{points[1], points[0]}, "point 1 "},
+		{[]Point{points[0], points[1], points[1]}, "point 2 "},
+	} {
+		err := loaded.LoadSorted(tt.points)
+		if !errors.Is(err, ErrUnsorted) || !strings.Contains(err.Error(), tt.index) {
+			t.Fatalf("LoadSorted of unsorted points: %v, want ErrUnsorted at %s", err, tt.index)
+		}
+	}
+	empty := []Point{points[0], {Timestamp: points[1].Timestamp}}
+	if err := loaded.LoadSorted(empty); !errors.Is(err, ErrEmptyValue) || !strings.Contains(err.Error(), "point 1:") {
+		t.Fatalf("LoadSorted of an empty point: %v", err)
+	}
+}
+
+func BenchmarkLoadSorted(b *testing.B) {
+	for _, name := range []string{"PutBatch", "LoadSorted"} {
+		b.Run(name, func(b *testing.B) {
+			points := sortedPoints(time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local), 20000)
+			for i := 0; i < b.N; i++ {
+				db, err := Open(filepath.Join(b.TempDir(), fmt.Sprint("db", i)), 0600)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if name == "PutBatch" {
+					err = db.PutBatch(points)
+				} else {
+					err = db.LoadSorted(points)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+func TestLoadSortedTransform(t *testing.T) {
+	opts := &Options{
+		MaxLeafPoints: DefaultMaxLeafPoints,
+		Transform:     func(metric string, v float64) float64 { return v * 10 },
+	}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Loaded into an empty database and into one holding points, every
+	// value is transformed once.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 2; i++ {
+		key := base.Add(time.Duration(i) * time.Hour).UnixNano()
+		if err := db.LoadSorted([]Point{{Timestamp: key, Value: map[string]float64{"v": 1}}}); err != nil {
+			t.Fatal(err)
+		}
+		p, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Value["v"] != 10 {
+			t.Fatalf("load %d: stored %v, want 10", i, p.Value["v"])
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package storage
+
+import "math"
+
+// Merge inserts every point of other into db, in batches of
+// importBatchSize. A point at a timestamp db already holds is stored
+// according to Options.MergeOnDuplicate of db, and a point put with a TTL
+// keeps the time it expires. Each batch is committed on its own, so an
+// error can leave the points of earlier batches merged.
+func (db *DB) Merge(other *DB) error {
+	batch := make([]Point, 0, importBatchSize)
+	err := other.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.rewind()
+		return c.each(math.MaxInt64, func(point *Point) error {
+			batch = append(batch, Point{Timestamp: point.Timestamp, Value: point.Value, expires: point.expires})
+			if len(batch) < importBatchSize {
+				return nil
+			}
+			err := db.putBatch(batch, true)
+			batch = batch[:0]
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.putBatch(batch, true)
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 {
+		return base.Add(time.Duration(i) * 11 * time.Minute).UnixNano()
+	}
+
+	// a holds 0..1499, b holds 1000..2999: 500 keys collide.
+	fill := func(db *DB, from, to int, value func(i int) map[string]float64) {
+		var points []Point
+		for i := from; i < to; i++ {
+			points = append(points, Point{Timestamp: key(i), Value: value(i)})
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromA := func(i int) map[string]float64 { return map[string]float64{"a": 1, "v": 1} }
+	fromB := func(i int) map[string]float64 { return map[string]float64{"b": 1, "v": 2} }
+
+	for _, merge := range []bool{false, true} {
+		opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, MergeOnDuplicate: merge}
+		a, err := OpenWithOptions(filepath.Join(t.TempDir(), "a"), 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := tempDB(t)
+		fill(a, 0, 1500, fromA)
+		fill(b, 1000, 3000, fromB)
+
+		if err := a.Merge(b); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := a.Count(key(0), key(2999)); err != nil {
+			t.Fatal(err)
+		} else if n != 3000 {
+			t.Fatalf("merge=%v: got %d points, want 3000", merge, n)
+		}
+
+		// Colliding keys take v from b either way, and keep a only when
+		// merging.
+		wantA := 1000
+		if merge {
+			wantA = 1500
+		}
+		value, err := a.Aggregate(key(0), key(2999), LevelRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := value["a"].Count(); got != wantA {
+			t.Fatalf("merge=%v: got %d points with a, want %d", merge, got, wantA)
+		}
+		if got := value["b"].Count(); got != 2000 {
+			t.Fatalf("merge=%v: got %d points with b, want 2000", merge, got)
+		}
+		if got, want := value["v"].Sum(), float64(1000*1+2000*2); got != want {
+			t.Fatalf("merge=%v: got sum of v %v, want %v", merge, got, want)
+		}
+		if v := a.root.reduce()["v"]; v.Sum() != value["v"].Sum() {
+			t.Fatalf("merge=%v: root holds sum %v, want %v", merge, v.Sum(), value["v"].Sum())
+		}
+
+		// b is left as it was.
+		if n, err := b.Count(key(0), key(2999)); err != nil {
+			t.Fatal(err)
+		} else if n != 2000 {
+			t.Fatalf("got %d points in b, want 2000", n)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"sync/atomic"
+)
+
+// Metrics holds counters of the work a database has done since it was
+// opened, for monitoring. They only ever grow.
+type Metrics struct {
+	// Puts, Gets and Ranges count the calls to Put, Get, and Range or
+	// RangeContext, whether they succeed or not.
+	Puts   uint64
+	Gets   uint64
+	Ranges uint64
+
+	// CacheHits and CacheMisses count the nodes read from the node cache
+	// and from the file. Both stay zero if Options.MaxCachedNodes is zero.
+	CacheHits   uint64
+	CacheMisses uint64
+
+	// QueryCacheHits and QueryCacheMisses count the calls to Aggregate
+	// answered from the query cache and not. Both stay zero if
+	// Options.QueryCacheSize is zero.
+	QueryCacheHits   uint64
+	QueryCacheMisses uint64
+
+	// ChunksWritten counts the chunks appended to the file, nodes and
+	// series registries, and the meta and its copy.
+	ChunksWritten uint64
+
+	// BytesSynced counts the bytes written to the file and then synced.
+	BytesSynced uint64
+}
+
+// counters are the atomic counters behind Metrics, updated on the hot
+// paths without taking a lock.
+type counters struct {
+	puts             atomic.Uint64
+	gets             atomic.Uint64
+	ranges           atomic.Uint64
+	cacheHits        atomic.Uint64
+	cacheMisses      atomic.Uint64
+	queryCacheHits   atomic.Uint64
+	queryCacheMisses atomic.Uint64
+	chunksWritten    atomic.Uint64
+	tailAppends      atomic.Uint64 // puts that took appendTail, for tests
+}
+
+// Metrics returns the counters of the database.
+func (db *DB) Metrics() Metrics {
+	return Metrics{
+		Puts:             db.counters.puts.Load(),
+		Gets:             db.counters.gets.Load(),
+		Ranges:           db.counters.ranges.Load(),
+		CacheHits:        db.counters.cacheHits.Load(),
+		CacheMisses:      db.counters.cacheMisses.Load(),
+		QueryCacheHits:   db.counters.queryCacheHits.Load(),
+		QueryCacheMisses: db.counters.queryCacheMisses.Load(),
+		ChunksWritten:    db.counters.chunksWritten.Load(),
+		BytesSynced:      db.ops.synced.Load(),
+	}
+}
+
+// MemoryUsage returns the bytes of the chunks in the node cache, counted
+// as they are cached and evicted rather than by walking anything. It
+// leaves out the decoded nodes of the tree in memory, the query cache and
+// the series registry, so the database holds more than it reports.
+func (db *DB) MemoryUsage() int64 {
+	return db.cache.size()
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// Creating the file wrote its first chunks.
+	created := db.Metrics().ChunksWritten
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		if err := db.Put(base.Add(time.Duration(i)*time.Minute).UnixNano(), map[string]float64{"v": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := db.Metrics()
+	if m.Puts != 3 {
+		t.Fatalf("Puts = %d, want 3", m.Puts)
+	}
+	// Every flush writes at least the root, the meta and its copy.
+	if m.ChunksWritten-created < 9 {
+		t.Fatalf("ChunksWritten = %d after creating %d, want at least 9 more", m.ChunksWritten, created)
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.BytesSynced < uint64(stats.FileSize-int64(MetaSize)) {
+		t.Fatalf("BytesSynced = %d, want at least %d", m.BytesSynced, stats.FileSize-int64(MetaSize))
+	}
+
+	// The first reads of the tree miss the cache, the same reads again hit.
+	if _, err := db.Get(base.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	misses := db.Metrics().CacheMisses
+	if misses == 0 {
+		t.Fatal("no cache misses")
+	}
+	if _, err := db.Get(base.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(base.Add(time.Second).UnixNano()); err != ErrNotFound {
+		t.Fatalf("Get: %v, want ErrNotFound", err)
+	}
+	if _, err := db.Range(base.UnixNano(), base.Add(time.Hour).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	m = db.Metrics()
+	if m.Gets != 3 || m.Ranges != 1 {
+		t.Fatalf("Gets = %d, Ranges = %d, want 3 and 1", m.Gets, m.Ranges)
+	}
+	if m.CacheMisses != misses || m.CacheHits == 0 {
+		t.Fatalf("CacheHits = %d, CacheMisses = %d, want hits and %d misses", m.CacheHits, m.CacheMisses, misses)
+	}
+}
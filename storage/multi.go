@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"container/heap"
+)
+
+// MultiDB reads several database files as one, such as an archive kept as
+// a file per day. The files are opened read-only and may overlap: points at
+// the same timestamp in several of them are merged into one.
+type MultiDB struct {
+	dbs []*DB // in the order of the paths given
+}
+
+// OpenMulti opens the databases at paths read-only. If one fails to open
+// the ones opened already are closed.
+func OpenMulti(paths []string) (*MultiDB, error) {
+	m := &MultiDB{}
+	for _, path := range paths {
+		db, err := OpenWithOptions(path, 0, &Options{
+			MaxLeafPoints:  DefaultMaxLeafPoints,
+			MaxCachedNodes: DefaultMaxCachedNodes,
+			ReadOnly:       true,
+		})
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.dbs = append(m.dbs, db)
+	}
+	return m, nil
+}
+
+// Close closes every database, returning the first error.
+func (m *MultiDB) Close() error {
+	var err error
+	for _, db := range m.dbs {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	m.dbs = nil
+	return err
+}
+
+// Range returns the points of every database between start and end
+// inclusive, ordered by timestamp, see MultiIterator.
+func (m *MultiDB) Range(start, end int64) ([]Point, error) {
+	it, err := m.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	points := make([]Point, 0)
+	for it.Next() {
+		points = append(points, it.Point())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// Iterator returns an iterator over the points of every database between
+// start and end inclusive.
+func (m *MultiDB) Iterator(start, end int64) (*MultiIterator, error) {
+	it := &MultiIterator{}
+	for i, db := range m.dbs {
+		dbit, err := db.Iterator(start, end)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, &multiSource{it: dbit, index: i})
+	}
+	return it, nil
+}
+
+// MultiIterator steps through the points of several databases in timestamp
+// order, merging the iterators of each as it goes, so it holds a leaf of
+// points per database at most. Points at the same timestamp are merged into
+// one, the value of a metric held by several coming from the database
+// given last.
+type MultiIterator struct {
+	sources []*multiSource // every iterator, closed with the MultiIterator
+	heap    multiHeap      // the iterators not done, by their point
+	point   Point
+	started bool
+	err     error
+}
+
+// multiSource is the iterator of one database and the point it is at.
+type multiSource struct {
+	it    *Iterator
+	index int // of the database, ordering points at the same timestamp
+	point Point
+}
+
+// Next moves to the next point and reports whether there is one. Once it
+// returns false the iterator is closed, Err tells whether it ran out of
+// points or failed.
+func (it *MultiIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		for _, s := range it.sources {
+			it.advance(s)
+		}
+	}
+	if it.err != nil || len(it.heap) == 0 {
+		it.point = Point{}
+		it.Close()
+		return false
+	}
+
+	s := heap.Pop(&it.heap).(*multiSource)
+	it.point = s.point
+	merged := false
+	for len(it.heap) > 0 && it.heap[0].point.Timestamp == it.point.Timestamp {
+		next := heap.Pop(&it.heap).(*multiSource)
+		if !merged {
+			it.point.Value = copyMetrics(it.point.Value)
+			merged = true
+		}
+		for k, v := range next.point.Value {
+			it.point.Value[k] = v
+		}
+		it.advance(next)
+	}
+	it.advance(s)
+	if it.err != nil {
+		it.point = Point{}
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// advance moves s to its next point, pushing it back on the heap if there
+// is one.
+func (it *MultiIterator) advance(s *multiSource) {
+	if !s.it.Next() {
+		if err := s.it.Err(); err != nil && it.err == nil {
+			it.err = err
+		}
+		return
+	}
+	s.point = s.it.Point()
+	heap.Push(&it.heap, s)
+}
+
+// Point returns the point Next moved to. Its value must not be modified.
+func (it *MultiIterator) Point() Point {
+	return it.point
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *MultiIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterators of every database. It is safe to call more
+// than once.
+func (it *MultiIterator) Close() error {
+	var err error
+	for _, s := range it.sources {
+		if e := s.it.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	it.heap = nil
+	return err
+}
+
+// multiHeap orders sources by the timestamp of their point, then by the
+// order of their database.
+type multiHeap []*multiSource
+
+func (h multiHeap) Len() int { return len(h) }
+
+func (h multiHeap) Less(i, j int) bool {
+	if h[i].point.Timestamp != h[j].point.Timestamp {
+		return h[i].point.Timestamp < h[j].point.Timestamp
+	}
+	return h[i].index < h[j].index
+}
+
+func (h multiHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *multiHeap) Push(x interface{}) { *h = append(*h, x.(*multiSource)) }
+
+func (h *multiHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// copyMetrics returns a copy of value, so merging into it leaves the
+// point of the database alone.
+func copyMetrics(value map[string]float64) map[string]float64 {
+	out := make(map[string]float64, len(value))
+	for k, v := range value {
+		out[k] = v
+	}
+	return out
+}
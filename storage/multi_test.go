@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMulti(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(m int) int64 { return base.Add(time.Duration(m) * time.Minute).UnixNano() }
+
+	// a covers the first hour and b the second, adjacent to it. c overlaps
+	// both from half past, with a metric of its own and one of a's.
+	files := []struct {
+		name     string
+		from, to int
+		value    func(m int) map[string]float64
+	}{
+		{"a", 0, 60, func(m int) map[string]float64 { return map[string]float64{"x": float64(m)} }},
+		{"b", 60, 120, func(m int) map[string]float64 { return map[string]float64{"y": float64(m)} }},
+		{"c", 30, 90, func(m int) map[string]float64 { return map[string]float64{"x": -1, "z": float64(m)} }},
+	}
+	want := make(map[int64]map[string]float64)
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		db, err := Open(path, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var points []Point
+		for m := f.from; m < f.to; m++ {
+			points = append(points, Point{Timestamp: key(m), Value: f.value(m)})
+			if want[key(m)] == nil {
+				want[key(m)] = make(map[string]float64)
+			}
+			for k, v := range f.value(m) {
+				want[key(m)][k] = v
+			}
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	m, err := OpenMulti(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, r := range [][2]int{{0, 119}, {25, 65}, {59, 60}, {100, 200}, {10, 5}} {
+		points, err := m.Range(key(r[0]), key(r[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for i := r[0]; i <= r[1] && i < 120; i++ {
+			n++
+		}
+		if len(points) != n {
+			t.Fatalf("%v: %d points, want %d", r, len(points), n)
+		}
+		for i, p := range points {
+			if p.Timestamp != key(r[0]+i) {
+				t.Fatalf("%v: point %d at %d, want %d", r, i, p.Timestamp, key(r[0]+i))
+			}
+			if !reflect.DeepEqual(p.Value, want[p.Timestamp]) {
+				t.Fatalf("%v: point %d = %v, want %v", r, i, p.Value, want[p.Timestamp])
+			}
+		}
+	}
+
+	// Merging leaves the points of the databases alone.
+	points, err := m.dbs[0].Range(key(40), key(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(points[0].Value, map[string]float64{"x": 40}) {
+		t.Fatalf("a holds %v at 40 after merging", points[0].Value)
+	}
+
+	// A file that cannot be opened closes the ones opened before it, so
+	// they can be opened for writing again.
+	if _, err := OpenMulti([]string{paths[0], filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("OpenMulti of a missing file succeeded")
+	}
+	m.Close()
+	db, err := OpenWithOptions(paths[0], 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
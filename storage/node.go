@@ -2,6 +2,9 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
+	"runtime"
 	"sort"
 )
 
@@ -17,12 +20,60 @@ const (
 	LevelUSecond = 0x0100
 	LevelNSecond = 0x0200
 
-	LevelFlag         = 0x0FFF
+	// levelPoint makes a cursor descend all the way down to leaf points.
+	levelPoint = LevelNSecond << 1
+
+	LevelFlag         = 0x07FF
 	LeafFlag          = 0x3000
 	InteriorChunkFlag = 0x1000
 	LeafChunkFlag     = 0x2000
+
+	// VersionedChunkFlag, marking a chunk as both kinds, starts the header
+	// of node chunks: the flag, a version byte, a byte of header flags and
+	// the 32-bit length of the node encoded after it. Chunks without a
+	// header are version 1.
+	VersionedChunkFlag = 0x3000
+
+	// WideChunkFlag marks interior chunks storing the length of every
+	// pointer as a uvarint and the counts of values as 32 bits. Older
+	// chunks store both in 16 bits.
+	WideChunkFlag = 0x0800
+
+	// CountedChunkFlag marks interior chunks whose pointers carry the
+	// number of points below them. Older chunks lack the count.
+	CountedChunkFlag = 0x4000
+
+	// DeltaChunkFlag marks leaf chunks storing the first timestamp once
+	// and every following one as a varint delta from the previous. Older
+	// leaves store every timestamp in full.
+	DeltaChunkFlag = 0x8000
 )
 
+// The header flags of versioned node chunks, in their own byte so none
+// shares a bit of the flags of the node.
+const (
+	// HistogramChunkFlag marks interior chunks whose values are followed
+	// by their histogram.
+	HistogramChunkFlag = 0x01
+
+	// ExpiryChunkFlag marks delta leaf chunks storing after every timestamp
+	// the varint time its point expires, zero if it never does.
+	ExpiryChunkFlag = 0x02
+
+	// ValueDeltaChunkFlag marks delta leaf chunks storing every value as a
+	// delta from the previous value of its metric in the leaf, see
+	// Options.DeltaValues.
+	ValueDeltaChunkFlag = 0x04
+)
+
+// headerlessHistogramFlag marked interior chunks written without a header
+// whose values are followed by their histogram.
+const headerlessHistogramFlag = 0x8000
+
+// DefaultMaxLeafPoints is the default number of points a leaf holds before
+// it is expanded into sub-leaves one level finer.
+const DefaultMaxLeafPoints = 128
+
 // node represents an in-memory, deserialized page.
 type node struct {
 	db     *DB
@@ -34,24 +85,164 @@ type node struct {
 	dirty    int            // the dirty node will be flushed
 	pointers []*nodePointer // interior nodes will have this
 	points   []*Point       // leaf nodes will have this
+	size     int            // estimated encoded size of a leaf, see resize
 }
 
+// Value is the reduction of the values of a metric over a range of points.
+//
+// NaN values are left out of the sum, the extremes, the count and the
+// histogram, but are kept as the first or last value when they are. The
+// extremes of values that are all NaN are NaN, and their sum is zero.
+// Infinities are ordinary values: they are counted and can be the extremes,
+// and they turn the sum infinite, or NaN once both signs were added.
 type Value struct {
 	sum   float64
 	max   float64
 	min   float64
 	first float64
 	last  float64
-	count uint16
+	count uint32
+
+	// The histogram of the values, nil in both forms if some of them were
+	// reduced without one. Values read from a chunk keep it encoded until
+	// it is needed.
+	hist      *histogram
+	histBytes []byte
+}
+
+// Sum returns the sum of the values.
+func (v Value) Sum() float64 { return v.sum }
+
+// Max returns the largest value.
+func (v Value) Max() float64 { return v.max }
+
+// Min returns the smallest value.
+func (v Value) Min() float64 { return v.min }
+
+// First returns the earliest value.
+func (v Value) First() float64 { return v.first }
+
+// Last returns the latest value.
+func (v Value) Last() float64 { return v.last }
+
+// Count returns the number of values, leaving out NaN.
+func (v Value) Count() int { return int(v.count) }
+
+// Quantile returns the value below which a fraction q of the values lie,
+// within a relative error of 2%. ok is false if v was reduced from chunks
+// written without a histogram.
+func (v Value) Quantile(q float64) (f float64, ok bool) {
+	h := v.histogram()
+	if h == nil {
+		return 0, false
+	}
+	switch {
+	case q <= 0:
+		return v.min, true
+	case q >= 1:
+		return v.max, true
+	}
+	return math.Max(v.min, math.Min(v.max, h.quantile(q))), true
+}
+
+// histogram returns the histogram of v, decoding it if needed.
+func (v *Value) histogram() *histogram {
+	if v.hist == nil && v.histBytes != nil {
+		// The bytes were checked by histogramSize when they were read.
+		v.hist, _, _ = decodeHistogram(v.histBytes)
+		v.histBytes = nil
+	}
+	return v.hist
+}
+
+func (v *Value) hasHistogram() bool {
+	return v.hist != nil || v.histBytes != nil
+}
+
+// add folds the value f of a point, which must be later than the values in
+// v, into v.
+func (v *Value) add(f float64) {
+	if v.empty() {
+		*v = Value{max: math.NaN(), min: math.NaN(), first: f, hist: newHistogram()}
+	}
+	v.last = f
+	if math.IsNaN(f) {
+		return
+	}
+	if v.count == 0 || f > v.max {
+		v.max = f
+	}
+	if v.count == 0 || f < v.min {
+		v.min = f
+	}
+	v.sum += f
+	v.count++
+	if v.hist != nil {
+		v.hist.add(f)
+	}
+}
+
+// empty reports whether no value, not even NaN, was folded into v.
+func (v *Value) empty() bool {
+	return v.count == 0 && !math.IsNaN(v.first)
+}
+
+// merge folds o, which must be later than v, into v. The histogram of o is
+// copied, never shared.
+func (v *Value) merge(o Value) {
+	if o.empty() {
+		return
+	}
+	if v.empty() {
+		*v = o
+		if o.hist != nil {
+			v.hist = o.hist.clone()
+		}
+		return
+	}
+	if v.hasHistogram() && o.hasHistogram() {
+		v.histogram().merge(o.histogram())
+	} else {
+		v.hist, v.histBytes = nil, nil
+	}
+	if o.count > 0 {
+		if v.count == 0 || o.max > v.max {
+			v.max = o.max
+		}
+		if v.count == 0 || o.min < v.min {
+			v.min = o.min
+		}
+	}
+	v.sum += o.sum
+	v.last = o.last
+	v.count += o.count
 }
 
 type nodePointer struct {
 	key     int64
 	pos     int64
+	count   int64 // number of points below, -1 if unknown
 	pointer *node
 	value   map[string]Value
 }
 
+// lacksHistogram reports whether a value of the child in set was reduced
+// without a histogram.
+func (np *nodePointer) lacksHistogram(set metricSet) bool {
+	for k, v := range np.value {
+		if set.has(k) && !v.hasHistogram() {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh recomputes the reduced value and point count of the child.
+func (np *nodePointer) refresh() {
+	np.value = np.pointer.reduce()
+	np.count = np.pointer.count()
+}
+
 func (v *Value) encode() []byte {
 	buf := new(bytes.Buffer)
 	buf.Write(encodeFloat64(v.sum))
@@ -59,18 +250,31 @@ func (v *Value) encode() []byte {
 	buf.Write(encodeFloat64(v.min))
 	buf.Write(encodeFloat64(v.first))
 	buf.Write(encodeFloat64(v.last))
-	buf.Write(encodeUint16(v.count))
+	buf.Write(encodeUint32(v.count))
 	return buf.Bytes()
 }
 
-func decodeValue(valueBytes []byte) Value {
+// valueSize returns the length of an encoded Value, the count taking 32
+// bits if wide is set and 16 otherwise.
+func valueSize(wide bool) int {
+	if wide {
+		return 44
+	}
+	return 42
+}
+
+func decodeValue(valueBytes []byte, wide bool) Value {
 	v := Value{}
 	v.sum = decodeFloat64(valueBytes[0:8])
 	v.max = decodeFloat64(valueBytes[8:16])
 	v.min = decodeFloat64(valueBytes[16:24])
 	v.first = decodeFloat64(valueBytes[24:32])
 	v.last = decodeFloat64(valueBytes[32:40])
-	v.count = decodeUint16(valueBytes[40:42])
+	if wide {
+		v.count = decodeUint32(valueBytes[40:44])
+	} else {
+		v.count = uint32(decodeUint16(valueBytes[40:42]))
+	}
 	return v
 }
 
@@ -78,71 +282,198 @@ func (np *nodePointer) encode() []byte {
 	buf := new(bytes.Buffer)
 	buf.Write(encodeInt64(np.key))
 	buf.Write(encodeInt64(np.pos))
+	buf.Write(encodeInt64(np.count))
 	for k, v := range np.value {
 		keyBytes := []byte(k)
 		buf.Write(encodeUint16(uint16(len(keyBytes))))
 		buf.Write(keyBytes)
 		buf.Write(v.encode())
+		buf.Write(v.encodeHistogram())
 	}
 	return buf.Bytes()
 }
 
-func decodeNodePointer(npBytes []byte) (*nodePointer, error) {
-	np := &nodePointer{}
+// decodeNodePointer decodes an encoded pointer, keeping only the values of
+// the metrics in set.
+func decodeNodePointer(npBytes []byte, counted, hist, wide bool, set metricSet) (*nodePointer, error) {
+	if len(npBytes) < 16 || counted && len(npBytes) < 24 {
+		return nil, ErrInvalid
+	}
+	np := &nodePointer{count: -1}
 	np.key = decodeInt64(npBytes[0:8])
 	np.pos = decodeInt64(npBytes[8:16])
 
 	np.value = make(map[string]Value)
 	bufPos := 16
+	if counted {
+		np.count = decodeInt64(npBytes[16:24])
+		bufPos = 24
+	}
+	size := valueSize(wide)
 	for bufPos < len(npBytes) {
+		if len(npBytes)-bufPos < 2 {
+			return nil, ErrInvalid
+		}
 		keyLength := int(decodeUint16(npBytes[bufPos : bufPos+2]))
 		bufPos += 2
-		key := string(npBytes[bufPos : bufPos+keyLength])
+		if len(npBytes)-bufPos < keyLength+size {
+			return nil, ErrInvalid
+		}
+		keyBytes := npBytes[bufPos : bufPos+keyLength]
 		bufPos += keyLength
-		value := decodeValue(npBytes[bufPos : bufPos+42])
-		bufPos += 42
-		np.value[key] = value
+		valueBytes := npBytes[bufPos : bufPos+size]
+		bufPos += size
+		var histBytes []byte
+		if hist {
+			size, err := histogramSize(npBytes[bufPos:])
+			if err != nil {
+				return nil, err
+			}
+			if size > 1 {
+				histBytes = npBytes[bufPos : bufPos+size]
+			}
+			bufPos += size
+		}
+		if set != nil {
+			// Looked up without converting keyBytes to a string first, so
+			// the metrics skipped allocate nothing.
+			if _, ok := set[string(keyBytes)]; !ok {
+				continue
+			}
+		}
+		value := decodeValue(valueBytes, wide)
+		value.histBytes = histBytes
+		np.value[string(keyBytes)] = value
 	}
 
 	return np, nil
 }
 
+// ChunkVersion is the format version of the node chunks written. Chunks
+// without a header are version 1.
+const ChunkVersion = 2
+
+// chunkHeaderSize is the length of the header of a versioned node chunk.
+const chunkHeaderSize = 8
+
 func (n *node) encode() []byte {
 	buf := new(bytes.Buffer)
+	buf.Write(encodeUint16(VersionedChunkFlag))
+	buf.WriteByte(ChunkVersion)
+	buf.WriteByte(0)           // the header flags, set once they are known
+	buf.Write(encodeUint32(0)) // the length, set once it is known
+	var hflags byte
 	if n.isLeaf {
-		buf.Write(encodeUint16(n.level | LeafChunkFlag))
+		expiry := false
 		for _, point := range n.points {
-			pointBytes := point.encode()
-			buf.Write(encodeUint16(uint16(len(pointBytes))))
-			buf.Write(pointBytes)
+			expiry = expiry || point.expires != 0
+		}
+		if expiry {
+			hflags |= ExpiryChunkFlag
+		}
+		var values map[string]float64 // previous value of every metric
+		if n.db.deltaValues {
+			hflags |= ValueDeltaChunkFlag
+			values = make(map[string]float64)
+		}
+		buf.Write(encodeUint16(n.level | LeafChunkFlag | DeltaChunkFlag))
+		var prev int64
+		for i, point := range n.points {
+			if i == 0 {
+				buf.Write(encodeVarint(point.Timestamp))
+			} else {
+				buf.Write(encodeUvarint(uint64(point.Timestamp - prev)))
+			}
+			prev = point.Timestamp
+			if expiry {
+				buf.Write(encodeVarint(point.expires))
+			}
+
+			var valueBytes []byte
+			if values != nil {
+				valueBytes = point.encodeDeltaMetrics(values)
+			} else {
+				valueBytes = point.encodeMetrics()
+			}
+			buf.Write(encodeUvarint(uint64(len(valueBytes))))
+			buf.Write(valueBytes)
 		}
 	} else {
-		buf.Write(encodeUint16(n.level | InteriorChunkFlag))
+		hflags |= HistogramChunkFlag
+		buf.Write(encodeUint16(n.level | InteriorChunkFlag | CountedChunkFlag | WideChunkFlag))
 		for _, pointer := range n.pointers {
 			pointerBytes := pointer.encode()
-			buf.Write(encodeUint16(uint16(len(pointerBytes))))
+			buf.Write(encodeUvarint(uint64(len(pointerBytes))))
 			buf.Write(pointerBytes)
 		}
 	}
-	return buf.Bytes()
+	b := buf.Bytes()
+	b[3] = hflags
+	copy(b[4:chunkHeaderSize], encodeUint32(uint32(len(b)-chunkHeaderSize)))
+	return b
+}
+
+// chunkNode returns the node encoded in the data of a node chunk, after
+// its header if it has one, and the header flags. A chunk without a header
+// gets the flags its node flags stand for. It returns ErrVersionMismatch
+// for a version it cannot decode.
+func chunkNode(nodeBytes []byte) ([]byte, byte, error) {
+	if len(nodeBytes) < 2 {
+		return nil, 0, ErrInvalid
+	}
+	if flags := decodeUint16(nodeBytes[0:2]); flags&LeafFlag != VersionedChunkFlag {
+		var hflags byte
+		if flags&LeafFlag == InteriorChunkFlag && flags&headerlessHistogramFlag != 0 {
+			hflags = HistogramChunkFlag
+		}
+		return nodeBytes, hflags, nil
+	}
+	if len(nodeBytes) < chunkHeaderSize {
+		return nil, 0, ErrInvalid
+	}
+	if nodeBytes[2] != ChunkVersion {
+		return nil, 0, ErrVersionMismatch
+	}
+	length := decodeUint32(nodeBytes[4:chunkHeaderSize])
+	if uint64(length) > uint64(len(nodeBytes)-chunkHeaderSize) || length < 2 {
+		return nil, 0, ErrInvalid
+	}
+	return nodeBytes[chunkHeaderSize : chunkHeaderSize+int(length)], nodeBytes[3], nil
 }
 
 func (db *DB) decodeNode(nodeBytes []byte) (*node, error) {
+	nodeBytes, hflags, err := chunkNode(nodeBytes)
+	if err != nil {
+		return nil, err
+	}
 	flags := decodeUint16(nodeBytes[0:2])
 	if flags&LeafFlag == LeafChunkFlag {
-		return db.decodeLeafNode(nodeBytes)
+		return db.decodeLeafNode(nodeBytes, hflags)
 	}
-	return db.decodeInteriorNode(nodeBytes)
+	return db.decodeInteriorNode(nodeBytes, hflags)
 }
 
-func (db *DB) decodeLeafNode(nodeBytes []byte) (*node, error) {
+// decodeLeafNode decodes the node of a leaf chunk with the header flags
+// hflags.
+func (db *DB) decodeLeafNode(nodeBytes []byte, hflags byte) (*node, error) {
+	flags := decodeUint16(nodeBytes[0:2])
+	if flags&DeltaChunkFlag != 0 {
+		return db.decodeDeltaLeafNode(nodeBytes, hflags)
+	}
+
 	n := db.newLeafNode()
-	n.level = decodeUint16(nodeBytes[0:2]) & LevelFlag
+	n.level = flags & LevelFlag
 
 	bufPos := 2
 	for bufPos < len(nodeBytes) {
+		if len(nodeBytes)-bufPos < 2 {
+			return nil, ErrInvalid
+		}
 		pointLength := int(decodeUint16(nodeBytes[bufPos : bufPos+2]))
 		bufPos += 2
+		if len(nodeBytes)-bufPos < pointLength {
+			return nil, ErrInvalid
+		}
 		point, err := decodePoint(nodeBytes[bufPos : bufPos+pointLength])
 		if err != nil {
 			return nil, err
@@ -150,27 +481,163 @@ func (db *DB) decodeLeafNode(nodeBytes []byte) (*node, error) {
 		bufPos += pointLength
 		n.points = append(n.points, point)
 	}
+	n.resize()
 	return n, nil
 }
 
-func (db *DB) decodeInteriorNode(nodeBytes []byte) (*node, error) {
-	n := db.newInteriorNode()
-	n.level = decodeUint16(nodeBytes[0:2]) & LevelFlag
+func (db *DB) decodeDeltaLeafNode(nodeBytes []byte, hflags byte) (*node, error) {
+	n := db.newLeafNode()
+	flags := decodeUint16(nodeBytes[0:2])
+	n.level = flags & LevelFlag
+	expiry := hflags&ExpiryChunkFlag != 0
+	var values map[string]float64 // previous value of every metric
+	if hflags&ValueDeltaChunkFlag != 0 {
+		values = make(map[string]float64)
+	}
 
 	bufPos := 2
+	var ts int64
 	for bufPos < len(nodeBytes) {
-		pointerLength := int(decodeUint16(nodeBytes[bufPos : bufPos+2]))
-		bufPos += 2
-		pointer, err := decodeNodePointer(nodeBytes[bufPos : bufPos+pointerLength])
+		if len(n.points) == 0 {
+			v, size := binary.Varint(nodeBytes[bufPos:])
+			if size <= 0 {
+				return nil, ErrInvalid
+			}
+			ts = v
+			bufPos += size
+		} else {
+			delta, size := binary.Uvarint(nodeBytes[bufPos:])
+			if size <= 0 {
+				return nil, ErrInvalid
+			}
+			ts += int64(delta)
+			bufPos += size
+		}
+		var expires int64
+		if expiry {
+			v, size := binary.Varint(nodeBytes[bufPos:])
+			if size <= 0 {
+				return nil, ErrInvalid
+			}
+			expires = v
+			bufPos += size
+		}
+
+		length, size := binary.Uvarint(nodeBytes[bufPos:])
+		if size <= 0 || uint64(len(nodeBytes)-bufPos-size) < length {
+			return nil, ErrInvalid
+		}
+		bufPos += size
+
+		var value map[string]float64
+		var err error
+		if values != nil {
+			value, err = decodeDeltaMetrics(nodeBytes[bufPos:bufPos+int(length)], values)
+		} else {
+			value, err = decodeMetrics(nodeBytes[bufPos : bufPos+int(length)])
+		}
+		if err != nil {
+			return nil, err
+		}
+		point := &Point{Timestamp: ts, Value: value, expires: expires}
+		bufPos += int(length)
+		n.points = append(n.points, point)
+	}
+	n.resize()
+	return n, nil
+}
+
+func (db *DB) decodeInteriorNode(nodeBytes []byte, hflags byte) (*node, error) {
+	return db.decodeInteriorRange(nodeBytes, hflags, math.MinInt64, math.MaxInt64, nil)
+}
+
+// decodeInteriorRange decodes an interior node for a query of the metrics
+// in set between from and to inclusive. The pointers to children lying
+// outside the range are skipped, and only the values of the metrics in set
+// are decoded, so a node holding many pointers or metrics costs little for
+// a narrow query. The node returned must not be written.
+func (db *DB) decodeInteriorRange(nodeBytes []byte, hflags byte, from, to int64, set metricSet) (*node, error) {
+	n := db.newInteriorNode()
+	c := newInteriorChunk(nodeBytes, hflags)
+	n.level = c.level
+	level := n.level << 1
+	for c.more() {
+		pointerBytes, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if len(pointerBytes) < 8 {
+			return nil, ErrInvalid
+		}
+		key := decodeInt64(pointerBytes[0:8])
+		if key > to {
+			break
+		}
+		if from != math.MinInt64 {
+			if bucket := NewTime(key); bucket.next(level) <= from {
+				continue
+			}
+		}
+		pointer, err := decodeNodePointer(pointerBytes, c.counted, c.hist, c.wide, set)
 		if err != nil {
 			return nil, err
 		}
-		bufPos += pointerLength
 		n.pointers = append(n.pointers, pointer)
 	}
 	return n, nil
 }
 
+// interiorChunk reads the encoded pointers of an interior node one at a
+// time.
+type interiorChunk struct {
+	level               uint16
+	counted, hist, wide bool
+	data                []byte
+	pos                 int
+}
+
+func newInteriorChunk(nodeBytes []byte, hflags byte) *interiorChunk {
+	flags := decodeUint16(nodeBytes[0:2])
+	return &interiorChunk{
+		level:   flags & LevelFlag,
+		counted: flags&CountedChunkFlag != 0,
+		hist:    hflags&HistogramChunkFlag != 0,
+		wide:    flags&WideChunkFlag != 0,
+		data:    nodeBytes,
+		pos:     2,
+	}
+}
+
+// more reports whether pointers are left to read.
+func (c *interiorChunk) more() bool {
+	return c.pos < len(c.data)
+}
+
+// next returns the encoded next pointer.
+func (c *interiorChunk) next() ([]byte, error) {
+	var pointerLength int
+	if c.wide {
+		length, size := binary.Uvarint(c.data[c.pos:])
+		if size <= 0 || uint64(len(c.data)-c.pos-size) < length {
+			return nil, ErrInvalid
+		}
+		pointerLength = int(length)
+		c.pos += size
+	} else {
+		if len(c.data)-c.pos < 2 {
+			return nil, ErrInvalid
+		}
+		pointerLength = int(decodeUint16(c.data[c.pos : c.pos+2]))
+		c.pos += 2
+		if len(c.data)-c.pos < pointerLength {
+			return nil, ErrInvalid
+		}
+	}
+	pointerBytes := c.data[c.pos : c.pos+pointerLength]
+	c.pos += pointerLength
+	return pointerBytes, nil
+}
+
 func (db *DB) newLeafNode() *node {
 	return &node{
 		db:     db,
@@ -188,390 +655,901 @@ func (db *DB) newInteriorNode() *node {
 	}
 }
 
-// flush node to disk.
-func (n *node) flush() int64 {
-	flags := n.level
-	if !n.isLeaf {
-		if n.dirty != -1 {
-			n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
-			n.dirty = -1
+// flush node to disk, it returns the position the node was written at.
+func (n *node) flush() (int64, error) {
+	if !n.isLeaf && n.dirty != -1 {
+		pos, err := n.pointers[n.dirty].pointer.flush()
+		if err != nil {
+			return 0, err
 		}
-		flags = flags | InteriorChunkFlag
-	} else {
-		flags = flags | LeafChunkFlag
+		n.pointers[n.dirty].pos = pos
+		n.dirty = -1
 	}
-	nodeBytes := n.encode()
 
-	pos, _, err := n.db.writeChunk(nodeBytes)
+	pos, _, err := n.db.writeChunk(n.encode())
 	if err != nil {
-		return int64(0)
+		return 0, err
 	}
-
-	return pos
+	return pos, nil
 }
 
-func (n *node) put(t *Time, value map[string]float64) error {
-	var err error
-	if n.isLeaf {
-		err = n.insertPoint(t, value)
-	} else {
-		err = n.insertNode(t, value)
+// flushDirty reduces and flushes the dirty child of an interior node, so
+// another branch can become dirty.
+func (n *node) flushDirty() error {
+	if n.dirty == -1 {
+		return nil
 	}
+	np := n.pointers[n.dirty]
+	np.refresh()
+	pos, err := np.pointer.flush()
 	if err != nil {
 		return err
 	}
-
-	n.db.root.reduce()
+	np.pos = pos
+	n.dirty = -1
 	return nil
 }
 
-func (n *node) insertPoint(t *Time, value map[string]float64) error {
-	index := sort.Search(len(n.points), func(i int) bool {
-		return n.points[i].Timestamp >= t.TS
-	})
+// put stores value at t below n, expiring at expires unless it is zero.
+func (n *node) put(t *Time, value map[string]float64, expires int64) error {
+	if n.isLeaf {
+		return n.insertPoint(t, value, expires)
+	}
+	return n.insertNode(t, value, expires)
+}
+
+func (n *node) insertPoint(t *Time, value map[string]float64, expires int64) error {
+	// Points mostly come in order, check the end before searching.
+	index := len(n.points)
+	if index > 0 && n.points[index-1].Timestamp >= t.TS {
+		index = sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= t.TS
+		})
+	}
 	if index >= len(n.points) {
-		n.points = append(n.points, &Point{Timestamp: t.TS, Value: value})
+		n.points = append(n.points, &Point{Timestamp: t.TS, Value: value, expires: expires})
 	} else {
 		if n.points[index].Timestamp == t.TS {
-			n.points[index].Value = value
+			n.size -= n.db.pointSize(n.points[index])
+			n.points[index].Value = n.db.duplicate(n.points[index].Value, value)
+			n.points[index].expires = expires
 		} else {
 			n.points = append(n.points, &Point{})
 			copy(n.points[index+1:], n.points[index:])
 
-			n.points[index] = &Point{Timestamp: t.TS, Value: value}
+			n.points[index] = &Point{Timestamp: t.TS, Value: value, expires: expires}
 		}
 	}
+	n.size += n.db.pointSize(n.points[index])
 
+	if n.overfull() {
+		return n.expand()
+	}
 	return nil
 }
 
-func (n *node) insertNode(t *Time, value map[string]float64) error {
-	if t.Level()>>2 <= n.level {
-		leafNode := n.db.newLeafNode()
-		leafNode.parent = n
-		leafNode.level = n.level << 1
+// overfull reports whether a leaf holds more points, or more bytes, than
+// the options allow and can still be expanded.
+func (n *node) overfull() bool {
+	if n.level<<1 > LevelNSecond {
+		return false
+	}
+	if len(n.points) > n.db.maxLeafPoints {
+		return true
+	}
+	return n.db.maxLeafBytes > 0 && n.size > n.db.maxLeafBytes && len(n.points) > 1
+}
 
-		point := Point{
-			Timestamp: t.TS,
-			Value:     value,
-		}
-		leafNode.points = append(leafNode.points, &point)
+// resize recomputes the size estimate of a leaf after points were removed.
+func (n *node) resize() {
+	n.size = 0
+	for _, point := range n.points {
+		n.size += n.db.pointSize(point)
+	}
+}
 
-		index := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= t.TS
-		})
-		if len(n.pointers) == 0 || index >= len(n.pointers) || n.pointers[index].key != t.TS {
-			n.pointers = append(n.pointers, &nodePointer{})
-			copy(n.pointers[index+1:], n.pointers[index:])
-		}
+// insertNode puts value at t below an interior node, descending into the
+// child whose bucket holds t and creating the child only if there is none.
+func (n *node) insertNode(t *Time, value map[string]float64, expires int64) error {
+	level := n.level << 1
+	key := t.Timestamp(level)
+	index := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= key
+	})
 
-		np := nodePointer{
-			key:     t.Timestamp(n.level << 1),
-			pointer: leafNode,
+	if index < len(n.pointers) && n.pointers[index].key == key {
+		if n.dirty != index {
+			if err := n.flushDirty(); err != nil {
+				return err
+			}
+		}
+		child, err := n.childAt(index)
+		if err != nil {
+			return err
 		}
-		n.pointers[index] = &np
 		n.dirty = index
-
-		return nil
+		if child.isLeaf && t.Level()>>1 > child.level {
+			if err := child.expand(); err != nil {
+				return err
+			}
+		}
+		return child.put(t, value, expires)
 	}
 
-	interiorNode := n.db.newInteriorNode()
-	interiorNode.level = n.level << 1
-	interiorNode.parent = n
-
-	interiorNode.insertNode(t, value)
+	// The new child shifts the ones after it, the dirty one among them
+	// must be written first.
+	if err := n.flushDirty(); err != nil {
+		return err
+	}
 
-	index := sort.Search(len(n.pointers), func(i int) bool {
-		return n.pointers[i].key >= t.TS
-	})
-	if len(n.pointers) == 0 || index >= len(n.pointers) || n.pointers[index].key != t.TS {
-		n.pointers = append(n.pointers, &nodePointer{})
-		copy(n.pointers[index+1:], n.pointers[index:])
+	var child *node
+	if t.Level()>>2 <= n.level {
+		child = n.db.newLeafNode()
+		child.points = append(child.points, &Point{
+			Timestamp: t.TS,
+			Value:     value,
+			expires:   expires,
+		})
+		child.resize()
+		child.level = level
+	} else {
+		child = n.db.newInteriorNode()
+		child.level = level
+		if err := child.insertNode(t, value, expires); err != nil {
+			return err
+		}
 	}
+	child.parent = n
 
-	np := nodePointer{
-		key:     t.Timestamp(n.level << 1),
-		pointer: interiorNode,
+	n.pointers = append(n.pointers, nil)
+	copy(n.pointers[index+1:], n.pointers[index:])
+	n.pointers[index] = &nodePointer{
+		key:     key,
+		pointer: child,
 	}
-	n.pointers[index] = &np
 	n.dirty = index
-
 	return nil
 }
 
-// expand leafnode to iterior node
-func (n *node) expand() {
+// expand turns a leaf into an interior node, moving its points into
+// sub-leaves one level finer. The sub-leaves are flushed right away since
+// only one dirty branch is kept in the tree.
+func (n *node) expand() error {
+	points := n.points
 	n.isLeaf = false
+	n.dirty = -1
+	n.points = make([]*Point, 0)
 
-	for _, point := range n.points {
-		leafNode := n.db.newLeafNode()
-		leafNode.level = n.level << 1
+	level := n.level << 1
+	for _, point := range points {
+		t := NewTime(point.Timestamp)
+		key := t.Timestamp(level)
+
+		last := len(n.pointers) - 1
+		if last < 0 || n.pointers[last].key != key {
+			leafNode := n.db.newLeafNode()
+			leafNode.level = level
+			leafNode.parent = n
+			n.pointers = append(n.pointers, &nodePointer{key: key, pointer: leafNode})
+			last++
+		}
+		leafNode := n.pointers[last].pointer
 		leafNode.points = append(leafNode.points, point)
+		leafNode.size += n.db.pointSize(point)
+	}
+	n.size = 0
+
+	for _, np := range n.pointers {
+		child := np.pointer
+		if child.overfull() {
+			if err := child.expand(); err != nil {
+				return err
+			}
+		}
+		np.refresh()
+
+		var err error
+		if np.pos, err = child.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		np := nodePointer{
-			key:     point.Timestamp,
-			pos:     leafNode.flush(),
-			pointer: leafNode,
+// childAt returns the child of an interior node at index, reading it from
+// disk if it is not in memory yet.
+func (n *node) childAt(index int) (*node, error) {
+	np := n.pointers[index]
+	if np.pointer == nil {
+		child, err := n.db.node(np.pos)
+		if err != nil {
+			return nil, err
 		}
-		n.pointers = append(n.pointers, &np)
+		child.parent = n
+		np.pointer = child
 	}
+	return np.pointer, nil
 }
 
-func (n *node) clean(from, to *Time) bool {
+// walk calls fn for n and every node below it, depth first. The depth of n
+// is passed in, children are read from disk without being cached.
+func (n *node) walk(depth int, fn func(n *node, depth int) error) error {
+	if err := fn(n, depth); err != nil {
+		return err
+	}
 	if n.isLeaf {
-		index := sort.Search(len(n.points), func(i int) bool {
-			return n.points[i].Timestamp >= from.TS
-		})
-		for i, point := range n.points[index:] {
-			if point.Timestamp >= to.TS {
-				n.points = append(n.points[:index], n.points[i:]...)
+		return nil
+	}
+
+	for _, pointer := range n.pointers {
+		child := pointer.pointer
+		if child == nil {
+			var err error
+			if child, err = n.db.node(pointer.pos); err != nil {
+				return err
 			}
-			break
 		}
-		if len(n.points) == 0 {
-			return true
+		if err := child.walk(depth+1, fn); err != nil {
+			return err
 		}
-		return false
 	}
+	return nil
+}
+
+// aggregate merges the metrics in set of the points between from and to
+// inclusive into value, using the reduced value of every child that lies
+// entirely in the range. With hist set, children reduced without a
+// histogram are read instead. Children that have to be read are read
+// concurrently, up to GOMAXPROCS at a time.
+func (n *node) aggregate(from, to int64, set metricSet, hist bool, value map[string]Value) error {
+	return newAggregator(from, to, set, hist, runtime.GOMAXPROCS(0)).node(n, value)
+}
+
+// aggregator aggregates the points between from and to inclusive, reading
+// the children it has to descend into on up to workers goroutines.
+type aggregator struct {
+	from, to int64
+	set      metricSet
+	hist     bool
+	sem      chan struct{} // held by every goroutine besides the caller's
+}
+
+func newAggregator(from, to int64, set metricSet, hist bool, workers int) *aggregator {
+	if workers < 1 {
+		workers = 1
+	}
+	return &aggregator{
+		from: from,
+		to:   to,
+		set:  set,
+		hist: hist,
+		sem:  make(chan struct{}, workers-1),
+	}
+}
+
+// partial is what an aggregator gathered below one child.
+type partial struct {
+	value map[string]Value
+	err   error
+	done  chan struct{} // closed once value and err are set
+}
 
-	f := from.Timestamp(n.level << 1)
-	t := to.Timestamp(n.level << 1)
-	// if from and to in the same node, step in.
-	if f == t {
-		index := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= f
+// node merges what lies below n into value. Every child read gets a
+// partial of its own, filled on another goroutine if one is free and inline
+// otherwise, and the partials are merged in key order with the reduced
+// values of the children that are not read, so first and last hold.
+func (a *aggregator) node(n *node, value map[string]Value) error {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= a.from
 		})
-		if n.pointers[index].key == f {
-			if index != n.dirty {
-				if n.dirty != -1 {
-					n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
-				}
-				n.dirty = index
+		for _, point := range n.points[index:] {
+			if point.Timestamp > a.to {
+				break
 			}
-			if n.pointers[index].pointer == nil {
-				var err error
-				n.pointers[index].pointer, err = n.db.node(n.pointers[index].pos)
-				if err != nil {
-					return true
+			for k, v := range point.Value {
+				if !a.set.has(k) {
+					continue
 				}
+				vk := value[k]
+				vk.add(v)
+				value[k] = vk
 			}
-			if empty := n.pointers[index].pointer.clean(from, to); empty {
-				if len(n.pointers) == 1 {
-					return true
-				}
-				n.pointers = append(n.pointers[:index], n.pointers[index+1:]...)
-				return false
+		}
+		return nil
+	}
+
+	level := n.level << 1
+	parts := make(map[int]*partial)
+	for i, pointer := range n.pointers {
+		if pointer.key > a.to {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(level) - 1
+		if end < a.from {
+			continue
+		}
+		if pointer.key >= a.from && end <= a.to && !(a.hist && pointer.lacksHistogram(a.set)) {
+			continue
+		}
+
+		part := &partial{value: make(map[string]Value), done: make(chan struct{})}
+		parts[i] = part
+		select {
+		case a.sem <- struct{}{}:
+			go func(i int) {
+				defer func() { <-a.sem }()
+				a.child(n, i, part)
+			}(i)
+		default:
+			a.child(n, i, part)
+		}
+	}
+
+	var err error
+	for _, part := range parts {
+		<-part.done
+		if err == nil {
+			err = part.err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, pointer := range n.pointers {
+		if pointer.key > a.to {
+			break
+		}
+		reduced := pointer.value
+		if part, ok := parts[i]; ok {
+			reduced = part.value
+		} else if bucket := NewTime(pointer.key); bucket.next(level) <= a.from {
+			continue
+		}
+		for k, v := range reduced {
+			if !a.set.has(k) {
+				continue
 			}
+			vk := value[k]
+			vk.merge(v)
+			value[k] = vk
 		}
+	}
+	return nil
+}
+
+// child reads the child of n at index into part. Children of a node are
+// distinct, so reading several of them at once touches no shared state
+// besides the node cache, which is safe for concurrent use. When only some
+// metrics are aggregated, a child not in memory is decoded for the range
+// and those metrics alone, and left out of the tree.
+func (a *aggregator) child(n *node, index int, part *partial) {
+	defer close(part.done)
+	var child *node
+	var err error
+	if np := n.pointers[index]; np.pointer == nil && a.set != nil {
+		child, err = n.db.nodeRange(np.pos, a.from, a.to, a.set)
 	} else {
-		n.dirty = -1
-		fromIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= f
+		child, err = n.childAt(index)
+	}
+	if err != nil {
+		part.err = err
+		return
+	}
+	part.err = a.node(child, part.value)
+}
+
+// metricsIn adds to found the names of the metrics held by the points below
+// n between from and to inclusive.
+func (n *node) metricsIn(from, to int64, found map[string]struct{}) error {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= from
 		})
-		if n.pointers[fromIndex].key == f {
-			// if from time is the begin of node, drop it directly.
-			if f != from.TS {
-				n.dirty = fromIndex
-				if n.pointers[fromIndex].pointer == nil {
-					var err error
-					n.pointers[fromIndex].pointer, err = n.db.node(n.pointers[fromIndex].pos)
-					if err != nil {
-						return true
-					}
-				}
-				empty := n.pointers[fromIndex].pointer.cleanFrom(from)
-				if !empty {
-					n.pointers[fromIndex].pointer.reduce()
-					n.pointers[fromIndex].pos = n.pointers[fromIndex].pointer.flush()
+		for _, point := range n.points[index:] {
+			if point.Timestamp > to {
+				break
+			}
+			for k := range point.Value {
+				found[k] = struct{}{}
+			}
+		}
+		return nil
+	}
 
-					// persist fromIndex
-					fromIndex++
-				}
+	level := n.level << 1
+	for i, pointer := range n.pointers {
+		if pointer.key > to {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(level) - 1
+		if end < from {
+			continue
+		}
+
+		// The child holds every metric in its reduced value, and at least
+		// one point of each if it lies entirely in the range.
+		news := false
+		for k := range pointer.value {
+			if _, ok := found[k]; !ok {
+				news = true
+				break
+			}
+		}
+		if !news {
+			continue
+		}
+		if pointer.key >= from && end <= to {
+			for k := range pointer.value {
+				found[k] = struct{}{}
 			}
+			continue
 		}
 
-		toIndex := fromIndex
-		if n.pointers[len(n.pointers)-1].key < t {
-			n.pointers = n.pointers[:fromIndex]
-		} else {
-			for i, pointer := range n.pointers[toIndex:] {
-				if pointer.key >= t {
-					if pointer.key == t {
-						toIndex = fromIndex + i
-						if t != to.TS {
-							if n.pointers[toIndex].pointer == nil {
-								var err error
-								n.pointers[toIndex].pointer, err = n.db.node(n.pointers[toIndex].pos)
-								if err != nil {
-									return true
-								}
-							}
-							empty := n.pointers[toIndex].pointer.cleanTo(to)
-							if !empty {
-								n.pointers[toIndex].pointer.reduce()
-								n.pointers[toIndex].pos = n.pointers[toIndex].pointer.flush()
-							} else {
-								toIndex++
-							}
-							break
-						}
-					}
-				}
+		child, err := n.childAt(i)
+		if err != nil {
+			return err
+		}
+		if err := child.metricsIn(from, to, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// edge returns the first point below n, or the last one if last is set.
+func (n *node) edge(last bool) (*Point, error) {
+	if n.isLeaf {
+		if len(n.points) == 0 {
+			return nil, ErrNotFound
+		}
+		if last {
+			return n.points[len(n.points)-1], nil
+		}
+		return n.points[0], nil
+	}
+
+	if len(n.pointers) == 0 {
+		return nil, ErrNotFound
+	}
+	index := 0
+	if last {
+		index = len(n.pointers) - 1
+	}
+	child, err := n.childAt(index)
+	if err != nil {
+		return nil, err
+	}
+	return child.edge(last)
+}
+
+// count returns the number of points below n, or -1 if a child chunk was
+// written without counts and is not loaded.
+func (n *node) count() int64 {
+	if n.isLeaf {
+		return int64(len(n.points))
+	}
+
+	var total int64
+	for i, pointer := range n.pointers {
+		c := pointer.count
+		if i == n.dirty && pointer.pointer != nil {
+			c = pointer.pointer.count()
+		}
+		if c < 0 {
+			return -1
+		}
+		total += c
+	}
+	return total
+}
+
+// countRange returns the number of points between from and to inclusive,
+// using the count of every child that lies entirely in the range.
+func (n *node) countRange(from, to int64) (int64, error) {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= from
+		})
+		var total int64
+		for _, point := range n.points[index:] {
+			if point.Timestamp > to {
+				break
 			}
-			n.pointers = append(n.pointers[:fromIndex], n.pointers[toIndex:]...)
+			total++
 		}
-		if len(n.pointers) == 0 {
-			return true
+		return total, nil
+	}
+
+	var total int64
+	level := n.level << 1
+	for i, pointer := range n.pointers {
+		if pointer.key > to {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(level) - 1
+		if end < from {
+			continue
+		}
+
+		if pointer.key >= from && end <= to && i != n.dirty && pointer.count >= 0 {
+			total += pointer.count
+			continue
 		}
+
+		child, err := n.childAt(i)
+		if err != nil {
+			return 0, err
+		}
+		c, err := child.countRange(from, to)
+		if err != nil {
+			return 0, err
+		}
+		total += c
 	}
-	return false
+	return total, nil
 }
 
-func (n *node) cleanFrom(from *Time) bool {
+// remove deletes the point at t, it returns true if the node became empty.
+func (n *node) remove(t *Time) (bool, error) {
 	if n.isLeaf {
 		index := sort.Search(len(n.points), func(i int) bool {
-			return n.points[i].Timestamp >= from.TS
+			return n.points[i].Timestamp >= t.TS
 		})
-		if index == 0 {
-			return true
+		if index >= len(n.points) || n.points[index].Timestamp != t.TS {
+			return false, ErrNotFound
 		}
-		n.points = n.points[:index]
-		return false
-	} else {
-		f := from.Timestamp(n.level << 1)
-		fromIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= f
+		n.size -= n.db.pointSize(n.points[index])
+		n.points = append(n.points[:index], n.points[index+1:]...)
+		return len(n.points) == 0, nil
+	}
+
+	ts := t.Timestamp(n.level << 1)
+	index := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= ts
+	})
+	if index >= len(n.pointers) || n.pointers[index].key != ts {
+		return false, ErrNotFound
+	}
+
+	child, err := n.childAt(index)
+	if err != nil {
+		return false, err
+	}
+
+	empty, err := child.remove(t)
+	if err != nil {
+		return false, err
+	}
+
+	// Only one dirty branch in the tree.
+	if n.dirty != index {
+		if err := n.flushDirty(); err != nil {
+			return false, err
+		}
+	}
+	n.dirty = index
+
+	if empty {
+		n.pointers = append(n.pointers[:index], n.pointers[index+1:]...)
+		n.dirty = -1
+	}
+	return len(n.pointers) == 0, nil
+}
+
+// truncate removes the points before ts below n, dropping the children that
+// end before it without reading them. It returns true if n became empty.
+func (n *node) truncate(ts int64) (bool, error) {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= ts
 		})
+		n.points = append([]*Point(nil), n.points[index:]...)
+		n.resize()
+		return len(n.points) == 0, nil
+	}
 
-		if fromIndex >= len(n.pointers) {
-			return false
-		}
-		if n.pointers[fromIndex].key == f {
-			// if from time is the begin of node, drop it directly.
-			if f != from.TS {
-				if n.pointers[fromIndex].pointer == nil {
-					var err error
-					n.pointers[fromIndex].pointer, err = n.db.node(n.pointers[fromIndex].pos)
-					if err != nil {
-						return true
-					}
-				}
-				empty := n.pointers[fromIndex].pointer.cleanFrom(from)
-				if !empty {
-					n.pointers[fromIndex].pointer.reduce()
-					n.pointers[fromIndex].pos = n.pointers[fromIndex].pointer.flush()
+	level := n.level << 1
+	drop := sort.Search(len(n.pointers), func(i int) bool {
+		bucket := NewTime(n.pointers[i].key)
+		return bucket.next(level) > ts
+	})
+	if drop > 0 {
+		if n.dirty < drop {
+			n.dirty = -1
+		} else {
+			n.dirty -= drop
+		}
+		n.pointers = append([]*nodePointer(nil), n.pointers[drop:]...)
+	}
 
-					// persist fromIndex
-					fromIndex++
+	// The first child left may start before ts.
+	if len(n.pointers) == 0 || n.pointers[0].key >= ts {
+		return len(n.pointers) == 0, nil
+	}
+	// Only one dirty branch in the tree.
+	if n.dirty != 0 {
+		if err := n.flushDirty(); err != nil {
+			return false, err
+		}
+	}
+	child, err := n.childAt(0)
+	if err != nil {
+		return false, err
+	}
+	empty, err := child.truncate(ts)
+	if err != nil {
+		return false, err
+	}
+	n.dirty = 0
+	if empty {
+		n.pointers = n.pointers[1:]
+		n.dirty = -1
+	}
+	return len(n.pointers) == 0, nil
+}
+
+// deleteRange removes the points between from and to inclusive below n and
+// returns how many there were. Children lying entirely in the range are
+// dropped without reading them unless their count is unknown. It returns
+// true if n became empty.
+func (n *node) deleteRange(from, to int64) (int64, bool, error) {
+	if n.isLeaf {
+		lo := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= from
+		})
+		hi := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp > to
+		})
+		if lo >= hi {
+			return 0, len(n.points) == 0, nil
+		}
+		n.points = append(n.points[:lo:lo], n.points[hi:]...)
+		n.resize()
+		return int64(hi - lo), len(n.points) == 0, nil
+	}
+
+	var removed int64
+	level := n.level << 1
+	drop := make([]bool, len(n.pointers))
+	for i, pointer := range n.pointers {
+		if pointer.key > to {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(level) - 1
+		if end < from {
+			continue
+		}
+
+		if pointer.key >= from && end <= to {
+			count := pointer.count
+			if i == n.dirty || count < 0 {
+				child, err := n.childAt(i)
+				if err != nil {
+					return 0, false, err
+				}
+				if count, err = child.countRange(pointer.key, end); err != nil {
+					return 0, false, err
 				}
 			}
+			removed += count
+			drop[i] = true
+			continue
 		}
-		if fromIndex == 0 {
-			return true
+
+		// Only one dirty branch in the tree.
+		if n.dirty != i {
+			if err := n.flushDirty(); err != nil {
+				return 0, false, err
+			}
 		}
-		n.pointers = n.pointers[:fromIndex]
-		return false
+		child, err := n.childAt(i)
+		if err != nil {
+			return 0, false, err
+		}
+		count, empty, err := child.deleteRange(from, to)
+		if err != nil {
+			return 0, false, err
+		}
+		n.dirty = i
+		removed += count
+		drop[i] = empty
+	}
+
+	pointers := make([]*nodePointer, 0, len(n.pointers))
+	dirty := -1
+	for i, pointer := range n.pointers {
+		if drop[i] {
+			continue
+		}
+		if i == n.dirty {
+			dirty = len(pointers)
+		}
+		pointers = append(pointers, pointer)
 	}
+	n.pointers, n.dirty = pointers, dirty
+	return removed, len(n.pointers) == 0, nil
 }
 
-func (n *node) cleanTo(to *Time) bool {
+// expire removes the points before ts below n whose timestamps are aligned
+// to level or to nothing coarser, and returns how many there were. A child
+// keyed by such a timestamp and ending before ts holds only such points
+// and is dropped without reading it unless its count is unknown. It returns
+// true if n became empty. Children ending before from are passed over.
+func (n *node) expire(level uint16, ts, from int64) (int64, bool, error) {
 	if n.isLeaf {
-		index := sort.Search(len(n.points), func(i int) bool {
-			return n.points[i].Timestamp >= to.TS
-		})
-		if index == len(n.points) {
-			return true
+		points := n.points[:0:0]
+		for _, point := range n.points {
+			t := NewTime(point.Timestamp)
+			if point.Timestamp >= ts || t.Level() < level {
+				points = append(points, point)
+			}
 		}
-		n.points = n.points[index:]
-		return false
-	} else {
-		t := to.Timestamp(n.level << 1)
-		toIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= t
-		})
+		removed := int64(len(n.points) - len(points))
+		if removed > 0 {
+			n.points = points
+			n.resize()
+		}
+		return removed, len(n.points) == 0, nil
+	}
 
-		if toIndex == len(n.pointers) {
-			return true
+	var removed int64
+	childLevel := n.level << 1
+	drop := make([]bool, len(n.pointers))
+	loaded := make([]bool, len(n.pointers)) // read from disk by the expiry
+	for i, pointer := range n.pointers {
+		if pointer.key >= ts {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(childLevel) - 1
+		if end < from {
+			continue
 		}
-		if n.pointers[toIndex].key == t {
-			if t != to.TS {
-				if n.pointers[toIndex].pointer == nil {
-					var err error
-					n.pointers[toIndex].pointer, err = n.db.node(n.pointers[toIndex].pos)
-					if err != nil {
-						return true
-					}
+
+		if end < ts && bucket.Level() >= level {
+			count := pointer.count
+			if i == n.dirty || count < 0 {
+				child, err := n.childAt(i)
+				if err != nil {
+					return 0, false, err
 				}
-				empty := n.pointers[toIndex].pointer.cleanTo(to)
-				if !empty {
-					n.pointers[toIndex].pointer.reduce()
-					n.pointers[toIndex].pos = n.pointers[toIndex].pointer.flush()
-				} else {
-					toIndex++
+				if count, err = child.countRange(pointer.key, end); err != nil {
+					return 0, false, err
 				}
 			}
+			removed += count
+			drop[i] = true
+			continue
 		}
-		n.dirty = -1
-		if toIndex == len(n.pointers) {
-			return true
+
+		// Only one dirty branch in the tree.
+		if n.dirty != i {
+			if err := n.flushDirty(); err != nil {
+				return 0, false, err
+			}
 		}
-		n.pointers = n.pointers[toIndex:]
-		return false
+		loaded[i] = pointer.pointer == nil
+		child, err := n.childAt(i)
+		if err != nil {
+			return 0, false, err
+		}
+		count, empty, err := child.expire(level, ts, from)
+		if err != nil {
+			return 0, false, err
+		}
+		// A child left as it was need not be written again.
+		if count > 0 {
+			n.dirty = i
+		}
+		removed += count
+		drop[i] = empty
 	}
+
+	// As in sweep, the children read for the expiry are let go again.
+	pointers := make([]*nodePointer, 0, len(n.pointers))
+	dirty := -1
+	for i, pointer := range n.pointers {
+		if drop[i] {
+			continue
+		}
+		if i == n.dirty {
+			dirty = len(pointers)
+		} else if loaded[i] {
+			pointer.pointer = nil
+		}
+		pointers = append(pointers, pointer)
+	}
+	n.pointers, n.dirty = pointers, dirty
+	return removed, len(n.pointers) == 0, nil
+}
+
+// rename renames the metric old to new in the points below n, keeping the
+// value of new in points holding both, and returns how many points held
+// old. Only the children whose values hold old are read.
+func (n *node) rename(old, new string) (int64, error) {
+	if n.isLeaf {
+		var renamed int64
+		for _, point := range n.points {
+			v, ok := point.Value[old]
+			if !ok {
+				continue
+			}
+			// The map may be one the caller of Put still holds.
+			value := make(map[string]float64, len(point.Value))
+			for k, f := range point.Value {
+				if k != old {
+					value[k] = f
+				}
+			}
+			if _, ok := value[new]; !ok {
+				value[new] = v
+			}
+			point.Value = value
+			renamed++
+		}
+		if renamed > 0 {
+			n.resize()
+		}
+		return renamed, nil
+	}
+
+	var renamed int64
+	for i, pointer := range n.pointers {
+		// The values of the dirty child are not refreshed yet.
+		if _, ok := pointer.value[old]; !ok && i != n.dirty {
+			continue
+		}
+
+		// Only one dirty branch in the tree.
+		if n.dirty != i {
+			if err := n.flushDirty(); err != nil {
+				return 0, err
+			}
+		}
+		child, err := n.childAt(i)
+		if err != nil {
+			return 0, err
+		}
+		count, err := child.rename(old, new)
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			n.dirty = i
+		}
+		renamed += count
+	}
+	return renamed, nil
 }
 
 func (n *node) reduce() map[string]Value {
 	value := make(map[string]Value)
 	if n.isLeaf {
-		for index, point := range n.points {
+		// points are sorted, the latest one wins.
+		for _, point := range n.points {
 			for k, v := range point.Value {
-				if vk, ok := value[k]; !ok {
-					value[k] = Value{
-						sum:   v,
-						max:   v,
-						min:   v,
-						first: v,
-						last:  v,
-						count: 1,
-					}
-				} else {
-					vk.sum += v
-					if vk.max < v {
-						vk.max = v
-					} else if value[k].min > v {
-						vk.min = v
-					}
-					if index == len(n.points)-1 {
-						vk.last = v
-					}
-					vk.count++
-
-					value[k] = vk
-				}
+				vk := value[k]
+				vk.add(v)
+				value[k] = vk
 			}
 		}
 	} else {
 		if n.dirty != -1 {
-			n.pointers[n.dirty].value = n.pointers[n.dirty].pointer.reduce()
+			n.pointers[n.dirty].refresh()
 		}
-		for index, pointer := range n.pointers {
+		// pointers are sorted by key, so the first pointer carrying a
+		// metric holds its first value and the last one holds its last.
+		for _, pointer := range n.pointers {
 			for k, v := range pointer.value {
-				if vk, ok := value[k]; !ok {
-					value[k] = v
-				} else {
-					vk.sum += v.sum
-					if vk.max < v.max {
-						vk.max = v.max
-					}
-					if value[k].min < v.min {
-						vk.min = v.min
-					}
-					if index == len(n.pointers)-1 {
-						vk.last = v.last
-					}
-					vk.count += v.count
-					value[k] = vk
-				}
+				vk := value[k]
+				vk.merge(v)
+				value[k] = vk
 			}
 		}
 	}
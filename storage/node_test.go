@@ -0,0 +1,794 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReduceLeaf(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   Value
+	}{
+		{[]float64{5}, Value{sum: 5, max: 5, min: 5, first: 5, last: 5, count: 1}},
+		{[]float64{5, 2, 8}, Value{sum: 15, max: 8, min: 2, first: 5, last: 8, count: 3}},
+		{[]float64{1, 2, 3, 4}, Value{sum: 10, max: 4, min: 1, first: 1, last: 4, count: 4}},
+		{[]float64{4, 3, 2, 1}, Value{sum: 10, max: 4, min: 1, first: 4, last: 1, count: 4}},
+		{[]float64{-1, 7, -3, 2}, Value{sum: 5, max: 7, min: -3, first: -1, last: 2, count: 4}},
+	}
+
+	db := &DB{}
+	for _, tt := range tests {
+		n := db.newLeafNode()
+		for i, v := range tt.values {
+			n.points = append(n.points, &Point{
+				Timestamp: int64(i),
+				Value:     map[string]float64{"v": v},
+			})
+		}
+
+		if got := n.reduce()["v"]; !sameValue(got, tt.want) {
+			t.Errorf("reduce(%v) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
+
+// sameValue reports whether a and b hold the same aggregates, leaving out
+// their histograms.
+func sameValue(a, b Value) bool {
+	return a.sum == b.sum && a.max == b.max && a.min == b.min &&
+		a.first == b.first && a.last == b.last && a.count == b.count
+}
+
+func TestReduceInteriorFirstLast(t *testing.T) {
+	db := tempDB(t)
+
+	// Keys carry nanoseconds so every day gets its own subtree.
+	base := time.Date(2016, 8, 1, 0, 0, 0, 123, time.Local)
+	puts := []struct {
+		day   int
+		value map[string]float64
+	}{
+		{3, map[string]float64{"a": 30}},
+		{1, map[string]float64{"a": 10, "b": 1}},
+		{5, map[string]float64{"b": 5}},
+		{2, map[string]float64{"a": 20}},
+	}
+	for _, p := range puts {
+		key := base.AddDate(0, 0, p.day).UnixNano()
+		if err := db.Put(key, p.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value := db.root.reduce()
+	if a := value["a"]; a.first != 10 || a.last != 30 {
+		t.Fatalf("unexpected a: %+v", a)
+	}
+	if b := value["b"]; b.first != 1 || b.last != 5 {
+		t.Fatalf("unexpected b: %+v", b)
+	}
+}
+
+func TestReduceInteriorMinMax(t *testing.T) {
+	db := &DB{}
+
+	// Two leaf siblings with overlapping ranges, the global minimum in the
+	// second and the global maximum in the first.
+	leaves := [][]float64{{4, 9, 2}, {7, -3, 5}}
+	parent := db.newInteriorNode()
+	parent.level = LevelDay
+	for i, values := range leaves {
+		leaf := db.newLeafNode()
+		leaf.level = LevelHour
+		leaf.parent = parent
+		for j, v := range values {
+			leaf.points = append(leaf.points, &Point{
+				Timestamp: int64(i*10 + j),
+				Value:     map[string]float64{"v": v},
+			})
+		}
+		parent.pointers = append(parent.pointers, &nodePointer{
+			key:     int64(i * 10),
+			pointer: leaf,
+			value:   leaf.reduce(),
+		})
+	}
+
+	want := Value{sum: 24, max: 9, min: -3, first: 4, last: 5, count: 6}
+	if got := parent.reduce()["v"]; !sameValue(got, want) {
+		t.Fatalf("reduce = %+v, want %+v", got, want)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	db := tempDB(t)
+
+	// Millisecond keys within one second all land in a single leaf.
+	base := time.Date(2016, 8, 28, 21, 24, 5, 0, time.Local).UnixNano()
+	var sum float64
+	for i := 0; i <= DefaultMaxLeafPoints; i++ {
+		key := base + int64(i)*int64(time.Millisecond)
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		sum += float64(i)
+	}
+
+	n := db.root
+	for n.level != LevelSecond {
+		if n.isLeaf || len(n.pointers) != 1 {
+			t.Fatalf("unexpected node at level %#x", n.level)
+		}
+		n = n.pointers[0].pointer
+	}
+	if n.isLeaf {
+		t.Fatal("expected leaf to be expanded")
+	}
+	if len(n.pointers) != DefaultMaxLeafPoints+1 {
+		t.Fatalf("unexpected child count: %d", len(n.pointers))
+	}
+	for _, np := range n.pointers {
+		if !np.pointer.isLeaf || np.pointer.level != LevelMSecond || len(np.pointer.points) != 1 {
+			t.Fatal("unexpected child")
+		}
+	}
+
+	v := db.root.reduce()["v"]
+	if v.sum != sum || v.count != DefaultMaxLeafPoints+1 || v.max != DefaultMaxLeafPoints ||
+		v.first != 0 || v.last != DefaultMaxLeafPoints {
+		t.Fatalf("unexpected aggregate: %+v", v)
+	}
+
+	db = reopen(t, db, nil)
+	points, err := db.Range(base, base+int64(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != DefaultMaxLeafPoints+1 {
+		t.Fatalf("unexpected point count: %d", len(points))
+	}
+	for i, p := range points {
+		if p.Value["v"] != float64(i) {
+			t.Fatalf("unexpected point: %+v", p)
+		}
+	}
+}
+
+func TestExpandMaxLeafPoints(t *testing.T) {
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{}); err != ErrInvalidOptions {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	leaf := func(db *DB) *node {
+		n := db.root
+		for n.level != LevelSecond {
+			n = n.pointers[0].pointer
+		}
+		return n
+	}
+
+	base := time.Date(2016, 8, 28, 21, 24, 5, 0, time.Local).UnixNano()
+	for _, max := range []int{4, 5, DefaultMaxLeafPoints} {
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := db.Put(base+int64(i)*int64(time.Millisecond), map[string]float64{"v": 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := leaf(db); n.isLeaf != (max >= 5) {
+			t.Fatalf("max %d: unexpected leaf state %v", max, n.isLeaf)
+		}
+	}
+}
+
+func TestExpandMaxLeafBytes(t *testing.T) {
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 1, MaxLeafBytes: -1}); err != ErrInvalidOptions {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 40 points a second apart in the same minute, each carrying width
+	// metrics.
+	second := func(width, maxBytes int) *node {
+		opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, MaxLeafBytes: maxBytes}
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local)
+		for i := 0; i < 40; i++ {
+			value := make(map[string]float64)
+			for m := 0; m < width; m++ {
+				value[fmt.Sprintf("metric%d", m)] = float64(i)
+			}
+			if err := db.Put(base.Add(time.Duration(i)*time.Second).UnixNano(), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		n := db.root
+		for n.level != LevelMinute {
+			n = n.pointers[0].pointer
+		}
+		return n
+	}
+
+	if n := second(1, 4096); !n.isLeaf {
+		t.Fatal("narrow points were expanded")
+	}
+	if n := second(20, 4096); n.isLeaf {
+		t.Fatal("wide points were not expanded")
+	} else if n.pointers[0].pointer.size > 4096 {
+		t.Fatalf("leaf estimated at %d bytes", n.pointers[0].pointer.size)
+	}
+	if n := second(20, 0); !n.isLeaf {
+		t.Fatal("wide points were expanded without a byte bound")
+	}
+}
+
+func TestLeafDeltaEncoding(t *testing.T) {
+	db := &DB{}
+
+	leaf := db.newLeafNode()
+	leaf.level = LevelMinute
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local).UnixNano()
+	for i := 0; i < 60; i++ {
+		leaf.points = append(leaf.points, &Point{
+			Timestamp: base + int64(i)*int64(time.Second),
+			Value:     map[string]float64{"v": float64(i), "w": -1},
+		})
+	}
+
+	// The layout written before DeltaChunkFlag.
+	v1 := encodeUint16(leaf.level | LeafChunkFlag)
+	for _, point := range leaf.points {
+		pointBytes := point.encode()
+		v1 = append(v1, encodeUint16(uint16(len(pointBytes)))...)
+		v1 = append(v1, pointBytes...)
+	}
+	v2 := leaf.encode()
+
+	for _, b := range [][]byte{v1, v2} {
+		n, err := db.decodeNode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !n.isLeaf || n.level != leaf.level || len(n.points) != len(leaf.points) {
+			t.Fatalf("decoded level %#x leaf %v with %d points", n.level, n.isLeaf, len(n.points))
+		}
+		for i, p := range n.points {
+			want := leaf.points[i]
+			if p.Timestamp != want.Timestamp || len(p.Value) != 2 || p.Value["v"] != want.Value["v"] || p.Value["w"] != -1 {
+				t.Fatalf("point %d: got %d %v, want %d %v", i, p.Timestamp, p.Value, want.Timestamp, want.Value)
+			}
+		}
+	}
+
+	// A varint delta of a second takes 5 bytes instead of 8 for the
+	// timestamp, and the length takes 1 instead of 2.
+	if len(v2) >= len(v1)-len(leaf.points)*3 {
+		t.Fatalf("delta leaf takes %d bytes, full leaf %d", len(v2), len(v1))
+	}
+	t.Logf("delta leaf takes %d bytes, full leaf %d", len(v2), len(v1))
+
+	if _, err := db.decodeNode(v2[:len(v2)-3]); err != ErrInvalid {
+		t.Fatalf("unexpected error decoding a truncated leaf: %v", err)
+	}
+}
+
+// wideDB returns a database holding a point every minute for days days,
+// copied so that no interior node keeps a histogram. Quantiles over it read
+// every leaf in the range.
+func wideDB(tb testing.TB, days int) *DB {
+	dir := tb.TempDir()
+	src, err := Open(filepath.Join(dir, "src"), 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer src.Close()
+
+	base := time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local)
+	for day := 0; day < days; day++ {
+		points := make([]Point, 24*60)
+		for i := range points {
+			key := base.AddDate(0, 0, day).Add(time.Duration(i) * time.Minute).UnixNano()
+			points[i] = Point{Timestamp: key, Value: map[string]float64{"v": float64(day*len(points) + i), "w": 1}}
+		}
+		if err := src.PutBatch(points); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	tx, err := src.Begin(false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+	var strip func(n *node)
+	strip = func(n *node) {
+		for i, pointer := range n.pointers {
+			for k, v := range pointer.value {
+				v.hist, v.histBytes = nil, nil
+				pointer.value[k] = v
+			}
+			child, err := n.childAt(i)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			strip(child)
+		}
+	}
+	strip(tx.root)
+
+	dst, err := Open(filepath.Join(dir, "dst"), 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if dst.meta.root, err = tx.root.compact(dst); err != nil {
+		tb.Fatal(err)
+	}
+	if err := dst.writeMeta(dst.meta); err != nil {
+		tb.Fatal(err)
+	}
+	path := dst.Path()
+	if err := dst.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	db, err := Open(path, 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestAggregateParallel(t *testing.T) {
+	db := wideDB(t, 10)
+	base := time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local)
+
+	aggregate := func(from, to int64, hist bool, workers int) map[string]Value {
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		value := make(map[string]Value)
+		if err := newAggregator(from, to, nil, hist, workers).node(tx.root, value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	ranges := [][2]time.Time{
+		{base, base.AddDate(0, 0, 10)},
+		{base.Add(90 * time.Minute), base.AddDate(0, 0, 7).Add(-time.Second)},
+		{base.AddDate(0, 0, 3).Add(17 * time.Minute), base.AddDate(0, 0, 3).Add(5 * time.Hour)},
+	}
+	for _, r := range ranges {
+		from, to := r[0].UnixNano(), r[1].UnixNano()
+		for _, hist := range []bool{false, true} {
+			want := aggregate(from, to, hist, 1)
+			for _, workers := range []int{2, 8} {
+				got := aggregate(from, to, hist, workers)
+				if len(got) != len(want) {
+					t.Fatalf("%v-%v hist %v workers %d: got metrics %v, want %v", r[0], r[1], hist, workers, got, want)
+				}
+				for k, w := range want {
+					if g := got[k]; !sameValue(g, w) || g.hasHistogram() != w.hasHistogram() {
+						t.Fatalf("%v-%v hist %v workers %d: %s = %+v, want %+v", r[0], r[1], hist, workers, k, g, w)
+					}
+					gq, _ := got[k].Quantile(0.5)
+					wq, _ := w.Quantile(0.5)
+					if gq != wq {
+						t.Fatalf("%v-%v hist %v workers %d: %s median %v, want %v", r[0], r[1], hist, workers, k, gq, wq)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkAggregateParallel(b *testing.B) {
+	db := wideDB(b, 31)
+	from := time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local).UnixNano()
+	to := time.Date(2016, 9, 1, 0, 0, 0, 0, time.Local).UnixNano() - 1
+
+	for _, workers := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tx, err := db.Begin(false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				value := make(map[string]Value)
+				if err := newAggregator(from, to, nil, true, workers).node(tx.root, value); err != nil {
+					b.Fatal(err)
+				}
+				tx.Rollback()
+			}
+		})
+	}
+}
+
+func TestInsertNodeExistingChild(t *testing.T) {
+	db := tempDB(t)
+
+	// Put straight into the root, without a cursor routing the second
+	// point into the subtree made for the first.
+	if err := db.root.expand(); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 10, 5, 0, 0, time.Local)
+	for _, key := range []time.Time{base, base.Add(15 * time.Minute)} {
+		tm := NewTime(key.UnixNano())
+		if err := db.root.put(&tm, map[string]float64{"v": 1}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := db.root
+	for !n.isLeaf {
+		if len(n.pointers) != 1 {
+			t.Fatalf("node at level %#x has %d children, want 1", n.level, len(n.pointers))
+		}
+		child, err := n.childAt(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n = child
+	}
+	if n.level != LevelHour || len(n.points) != 2 {
+		t.Fatalf("leaf at level %#x holds %d points, want one hour holding 2", n.level, len(n.points))
+	}
+
+	db.root.reduce()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestWideCount(t *testing.T) {
+	db := tempDB(t)
+
+	// 70000 points in one hour, more than 16 bits can count.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	points := make([]Point, 70000)
+	for i := range points {
+		points[i] = Point{
+			Timestamp: base.Add(time.Duration(i) * 50 * time.Millisecond).UnixNano(),
+			Value:     map[string]float64{"v": 1},
+		}
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, nil)
+	value, err := db.Aggregate(base.UnixNano(), base.UnixNano(), LevelHour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := value["v"]; v.Count() != len(points) || v.Sum() != float64(len(points)) {
+		t.Fatalf("got count %d sum %v, want %d", v.Count(), v.Sum(), len(points))
+	}
+
+	long := string(make([]byte, MaxMetricNameLength+1))
+	if err := db.Put(base.UnixNano(), map[string]float64{long: 1}); err != ErrMetricNameTooLong {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Chunks written before WideChunkFlag store lengths and counts in 16
+	// bits.
+	old := encodeUint16(LevelDay | InteriorChunkFlag | CountedChunkFlag | headerlessHistogramFlag)
+	pointer := append(encodeInt64(base.UnixNano()), encodeInt64(1234)...)
+	pointer = append(pointer, encodeInt64(3)...)
+	pointer = append(pointer, encodeUint16(1)...)
+	pointer = append(pointer, 'v')
+	for _, f := range []float64{6, 3, 1, 1, 3} {
+		pointer = append(pointer, encodeFloat64(f)...)
+	}
+	pointer = append(pointer, encodeUint16(3)...)
+	pointer = append(pointer, encodeUvarint(0)...)
+	old = append(old, encodeUint16(uint16(len(pointer)))...)
+	old = append(old, pointer...)
+	n, err := db.decodeNode(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.pointers) != 1 || n.pointers[0].pos != 1234 || n.pointers[0].count != 3 {
+		t.Fatalf("decoded %+v", n.pointers)
+	}
+	if v := n.pointers[0].value["v"]; v.Count() != 3 || v.Sum() != 6 || v.Max() != 3 {
+		t.Fatalf("decoded value %+v", v)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 50; i++ {
+		key := base.Add(time.Duration(i) * 7 * time.Minute).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": float64(i), "w": -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaf := db.root
+	for !leaf.isLeaf {
+		leaf = leaf.pointers[0].pointer
+	}
+
+	// The layout of leaves written before DeltaChunkFlag.
+	old := encodeUint16(leaf.level | LeafChunkFlag)
+	for _, point := range leaf.points {
+		pointBytes := point.encode()
+		old = append(old, encodeUint16(uint16(len(pointBytes)))...)
+		old = append(old, pointBytes...)
+	}
+	db.deltaValues = true
+	deltas := leaf.encode()
+	db.deltaValues = false
+	chunks := [][]byte{db.root.encode(), leaf.encode(), leaf.encode()[chunkHeaderSize:], old, deltas}
+
+	decode := func(b []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("decoding %x: %v", b, r)
+			}
+		}()
+		if n, err := db.decodeNode(b); err == nil && !n.isLeaf {
+			for _, pointer := range n.pointers {
+				pointer.value["v"].Quantile(0.5)
+			}
+		}
+		if body, hflags, err := chunkNode(b); err == nil && decodeUint16(body[0:2])&LeafFlag == LeafChunkFlag {
+			leafChunkFind(body, hflags, leaf.points[len(leaf.points)-1].Timestamp)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, chunk := range chunks {
+		if _, err := db.decodeNode(chunk); err != nil {
+			t.Fatal(err)
+		}
+		for i := range chunk {
+			decode(chunk[:i])
+		}
+		for i := 0; i < 1000; i++ {
+			b := append([]byte(nil), chunk...)
+			for j := rnd.Intn(4); j >= 0; j-- {
+				b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+			}
+			decode(b)
+		}
+	}
+}
+
+func TestDeltaValues(t *testing.T) {
+	// A slowly changing series with repeats, steps whose delta is not exact
+	// in a float32 and values that have no delta at all.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var points []Point
+	v := 100.0
+	for i := 0; i < 2000; i++ {
+		if i%3 != 0 {
+			v += 0.25
+		}
+		value := map[string]float64{"slow": v, "step": float64(i) * 0.1}
+		switch i {
+		case 10:
+			value["odd"] = math.NaN()
+		case 11:
+			value["odd"] = math.Inf(-1)
+		case 12:
+			value["odd"] = math.Copysign(0, -1)
+		case 13:
+			value["odd"] = math.MaxFloat64
+		case 14:
+			value["odd"] = math.SmallestNonzeroFloat64
+		}
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano(), Value: value})
+	}
+
+	open := func(deltas bool) *DB {
+		db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 64, DeltaValues: deltas})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.LoadSorted(points); err != nil {
+			t.Fatal(err)
+		}
+		return reopen(t, db, &Options{MaxLeafPoints: 64})
+	}
+	plain, deltas := open(false), open(true)
+	defer plain.Close()
+	defer deltas.Close()
+
+	got, err := deltas.Range(points[0].Timestamp, points[len(points)-1].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(points) {
+		t.Fatalf("Range returned %d points, want %d", len(got), len(points))
+	}
+	for i, point := range got {
+		if len(point.Value) != len(points[i].Value) {
+			t.Fatalf("point %d: %v, want %v", i, point.Value, points[i].Value)
+		}
+		for k, want := range points[i].Value {
+			if math.Float64bits(point.Value[k]) != math.Float64bits(want) {
+				t.Fatalf("point %d: %s = %v, want %v", i, k, point.Value[k], want)
+			}
+		}
+	}
+	dst := make(map[string]float64)
+	if ok, err := deltas.GetInto(points[1234].Timestamp, dst); err != nil || !ok || dst["slow"] != points[1234].Value["slow"] {
+		t.Fatalf("GetInto = %v, %v, %v", ok, err, dst)
+	}
+
+	// A leaf of the slow series alone is a fifth smaller.
+	leaf := deltas.newLeafNode()
+	for i := range points {
+		leaf.points = append(leaf.points, &Point{Timestamp: points[i].Timestamp, Value: map[string]float64{"slow": points[i].Value["slow"]}})
+	}
+	deltas.deltaValues = true
+	d := len(leaf.encode())
+	deltas.deltaValues = false
+	if p := len(leaf.encode()); d*5 > p*4 {
+		t.Fatalf("leaf of deltas takes %d bytes, plain %d", d, p)
+	}
+}
+
+// wideInterior returns an encoded interior node of a minute of seconds,
+// every pointer carrying values for metrics metrics, and its header flags.
+func wideInterior(db *DB, metrics int) ([]byte, byte) {
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local)
+	n := db.newInteriorNode()
+	n.level = LevelMinute
+	for i := 0; i < 60; i++ {
+		value := make(map[string]Value, metrics)
+		for m := 0; m < metrics; m++ {
+			v := float64(i*metrics + m)
+			value[fmt.Sprintf("m%d", m)] = Value{sum: v, max: v, min: v, first: v, last: v, count: 1}
+		}
+		n.pointers = append(n.pointers, &nodePointer{
+			key:   base.Add(time.Duration(i) * time.Second).UnixNano(),
+			pos:   int64(i),
+			count: 1,
+			value: value,
+		})
+	}
+	nodeBytes, hflags, err := chunkNode(n.encode())
+	if err != nil {
+		panic(err)
+	}
+	return nodeBytes, hflags
+}
+
+func TestDecodeInteriorRange(t *testing.T) {
+	db := &DB{}
+	nodeBytes, hflags := wideInterior(db, 50)
+	full, err := db.decodeInteriorNode(nodeBytes, hflags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local)
+	from := base.Add(10*time.Second + time.Millisecond).UnixNano()
+	to := base.Add(20 * time.Second).UnixNano()
+	set := newMetricSet([]string{"m3", "m41", "missing"})
+	n, err := db.decodeInteriorRange(nodeBytes, hflags, from, to, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.level != full.level {
+		t.Fatalf("level %#x, want %#x", n.level, full.level)
+	}
+	// The second holding from is kept, though from is past its start.
+	if want := full.pointers[10:21]; len(n.pointers) != len(want) {
+		t.Fatalf("decoded %d pointers, want %d", len(n.pointers), len(want))
+	}
+	for i, pointer := range n.pointers {
+		want := full.pointers[10+i]
+		if pointer.key != want.key || pointer.pos != want.pos || pointer.count != want.count {
+			t.Fatalf("pointer %d = %+v, want %+v", i, pointer, want)
+		}
+		if len(pointer.value) != 2 {
+			t.Fatalf("pointer %d holds %d metrics, want 2", i, len(pointer.value))
+		}
+		for k, v := range pointer.value {
+			if !sameValue(v, want.value[k]) {
+				t.Fatalf("pointer %d: %s = %+v, want %+v", i, k, v, want.value[k])
+			}
+		}
+	}
+
+	if _, err := db.decodeInteriorRange(nodeBytes[:len(nodeBytes)-1], hflags, from, math.MaxInt64, set); err != ErrInvalid {
+		t.Fatalf("decoding a truncated node: %v, want ErrInvalid", err)
+	}
+}
+
+func TestAggregateMetricsOnDisk(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	points := make([]Point, 2000)
+	for i := range points {
+		value := make(map[string]float64)
+		for m := 0; m < 20; m++ {
+			if (i+m)%3 != 0 {
+				value[fmt.Sprintf("m%d", m)] = float64(i * m)
+			}
+		}
+		points[i] = Point{Timestamp: base.Add(time.Duration(i) * 37 * time.Second).UnixNano(), Value: value}
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, &Options{MaxLeafPoints: 8})
+	defer db.Close()
+
+	ranges := [][2]int64{
+		{points[0].Timestamp, points[len(points)-1].Timestamp},
+		{points[13].Timestamp + 1, points[1500].Timestamp},
+		{points[700].Timestamp, points[701].Timestamp - 1},
+	}
+	for _, r := range ranges {
+		all, err := db.Aggregate(r[0], r[1], LevelNSecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, metric := range []string{"m0", "m7", "none"} {
+			got, err := db.Aggregate(r[0], r[1], LevelNSecond, metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, ok := all[metric]
+			if _, found := got[metric]; found != ok || len(got) > 1 || !sameValue(got[metric], want) {
+				t.Fatalf("%v: Aggregate(%s) = %+v, want %+v", r, metric, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeWideInterior(b *testing.B) {
+	db := &DB{}
+	nodeBytes, hflags := wideInterior(db, 1000)
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local)
+	from := base.Add(30 * time.Second).UnixNano()
+	set := newMetricSet([]string{"m500"})
+
+	b.Run("Full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.decodeInteriorNode(nodeBytes, hflags); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Range", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.decodeInteriorRange(nodeBytes, hflags, from, math.MaxInt64, set); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"time"
+)
+
+// Bar is a candlestick of the values of a metric over a window.
+type Bar struct {
+	Start  int64 // the start of the window
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+}
+
+// OHLC groups the points between start and end inclusive into windows of
+// width bucket starting at start, like Downsample, and returns a bar for
+// every window holding values of metric: its first, largest, smallest and
+// last value, and the sum of the values of the metric volume in the window
+// as its volume. An empty volume leaves the volumes zero.
+func (db *DB) OHLC(start, end int64, metric, volume string, bucket time.Duration) ([]Bar, error) {
+	if bucket <= 0 {
+		return nil, ErrInvalidBucket
+	}
+
+	bars := make([]Bar, 0)
+	if start > end {
+		return bars, nil
+	}
+
+	var window int64
+	var price, vol Value
+	emit := func() {
+		if price.count == 0 {
+			price, vol = Value{}, Value{}
+			return
+		}
+		bars = append(bars, Bar{
+			Start:  window,
+			Open:   price.first,
+			High:   price.max,
+			Low:    price.min,
+			Close:  price.last,
+			Volume: vol.sum,
+		})
+		price, vol = Value{}, Value{}
+	}
+
+	width := int64(bucket)
+	err := db.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.level = levelPoint
+		c.seek(start)
+		return c.each(end, func(point *Point) error {
+			if point.Timestamp < start {
+				return nil
+			}
+			if w := start + (point.Timestamp-start)/width*width; w != window {
+				emit()
+				window = w
+			}
+			if v, ok := point.Value[metric]; ok {
+				price.add(v)
+			}
+			if v, ok := point.Value[volume]; ok && volume != "" {
+				vol.add(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	emit()
+	return bars, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOHLC(t *testing.T) {
+	db := tempDB(t)
+
+	// Ticks every ten seconds over three minutes, the second of which has
+	// trades without a price.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	prices := []float64{10, 12, 9, 11, 11.5, 10.5, 0, 0, 0, 0, 0, 0, 20, 18, 21, 19, 17, 19.5}
+	var points []Point
+	for i, price := range prices {
+		value := map[string]float64{"qty": float64(i + 1)}
+		if i < 6 || i >= 12 {
+			value["price"] = price
+		}
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 10 * time.Second).UnixNano(),
+			Value:     value,
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	bars, err := db.OHLC(base.UnixNano(), base.Add(3*time.Minute).UnixNano(), "price", "qty", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bar{
+		{Start: base.UnixNano(), Open: 10, High: 12, Low: 9, Close: 10.5, Volume: 1 + 2 + 3 + 4 + 5 + 6},
+		{Start: base.Add(2 * time.Minute).UnixNano(), Open: 20, High: 21, Low: 17, Close: 19.5, Volume: 13 + 14 + 15 + 16 + 17 + 18},
+	}
+	if len(bars) != len(want) {
+		t.Fatalf("got %d bars, want %d: %+v", len(bars), len(want), bars)
+	}
+	for i := range want {
+		if bars[i] != want[i] {
+			t.Fatalf("bar %d: got %+v, want %+v", i, bars[i], want[i])
+		}
+	}
+
+	// Without a volume metric the volumes are zero.
+	bars, err = db.OHLC(base.UnixNano(), base.Add(50*time.Second).UnixNano(), "price", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bars) != 1 || bars[0].Volume != 0 || bars[0].Close != 10.5 {
+		t.Fatalf("unexpected bars: %+v", bars)
+	}
+
+	if _, err := db.OHLC(0, 1, "price", "qty", 0); err != ErrInvalidBucket {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
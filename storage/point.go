@@ -3,16 +3,34 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
 )
 
+// Point is a timestamp in unixnano and the values of the metrics stored at
+// it. It is what Range, Iterator and the other queries return, and its
+// JSON field names are part of the API.
 type Point struct {
-	Timestamp int64              `json:timestamp`
-	Value     map[string]float64 `json:value`
+	Timestamp int64              `json:"timestamp"`
+	Value     map[string]float64 `json:"value"`
+
+	expires int64 // when a point put with a TTL expires, zero if never
+}
+
+// expired reports whether p was put with a TTL that ran out by now.
+func (p *Point) expired(now int64) bool {
+	return p.expires != 0 && p.expires <= now
 }
 
 func (p *Point) encode() []byte {
 	buf := new(bytes.Buffer)
 	buf.Write(encodeInt64(p.Timestamp))
+	buf.Write(p.encodeMetrics())
+	return buf.Bytes()
+}
+
+// encodeMetrics encodes the metrics of p without its timestamp.
+func (p *Point) encodeMetrics() []byte {
+	buf := new(bytes.Buffer)
 	for k, v := range p.Value {
 		keyBytes := []byte(k)
 		buf.Write(encodeUint16(uint16(len(keyBytes))))
@@ -22,6 +40,71 @@ func (p *Point) encode() []byte {
 	return buf.Bytes()
 }
 
+// Tags of the values encoded by encodeDeltaMetrics.
+const (
+	deltaSame    = iota // the previous value, nothing follows
+	deltaFloat32        // a float32 delta follows
+	deltaFull           // the value follows in full
+)
+
+// encodeDeltaMetrics encodes the metrics of p like encodeMetrics, but each
+// value as a tag and a delta from the previous value of its metric in
+// values, zero for the first, which it then updates. Values are stored in
+// full where the delta does not fit a float32 or adding it back to the
+// previous value would not give the value bit for bit, so they always
+// decode exactly; only slowly changing series, whose deltas are small, get
+// smaller.
+func (p *Point) encodeDeltaMetrics(values map[string]float64) []byte {
+	buf := new(bytes.Buffer)
+	for k, v := range p.Value {
+		keyBytes := []byte(k)
+		buf.Write(encodeUint16(uint16(len(keyBytes))))
+		buf.Write(keyBytes)
+
+		prev := values[k]
+		values[k] = v
+		delta := float32(v - prev)
+		switch {
+		case math.Float64bits(v) == math.Float64bits(prev):
+			buf.WriteByte(deltaSame)
+		case math.Float64bits(prev+float64(delta)) == math.Float64bits(v):
+			buf.WriteByte(deltaFloat32)
+			buf.Write(encodeUint32(math.Float32bits(delta)))
+		default:
+			buf.WriteByte(deltaFull)
+			buf.Write(encodeFloat64(v))
+		}
+	}
+	return buf.Bytes()
+}
+
+// pointSize returns an upper bound of the bytes p takes in a leaf of db.
+func (db *DB) pointSize(p *Point) int {
+	size := p.encodedSize()
+	if db.deltaValues {
+		// A value delta takes a tag besides at most the 8 bytes of the
+		// value.
+		size += len(p.Value)
+	}
+	return size
+}
+
+// MaxMetricNameLength is the longest metric name in bytes, its length is
+// stored in 16 bits.
+const MaxMetricNameLength = math.MaxUint16
+
+// encodedSize returns an upper bound of the bytes p takes in a leaf.
+func (p *Point) encodedSize() int {
+	size := binary.MaxVarintLen64 + binary.MaxVarintLen32
+	if p.expires != 0 {
+		size += binary.MaxVarintLen64
+	}
+	for k := range p.Value {
+		size += 2 + len(k) + 8
+	}
+	return size
+}
+
 func newPoint() *Point {
 	return &Point{
 		Value: make(map[string]float64, 0),
@@ -29,17 +112,127 @@ func newPoint() *Point {
 }
 
 func decodePoint(pointBytes []byte) (*Point, error) {
+	if len(pointBytes) < 8 {
+		return nil, ErrInvalid
+	}
 	p := newPoint()
-	p.Timestamp = int64(binary.BigEndian.Uint64(pointBytes[0:8]))
-	bufPos := 8
-	for bufPos < len(pointBytes) {
-		keyLength := int(decodeUint16(pointBytes[bufPos : bufPos+2]))
+	p.Timestamp = decodeInt64(pointBytes[0:8])
+	var err error
+	if p.Value, err = decodeMetrics(pointBytes[8:]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decodeMetrics decodes metrics encoded by Point.encodeMetrics. It returns
+// ErrInvalid if valueBytes ends within a metric.
+func decodeMetrics(valueBytes []byte) (map[string]float64, error) {
+	value := make(map[string]float64)
+	if err := decodeMetricsInto(valueBytes, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// decodeMetricsInto is decodeMetrics, adding the metrics to value.
+func decodeMetricsInto(valueBytes []byte, value map[string]float64) error {
+	bufPos := 0
+	for bufPos < len(valueBytes) {
+		if len(valueBytes)-bufPos < 2 {
+			return ErrInvalid
+		}
+		keyLength := int(decodeUint16(valueBytes[bufPos : bufPos+2]))
 		bufPos += 2
-		key := string(pointBytes[bufPos : bufPos+keyLength])
+		if len(valueBytes)-bufPos < keyLength+8 {
+			return ErrInvalid
+		}
+		key := string(valueBytes[bufPos : bufPos+keyLength])
 		bufPos += keyLength
-		value := decodeFloat64(pointBytes[bufPos : bufPos+8])
+		value[key] = decodeFloat64(valueBytes[bufPos : bufPos+8])
 		bufPos += 8
-		p.Value[key] = value
 	}
-	return p, nil
+	return nil
+}
+
+// decodeDeltaMetrics decodes metrics encoded by Point.encodeDeltaMetrics
+// from the previous values, which it updates.
+func decodeDeltaMetrics(valueBytes []byte, values map[string]float64) (map[string]float64, error) {
+	value := make(map[string]float64)
+	bufPos := 0
+	for bufPos < len(valueBytes) {
+		if len(valueBytes)-bufPos < 2 {
+			return nil, ErrInvalid
+		}
+		keyLength := int(decodeUint16(valueBytes[bufPos : bufPos+2]))
+		bufPos += 2
+		if len(valueBytes)-bufPos < keyLength+1 {
+			return nil, ErrInvalid
+		}
+		key := string(valueBytes[bufPos : bufPos+keyLength])
+		bufPos += keyLength
+		tag := valueBytes[bufPos]
+		bufPos++
+
+		v := values[key]
+		switch tag {
+		case deltaSame:
+		case deltaFloat32:
+			if len(valueBytes)-bufPos < 4 {
+				return nil, ErrInvalid
+			}
+			v += float64(math.Float32frombits(decodeUint32(valueBytes[bufPos : bufPos+4])))
+			bufPos += 4
+		case deltaFull:
+			if len(valueBytes)-bufPos < 8 {
+				return nil, ErrInvalid
+			}
+			v = decodeFloat64(valueBytes[bufPos : bufPos+8])
+			bufPos += 8
+		default:
+			return nil, ErrInvalid
+		}
+		values[key] = v
+		value[key] = v
+	}
+	return value, nil
+}
+
+// metricSet holds the metrics a query asked for, nil means all of them.
+type metricSet map[string]struct{}
+
+func newMetricSet(metrics []string) metricSet {
+	if len(metrics) == 0 {
+		return nil
+	}
+	s := make(metricSet, len(metrics))
+	for _, metric := range metrics {
+		s[metric] = struct{}{}
+	}
+	return s
+}
+
+func (s metricSet) has(metric string) bool {
+	if s == nil {
+		return true
+	}
+	_, ok := s[metric]
+	return ok
+}
+
+// filter returns the values of p that are in s, or nil if there are none.
+func (s metricSet) filter(p *Point) map[string]float64 {
+	if s == nil {
+		return p.Value
+	}
+	var value map[string]float64
+	for k, v := range p.Value {
+		if !s.has(k) {
+			continue
+		}
+		if value == nil {
+			value = make(map[string]float64, len(s))
+		}
+		value[k] = v
+	}
+	return value
 }
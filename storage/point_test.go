@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPointJSON(t *testing.T) {
+	p := Point{Timestamp: 1472390640000000000, Value: map[string]float64{"v": 1.5}, expires: 1}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"timestamp":1472390640000000000,"value":{"v":1.5}}`; string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+
+	var got Point
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Timestamp != p.Timestamp || !reflect.DeepEqual(got.Value, p.Value) {
+		t.Fatalf("got %+v, want %+v", got, p)
+	}
+}
+
+func TestPointEncode(t *testing.T) {
+	p := &Point{Timestamp: -3, Value: map[string]float64{"a": 1, "bb": -2.5}}
+	got, err := decodePoint(p.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Timestamp != p.Timestamp || !reflect.DeepEqual(got.Value, p.Value) {
+		t.Fatalf("got %+v, want %+v", got, p)
+	}
+}
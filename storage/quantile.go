@@ -0,0 +1,31 @@
+package storage
+
+// Quantile returns the value of metric below which a fraction q of the
+// points between start and end inclusive lie, within a relative error of
+// 2%. q of 0 and 1 give the exact minimum and maximum. It returns
+// ErrNotFound if no point in the range holds metric.
+//
+// Subtrees lying entirely in the range are merged from the histograms kept
+// in their parents, only the leaves at either end are read. Subtrees
+// written before histograms were kept are read down to their leaves.
+func (db *DB) Quantile(start, end int64, metric string, q float64) (float64, error) {
+	if !(q >= 0 && q <= 1) {
+		return 0, ErrInvalidQuantile
+	}
+
+	value := make(map[string]Value)
+	set := newMetricSet([]string{metric})
+	err := db.View(func(tx *Tx) error {
+		return tx.root.aggregate(start, end, set, true, value)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	v, ok := value[metric]
+	if !ok || v.count == 0 {
+		return 0, ErrNotFound
+	}
+	f, _ := v.Quantile(q)
+	return f, nil
+}
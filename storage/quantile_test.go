@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	db := tempDB(t)
+
+	// Three days of latencies, every two minutes.
+	rnd := rand.New(rand.NewSource(1))
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	var keys []int64
+	var values []float64
+	for i := 0; i < 3*24*30; i++ {
+		key := base.Add(time.Duration(i) * 2 * time.Minute).UnixNano()
+		v := math.Exp(rnd.NormFloat64()) * 20
+		keys = append(keys, key)
+		values = append(values, v)
+		if err := db.Put(key, map[string]float64{"latency": v, "other": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := func(from, to int, q float64) float64 {
+		sorted := append([]float64(nil), values[from:to+1]...)
+		sort.Float64s(sorted)
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	check := func(db *DB, from, to int) {
+		for _, q := range []float64{0, 0.5, 0.95, 0.99, 1} {
+			got, err := db.Quantile(keys[from], keys[to], "latency", q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := want(from, to, q)
+			if math.Abs(got-w) > histogramAccuracy*w {
+				t.Fatalf("points %d-%d p%v: got %v, want %v", from, to, q*100, got, w)
+			}
+			if (q == 0 || q == 1) && got != w {
+				t.Fatalf("points %d-%d p%v: got %v, want exactly %v", from, to, q*100, got, w)
+			}
+		}
+	}
+
+	// The whole range, and one cutting days and leaves in the middle.
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			db = reopen(t, db, nil)
+		}
+		check(db, 0, len(keys)-1)
+		check(db, 500, 1700)
+	}
+
+	if _, err := db.Quantile(keys[0], keys[len(keys)-1], "latency", 1.5); err != ErrInvalidQuantile {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Quantile(keys[0], keys[len(keys)-1], "missing", 0.5); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Values reduced without a histogram are read from the leaves.
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, pointer := range tx.root.pointers {
+		for k, v := range pointer.value {
+			v.hist, v.histBytes = nil, nil
+			pointer.value[k] = v
+		}
+	}
+	value := make(map[string]Value)
+	if err := tx.root.aggregate(keys[0], keys[len(keys)-1], newMetricSet([]string{"latency"}), true, value); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := value["latency"].Quantile(0.5)
+	if w := want(0, len(keys)-1, 0.5); !ok || math.Abs(got-w) > histogramAccuracy*w {
+		t.Fatalf("p50 from leaves: got %v %v, want %v", got, ok, w)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	// Values spread wider than the bins can hold at full accuracy.
+	h := newHistogram()
+	var values []float64
+	for i := -300; i <= 600; i++ {
+		v := math.Pow(1.05, float64(i))
+		if i%3 == 0 {
+			v = -v
+		}
+		values = append(values, v)
+		h.add(v)
+	}
+	h.add(0)
+	values = append(values, 0)
+
+	if n := len(h.pos) + len(h.neg); n > maxHistogramBins {
+		t.Fatalf("%d bins, max %d", n, maxHistogramBins)
+	}
+	if h.count() != uint64(len(values)) {
+		t.Fatalf("count = %d, want %d", h.count(), len(values))
+	}
+
+	// Encoding keeps the buckets.
+	b := encodeHistogram(h)
+	if n, err := histogramSize(b); err != nil || n != len(b) {
+		t.Fatalf("histogramSize = %d, %v, want %d", n, err, len(b))
+	}
+	d, n, err := decodeHistogram(b)
+	if err != nil || n != len(b) {
+		t.Fatalf("decodeHistogram = %d, %v", n, err)
+	}
+
+	// Only the buckets nearest to zero were folded, the large quantiles
+	// stay accurate.
+	sort.Float64s(values)
+	for _, q := range []float64{0.01, 0.9, 0.99} {
+		w := values[int(q*float64(len(values)-1))]
+		for _, h := range []*histogram{h, d} {
+			if got := h.quantile(q); math.Abs(got-w) > histogramAccuracy*math.Abs(w) {
+				t.Fatalf("p%v: got %v, want %v", q*100, got, w)
+			}
+		}
+	}
+
+	if n, err := histogramSize(encodeHistogram(nil)); err != nil || n != 1 {
+		t.Fatalf("histogramSize(nil) = %d, %v", n, err)
+	}
+	if _, err := histogramSize(b[:len(b)-1]); err != ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"container/list"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// queryCache keeps the results of the most recent aggregates, evicting the
+// least recently used once it holds max of them. Every result is keyed by
+// the transaction it was computed in, so one computed before a write is
+// never returned after it: later queries carry a newer txid and miss, and
+// the old results are evicted in time.
+type queryCache struct {
+	mu    sync.Mutex
+	max   int
+	lru   *list.List // front is the most recently used
+	items map[queryKey]*list.Element
+}
+
+// queryKey identifies an aggregate: its range, already aligned to its
+// level, its metrics, and the txid it was read at. The metrics are sorted,
+// deduplicated and each prefixed with its length, so no two lists of names
+// encode the same; all is set instead when no metrics were given.
+type queryKey struct {
+	from, to int64
+	level    uint16
+	all      bool
+	metrics  string
+	txid     uint64
+}
+
+type queryEntry struct {
+	key   queryKey
+	value map[string]Value
+}
+
+func newQueryKey(from, to int64, level uint16, metrics []string, txid uint64) queryKey {
+	key := queryKey{from: from, to: to, level: level, all: len(metrics) == 0, txid: txid}
+	sorted := append([]string(nil), metrics...)
+	sort.Strings(sorted)
+	var b strings.Builder
+	for i, k := range sorted {
+		if i > 0 && k == sorted[i-1] {
+			continue
+		}
+		b.WriteString(strconv.Itoa(len(k)))
+		b.WriteByte(':')
+		b.WriteString(k)
+	}
+	key.metrics = b.String()
+	return key
+}
+
+// newQueryCache returns a cache of max results, or nil if max is zero.
+func newQueryCache(max int) *queryCache {
+	if max == 0 {
+		return nil
+	}
+	return &queryCache{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[queryKey]*list.Element),
+	}
+}
+
+// get returns a copy of the result cached for key, if there is one.
+func (c *queryCache) get(key queryKey) (map[string]Value, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return copyValues(e.Value.(*queryEntry).value), true
+}
+
+// put caches a copy of value for key, evicting the least recently used
+// results over the limit.
+func (c *queryCache) put(key queryKey, value map[string]Value) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&queryEntry{key: key, value: copyValues(value)})
+	for c.lru.Len() > c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*queryEntry).key)
+	}
+}
+
+// copyValues returns a copy of value, so the caller of Aggregate can change
+// the map it gets without touching the cached one.
+func copyValues(value map[string]Value) map[string]Value {
+	out := make(map[string]Value, len(value))
+	for k, v := range value {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryCache(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 16, QueryCacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	points := make([]Point, 500)
+	for i := range points {
+		points[i] = Point{
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+			Value:     map[string]float64{"a": float64(i), "b": 1},
+		}
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	var hits, misses uint64
+	aggregate := func(start, end int64, level uint16, hit bool, metrics ...string) map[string]Value {
+		t.Helper()
+		value, err := db.Aggregate(start, end, level, metrics...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+		if m := db.Metrics(); m.QueryCacheHits != hits || m.QueryCacheMisses != misses {
+			t.Fatalf("%d hits and %d misses, want %d and %d", m.QueryCacheHits, m.QueryCacheMisses, hits, misses)
+		}
+		return value
+	}
+
+	start, end := points[10].Timestamp, points[400].Timestamp
+	want := aggregate(start, end, LevelHour, false)
+	got := aggregate(start, end, LevelHour, true)
+	if !sameValue(got["a"], want["a"]) || !sameValue(got["b"], want["b"]) {
+		t.Fatalf("cached %+v, want %+v", got, want)
+	}
+
+	// The caller's map is its own.
+	delete(got, "a")
+	if got := aggregate(start, end, LevelHour, true); !sameValue(got["a"], want["a"]) {
+		t.Fatalf("cached a = %+v after the caller changed its map, want %+v", got["a"], want["a"])
+	}
+	// Ends in the same buckets of the level are the same query.
+	aggregate(start+1, end+1, LevelHour, true)
+
+	// A write makes the next query miss, and it sees the write.
+	if err := db.Put(points[200].Timestamp+1, map[string]float64{"b": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := aggregate(start, end, LevelHour, false); got["b"].count != want["b"].count+1 {
+		t.Fatalf("b counted %d points after a put, want %d", got["b"].count, want["b"].count+1)
+	}
+	aggregate(start, end, LevelHour, true)
+
+	// Metrics are matched in any order, and other queries evict the least
+	// recently used.
+	aggregate(start, end, LevelHour, false, "b", "a")
+	aggregate(start, end, LevelHour, true, "a", "b")
+	aggregate(start, end, LevelDay, false)
+	aggregate(start, end, LevelHour, false)
+}
+
+func TestQueryKey(t *testing.T) {
+	key := func(metrics ...string) queryKey {
+		return newQueryKey(1, 2, LevelHour, metrics, 3)
+	}
+	for _, pair := range [][2][]string{
+		{nil, {""}},
+		{{"a", "b"}, {"a\x00b"}},
+		{{"a", "b"}, {"ab"}},
+		{{"", "a"}, {"a"}},
+	} {
+		if key(pair[0]...) == key(pair[1]...) {
+			t.Fatalf("%q and %q share a key", pair[0], pair[1])
+		}
+	}
+	if key("b", "a", "a") != key("a", "b") {
+		t.Fatal("order or duplicates change the key")
+	}
+
+	// Through Aggregate, the empty metric name is not every metric.
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 16, QueryCacheSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := db.Put(base, map[string]float64{"a": 1, "b": 2, "a\x00b": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := db.Aggregate(base, base, LevelHour); err != nil || len(all) != 3 {
+		t.Fatalf("Aggregate = %v, %v", all, err)
+	}
+	if empty, err := db.Aggregate(base, base, LevelHour, ""); err != nil || len(empty) != 0 {
+		t.Fatalf("Aggregate of the empty name = %v, %v", empty, err)
+	}
+	if ab, err := db.Aggregate(base, base, LevelHour, "a", "b"); err != nil || len(ab) != 2 {
+		t.Fatalf("Aggregate of a and b = %v, %v", ab, err)
+	}
+	joined, err := db.Aggregate(base, base, LevelHour, "a\x00b")
+	if err != nil || len(joined) != 1 || joined["a\x00b"].Sum() != 3 {
+		t.Fatalf("Aggregate of a\\x00b = %v, %v", joined, err)
+	}
+}
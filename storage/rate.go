@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"time"
+)
+
+// Rate returns the per-second rate of the counter metric between every two
+// consecutive points between start and end inclusive that carry it. Each
+// rate is stamped with the later of the two points. A counter that went
+// down was reset, the rate across the reset is zero.
+func (db *DB) Rate(start, end int64, metric string) ([]Point, error) {
+	points := make([]Point, 0)
+	if start > end {
+		return points, nil
+	}
+
+	var prev *Point
+	err := db.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.level = levelPoint
+		c.seek(start)
+		return c.each(end, func(point *Point) error {
+			if point.Timestamp < start {
+				return nil
+			}
+			v, ok := point.Value[metric]
+			if !ok {
+				return nil
+			}
+			if prev != nil {
+				rate := 0.0
+				if delta := v - prev.Value[metric]; delta > 0 {
+					rate = delta / (float64(point.Timestamp-prev.Timestamp) / float64(time.Second))
+				}
+				points = append(points, Point{Timestamp: point.Timestamp, Value: map[string]float64{metric: rate}})
+			}
+			prev = point
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	db := tempDB(t)
+
+	// A counter read every ten seconds, growing by 5 and then by 20 a
+	// second, reset to 0 after the sixth read. One point in between does
+	// not carry it.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	counts := []float64{0, 50, 100, 150, 350, 550, 0, 200, 400}
+	var points []Point
+	for i, v := range counts {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 10 * time.Second).UnixNano(),
+			Value:     map[string]float64{"requests": v},
+		})
+	}
+	points = append(points, Point{
+		Timestamp: base.Add(15 * time.Second).UnixNano(),
+		Value:     map[string]float64{"other": 1},
+	})
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(i int) int64 { return base.Add(time.Duration(i) * 10 * time.Second).UnixNano() }
+	tests := []struct {
+		from, to int
+		want     []float64
+	}{
+		{0, 3, []float64{5, 5, 5}},
+		{0, 8, []float64{5, 5, 5, 20, 20, 0, 20, 20}},
+		{5, 7, []float64{0, 20}},
+		{4, 4, nil},
+	}
+	for _, tt := range tests {
+		got, err := db.Rate(key(tt.from), key(tt.to), "requests")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%d-%d: got %d rates, want %d", tt.from, tt.to, len(got), len(tt.want))
+		}
+		for i, p := range got {
+			if p.Timestamp != key(tt.from+i+1) || p.Value["requests"] != tt.want[i] {
+				t.Fatalf("%d-%d: rate %d is %v at %d, want %v at %d", tt.from, tt.to, i, p.Value, p.Timestamp, tt.want[i], key(tt.from+i+1))
+			}
+		}
+	}
+
+	if got, err := db.Rate(key(0), key(8), "missing"); err != nil || len(got) != 0 {
+		t.Fatalf("got %v, %v, want no rates", got, err)
+	}
+}
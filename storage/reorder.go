@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// ReorderWriter puts points that arrive slightly out of order. It holds
+// them in memory and, once flushEvery points are held, writes the ones more
+// than lateness behind the latest point it was given sorted in one
+// PutBatch, so the tree sees them in order. A point arriving behind what
+// was already written, or more than lateness behind the latest point, is
+// put on its own with Put, after the points held up to it. Points held are
+// lost by a crash. A ReorderWriter
+// must only be used from one goroutine.
+type ReorderWriter struct {
+	db         *DB
+	lateness   int64
+	flushEvery int
+	points     []Point // held, in the order they arrived
+	latest     int64   // latest timestamp given
+	written    int64   // latest timestamp written by a batch
+	started    bool    // whether latest and written are set
+}
+
+// NewReorderWriter returns a ReorderWriter holding points up to lateness
+// behind the latest one, writing them out every flushEvery points. A
+// flushEvery below one is taken as one.
+func (db *DB) NewReorderWriter(lateness time.Duration, flushEvery int) *ReorderWriter {
+	if flushEvery < 1 {
+		flushEvery = 1
+	}
+	return &ReorderWriter{db: db, lateness: int64(lateness), flushEvery: flushEvery}
+}
+
+// Write puts a point, holding it if it is within lateness of the latest
+// one. If writing the points held fails they are dropped.
+func (w *ReorderWriter) Write(key int64, value map[string]float64) error {
+	if w.db == nil {
+		return ErrWriterClosed
+	}
+	if !w.started {
+		w.latest, w.written, w.started = key, key-1, true
+	}
+	if key <= w.written || key < w.latest-w.lateness {
+		// Points held at or before key are written first, so an older
+		// one at key does not overwrite it later.
+		if err := w.write(key); err != nil {
+			return err
+		}
+		return w.db.Put(key, value)
+	}
+
+	w.points = append(w.points, Point{Timestamp: key, Value: value})
+	if key > w.latest {
+		w.latest = key
+	}
+	if len(w.points) < w.flushEvery {
+		return nil
+	}
+	return w.write(w.latest - w.lateness)
+}
+
+// Flush writes every point held.
+func (w *ReorderWriter) Flush() error {
+	if w.db == nil {
+		return ErrWriterClosed
+	}
+	return w.write(w.latest)
+}
+
+// Close writes the points held and closes the ReorderWriter.
+func (w *ReorderWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.db = nil
+	return nil
+}
+
+// write puts the points held up to end in one batch.
+func (w *ReorderWriter) write(end int64) error {
+	// Points at the same time keep the order they arrived in, so the last
+	// one wins as with Put.
+	sort.SliceStable(w.points, func(i, j int) bool {
+		return w.points[i].Timestamp < w.points[j].Timestamp
+	})
+	n := sort.Search(len(w.points), func(i int) bool {
+		return w.points[i].Timestamp > end
+	})
+	if n == 0 {
+		return nil
+	}
+
+	batch := w.points[:n]
+	w.points = append(w.points[:0:0], w.points[n:]...)
+	w.written = batch[len(batch)-1].Timestamp
+	return w.db.PutBatch(batch)
+}
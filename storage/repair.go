@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"os"
+	"sort"
+)
+
+// Repair rebuilds the database at path from the leaf chunks left in its
+// file, as a last resort when its meta or the interior of its tree is lost
+// and Open fails. It scans the whole file for chunks that match their crc,
+// skipping over damaged ones, and collects the points of every leaf; where
+// several leaves hold a point, the one written last wins. The points are
+// then written as a new tree after the old chunks and both metas are
+// rewritten to point at it. The new root keeps the level of the old one,
+// see Options.RootLevel, unless the points recovered no longer fit it.
+//
+// Points deleted since they were last written may come back, and the
+// points of series, whose leaves cannot be told apart from those of the
+// database, are recovered into the database itself. The file must not be
+// open elsewhere.
+func Repair(path string) error {
+	db := &DB{path: path, maxLeafPoints: DefaultMaxLeafPoints, logger: discardLogger{}}
+	var err error
+	if db.file, err = db.ops.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := flock(db.file, true, 0); err != nil {
+		return err
+	}
+	if db.pos, err = db.ops.GotoEOF(); err != nil {
+		return err
+	}
+	if db.pos < int64(MetaSize) {
+		return ErrInvalid
+	}
+
+	points, err := db.scanLeaves()
+	if err != nil {
+		return err
+	}
+
+	// Keep the checksum and the root level of the file if either meta can
+	// still be read, and else the level of the first root, written right
+	// after the metas when the file was created.
+	rootPos := int64(MetaSize)
+	for _, pos := range []uint64{0, MetaCopyPos} {
+		if m, err := db.readMetaAt(pos); err == nil {
+			db.checksum = m.checksum
+			rootPos = m.root
+			break
+		}
+	}
+	level := db.rootLevelAt(rootPos)
+	if len(points) > 0 && level != LevelRoot {
+		first, last := NewTime(points[0].Timestamp), NewTime(points[len(points)-1].Timestamp)
+		if first.Timestamp(level) != last.Timestamp(level) {
+			level = LevelRoot
+		}
+	}
+
+	root := db.newLeafNode()
+	root.level = level
+	if len(points) > 0 {
+		if root, err = db.build(level, points); err != nil {
+			return err
+		}
+	}
+	db.meta = newMeta(db.checksum)
+	if db.meta.root, err = root.flush(); err != nil {
+		return err
+	}
+	if err := db.writeMeta(db.meta); err != nil {
+		return err
+	}
+	return db.ops.Sync()
+}
+
+// rootLevelAt returns the level of the root chunk at pos, or LevelRoot if
+// it cannot be read or is not at a level a root can be.
+func (db *DB) rootLevelAt(pos int64) uint16 {
+	data, err := db.readChunkAt(pos)
+	if err != nil {
+		return LevelRoot
+	}
+	body, _, err := chunkNode(data)
+	if err != nil {
+		return LevelRoot
+	}
+	if level := decodeUint16(body[0:2]) & LevelFlag; validRootLevel(level) {
+		return level
+	}
+	return LevelRoot
+}
+
+// scanLeaves returns the points of every leaf chunk in the file, sorted by
+// timestamp, the later chunk winning where two hold the same one. A chunk
+// that does not match its crc is skipped byte by byte until one does.
+func (db *DB) scanLeaves() ([]Point, error) {
+	latest := make(map[int64]*Point)
+	prefix := make([]byte, ChunkLengthSize+ChunkCrcSize)
+	for pos := int64(MetaSize); pos+int64(len(prefix)) <= db.pos; {
+		if _, err := db.ops.ReadAt(prefix, pos); err != nil {
+			return nil, err
+		}
+		size := int64(decodeUint32(prefix[0:ChunkLengthSize]))
+		if size < ChunkCrcSize || pos+ChunkLengthSize+size > db.pos {
+			pos++
+			continue
+		}
+		data, err := db.readChunkAt(pos)
+		if err != nil {
+			pos++
+			continue
+		}
+		pos += ChunkLengthSize + size
+
+		body, hflags, err := chunkNode(data)
+		if err != nil || decodeUint16(body[0:2])&LeafFlag != LeafChunkFlag {
+			continue
+		}
+		leaf, err := db.decodeLeafNode(body, hflags)
+		if err != nil {
+			continue
+		}
+		for _, point := range leaf.points {
+			latest[point.Timestamp] = point
+		}
+	}
+
+	points := make([]Point, 0, len(latest))
+	for _, point := range latest {
+		points = append(points, *point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	return points, nil
+}
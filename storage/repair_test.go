@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepair(t *testing.T) {
+	db := tempDB(t)
+	path := db.Path()
+
+	// Three days of points every 10 minutes, put one by one so the file
+	// holds every version of the leaves, the first day put again.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 3*24*6; i++ {
+		key := base.Add(time.Duration(i) * 10 * time.Minute).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 24*6; i++ {
+		key := base.Add(time.Duration(i) * 10 * time.Minute).UnixNano()
+		if err := db.Put(key, map[string]float64{"v": -float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, end := base.UnixNano(), base.AddDate(0, 0, 3).UnixNano()
+	want, err := db.Range(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wipe both metas and damage the last root written.
+	root := db.meta.root
+	if _, err := db.ops.WriteAt(make([]byte, MetaSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ops.WriteAt([]byte{0xFF, 0xFF}, root+ChunkLengthSize+ChunkCrcSize+2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, 0600); err == nil {
+		t.Fatal("opened a database without a meta")
+	}
+
+	if err := Repair(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+	got, err := db.Range(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("repaired %d points, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Timestamp != want[i].Timestamp || got[i].Value["v"] != want[i].Value["v"] {
+			t.Fatalf("point %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if err := db.Put(end, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairRootLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenWithOptions(path, 0600, &Options{MaxLeafPoints: 16, RootLevel: LevelDay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 24*6; i++ {
+		if err := db.Put(day.Add(time.Duration(i)*10*time.Minute).UnixNano(), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without either meta the level is that of the first root of the file.
+	if _, err := db.ops.WriteAt(make([]byte, MetaSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repair(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+	if db.root.level != LevelDay {
+		t.Fatalf("root at level %#x, want %#x", db.root.level, LevelDay)
+	}
+	if err := db.Put(day.AddDate(0, 0, 1).UnixNano(), map[string]float64{"v": 1}); err != ErrOutsideRootSpan {
+		t.Fatalf("Put after the day: %v, want ErrOutsideRootSpan", err)
+	}
+}
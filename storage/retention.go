@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultRetentionInterval is how often points are expired when
+// Options.Retention is set and Options.RetentionInterval is not.
+const DefaultRetentionInterval = time.Minute
+
+// Expire removes the points older than age whose timestamps are aligned to
+// level or to nothing coarser, and returns how many there were. With a
+// level of LevelSecond a point at 10:00:05 is removed while one at 10:00:00,
+// aligned to the hour, is kept. Subtrees holding only such points are
+// dropped whole, their chunks are left for Compact to leave behind.
+// Subtrees trimmed by an earlier call for level, and not written since, are
+// passed over without being read.
+func (db *DB) Expire(level uint16, age time.Duration) (int, error) {
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	ts := time.Now().Add(-age).UnixNano()
+	from, ok := db.expired[level]
+	if !ok {
+		from = math.MinInt64
+	}
+	removed, empty, err := db.root.expire(level, ts, from)
+	if err != nil {
+		db.rollback()
+		return 0, err
+	}
+	if removed == 0 {
+		db.setExpired(level, ts)
+		return 0, nil
+	}
+	db.changes.lose()
+	if empty {
+		db.root.isLeaf = true
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return 0, err
+	}
+	db.setExpired(level, ts)
+	return int(removed), nil
+}
+
+// setExpired records that no point aligned to level is left before ts,
+// unless an earlier Expire went further.
+func (db *DB) setExpired(level uint16, ts int64) {
+	if db.expired == nil {
+		db.expired = make(map[uint16]int64)
+	}
+	if from, ok := db.expired[level]; !ok || ts > from {
+		db.expired[level] = ts
+	}
+}
+
+// unexpire moves the times of db.expired back to key, which a point is put
+// at.
+func (db *DB) unexpire(key int64) {
+	for level, ts := range db.expired {
+		if key < ts {
+			db.expired[level] = key
+		}
+	}
+}
+
+// validRetention reports whether every level of retention is one a point
+// can be aligned to, kept for a positive time.
+func validRetention(retention map[uint16]time.Duration) bool {
+	for level, age := range retention {
+		if level < LevelYear || level > LevelNSecond || level&(level-1) != 0 || age <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// startRetention starts expiring points every interval by the policy of
+// Options.Retention, until stopRetention is called.
+func (db *DB) startRetention(retention map[uint16]time.Duration, interval time.Duration) {
+	policy := make(map[uint16]time.Duration, len(retention))
+	for level, age := range retention {
+		policy[level] = age
+	}
+	db.retention, db.retentionInterval = policy, interval
+	if interval == 0 {
+		interval = DefaultRetentionInterval
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	db.retentionStop, db.retentionDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for level, age := range policy {
+				if _, err := db.Expire(level, age); err != nil {
+					db.logger.Printf("tickdb: %s: expire level %#x: %v", db.path, level, err)
+				}
+			}
+		}
+	}()
+}
+
+// stopRetention stops the goroutine started by startRetention and waits for
+// it to return.
+func (db *DB) stopRetention() {
+	if db.retentionStop == nil {
+		return
+	}
+	close(db.retentionStop)
+	<-db.retentionDone
+	db.retentionStop, db.retentionDone = nil, nil
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// retentionPoints puts 12 hours of points every 10 seconds ending an hour
+// ago and returns the keys of the ones on the minute, which a LevelSecond
+// policy keeps, and the rest apart.
+func retentionPoints(t *testing.T, db *DB) (coarse, fine []int64) {
+	end := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	for ts := end.Add(-12 * time.Hour); ts.Before(end); ts = ts.Add(10 * time.Second) {
+		key := ts.UnixNano()
+		if tt := NewTime(key); tt.Level() < LevelSecond {
+			coarse = append(coarse, key)
+		} else {
+			fine = append(fine, key)
+		}
+		if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return coarse, fine
+}
+
+func TestExpire(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 64})
+	defer db.Close()
+
+	coarse, fine := retentionPoints(t, db)
+	recent := time.Now().Add(-time.Second).UnixNano()
+	if err := db.Put(recent, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.Expire(LevelSecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(fine) {
+		t.Fatalf("Expire removed %d points, want %d", n, len(fine))
+	}
+	if n, err := db.Expire(LevelSecond, time.Minute); err != nil || n != 0 {
+		t.Fatalf("Expire again = %d, %v, want 0", n, err)
+	}
+
+	check := func(db *DB) {
+		for _, key := range fine[:10] {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Fatalf("Get(%d): %v, want ErrNotFound", key, err)
+			}
+		}
+		for _, key := range append(coarse, recent) {
+			if _, err := db.Get(key); err != nil {
+				t.Fatalf("Get(%d): %v", key, err)
+			}
+		}
+		count, err := db.Count(0, recent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(coarse)+1 {
+			t.Fatalf("Count = %d, want %d", count, len(coarse)+1)
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatal(errs)
+		}
+	}
+	check(db)
+	db = reopen(t, db, &Options{MaxLeafPoints: 64})
+	check(db)
+}
+
+func TestExpireSkipsTrimmed(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 64})
+	_, fine := retentionPoints(t, db)
+	db = reopen(t, db, &Options{MaxLeafPoints: 64})
+	defer db.Close()
+	if n, err := db.Expire(LevelSecond, time.Minute); err != nil || n != len(fine) {
+		t.Fatalf("Expire = %d, %v, want %d", n, err, len(fine))
+	}
+
+	// The nodes read are let go again.
+	held := 0
+	var count func(n *node)
+	count = func(n *node) {
+		held++
+		for _, pointer := range n.pointers {
+			if pointer.pointer != nil {
+				count(pointer.pointer)
+			}
+		}
+	}
+	count(db.root)
+	if held > 10 {
+		t.Fatalf("Expire left %d nodes in memory", held)
+	}
+
+	// The tree trimmed by the first run is not read again.
+	reads := 0
+	db.ops.readAt = func(b []byte, off int64) (int, error) {
+		reads++
+		return db.file.ReadAt(b, off)
+	}
+	if n, err := db.Expire(LevelSecond, time.Minute); err != nil || n != 0 {
+		t.Fatalf("Expire again = %d, %v, want 0", n, err)
+	}
+	if reads > 2 {
+		t.Fatalf("Expire again read %d chunks", reads)
+	}
+	db.ops.readAt = nil
+
+	// A point put before the trimmed time is expired by the next run.
+	key := fine[0]
+	if err := db.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Expire(LevelSecond, time.Minute); err != nil || n != 1 {
+		t.Fatalf("Expire after Put = %d, %v, want 1", n, err)
+	}
+	if _, err := db.Get(key); err != ErrNotFound {
+		t.Fatalf("Get(%d): %v, want ErrNotFound", key, err)
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db := tempDB(t)
+	coarse, fine := retentionPoints(t, db)
+
+	opts := &Options{
+		MaxLeafPoints:     DefaultMaxLeafPoints,
+		Retention:         map[uint16]time.Duration{LevelSecond: time.Hour},
+		RetentionInterval: 10 * time.Millisecond,
+	}
+	db = reopen(t, db, opts)
+	defer db.Close()
+
+	recent := time.Now().UnixNano()
+	if err := db.Put(recent, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := db.Get(fine[len(fine)-1]); err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old points were not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range append(coarse, recent) {
+		if _, err := db.Get(key); err != nil {
+			t.Fatalf("Get(%d): %v", key, err)
+		}
+	}
+
+	// A policy for a level no point can be aligned to is rejected.
+	for _, opts := range []*Options{
+		{MaxLeafPoints: 1, Retention: map[uint16]time.Duration{LevelSecond | LevelHour: time.Hour}},
+		{MaxLeafPoints: 1, Retention: map[uint16]time.Duration{LevelRoot: time.Hour}},
+		{MaxLeafPoints: 1, Retention: map[uint16]time.Duration{LevelSecond: 0}},
+		{MaxLeafPoints: 1, Retention: map[uint16]time.Duration{LevelSecond: time.Hour}, ReadOnly: true},
+	} {
+		if _, err := OpenWithOptions(db.Path(), 0600, opts); err != ErrInvalidOptions {
+			t.Fatalf("OpenWithOptions(%v) = %v, want ErrInvalidOptions", opts.Retention, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// Sample returns at most max of the points between start and end
+// inclusive, spread evenly over them by position and always holding the
+// first and the last, for previews of ranges too long to read whole. The
+// counts kept in the parents are used to step over the children between
+// the points picked, so only the leaves holding one are read. Expired
+// points are counted in the spacing but left out, see PutWithTTL.
+func (db *DB) Sample(start, end int64, max int) ([]Point, error) {
+	points := make([]Point, 0)
+	if start > end || max <= 0 {
+		return points, nil
+	}
+
+	err := db.View(func(tx *Tx) error {
+		total, err := tx.root.countRange(start, end)
+		if err != nil {
+			return err
+		}
+		if total == 0 {
+			return nil
+		}
+
+		targets := sampleTargets(total, int64(max))
+		points = make([]Point, 0, len(targets))
+		points, _, err = tx.root.sample(start, end, 0, targets, points, time.Now().UnixNano())
+		return err
+	})
+	return points, err
+}
+
+// sampleTargets returns the positions of max points spread evenly over
+// total, the first and the last included, or all of them if there are not
+// more than max.
+func sampleTargets(total, max int64) []int64 {
+	if total <= max {
+		max = total
+	}
+	targets := make([]int64, max)
+	if max == 1 {
+		return targets
+	}
+	for i := range targets {
+		targets[i] = int64(i) * (total - 1) / (max - 1)
+	}
+	return targets
+}
+
+// sample appends to points the points between from and to at the
+// positions in targets, sorted, counted from offset for the first point of
+// the range below n. It returns the targets it did not reach.
+func (n *node) sample(from, to, offset int64, targets []int64, points []Point, now int64) ([]Point, []int64, error) {
+	if n.isLeaf {
+		index := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= from
+		})
+		for _, point := range n.points[index:] {
+			if len(targets) == 0 || point.Timestamp > to {
+				break
+			}
+			if targets[0] == offset {
+				targets = targets[1:]
+				if !point.expired(now) {
+					points = append(points, Point{Timestamp: point.Timestamp, Value: point.Value})
+				}
+			}
+			offset++
+		}
+		return points, targets, nil
+	}
+
+	level := n.level << 1
+	for i, pointer := range n.pointers {
+		if len(targets) == 0 || pointer.key > to {
+			break
+		}
+		bucket := NewTime(pointer.key)
+		end := bucket.next(level) - 1
+		if end < from {
+			continue
+		}
+
+		count := pointer.count
+		if pointer.key < from || end > to || i == n.dirty || count < 0 {
+			child, err := n.childAt(i)
+			if err != nil {
+				return nil, nil, err
+			}
+			if count, err = child.countRange(from, to); err != nil {
+				return nil, nil, err
+			}
+		}
+		if targets[0] >= offset+count {
+			offset += count
+			continue
+		}
+
+		child, err := n.childAt(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if points, targets, err = child.sample(from, to, offset, targets, points, now); err != nil {
+			return nil, nil, err
+		}
+		offset += count
+	}
+	return points, targets, nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSample(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	defer db.Close()
+
+	if err := db.LoadSorted(sortedPoints(time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local), 5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := db.Range(0, 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		from, to int
+		max      int
+	}{
+		{0, len(all) - 1, 100},
+		{0, len(all) - 1, 2},
+		{0, len(all) - 1, 1},
+		{123, 4321, 77},
+		{10, 40, 100},
+		{5, 5, 10},
+	} {
+		start, end := all[tt.from].Timestamp, all[tt.to].Timestamp
+		points, err := db.Sample(start, end, tt.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := tt.to - tt.from + 1
+		if want > tt.max {
+			want = tt.max
+		}
+		if len(points) != want {
+			t.Fatalf("Sample(%d, %d, %d) returned %d points, want %d", tt.from, tt.to, tt.max, len(points), want)
+		}
+		if points[0].Timestamp != start {
+			t.Fatalf("Sample(%d, %d, %d) starts at %d, want %d", tt.from, tt.to, tt.max, points[0].Timestamp, start)
+		}
+		if tt.max > 1 && points[len(points)-1].Timestamp != end {
+			t.Fatalf("Sample(%d, %d, %d) ends at %d, want %d", tt.from, tt.to, tt.max, points[len(points)-1].Timestamp, end)
+		}
+
+		// The points are spread evenly by position, one step apart give or
+		// take one.
+		index := tt.from
+		prev := -1
+		minStep, maxStep := len(all), 0
+		for _, point := range points {
+			for all[index].Timestamp != point.Timestamp {
+				index++
+			}
+			if point.Value["a"] != all[index].Value["a"] {
+				t.Fatalf("point at %d has a = %v, want %v", point.Timestamp, point.Value["a"], all[index].Value["a"])
+			}
+			if prev >= 0 {
+				step := index - prev
+				if step < minStep {
+					minStep = step
+				}
+				if step > maxStep {
+					maxStep = step
+				}
+			}
+			prev = index
+		}
+		if maxStep-minStep > 1 {
+			t.Fatalf("Sample(%d, %d, %d) steps from %d to %d points", tt.from, tt.to, tt.max, minStep, maxStep)
+		}
+	}
+
+	if points, err := db.Sample(2, 1, 10); err != nil || len(points) != 0 {
+		t.Fatalf("Sample of an empty range = %v, %v", points, err)
+	}
+}
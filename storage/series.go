@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"sort"
+)
+
+// Series is a named tree of points kept in the same file as the main tree
+// of the database and every other series, so streams that must not mix
+// can share one file. A series is created by its first Put.
+//
+// The roots of the series are kept in a registry chunk that the meta
+// points to, rewritten by every flush that changes a series.
+type Series struct {
+	db    *DB
+	name  string
+	root  *node // the tree in memory, nil until it is first written
+	dirty bool  // root changed since the last flush
+}
+
+// Series returns the series called name, which need not exist yet.
+func (db *DB) Series(name string) (*Series, error) {
+	if name == "" || len(name) > math.MaxUint16 {
+		return nil, ErrInvalidSeries
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if db.file == nil {
+		return nil, ErrDatabaseNotOpen
+	}
+	s, ok := db.series[name]
+	if !ok {
+		s = &Series{db: db, name: name}
+		db.series[name] = s
+	}
+	return s, nil
+}
+
+// Name returns the name of the series.
+func (s *Series) Name() string {
+	return s.name
+}
+
+// Put stores a point in the series, creating the series if needed. It
+// replaces any point at the same timestamp like DB.Put.
+func (s *Series) Put(key int64, value map[string]float64) error {
+	db := s.db
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.dirty = true
+	if err := db.putIn(s.root, key, value, 0); err != nil {
+		db.rollback()
+		return err
+	}
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// Get returns the point of the series at key, or ErrNotFound.
+func (s *Series) Get(key int64) (point *Point, err error) {
+	err = s.view(func(tx *Tx) error {
+		point, err = tx.Get(key)
+		return err
+	})
+	return point, err
+}
+
+// Range returns the points of the series between start and end inclusive,
+// filtered to metrics like DB.Range.
+func (s *Series) Range(start, end int64, metrics ...string) (points []Point, err error) {
+	err = s.view(func(tx *Tx) error {
+		points, err = tx.Range(start, end, metrics...)
+		return err
+	})
+	return points, err
+}
+
+// view calls fn within a read-only transaction over the tree of the series
+// as of the last flush, which is empty if the series did not exist then.
+func (s *Series) view(fn func(tx *Tx) error) error {
+	return s.db.View(func(tx *Tx) error {
+		registry, err := s.db.readRegistry(tx.meta.registry)
+		if err != nil {
+			return err
+		}
+
+		root := s.db.newLeafNode()
+		root.level = LevelRoot
+		if pos, ok := registry[s.name]; ok {
+			if root, err = s.db.node(pos); err != nil {
+				return err
+			}
+		}
+		return fn(&Tx{db: s.db, meta: tx.meta, root: root})
+	})
+}
+
+// load reads the root of the series as of the last flush, or starts an
+// empty one.
+func (s *Series) load() error {
+	if s.root != nil {
+		return nil
+	}
+	if pos, ok := s.db.registry[s.name]; ok {
+		root, err := s.db.node(pos)
+		if err != nil {
+			return err
+		}
+		s.root = root
+		return nil
+	}
+	s.root = s.db.newLeafNode()
+	s.root.level = LevelRoot
+	return nil
+}
+
+// flushSeries flushes the series changed since the last flush and writes
+// the registry holding their new roots. It returns a nil registry if no
+// series changed.
+func (db *DB) flushSeries() (map[string]int64, int64, error) {
+	var registry map[string]int64
+	for name, s := range db.series {
+		if !s.dirty {
+			continue
+		}
+		if registry == nil {
+			registry = make(map[string]int64, len(db.registry)+1)
+			for k, v := range db.registry {
+				registry[k] = v
+			}
+		}
+		pos, err := s.root.flush()
+		if err != nil {
+			return nil, 0, err
+		}
+		registry[name] = pos
+	}
+	if registry == nil {
+		return nil, 0, nil
+	}
+
+	pos, _, err := db.writeChunk(encodeRegistry(registry))
+	if err != nil {
+		return nil, 0, err
+	}
+	return registry, pos, nil
+}
+
+// commitSeries makes registry, written by flushSeries, the current one.
+func (db *DB) commitSeries(registry map[string]int64) {
+	db.registry = registry
+	for _, s := range db.series {
+		s.dirty = false
+	}
+}
+
+// rollbackSeries discards the changes made to series since the last flush.
+func (db *DB) rollbackSeries() {
+	for _, s := range db.series {
+		if s.dirty {
+			s.root, s.dirty = nil, false
+		}
+	}
+}
+
+// readRegistry reads the registry chunk at pos, 0 meaning there is none.
+func (db *DB) readRegistry(pos int64) (map[string]int64, error) {
+	registry := make(map[string]int64)
+	if pos == 0 {
+		return registry, nil
+	}
+	data, err := db.readChunkAt(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	bufPos := 0
+	for bufPos < len(data) {
+		if len(data)-bufPos < 2 {
+			return nil, ErrInvalid
+		}
+		nameLength := int(decodeUint16(data[bufPos : bufPos+2]))
+		bufPos += 2
+		if len(data)-bufPos < nameLength+8 {
+			return nil, ErrInvalid
+		}
+		name := string(data[bufPos : bufPos+nameLength])
+		bufPos += nameLength
+		registry[name] = decodeInt64(data[bufPos : bufPos+8])
+		bufPos += 8
+	}
+	return registry, nil
+}
+
+// encodeRegistry encodes the name and root position of every series, in
+// name order.
+func encodeRegistry(registry map[string]int64) []byte {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	for _, name := range names {
+		buf.Write(encodeUint16(uint16(len(name))))
+		buf.Write([]byte(name))
+		buf.Write(encodeInt64(registry[name]))
+	}
+	return buf.Bytes()
+}
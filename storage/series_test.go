@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeries(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+	key := func(i int) int64 { return base.Add(time.Duration(i) * 7 * time.Minute).UnixNano() }
+
+	cpu, err := db.Series("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := db.Series("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.Series("cpu"); err != nil || s != cpu {
+		t.Fatalf("Series returned %p, %v, want %p", s, err, cpu)
+	}
+
+	// Nothing is stored before the first write.
+	if _, err := cpu.Get(key(0)); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The same timestamps in both series and the main tree.
+	const n = 500
+	for i := 0; i < n; i++ {
+		if err := cpu.Put(key(i), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := mem.Put(key(i), map[string]float64{"v": float64(-i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Put(key(0), map[string]float64{"main": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		cpu, err := db.Series("cpu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem, err := db.Series("mem")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points, err := cpu.Range(key(0), key(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != n {
+			t.Fatalf("cpu holds %d points, want %d", len(points), n)
+		}
+		for i, p := range points {
+			if p.Timestamp != key(i) || p.Value["v"] != float64(i) {
+				t.Fatalf("cpu point %d: got %d %v", i, p.Timestamp, p.Value)
+			}
+		}
+
+		points, err = mem.Range(key(0), key(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != n/2 {
+			t.Fatalf("mem holds %d points, want %d", len(points), n/2)
+		}
+		for i, p := range points {
+			if p.Timestamp != key(2*i) || p.Value["v"] != float64(-2*i) {
+				t.Fatalf("mem point %d: got %d %v", i, p.Timestamp, p.Value)
+			}
+		}
+		if _, err := mem.Get(key(1)); err != ErrNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The main tree holds only its own point.
+		if n, err := db.Count(key(0), key(n)); err != nil || n != 1 {
+			t.Fatalf("main tree holds %d points, %v", n, err)
+		}
+		if p, err := db.Get(key(0)); err != nil || p.Value["main"] != 1 {
+			t.Fatalf("main point %v, %v", p, err)
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+	check(db)
+	db = reopen(t, db, nil)
+	check(db)
+
+	// A series written after reopening keeps the others.
+	disk, err := db.Series("disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Put(key(0), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	path := filepath.Join(t.TempDir(), "compact")
+	if err := db.Compact(path); err != nil {
+		t.Fatal(err)
+	}
+	cdb, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+	check(cdb)
+	if disk, err = cdb.Series("disk"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.Get(key(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Series(""); err != ErrInvalidSeries {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Series(strings.Repeat("x", 1<<16)); err != ErrInvalidSeries {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSeriesRollback(t *testing.T) {
+	db := tempDB(t)
+
+	s, err := db.Series("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := s.Put(key, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write leaves the series as it was.
+	errDisk := errors.New("disk full")
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		return 0, errDisk
+	}
+	if err := s.Put(key+1, map[string]float64{"v": 2}); err != errDisk {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.ops.writeAt = nil
+
+	if err := s.Put(key+2, map[string]float64{"v": 3}); err != nil {
+		t.Fatal(err)
+	}
+	points, err := s.Range(key, key+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Timestamp != key || points[1].Timestamp != key+2 {
+		t.Fatalf("unexpected points: %v", points)
+	}
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"encoding/gob"
+	"io"
+	"sort"
+)
+
+// snapshot is the gob form of the tree held in memory. Children that were
+// never loaded are kept as pointers only.
+type snapshot struct {
+	Version uint16
+	Root    int64 // position of the root the tree was flushed to
+	Node    *snapshotNode
+}
+
+type snapshotNode struct {
+	Level    uint16
+	Leaf     bool
+	Points   []*snapshotPoint
+	Pointers []*snapshotPointer
+}
+
+// snapshotPoint is a Point with the expiry gob would drop from it.
+type snapshotPoint struct {
+	Timestamp int64
+	Value     map[string]float64
+	Expires   int64
+}
+
+type snapshotPointer struct {
+	Key   int64
+	Pos   int64
+	Count int64
+	Value map[string]snapshotValue
+	Child *snapshotNode // nil if the child was not loaded
+}
+
+type snapshotValue struct {
+	Sum, Max, Min, First, Last float64
+	Count                      uint32
+	Hist                       []byte // encoded by encodeHistogram
+}
+
+// Snapshot writes the tree held in memory to w, so a restarted process can
+// Restore it instead of reading the chunks again.
+func (db *DB) Snapshot(w io.Writer) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if db.file == nil {
+		return ErrDatabaseNotOpen
+	}
+
+	s := snapshot{
+		Version: Version,
+		Root:    db.meta.root,
+		Node:    db.root.snapshot(),
+	}
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// Restore replaces the tree held in memory with one written by Snapshot.
+// It returns ErrSnapshotMismatch if the snapshot was taken at a different
+// root than the one the database is at now, and ErrInvalid if its levels
+// are not consistent.
+func (db *DB) Restore(r io.Reader) error {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != Version {
+		return ErrVersionMismatch
+	}
+	if s.Node == nil {
+		return ErrInvalid
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if db.file == nil {
+		return ErrDatabaseNotOpen
+	}
+	if s.Root != db.meta.root {
+		return ErrSnapshotMismatch
+	}
+	if s.Node.Level != db.root.level {
+		return ErrInvalid
+	}
+
+	root, err := db.restoreNode(s.Node, nil)
+	if err != nil {
+		return err
+	}
+	db.root = root
+	db.expired = nil
+	return nil
+}
+
+func (n *node) snapshot() *snapshotNode {
+	sn := &snapshotNode{Level: n.level, Leaf: n.isLeaf}
+	if n.isLeaf {
+		sn.Points = make([]*snapshotPoint, len(n.points))
+		for i, p := range n.points {
+			sn.Points[i] = &snapshotPoint{p.Timestamp, p.Value, p.expires}
+		}
+		return sn
+	}
+
+	for _, pointer := range n.pointers {
+		sp := &snapshotPointer{
+			Key:   pointer.key,
+			Pos:   pointer.pos,
+			Count: pointer.count,
+			Value: make(map[string]snapshotValue, len(pointer.value)),
+		}
+		for k, v := range pointer.value {
+			sp.Value[k] = snapshotValue{v.sum, v.max, v.min, v.first, v.last, v.count, v.encodeHistogram()}
+		}
+		if pointer.pointer != nil {
+			sp.Child = pointer.pointer.snapshot()
+		}
+		sn.Pointers = append(sn.Pointers, sp)
+	}
+	return sn
+}
+
+// restoreNode rebuilds a node from its snapshot, checking that every child
+// is one level finer than its parent and that keys are sorted.
+func (db *DB) restoreNode(sn *snapshotNode, parent *node) (*node, error) {
+	if sn.Level == 0 || sn.Level&LevelFlag != sn.Level || sn.Level > LevelNSecond<<1 {
+		return nil, ErrInvalid
+	}
+	if parent != nil && sn.Level != parent.level<<1 {
+		return nil, ErrInvalid
+	}
+
+	if sn.Leaf {
+		n := db.newLeafNode()
+		n.level = sn.Level
+		n.parent = parent
+		if !sort.SliceIsSorted(sn.Points, func(i, j int) bool {
+			return sn.Points[i].Timestamp < sn.Points[j].Timestamp
+		}) {
+			return nil, ErrInvalid
+		}
+		for _, sp := range sn.Points {
+			n.points = append(n.points, &Point{Timestamp: sp.Timestamp, Value: sp.Value, expires: sp.Expires})
+		}
+		n.resize()
+		return n, nil
+	}
+
+	n := db.newInteriorNode()
+	n.level = sn.Level
+	n.parent = parent
+	for i, sp := range sn.Pointers {
+		if i > 0 && sp.Key <= sn.Pointers[i-1].Key {
+			return nil, ErrInvalid
+		}
+		np := &nodePointer{
+			key:   sp.Key,
+			pos:   sp.Pos,
+			count: sp.Count,
+			value: make(map[string]Value, len(sp.Value)),
+		}
+		for k, v := range sp.Value {
+			hist, _, err := decodeHistogram(v.Hist)
+			if err != nil {
+				return nil, err
+			}
+			np.value[k] = Value{
+				sum: v.Sum, max: v.Max, min: v.Min, first: v.First, last: v.Last,
+				count: v.Count, hist: hist,
+			}
+		}
+		if sp.Child != nil {
+			child, err := db.restoreNode(sp.Child, n)
+			if err != nil {
+				return nil, err
+			}
+			np.pointer = child
+		}
+		n.pointers = append(n.pointers, np)
+	}
+	return n, nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 3, time.Local)
+	var points []Point
+	for i := 0; i < 500; i++ {
+		points = append(points, Point{
+			Timestamp: base.Add(time.Duration(i) * 13 * time.Minute).UnixNano(),
+			Value:     map[string]float64{"v": float64(i)},
+		})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+
+	db = reopen(t, db, nil)
+	if err := db.Restore(bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("stats after restore: got %+v, want %+v", got, want)
+	}
+	if db.root.pointers[0].pointer == nil {
+		t.Fatal("expected restored children to be loaded")
+	}
+	if v := db.root.reduce()["v"]; v.Count() != len(points) {
+		t.Fatalf("restored tree holds %d points, want %d", v.Count(), len(points))
+	}
+
+	// The restored tree takes further writes.
+	key := base.Add(-time.Hour).UnixNano()
+	if err := db.Put(key, map[string]float64{"v": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Count(key, points[len(points)-1].Timestamp); err != nil {
+		t.Fatal(err)
+	} else if n != len(points)+1 {
+		t.Fatalf("got %d points, want %d", n, len(points)+1)
+	}
+
+	// The snapshot is now behind the database.
+	if err := db.Restore(bytes.NewReader(snap)); err != ErrSnapshotMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	db := tempDB(t)
+	if err := db.Put(time.Now().UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var s snapshot
+	if err := gob.NewDecoder(&buf).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip a level between the root and its child.
+	s.Node.Pointers[0].Child.Level <<= 1
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Restore(&buf); err != ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	db := tempDB(t)
+
+	const ttl = 300 * time.Millisecond
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := db.PutWithTTL(base, map[string]float64{"v": 1}, ttl); err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(ttl)
+
+	var buf bytes.Buffer
+	if err := db.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, nil)
+	if err := db.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A put into the restored leaf writes it again, expiry and all.
+	if err := db.Put(base+1, map[string]float64{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, nil)
+	defer db.Close()
+	time.Sleep(time.Until(expiry))
+
+	if _, err := db.Get(base); err != ErrNotFound {
+		t.Fatalf("Get of an expired point: %v, want ErrNotFound", err)
+	}
+	if _, err := db.Get(base + 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// Stats represents statistics about the database tree.
+type Stats struct {
+	InteriorNodes int   // number of interior nodes
+	LeafNodes     int   // number of leaf nodes
+	Points        int   // number of points in all leaves
+	Depth         int   // number of levels from the root to the deepest leaf
+	FileSize      int64 // size of the database file in bytes
+}
+
+// Stats walks the tree as of the last flush and returns its statistics.
+func (db *DB) Stats() (Stats, error) {
+	var s Stats
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return s, err
+	}
+	defer tx.Rollback()
+
+	err = tx.root.walk(1, func(n *node, depth int) error {
+		if n.isLeaf {
+			s.LeafNodes++
+			s.Points += len(n.points)
+		} else {
+			s.InteriorNodes++
+		}
+		if depth > s.Depth {
+			s.Depth = depth
+		}
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return s, fmt.Errorf("stat: %w", err)
+	}
+	s.FileSize = info.Size()
+
+	return s, nil
+}
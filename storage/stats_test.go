@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	db := tempDB(t)
+
+	s, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.InteriorNodes != 0 || s.LeafNodes != 1 || s.Points != 0 || s.Depth != 1 {
+		t.Fatalf("unexpected stats for empty db: %+v", s)
+	}
+
+	// Minute keys in two hours of the same day: the day node gets one
+	// leaf per hour.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	for _, d := range []time.Duration{0, 5 * time.Minute, 30 * time.Minute, time.Hour, time.Hour + time.Minute} {
+		if err := db.Put(base.Add(d).UnixNano(), map[string]float64{"v": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root, year, month and day are interior.
+	if s.InteriorNodes != 4 || s.LeafNodes != 2 || s.Points != 5 || s.Depth != 5 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s.FileSize <= int64(MetaSize) {
+		t.Fatalf("unexpected file size: %d", s.FileSize)
+	}
+}
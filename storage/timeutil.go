@@ -1,11 +1,19 @@
 package storage
 
 import (
+	"math"
 	"time"
 )
 
 const TimeFormat string = "2006-01-02 15:04:05"
 
+// minTime and maxTime are the earliest and latest times a unixnano key can
+// hold.
+var (
+	minTime = time.Unix(0, math.MinInt64)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
 type Time struct {
 	Time time.Time
 	TS   int64
@@ -47,7 +55,19 @@ func (t *Time) Level() uint16 {
 	return LevelYear
 }
 
+// Timestamp returns the start of the bucket holding t at the given level,
+// or math.MinInt64 if that is before the first key.
 func (t *Time) Timestamp(level uint16) int64 {
+	tm := t.start(level)
+	if tm.Before(minTime) {
+		return math.MinInt64
+	}
+	return tm.UnixNano()
+}
+
+// start returns the start of the bucket holding t at the given level, which
+// can be before the first key.
+func (t *Time) start(level uint16) time.Time {
 	var tp string
 	var tm time.Time
 	switch level {
@@ -70,12 +90,76 @@ func (t *Time) Timestamp(level uint16) int64 {
 		tp = t.Time.Format("2006-01-02 15:04:05")
 		tm, _ = time.ParseInLocation(TimeFormat, tp, time.Local)
 	case LevelMSecond:
-		tm = time.Unix(0, (t.Time.UnixNano()/1e6)*1e6)
+		// Truncate rounds down before 1970 too, unlike dividing TS.
+		tm = t.Time.Truncate(time.Millisecond)
 	case LevelUSecond:
-		tm = time.Unix(0, (t.Time.UnixNano()/1e3)*1e3)
+		tm = t.Time.Truncate(time.Microsecond)
 	default:
 		tm = t.Time
 	}
+	return tm
+}
+
+// Truncate returns the start of the bucket holding t at the given level,
+// e.g. the start of its hour for LevelHour.
+func (t *Time) Truncate(level uint16) int64 {
+	return t.Timestamp(level)
+}
 
+// LevelFor returns the coarsest level whose bucket is not wider than d, so
+// a duration of one hour maps to LevelHour and 90 minutes does as well.
+// Months count as 28 days and years as 365.
+func LevelFor(d time.Duration) uint16 {
+	const day = 24 * time.Hour
+	switch {
+	case d >= 365*day:
+		return LevelYear
+	case d >= 28*day:
+		return LevelMonth
+	case d >= day:
+		return LevelDay
+	case d >= time.Hour:
+		return LevelHour
+	case d >= time.Minute:
+		return LevelMinute
+	case d >= time.Second:
+		return LevelSecond
+	case d >= time.Millisecond:
+		return LevelMSecond
+	case d >= time.Microsecond:
+		return LevelUSecond
+	}
+	return LevelNSecond
+}
+
+// next returns the start of the bucket following t at the given level, or
+// math.MaxInt64 if that is past the last key.
+func (t *Time) next(level uint16) int64 {
+	tm := t.start(level)
+	switch level {
+	case LevelYear:
+		tm = tm.AddDate(1, 0, 0)
+	case LevelMonth:
+		tm = tm.AddDate(0, 1, 0)
+	case LevelDay:
+		tm = tm.AddDate(0, 0, 1)
+	case LevelHour:
+		tm = tm.Add(time.Hour)
+	case LevelMinute:
+		tm = tm.Add(time.Minute)
+	case LevelSecond:
+		tm = tm.Add(time.Second)
+	case LevelMSecond:
+		tm = tm.Add(time.Millisecond)
+	case LevelUSecond:
+		tm = tm.Add(time.Microsecond)
+	case LevelNSecond:
+		tm = tm.Add(time.Nanosecond)
+	default:
+		return math.MaxInt64
+	}
+	if tm.After(maxTime) {
+		return math.MaxInt64
+	}
 	return tm.UnixNano()
 }
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLevelFor(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want uint16
+	}{
+		{0, LevelNSecond},
+		{time.Nanosecond, LevelNSecond},
+		{999 * time.Nanosecond, LevelNSecond},
+		{time.Microsecond, LevelUSecond},
+		{5 * time.Millisecond, LevelMSecond},
+		{time.Second, LevelSecond},
+		{30 * time.Second, LevelSecond},
+		{time.Minute, LevelMinute},
+		{time.Hour, LevelHour},
+		{90 * time.Minute, LevelHour},
+		{24 * time.Hour, LevelDay},
+		{7 * 24 * time.Hour, LevelDay},
+		{30 * 24 * time.Hour, LevelMonth},
+		{365 * 24 * time.Hour, LevelYear},
+	}
+	for _, tt := range tests {
+		if got := LevelFor(tt.d); got != tt.want {
+			t.Errorf("LevelFor(%v) = %#x, want %#x", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTimeTruncate(t *testing.T) {
+	tm := NewTime(time.Date(2016, 8, 28, 21, 24, 5, 123456789, time.Local).UnixNano())
+
+	tests := []struct {
+		level uint16
+		want  time.Time
+	}{
+		{LevelYear, time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)},
+		{LevelMonth, time.Date(2016, 8, 1, 0, 0, 0, 0, time.Local)},
+		{LevelDay, time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)},
+		{LevelHour, time.Date(2016, 8, 28, 21, 0, 0, 0, time.Local)},
+		{LevelMinute, time.Date(2016, 8, 28, 21, 24, 0, 0, time.Local)},
+		{LevelSecond, time.Date(2016, 8, 28, 21, 24, 5, 0, time.Local)},
+		{LevelMSecond, time.Date(2016, 8, 28, 21, 24, 5, 123000000, time.Local)},
+		{LevelUSecond, time.Date(2016, 8, 28, 21, 24, 5, 123456000, time.Local)},
+		{LevelNSecond, time.Date(2016, 8, 28, 21, 24, 5, 123456789, time.Local)},
+	}
+	for _, tt := range tests {
+		if got := tm.Truncate(tt.level); got != tt.want.UnixNano() {
+			t.Errorf("Truncate(%#x) = %v, want %v", tt.level, time.Unix(0, got), tt.want)
+		}
+	}
+}
+
+func TestTimeTruncatePreEpoch(t *testing.T) {
+	tm := NewTime(time.Date(1969, 12, 31, 23, 59, 59, 998765432, time.Local).UnixNano())
+
+	tests := []struct {
+		level uint16
+		want  time.Time
+	}{
+		{LevelYear, time.Date(1969, 1, 1, 0, 0, 0, 0, time.Local)},
+		{LevelMonth, time.Date(1969, 12, 1, 0, 0, 0, 0, time.Local)},
+		{LevelDay, time.Date(1969, 12, 31, 0, 0, 0, 0, time.Local)},
+		{LevelHour, time.Date(1969, 12, 31, 23, 0, 0, 0, time.Local)},
+		{LevelMinute, time.Date(1969, 12, 31, 23, 59, 0, 0, time.Local)},
+		{LevelSecond, time.Date(1969, 12, 31, 23, 59, 59, 0, time.Local)},
+		{LevelMSecond, time.Date(1969, 12, 31, 23, 59, 59, 998000000, time.Local)},
+		{LevelUSecond, time.Date(1969, 12, 31, 23, 59, 59, 998765000, time.Local)},
+		{LevelNSecond, time.Date(1969, 12, 31, 23, 59, 59, 998765432, time.Local)},
+	}
+	for _, tt := range tests {
+		if got := tm.Truncate(tt.level); got != tt.want.UnixNano() {
+			t.Errorf("Truncate(%#x) = %v, want %v", tt.level, time.Unix(0, got), tt.want)
+		}
+	}
+
+	// Just before the epoch in UTC.
+	tm = NewTime(-1)
+	if got := tm.Truncate(LevelMSecond); got != -1e6 {
+		t.Errorf("Truncate(LevelMSecond) of -1 = %d, want %d", got, int64(-1e6))
+	}
+	if got := tm.Truncate(LevelUSecond); got != -1e3 {
+		t.Errorf("Truncate(LevelUSecond) of -1 = %d, want %d", got, int64(-1e3))
+	}
+}
+
+func TestTimeNextLast(t *testing.T) {
+	tm := NewTime(math.MaxInt64)
+	for _, level := range []uint16{LevelYear, LevelMonth, LevelDay, LevelHour, LevelMinute, LevelSecond, LevelMSecond, LevelUSecond, LevelNSecond} {
+		if got := tm.next(level); got != math.MaxInt64 {
+			t.Errorf("next(%#x) of the last key = %d, want math.MaxInt64", level, got)
+		}
+	}
+}
+
+func TestTimeFirst(t *testing.T) {
+	tm := NewTime(math.MinInt64)
+	for _, level := range []uint16{LevelYear, LevelMonth, LevelDay, LevelHour, LevelMinute, LevelSecond, LevelMSecond, LevelUSecond, LevelNSecond} {
+		if got := tm.Timestamp(level); got != math.MinInt64 {
+			t.Errorf("Timestamp(%#x) of the first key = %d, want math.MinInt64", level, got)
+		}
+		if got := tm.next(level); got <= tm.TS {
+			t.Errorf("next(%#x) of the first key = %d, not after it", level, got)
+		}
+	}
+}
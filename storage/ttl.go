@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// PutWithTTL is like Put but the point expires ttl from now: Get, Range,
+// Has and the cursors skip it from then on, and SweepExpired, or the sweep
+// of Options.SweepInterval, removes it. Until it is removed it still counts
+// in the aggregates and in Count. Putting the point again with Put clears
+// its TTL.
+func (db *DB) PutWithTTL(key int64, value map[string]float64, ttl time.Duration) error {
+	db.counters.puts.Add(1)
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	expires := time.Now().Add(ttl).UnixNano()
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if err := db.putIn(db.root, key, value, expires); err != nil {
+		db.rollback()
+		return err
+	}
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// SweepExpired removes the points put with PutWithTTL that have expired and
+// returns how many there were. Leaves on disk written without a TTL point
+// are passed over without being decoded.
+func (db *DB) SweepExpired() (int, error) {
+	if db.readOnly {
+		return 0, ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	removed, empty, err := db.root.sweep(time.Now().UnixNano())
+	if err != nil {
+		db.rollback()
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	db.changes.lose()
+	if empty {
+		db.root.isLeaf = true
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+// sweep removes the points below n expired at now, and returns how many
+// there were and whether n is left empty.
+func (n *node) sweep(now int64) (int64, bool, error) {
+	if n.isLeaf {
+		points := n.points[:0:0]
+		for _, point := range n.points {
+			if !point.expired(now) {
+				points = append(points, point)
+			}
+		}
+		removed := int64(len(n.points) - len(points))
+		if removed > 0 {
+			n.points = points
+			n.resize()
+		}
+		return removed, len(n.points) == 0, nil
+	}
+
+	var removed int64
+	drop := make([]bool, len(n.pointers))
+	loaded := make([]bool, len(n.pointers)) // read from disk by the sweep
+	for i, pointer := range n.pointers {
+		loaded[i] = pointer.pointer == nil
+		if pointer.pointer == nil && i != n.dirty {
+			ok, err := n.db.mayExpire(pointer.pos)
+			if err != nil {
+				return 0, false, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		// Only one dirty branch in the tree.
+		if n.dirty != i {
+			if err := n.flushDirty(); err != nil {
+				return 0, false, err
+			}
+		}
+		child, err := n.childAt(i)
+		if err != nil {
+			return 0, false, err
+		}
+		count, empty, err := child.sweep(now)
+		if err != nil {
+			return 0, false, err
+		}
+		// A child left as it was need not be written again.
+		if count > 0 {
+			n.dirty = i
+		}
+		removed += count
+		drop[i] = empty
+	}
+
+	// The children read for the sweep and written back, or left as they
+	// were, are let go again, so sweeping does not keep the whole tree in
+	// memory.
+	pointers := make([]*nodePointer, 0, len(n.pointers))
+	dirty := -1
+	for i, pointer := range n.pointers {
+		if drop[i] {
+			continue
+		}
+		if i == n.dirty {
+			dirty = len(pointers)
+		} else if loaded[i] {
+			pointer.pointer = nil
+		}
+		pointers = append(pointers, pointer)
+	}
+	n.pointers, n.dirty = pointers, dirty
+	return removed, len(n.pointers) == 0, nil
+}
+
+// mayExpire reports whether the node chunk at pos may hold a point with a
+// TTL, which only interior nodes and leaves with ExpiryChunkFlag do.
+func (db *DB) mayExpire(pos int64) (bool, error) {
+	nodeBytes, err := db.readChunkAt(pos)
+	if err != nil {
+		return false, fmt.Errorf("read node at %d: %w", pos, err)
+	}
+	body, hflags, err := chunkNode(nodeBytes)
+	if err != nil {
+		return false, fmt.Errorf("decode node at %d: %w", pos, err)
+	}
+	if len(body) < 2 {
+		return false, fmt.Errorf("decode node at %d: %w", pos, ErrInvalid)
+	}
+	flags := decodeUint16(body[0:2])
+	return flags&LeafFlag != LeafChunkFlag || flags&DeltaChunkFlag != 0 && hflags&ExpiryChunkFlag != 0, nil
+}
+
+// startSweep starts removing expired points every interval, until
+// stopSweep is called.
+func (db *DB) startSweep(interval time.Duration) {
+	db.sweepInterval = interval
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	db.sweepStop, db.sweepDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := db.SweepExpired(); err != nil {
+				db.logger.Printf("tickdb: %s: sweep expired points: %v", db.path, err)
+			}
+		}
+	}()
+}
+
+// stopSweep stops the goroutine started by startSweep and waits for it to
+// return.
+func (db *DB) stopSweep() {
+	if db.sweepStop == nil {
+		return
+	}
+	close(db.sweepStop)
+	<-db.sweepDone
+	db.sweepStop, db.sweepDone = nil, nil
+}
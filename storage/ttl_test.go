@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// ttlPoints puts 200 points a second apart, every other one with ttl, and
+// returns the keys of both kinds.
+func ttlPoints(t *testing.T, db *DB, ttl time.Duration) (kept, expiring []int64) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local).UnixNano()
+	for i := 0; i < 200; i++ {
+		key := start + int64(i)*int64(time.Second)
+		value := map[string]float64{"v": float64(i)}
+		if i%2 == 0 {
+			kept = append(kept, key)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expiring = append(expiring, key)
+		if err := db.PutWithTTL(key, value, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kept, expiring
+}
+
+func TestPutWithTTL(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	defer db.Close()
+
+	if err := db.PutWithTTL(1, map[string]float64{"v": 1}, 0); err != ErrInvalidTTL {
+		t.Fatalf("PutWithTTL with no ttl: %v, want ErrInvalidTTL", err)
+	}
+
+	const ttl = 500 * time.Millisecond
+	kept, expiring := ttlPoints(t, db, ttl)
+	expiry := time.Now().Add(ttl)
+	first, last := kept[0], expiring[len(expiring)-1]
+
+	if _, err := db.Get(last); err != nil {
+		t.Fatalf("Get before expiry: %v", err)
+	}
+	// The TTL is stored with the point.
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	time.Sleep(time.Until(expiry))
+
+	for _, key := range expiring {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("Get(%d): %v, want ErrNotFound", key, err)
+		}
+		if ok, err := db.Has(key); err != nil || ok {
+			t.Fatalf("Has(%d) = %v, %v, want false", key, ok, err)
+		}
+	}
+	points, err := db.Range(first, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(kept) {
+		t.Fatalf("Range returned %d points, want %d", len(points), len(kept))
+	}
+	for i, point := range points {
+		if point.Timestamp != kept[i] {
+			t.Fatalf("point %d at %d, want %d", i, point.Timestamp, kept[i])
+		}
+	}
+	it, err := db.Iterator(first, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil || n != len(kept) {
+		t.Fatalf("Iterator visited %d points, %v, want %d", n, err, len(kept))
+	}
+
+	removed, err := db.SweepExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(expiring) {
+		t.Fatalf("SweepExpired removed %d points, want %d", removed, len(expiring))
+	}
+	if removed, err := db.SweepExpired(); err != nil || removed != 0 {
+		t.Fatalf("SweepExpired again = %d, %v, want 0", removed, err)
+	}
+	if count, err := db.Count(first, last); err != nil || count != len(kept) {
+		t.Fatalf("Count = %d, %v, want %d", count, err, len(kept))
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+}
+
+func TestPutClearsTTL(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	if err := db.PutWithTTL(1, map[string]float64{"v": 1}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(1, map[string]float64{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	point, err := db.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.Value["v"] != 2 {
+		t.Fatalf("v = %v, want 2", point.Value["v"])
+	}
+}
+
+func TestSweepInterval(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16, SweepInterval: 10 * time.Millisecond})
+	defer db.Close()
+
+	kept, _ := ttlPoints(t, db, 50*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := db.Count(0, kept[len(kept)-1]+int64(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == len(kept) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Count = %d after sweeping, want %d", count, len(kept))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+
+	if _, err := OpenWithOptions(db.path, 0666, &Options{ReadOnly: true, SweepInterval: time.Second}); err != ErrInvalidOptions {
+		t.Fatalf("Open read-only with a sweep: %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestSweepLetsGo(t *testing.T) {
+	db := tempDB(t)
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+
+	// Points an hour apart over a year, the last day with a TTL.
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	var points []Point
+	for i := 0; i < 365*24; i++ {
+		points = append(points, Point{Timestamp: base.Add(time.Duration(i) * time.Hour).UnixNano(), Value: map[string]float64{"v": 1}})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	last := base.AddDate(1, 0, 0)
+	for i := 0; i < 24; i++ {
+		if err := db.PutWithTTL(last.Add(time.Duration(i)*time.Hour).UnixNano(), map[string]float64{"v": 1}, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = reopen(t, db, &Options{MaxLeafPoints: 16})
+	defer db.Close()
+	time.Sleep(2 * time.Millisecond)
+
+	// Sweeping reads every interior node, but only the path it wrote is
+	// left in memory.
+	for i := 0; i < 2; i++ {
+		removed, err := db.SweepExpired()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 24 * (1 - i); removed != want {
+			t.Fatalf("sweep %d removed %d points, want %d", i, removed, want)
+		}
+		held := 0
+		var count func(n *node)
+		count = func(n *node) {
+			held++
+			for _, pointer := range n.pointers {
+				if pointer.pointer != nil {
+					count(pointer.pointer)
+				}
+			}
+		}
+		count(db.root)
+		if held > 10 {
+			t.Fatalf("sweep %d left %d nodes in memory", i, held)
+		}
+	}
+	if n, err := db.Count(0, math.MaxInt64); err != nil || n != len(points) {
+		t.Fatalf("Count = %d, %v, want %d", n, err, len(points))
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+}
+
+func TestTTLMergeImport(t *testing.T) {
+	src := tempDB(t)
+	defer src.Close()
+	key := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := src.PutWithTTL(key, map[string]float64{"v": 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(key+1, map[string]float64{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := src.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := p.expires
+
+	// Points copied by Merge or through JSON expire when they did.
+	check := func(name string, db *DB) {
+		p, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.expires != expires {
+			t.Fatalf("%s: point expires at %d, want %d", name, p.expires, expires)
+		}
+		if p, err = db.Get(key + 1); err != nil {
+			t.Fatal(err)
+		}
+		if p.expires != 0 {
+			t.Fatalf("%s: point without a TTL expires at %d", name, p.expires)
+		}
+	}
+
+	merged := tempDB(t)
+	defer merged.Close()
+	if err := merged.Merge(src); err != nil {
+		t.Fatal(err)
+	}
+	check("Merge", merged)
+
+	var buf bytes.Buffer
+	if err := src.ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	imported := tempDB(t)
+	defer imported.Close()
+	if err := imported.ImportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	check("ImportJSON", imported)
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+)
+
+// Tx represents a transaction on the database.
+//
+// A writable transaction holds the writer lock and works on the in-memory
+// tree of the DB. A read-only transaction decodes its own tree from the
+// root the meta pointed to when it began; chunks are only ever appended to
+// the file, so that tree stays intact while writers move on.
+type Tx struct {
+	db       *DB
+	writable bool
+	meta     *meta
+	root     *node
+	onCommit []func(txid uint64)
+}
+
+// Begin starts a new transaction. Only one writable transaction can be open
+// at a time, Begin blocks until the previous one is committed or rolled
+// back.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	if writable {
+		if db.readOnly {
+			return nil, ErrDatabaseReadOnly
+		}
+		return db.beginRWTx()
+	}
+	return db.beginTx()
+}
+
+// View calls fn within a read-only transaction, which is closed once fn
+// returns or panics. Readers work on their own copy of the tree decoded
+// from disk, so they never see the nodes a writer is changing in memory.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx, err := db.beginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(tx)
+}
+
+// Update calls fn within a writable transaction and commits it if fn
+// returns nil. If fn returns an error the transaction is rolled back and
+// the error returned; if fn panics it is rolled back and the panic goes
+// on, so the writer lock is released either way. fn must not commit or
+// roll back the transaction itself.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx.db != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) beginTx() (*Tx, error) {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	if db.file == nil {
+		return nil, ErrDatabaseNotOpen
+	}
+
+	tx := &Tx{db: db, meta: &meta{}}
+	db.meta.copy(tx.meta)
+
+	root, err := db.node(tx.meta.root)
+	if err != nil {
+		return nil, err
+	}
+	tx.root = root
+
+	db.txs = append(db.txs, tx)
+	return tx, nil
+}
+
+// beginRWTx takes the writer lock, which the returned transaction holds
+// until it is committed or rolled back. It is released again on every
+// error.
+func (db *DB) beginRWTx() (tx *Tx, err error) {
+	db.rwlock.Lock()
+	defer func() {
+		if err != nil {
+			db.rwlock.Unlock()
+		}
+	}()
+
+	if db.file == nil {
+		return nil, ErrDatabaseNotOpen
+	}
+
+	tx = &Tx{db: db, writable: true, meta: &meta{}, root: db.root}
+	db.metalock.Lock()
+	db.meta.copy(tx.meta)
+	db.metalock.Unlock()
+
+	return tx, nil
+}
+
+// Writable returns whether the transaction can perform write operations.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// Cursor creates a cursor over the transaction's view of the tree.
+func (tx *Tx) Cursor() *Cursor {
+	return &Cursor{
+		db:    tx.db,
+		root:  tx.root,
+		stack: make([]elemRef, 0),
+	}
+}
+
+// Put stores a point within a writable transaction. The transaction sees it
+// right away, everyone else once it is committed. If Put fails the
+// transaction should be rolled back.
+func (tx *Tx) Put(key int64, value map[string]float64) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.db.put(key, value)
+}
+
+// Get returns the point at key as seen by the transaction, including the
+// points it put itself.
+func (tx *Tx) Get(key int64) (*Point, error) {
+	return tx.Cursor().get(key)
+}
+
+// Range returns the points between start and end inclusive as seen by the
+// transaction, filtered to metrics like DB.Range.
+func (tx *Tx) Range(start, end int64, metrics ...string) ([]Point, error) {
+	return tx.Cursor().collect(context.Background(), start, end, metrics)
+}
+
+// Commit flushes the changes of a writable transaction and releases the
+// writer lock. For a read-only transaction it is the same as Rollback.
+func (tx *Tx) Commit() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return tx.Rollback()
+	}
+
+	db := tx.db
+	tx.db = nil
+
+	txid, err := db.commit()
+	if err != nil {
+		return err
+	}
+	for _, fn := range tx.onCommit {
+		db.runOnCommit(fn, txid)
+	}
+	return nil
+}
+
+// Flush writes the nodes a writable transaction changed so far to the file
+// and syncs them, keeping the transaction open for more writes. The meta is
+// left pointing at the last commit, so until Commit neither readers nor a
+// database reopened after a crash see the changes, and Rollback still
+// drops them; their chunks are then left for Compact. A long transaction
+// can flush now and then to write its changes out as it goes, which also
+// starts the count of Options.MaxTxOps over. If Flush fails the
+// transaction should be rolled back.
+func (tx *Tx) Flush() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if _, err := tx.db.root.flush(); err != nil {
+		return err
+	}
+	if err := tx.db.ops.Sync(); err != nil {
+		return err
+	}
+	tx.db.txOps = 0
+	return nil
+}
+
+// commit flushes the tree of a writable transaction and releases the
+// writer lock, which it does even if flushing panics, rolling back the tree
+// first as it does on an error.
+func (db *DB) commit() (uint64, error) {
+	defer db.rwlock.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			db.rollback()
+			panic(r)
+		}
+	}()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return 0, err
+	}
+	return db.TxID(), nil
+}
+
+// OnCommit registers fn to be called with the id of the commit once a
+// writable transaction is committed and synced, after the writer lock is
+// released. Functions run in the order they were registered, and are
+// dropped if the transaction is rolled back or fails to commit.
+func (tx *Tx) OnCommit(fn func(txid uint64)) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// runOnCommit calls fn, logging a panic instead of passing it on to the
+// caller of Commit, whose changes are already stored.
+func (db *DB) runOnCommit(fn func(txid uint64), txid uint64) {
+	defer func() {
+		if r := recover(); r != nil {
+			db.logger.Printf("tickdb: %s: commit %d callback: %v", db.path, txid, r)
+		}
+	}()
+	fn(txid)
+}
+
+// Rollback closes the transaction. The changes of a writable transaction
+// are discarded.
+func (tx *Tx) Rollback() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	db := tx.db
+	tx.db = nil
+	tx.onCommit = nil
+	if tx.writable {
+		defer db.rwlock.Unlock()
+		return db.rollback()
+	}
+
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	for i, t := range db.txs {
+		if t == tx {
+			db.txs = append(db.txs[:i], db.txs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,688 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTxSnapshot(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Minute), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 10; i < 200; i++ {
+			if err := db.Put(base+int64(i)*int64(time.Minute), map[string]float64{"v": float64(i)}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- db.Delete(base)
+	}()
+
+	// The reader keeps seeing the first ten points while the writer runs.
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+
+		points, err := tx.Range(base, base+int64(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 10 {
+			t.Fatalf("snapshot changed: %d points", len(points))
+		}
+		if _, err := tx.Get(base); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(db.txs) != 0 {
+		t.Fatalf("unexpected open transactions: %d", len(db.txs))
+	}
+
+	// A new transaction sees the writes.
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	points, err := tx.Range(base, base+int64(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 199 {
+		t.Fatalf("unexpected point count: %d", len(points))
+	}
+	if _, err := tx.Get(base); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTxWritableExclusive(t *testing.T) {
+	db := tempDB(t)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	done := make(chan error)
+	go func() {
+		done <- db.Put(base, map[string]float64{"v": 1})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("put must wait for the writable transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxReleasesLock(t *testing.T) {
+	db := tempDB(t)
+
+	// begin fails the test unless a writable transaction can be started
+	// within a second.
+	begin := func() *Tx {
+		t.Helper()
+		done := make(chan *Tx, 1)
+		go func() {
+			tx, err := db.Begin(true)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- tx
+		}()
+		select {
+		case tx := <-done:
+			if tx == nil {
+				t.FailNow()
+			}
+			return tx
+		case <-time.After(time.Second):
+			t.Fatal("writer lock not released")
+			return nil
+		}
+	}
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	tx := begin()
+	if err := tx.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		panic("disk gone")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "disk gone" {
+				t.Fatalf("recovered %v", r)
+			}
+		}()
+		tx.Commit()
+	}()
+	db.ops.writeAt = nil
+
+	tx = begin()
+	if _, err := tx.Get(base); err != ErrNotFound {
+		t.Fatalf("point of the failed commit: %v, want ErrNotFound", err)
+	}
+	if err := tx.Put(base+1, map[string]float64{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := db.path
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Begin(true); err != ErrDatabaseNotOpen {
+		t.Fatalf("Begin on a closed database: %v, want ErrDatabaseNotOpen", err)
+	}
+	if !db.rwlock.TryLock() {
+		t.Fatal("writer lock held after Begin failed")
+	}
+	db.rwlock.Unlock()
+
+	db, err := Open(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if p, err := db.Get(base + 1); err != nil || p.Value["v"] != 2 {
+		t.Fatalf("Get = %v, %v", p, err)
+	}
+}
+
+func TestTxFlush(t *testing.T) {
+	db := tempDB(t)
+	defer func() { db.Close() }()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	key := func(i int) int64 { return base + int64(i)*int64(time.Minute) }
+	if err := db.Put(key(0), map[string]float64{"v": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := tx.Put(key(i), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i%25 == 0 {
+			if err := tx.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if p, err := tx.Get(key(60)); err != nil || p.Value["v"] != 60 {
+		t.Fatalf("Get within the transaction = %v, %v", p, err)
+	}
+	if n, err := db.Count(key(0), key(100)); err != nil || n != 1 {
+		t.Fatalf("Count outside the transaction = %d, %v, want 1", n, err)
+	}
+
+	// A crash now leaves the file as it is: a copy of it opens at the last
+	// commit.
+	data, err := os.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := filepath.Join(t.TempDir(), "crashed")
+	if err := os.WriteFile(crashed, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := Open(crashed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := copied.Count(key(0), key(100)); err != nil || n != 1 {
+		t.Fatalf("Count after a crash = %d, %v, want 1", n, err)
+	}
+	if errs := copied.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+	copied.Close()
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Flush(); err != ErrTxClosed {
+		t.Fatalf("Flush after Commit: %v, want ErrTxClosed", err)
+	}
+	db = reopen(t, db, nil)
+	if n, err := db.Count(key(0), key(100)); err != nil || n != 101 {
+		t.Fatalf("Count after Commit = %d, %v, want 101", n, err)
+	}
+
+	// Rolled back, flushed changes are dropped.
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(key(200), map[string]float64{"v": 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key(200)); err != ErrNotFound {
+		t.Fatalf("Get after Rollback: %v, want ErrNotFound", err)
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+
+	ro, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Rollback()
+	if err := ro.Flush(); err != ErrTxNotWritable {
+		t.Fatalf("Flush of a read-only transaction: %v, want ErrTxNotWritable", err)
+	}
+}
+
+func TestTxPut(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys far enough apart to switch the dirty branch in between.
+	keys := []int64{base, base + int64(48*time.Hour), base + int64(time.Minute)}
+	for i, key := range keys {
+		if err := tx.Put(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The transaction reads its own puts, other readers do not.
+	for i, key := range keys {
+		p, err := tx.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Value["v"] != float64(i) {
+			t.Fatalf("unexpected value: %v", p.Value)
+		}
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("uncommitted put visible: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		p, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Value["v"] != float64(i) {
+			t.Fatalf("unexpected value: %v", p.Value)
+		}
+	}
+	if err := tx.Put(base, nil); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A rolled back put is gone.
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put(base-1, map[string]float64{"v": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(base - 1); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := tx.Put(base, nil); err != ErrTxNotWritable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxTxOps(t *testing.T) {
+	db := reopen(t, tempDB(t), &Options{MaxLeafPoints: DefaultMaxLeafPoints, MaxTxOps: 3})
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	var points []Point
+	for i := 0; i < 5; i++ {
+		points = append(points, Point{Timestamp: base + int64(i)*int64(time.Second), Value: map[string]float64{"v": float64(i)}})
+	}
+
+	// The batch fails at its fourth point and stores none of them.
+	if err := db.PutBatch(points); !errors.Is(err, ErrTxTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Get(base); err != ErrNotFound {
+		t.Fatalf("point of a failed batch stored: %v", err)
+	}
+
+	// The count starts over, so a batch within the limit still goes in.
+	if err := db.PutBatch(points[:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		// Overwriting a point counts as well.
+		for _, p := range append(points[3:], points[:2]...) {
+			if err := tx.Put(p.Timestamp, p.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrTxTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Get(points[3].Timestamp); err != ErrNotFound {
+		t.Fatalf("put of a rolled back transaction stored: %v", err)
+	}
+
+	// The database stays usable afterwards.
+	if err := db.Delete(base); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(points[4].Timestamp, points[4].Value); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Range(base, points[4].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d points, want 3", len(got))
+	}
+
+	if _, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: 1, MaxTxOps: -1}); err != ErrInvalidOptions {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMaxTxOpsFlush(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, MaxTxOps: 3, RootLevel: LevelHour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A transaction flushing within the limit goes over it in total, and a
+	// put the tree rejects is not counted.
+	hour := time.Date(2016, 8, 28, 14, 0, 0, 0, time.Local)
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < 9; i++ {
+			if i%3 == 0 {
+				if err := tx.Flush(); err != nil {
+					return err
+				}
+			}
+			if err := tx.Put(hour.Add(time.Duration(i)*time.Minute).UnixNano(), map[string]float64{"v": 1}); err != nil {
+				return err
+			}
+			if i%3 == 0 {
+				if err := tx.Put(hour.Add(time.Hour).UnixNano(), map[string]float64{"v": 1}); err != ErrOutsideRootSpan {
+					t.Fatalf("Put after the hour: %v, want ErrOutsideRootSpan", err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Range(hour.UnixNano(), hour.Add(time.Hour).UnixNano()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 9 {
+		t.Fatalf("got %d points, want 9", len(got))
+	}
+}
+
+func TestWaitForTxID(t *testing.T) {
+	db := tempDB(t)
+
+	start := db.TxID()
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	if err := db.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.TxID(); got != start+1 {
+		t.Fatalf("got txid %d after a put, want %d", got, start+1)
+	}
+	if err := db.WaitForTxID(context.Background(), start+1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the third commit from now, the writer reports the id of
+	// every commit it makes.
+	want := start + 4
+	done := make(chan uint64)
+	go func() {
+		if err := db.WaitForTxID(context.Background(), want); err != nil {
+			t.Error(err)
+		}
+		done <- db.TxID()
+	}()
+	for i := 1; i <= 2; i++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Put(base+int64(i), map[string]float64{"v": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+			t.Fatalf("woke up at txid %d", db.TxID())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := db.Put(base+3, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != want {
+		t.Fatalf("woke up at txid %d, want %d", got, want)
+	}
+
+	// The id is kept across reopening.
+	db = reopen(t, db, nil)
+	if got := db.TxID(); got != want {
+		t.Fatalf("got txid %d after reopening, want %d", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := db.WaitForTxID(ctx, want+1); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errc := make(chan error)
+	go func() { errc <- db.WaitForTxID(context.Background(), want+1) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	logger := &captureLogger{}
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "db"), 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+
+	var calls []string
+	record := func(name string) func(uint64) {
+		return func(txid uint64) { calls = append(calls, fmt.Sprintf("%s %d", name, txid)) }
+	}
+
+	// Rolled back, nothing runs.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnCommit(record("rolled back"))
+	if err := tx.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing to commit, nothing runs.
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnCommit(record("failed"))
+	if err := tx.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	errDisk := errors.New("disk full")
+	db.ops.writeAt = func(b []byte, off int64) (int, error) { return 0, errDisk }
+	if err := tx.Commit(); err != errDisk {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.ops.writeAt = nil
+	if len(calls) != 0 {
+		t.Fatalf("callbacks ran without a commit: %v", calls)
+	}
+
+	// Committed, every callback runs in order with the new id, one that
+	// panics is logged.
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnCommit(record("first"))
+	tx.OnCommit(func(uint64) { panic("callback failed") })
+	tx.OnCommit(record("second"))
+	if err := tx.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	txid := db.TxID()
+	want := []string{fmt.Sprintf("first %d", txid), fmt.Sprintf("second %d", txid)}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("got calls %v, want %v", calls, want)
+	}
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], "callback failed") {
+		t.Fatalf("got log %q", logger.messages)
+	}
+}
+
+func TestUpdateView(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	put := func(key int64) func(tx *Tx) error {
+		return func(tx *Tx) error {
+			return tx.Put(key, map[string]float64{"v": 1})
+		}
+	}
+	has := func(key int64) bool {
+		var ok bool
+		err := db.View(func(tx *Tx) error {
+			_, err := tx.Get(key)
+			ok = err == nil
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// Committed on success.
+	if err := db.Update(put(base)); err != nil {
+		t.Fatal(err)
+	}
+	if !has(base) {
+		t.Fatal("point of a successful update missing")
+	}
+
+	// Rolled back on error.
+	errFn := errors.New("fn failed")
+	err := db.Update(func(tx *Tx) error {
+		if err := put(base + 1)(tx); err != nil {
+			return err
+		}
+		return errFn
+	})
+	if err != errFn {
+		t.Fatalf("Update = %v, want %v", err, errFn)
+	}
+	if has(base + 1) {
+		t.Fatal("point of a failed update stored")
+	}
+
+	// Rolled back on panic, which goes on, and the writer lock released.
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recovered %v, want the panic of fn", r)
+			}
+		}()
+		db.Update(func(tx *Tx) error {
+			put(base + 2)(tx)
+			panic("boom")
+		})
+	}()
+	if has(base + 2) {
+		t.Fatal("point of a panicking update stored")
+	}
+	done := make(chan error)
+	go func() {
+		done <- db.Update(put(base + 3))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer lock held after a panicking update")
+	}
+
+	// A read-only database refuses updates.
+	db = reopen(t, db, &Options{MaxLeafPoints: DefaultMaxLeafPoints, ReadOnly: true})
+	defer db.Close()
+	if err := db.Update(put(base + 4)); err != ErrDatabaseReadOnly {
+		t.Fatalf("Update = %v, want ErrDatabaseReadOnly", err)
+	}
+	if !has(base + 3) {
+		t.Fatal("point of an update after a panic missing")
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+)
+
+// Vacuum recomputes the values and counts interior nodes keep for their
+// children from the points in the leaves, bottom-up, and rewrites the nodes
+// where they were wrong. It mends the aggregates of a database whose leaves
+// are intact but whose interior values drifted. Every node of the tree is
+// read; series are left alone.
+func (db *DB) Vacuum() error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	changed, err := db.root.vacuum()
+	if err != nil {
+		db.rollback()
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	db.root.reduce()
+
+	if err := db.Flush(); err != nil {
+		db.rollback()
+		return err
+	}
+	return nil
+}
+
+// vacuum recomputes the values of the children of n below it and reports
+// whether any of them, or any node below, had to be changed.
+func (n *node) vacuum() (bool, error) {
+	if n.isLeaf {
+		return false, nil
+	}
+
+	changed := false
+	for i, pointer := range n.pointers {
+		// Only one dirty branch in the tree.
+		if n.dirty != i {
+			if err := n.flushDirty(); err != nil {
+				return false, err
+			}
+		}
+		child, err := n.childAt(i)
+		if err != nil {
+			return false, err
+		}
+		below, err := child.vacuum()
+		if err != nil {
+			return false, err
+		}
+		if below || pointer.count != child.count() || !sameValues(pointer.value, child.reduce()) {
+			n.dirty = i
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// sameValues reports whether a and b hold the same metrics with the same
+// encoded values, so NaN matches NaN.
+func sameValues(a, b map[string]Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, va := range a {
+		vb, ok := b[k]
+		if !ok || !bytes.Equal(va.encode(), vb.encode()) {
+			return false
+		}
+	}
+	return true
+}
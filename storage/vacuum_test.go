@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// sameTree reports the first place the values or counts kept in the
+// interior nodes of a and b differ, which must have the same shape.
+func sameTree(a, b *node) error {
+	if a.isLeaf || b.isLeaf {
+		return nil
+	}
+	if len(a.pointers) != len(b.pointers) {
+		return fmt.Errorf("level %#x: %d pointers, want %d", a.level, len(a.pointers), len(b.pointers))
+	}
+	for i := range a.pointers {
+		pa, pb := a.pointers[i], b.pointers[i]
+		if pa.count != pb.count || !sameValues(pa.value, pb.value) {
+			return fmt.Errorf("level %#x: pointer %d at %d: %v, %d, want %v, %d", a.level, i, pa.key, pa.value, pa.count, pb.value, pb.count)
+		}
+		ca, err := a.childAt(i)
+		if err != nil {
+			return err
+		}
+		cb, err := b.childAt(i)
+		if err != nil {
+			return err
+		}
+		if err := sameTree(ca, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestVacuum(t *testing.T) {
+	fill := func(db *DB) {
+		base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local)
+		var points []Point
+		for i := 0; i < 500; i++ {
+			ts := base.Add(time.Duration(i) * 17 * time.Minute)
+			points = append(points, Point{Timestamp: ts.UnixNano(), Value: map[string]float64{"v": float64(i), "w": float64(i % 7)}})
+		}
+		if err := db.PutBatch(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &Options{MaxLeafPoints: 16}
+	want := reopen(t, tempDB(t), opts)
+	defer want.Close()
+	fill(want)
+	db := reopen(t, tempDB(t), opts)
+	fill(db)
+
+	// Damage the values of the root and of a child below it: the root
+	// takes its value for the child from the damaged one when flushed.
+	child, err := db.root.childAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.isLeaf {
+		t.Fatal("expected an interior child")
+	}
+	v := child.pointers[0].value["v"]
+	v.sum += 1000
+	child.pointers[0].value["v"] = v
+	child.pointers[1].count++
+	db.root.dirty = 0
+	last := len(db.root.pointers) - 1
+	w := db.root.pointers[last].value["w"]
+	w.max = -1
+	db.root.pointers[last].value["w"] = w
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopen(t, db, opts)
+	defer db.Close()
+	if err := sameTree(db.root, want.root); err == nil {
+		t.Fatal("expected the values to differ before Vacuum")
+	}
+
+	if err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		if err := sameTree(db.root, want.root); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.Aggregate(0, 1<<62, LevelRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantAgg, err := want.Aggregate(0, 1<<62, LevelRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameValues(got, wantAgg) {
+			t.Fatalf("Aggregate = %v, want %v", got, wantAgg)
+		}
+		if errs := db.Check(); errs != nil {
+			t.Fatal(errs)
+		}
+	}
+	check(db)
+	db = reopen(t, db, opts)
+	check(db)
+
+	// A sound tree is left as it is.
+	pos := db.meta.root
+	if err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if db.meta.root != pos {
+		t.Fatal("Vacuum rewrote a sound tree")
+	}
+}
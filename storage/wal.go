@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// walSuffix is appended to the database path to name its write-ahead log.
+const walSuffix = ".wal"
+
+// walRecordSize is the size of a log record: the root position, the
+// position of the series registry, the txid and the checksum of the meta,
+// followed by their crc.
+const walRecordSize = 29
+
+// walRootRecordSize is the size of the records written before the registry,
+// the txid and the checksum were logged, holding the root alone.
+const walRootRecordSize = 12
+
+// wal is an optional write-ahead log for the meta. The meta is rewritten in
+// place on every flush, so a crash in the middle of that write leaves a
+// chunk that fails its crc. Before the meta is written its fields are
+// recorded in the log, and Open replays them when the meta is unreadable or
+// points at an older root.
+//
+// Only the latest meta matters, so the log holds a single record at the
+// start of the file.
+type wal struct {
+	file *os.File
+}
+
+// openWAL opens the log next to the database at path, creating it unless
+// readOnly is set. A missing log in read-only mode returns a nil wal.
+func openWAL(path string, mode os.FileMode, readOnly bool) (*wal, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path+walSuffix, flag, mode)
+	if os.IsNotExist(err) && readOnly {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &wal{file: file}, nil
+}
+
+// write records the fields of m and syncs the log.
+func (w *wal) write(m *meta) error {
+	record := make([]byte, 0, walRecordSize)
+	record = append(record, encodeInt64(m.root)...)
+	record = append(record, encodeInt64(m.registry)...)
+	record = append(record, encodeUint64(m.txid)...)
+	record = append(record, byte(m.checksum))
+	record = append(record, encodeUint32(crc32.ChecksumIEEE(record))...)
+	if _, err := w.file.WriteAt(record, 0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// read returns the recorded meta, nil if the log is empty or its record is
+// torn. full is false for a record holding the root alone, whose meta has
+// no other field set.
+func (w *wal) read() (m *meta, full bool, err error) {
+	record := make([]byte, walRecordSize)
+	n, err := w.file.ReadAt(record, 0)
+	if n < walRootRecordSize {
+		return nil, false, nil
+	} else if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	if n == walRecordSize && crc32.ChecksumIEEE(record[:25]) == decodeUint32(record[25:]) {
+		m = newMeta(Checksum(record[24]))
+		if !m.checksum.valid() {
+			return nil, false, nil
+		}
+		m.root = decodeInt64(record[:8])
+		m.registry = decodeInt64(record[8:16])
+		m.txid = decodeUint64(record[16:24])
+		return m, true, nil
+	}
+	if crc32.ChecksumIEEE(record[:8]) == decodeUint32(record[8:12]) {
+		return &meta{root: decodeInt64(record[:8])}, false, nil
+	}
+	return nil, false, nil
+}
+
+// reset empties the log.
+func (w *wal) reset() error {
+	return w.file.Truncate(0)
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// recoverMeta replays the meta recorded in the log if the meta could not be
+// loaded, metaErr being the error, or points at an older root.
+func (db *DB) recoverMeta(metaErr error) error {
+	logged, full, err := db.wal.read()
+	if err != nil {
+		return err
+	}
+	if logged == nil {
+		return metaErr
+	}
+	if metaErr == nil && db.meta.root == logged.root {
+		return nil
+	}
+
+	// The chunks are synced before the meta is logged, so the root can
+	// be read back unless the file itself is damaged.
+	if _, err := db.node(logged.root); err != nil {
+		return err
+	}
+
+	switch {
+	case full:
+		db.meta = logged
+	case metaErr != nil:
+		db.meta = newMeta(db.checksum)
+		db.meta.root = logged.root
+	default:
+		db.meta.root = logged.root
+	}
+	if db.readOnly {
+		return nil
+	}
+	if err := db.writeMeta(db.meta); err != nil {
+		return err
+	}
+	return db.ops.Sync()
+}
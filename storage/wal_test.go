@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALRecover(t *testing.T) {
+	errCrash := errors.New("crash")
+	metaData := ChunkLengthSize + ChunkCrcSize
+
+	tests := []struct {
+		name string
+		// writeAt fails the write of the meta.
+		writeAt func(db *DB) func(b []byte, off int64) (int, error)
+	}{
+		{
+			name: "meta not written",
+			writeAt: func(db *DB) func(b []byte, off int64) (int, error) {
+				return func(b []byte, off int64) (int, error) {
+					if off == 0 {
+						return 0, errCrash
+					}
+					return db.ops.File.WriteAt(b, off)
+				}
+			},
+		},
+		{
+			name: "meta torn",
+			writeAt: func(db *DB) func(b []byte, off int64) (int, error) {
+				return func(b []byte, off int64) (int, error) {
+					if off == metaData {
+						n, _ := db.ops.File.WriteAt(b[:len(b)/2], off)
+						return n, errCrash
+					}
+					return db.ops.File.WriteAt(b, off)
+				}
+			},
+		},
+	}
+
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, WAL: true}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := OpenWithOptions(path, 0600, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put(base, map[string]float64{"v": 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The chunks and the log are written, then the meta write
+			// fails as if the process died.
+			db.ops.writeAt = tt.writeAt(db)
+			if err := db.Put(base+1, map[string]float64{"v": 2}); err != errCrash {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Without the log the meta is at the previous root.
+			plain, err := Open(path, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := plain.Get(base + 1); err != ErrNotFound {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := plain.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				db, err = OpenWithOptions(path, 0600, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, want := range map[int64]float64{base: 1, base + 1: 2} {
+					if p, err := db.Get(k); err != nil {
+						t.Fatal(err)
+					} else if p.Value["v"] != want {
+						t.Fatalf("unexpected value at %d: %v", k, p.Value)
+					}
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The replayed root is written back to the meta.
+			if db, err = Open(path, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Get(base + 1); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWALStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	opts := &Options{MaxLeafPoints: DefaultMaxLeafPoints, WAL: true}
+	db, err := OpenWithOptions(path, 0600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(time.Now().UnixNano(), map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A log left behind by a removed database is not replayed into a new
+	// one at the same path.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(path, 0600, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(path, 0600, opts); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Count(0, time.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("got %d points in a new database", n)
+	}
+}
+
+func TestWALRecoverMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := OpenWithOptions(path, 0600, &Options{MaxLeafPoints: DefaultMaxLeafPoints, WAL: true, Checksum: ChecksumSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	s, err := db.Series("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(base, map[string]float64{"v": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(base, map[string]float64{"v": 2}); err != nil {
+		t.Fatal(err)
+	}
+	txid := db.TxID()
+
+	// With both metas lost, the log brings back the series registry, the
+	// txid and the checksum, not only the root.
+	if _, err := db.ops.WriteAt(make([]byte, MetaSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*Options{{MaxLeafPoints: DefaultMaxLeafPoints, WAL: true}, nil} {
+		db, err := OpenWithOptions(path, 0600, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := db.TxID(); got != txid {
+			t.Fatalf("txid %d, want %d", got, txid)
+		}
+		if db.meta.checksum != ChecksumSHA256 {
+			t.Fatalf("meta checked with %v, want %v", db.meta.checksum, ChecksumSHA256)
+		}
+		if _, err := db.Get(base); err != nil {
+			t.Fatal(err)
+		}
+		s, err := db.Series("cpu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := s.Get(base); err != nil {
+			t.Fatal(err)
+		} else if p.Value["v"] != 1 {
+			t.Fatalf("unexpected series value %v", p.Value)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package storage
+
+import "time"
+
+// PutTime is Put at t. Only the instant of t counts: times in any location
+// naming the same instant put the same point.
+func (db *DB) PutTime(t time.Time, value map[string]float64) error {
+	return db.Put(t.UnixNano(), value)
+}
+
+// GetTime is Get at t, whatever the location of t.
+func (db *DB) GetTime(t time.Time) (*Point, error) {
+	return db.Get(t.UnixNano())
+}
+
+// RangeTime is Range between start and end inclusive, whatever their
+// locations.
+func (db *DB) RangeTime(start, end time.Time, metrics ...string) ([]Point, error) {
+	return db.Range(start.UnixNano(), end.UnixNano(), metrics...)
+}
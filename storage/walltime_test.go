@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWallTime(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	base := time.Date(2016, 8, 28, 21, 24, 5, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		tm := base.Add(time.Duration(i) * time.Minute)
+		if i%2 == 1 {
+			tm = tm.In(tokyo)
+		}
+		if err := db.PutTime(tm, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same instant in another location is the same point.
+	for _, tm := range []time.Time{base, base.In(tokyo), base.Local()} {
+		got, err := db.GetTime(tm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := db.Get(base.UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("GetTime(%v) = %v, want %v", tm, got, want)
+		}
+	}
+	if _, err := db.GetTime(base.Add(time.Second)); err != ErrNotFound {
+		t.Fatalf("GetTime of a missing point: %v, want ErrNotFound", err)
+	}
+
+	start, end := base.Add(2*time.Minute).In(tokyo), base.Add(6*time.Minute)
+	got, err := db.RangeTime(start, end, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := db.Range(start.UnixNano(), end.UnixNano(), "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("RangeTime = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"math"
+)
+
+// TimeWeightedAverage returns the mean of metric between start and end
+// inclusive with every value weighted by how long it held: from its point
+// to the next point carrying metric, and for the last one to end. A burst
+// of points close together then counts for the time it spans rather than
+// for its number of points. Points holding metric as NaN are left out. It
+// returns the value of the only point if it is at end, and ErrNotFound if
+// no point in the range holds metric.
+func (db *DB) TimeWeightedAverage(start, end int64, metric string) (float64, error) {
+	if start > end {
+		return 0, ErrNotFound
+	}
+
+	var sum, total float64
+	var prev *Point
+	err := db.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		c.level = levelPoint
+		c.seek(start)
+		return c.each(end, func(point *Point) error {
+			if point.Timestamp < start {
+				return nil
+			}
+			v, ok := point.Value[metric]
+			if !ok || math.IsNaN(v) {
+				return nil
+			}
+			if prev != nil {
+				d := float64(point.Timestamp - prev.Timestamp)
+				sum += prev.Value[metric] * d
+				total += d
+			}
+			prev = point
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if prev == nil {
+		return 0, ErrNotFound
+	}
+
+	d := float64(end - prev.Timestamp)
+	sum += prev.Value[metric] * d
+	total += d
+	if total == 0 {
+		return prev.Value[metric], nil
+	}
+	return sum / total, nil
+}
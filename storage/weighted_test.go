@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTimeWeightedAverage(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// A gauge at 10 for a minute, then a burst of three reads at 100 over
+	// two seconds, then 40 for the rest. One point in between does not
+	// carry it and one holds it as NaN.
+	base := time.Date(2016, 8, 28, 10, 0, 0, 0, time.Local)
+	at := func(d time.Duration) int64 { return base.Add(d).UnixNano() }
+	points := []Point{
+		{Timestamp: at(0), Value: map[string]float64{"gauge": 10}},
+		{Timestamp: at(30 * time.Second), Value: map[string]float64{"other": 1}},
+		{Timestamp: at(time.Minute), Value: map[string]float64{"gauge": 100}},
+		{Timestamp: at(time.Minute + time.Second), Value: map[string]float64{"gauge": 100}},
+		{Timestamp: at(time.Minute + 2*time.Second), Value: map[string]float64{"gauge": 100}},
+		{Timestamp: at(time.Minute + 3*time.Second), Value: map[string]float64{"gauge": 40}},
+		{Timestamp: at(90 * time.Second), Value: map[string]float64{"gauge": math.NaN()}},
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end time.Duration
+		want       float64
+	}{
+		// 10 for 60s, 100 for 3s, 40 for 57s.
+		{0, 2 * time.Minute, (10*60 + 100*3 + 40*57) / 120.0},
+		// 100 for 2s from the second read, 40 for 3s.
+		{time.Minute + time.Second, time.Minute + 6*time.Second, (100*2 + 40*3) / 5.0},
+		// The first value holds to the end of a range before the next.
+		{0, 20 * time.Second, 10},
+		// A single point at the end is its own mean.
+		{time.Minute + 3*time.Second, time.Minute + 3*time.Second, 40},
+	}
+	for _, tt := range tests {
+		got, err := db.TimeWeightedAverage(at(tt.start), at(tt.end), "gauge")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Fatalf("%v-%v: %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	// The plain mean over-weights the burst.
+	if avg, _ := db.Average(at(0), at(2*time.Minute), "gauge"); avg <= tests[0].want {
+		t.Fatalf("Average %v is not above the time-weighted %v", avg, tests[0].want)
+	}
+
+	if _, err := db.TimeWeightedAverage(at(0), at(2*time.Minute), "missing"); err != ErrNotFound {
+		t.Fatalf("missing metric: %v, want ErrNotFound", err)
+	}
+	if _, err := db.TimeWeightedAverage(at(time.Hour), at(2*time.Hour), "gauge"); err != ErrNotFound {
+		t.Fatalf("empty range: %v, want ErrNotFound", err)
+	}
+}
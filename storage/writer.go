@@ -0,0 +1,71 @@
+package storage
+
+// Writer puts points within a writable transaction that it commits every
+// flushEvery points, so a stream of points costs one flush per batch
+// instead of one per point. A crash loses at most the points written since
+// the last commit. Other writers wait while a batch is open. A Writer must
+// only be used from one goroutine.
+type Writer struct {
+	db         *DB
+	tx         *Tx // nil between batches
+	flushEvery int
+	n          int // points written in the open batch
+}
+
+// NewWriter returns a Writer committing every flushEvery points. A
+// flushEvery below one is taken as one.
+func (db *DB) NewWriter(flushEvery int) *Writer {
+	if flushEvery < 1 {
+		flushEvery = 1
+	}
+	return &Writer{db: db, flushEvery: flushEvery}
+}
+
+// Write puts a point, committing the batch once it holds flushEvery
+// points. If it fails the open batch is rolled back.
+func (w *Writer) Write(key int64, value map[string]float64) error {
+	if w.db == nil {
+		return ErrWriterClosed
+	}
+	if w.tx == nil {
+		tx, err := w.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+
+	if err := w.tx.Put(key, value); err != nil {
+		w.rollback()
+		return err
+	}
+	w.n++
+	if w.n >= w.flushEvery {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush commits the open batch, if any.
+func (w *Writer) Flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	tx := w.tx
+	w.tx, w.n = nil, 0
+	return tx.Commit()
+}
+
+// Close commits the open batch and closes the Writer.
+func (w *Writer) Close() error {
+	if w.db == nil {
+		return ErrWriterClosed
+	}
+	w.db = nil
+	return w.Flush()
+}
+
+func (w *Writer) rollback() {
+	_ = w.tx.Rollback()
+	w.tx, w.n = nil, 0
+}
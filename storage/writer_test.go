@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	db := tempDB(t)
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	key := func(i int) int64 { return base + int64(i)*int64(time.Second) }
+
+	w := db.NewWriter(10)
+	for i := 0; i < 25; i++ {
+		if err := w.Write(key(i), map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two batches are committed, the last five points are not yet.
+	if n, err := db.Count(key(0), key(100)); err != nil || n != 20 {
+		t.Fatalf("Count = %d, %v, want 20", n, err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Count(key(0), key(100)); err != nil || n != 25 {
+		t.Fatalf("Count after Close = %d, %v, want 25", n, err)
+	}
+	if err := w.Write(key(25), nil); err != ErrWriterClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != ErrWriterClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The writer lock is free between batches.
+	w = db.NewWriter(2)
+	if err := w.Write(key(30), map[string]float64{"v": 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(key(31), map[string]float64{"v": 31}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(key(32), map[string]float64{"v": 32}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopen(t, db, nil)
+	for _, i := range []int{0, 24, 30, 31, 32} {
+		p, err := db.Get(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Value["v"] != float64(i) {
+			t.Fatalf("unexpected value: %v", p.Value)
+		}
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "db"), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	value := map[string]float64{"v": 1}
+
+	b.ResetTimer()
+	w := db.NewWriter(1000)
+	for i := 0; i < b.N; i++ {
+		if err := w.Write(base+int64(i)*int64(time.Second), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestReorderWriter(t *testing.T) {
+	want := tempDB(t)
+	defer want.Close()
+	db := tempDB(t)
+
+	// Points a second apart arrive shuffled within blocks of ten seconds,
+	// every hundredth one a minute late.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	rng := rand.New(rand.NewSource(1))
+	var keys []int64
+	for block := 0; block < 100; block++ {
+		perm := rng.Perm(10)
+		for _, i := range perm {
+			keys = append(keys, base+int64(block*10+i)*int64(time.Second))
+		}
+	}
+	for i := 100; i < len(keys); i += 100 {
+		keys[i], keys[i-60] = keys[i-60], keys[i]
+	}
+
+	w := db.NewReorderWriter(10*time.Second, 50)
+	for _, key := range keys {
+		value := map[string]float64{"v": float64(key % 1e10)}
+		if err := w.Write(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := want.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(base, nil); err != ErrWriterClosed {
+		t.Fatalf("Write after Close: %v, want ErrWriterClosed", err)
+	}
+
+	db = reopen(t, db, nil)
+	defer db.Close()
+	points, err := db.Range(base, base+int64(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(keys) {
+		t.Fatalf("Range returned %d points, want %d", len(points), len(keys))
+	}
+	for i, point := range points {
+		if key := base + int64(i)*int64(time.Second); point.Timestamp != key {
+			t.Fatalf("point %d at %d, want %d", i, point.Timestamp, key)
+		}
+	}
+	for _, level := range []uint16{LevelRoot, LevelMinute} {
+		got, err := db.Aggregate(base, base+int64(time.Hour), level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantAgg, err := want.Aggregate(base, base+int64(time.Hour), level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameValues(got, wantAgg) {
+			t.Fatalf("Aggregate at %#x = %v, want %v", level, got, wantAgg)
+		}
+	}
+	if errs := db.Check(); errs != nil {
+		t.Fatal(errs)
+	}
+}
+
+func TestReorderWriterLatePut(t *testing.T) {
+	db := tempDB(t)
+	defer db.Close()
+
+	// A point held at base, then one far later, then base again: the last
+	// goes straight through and the one held must not overwrite it.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.Local).UnixNano()
+	w := db.NewReorderWriter(10*time.Second, 50)
+	for i, key := range []int64{base, base + int64(time.Minute), base} {
+		if err := w.Write(key, map[string]float64{"v": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := db.Get(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Value["v"] != 2 {
+		t.Fatalf("value at base %v, want the last written", p.Value["v"])
+	}
+}